@@ -0,0 +1,85 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"math/rand"
+)
+
+// Balancer selects the Client of ClientPool for every call, see ClientPool.SetBalancer.
+type Balancer interface {
+	// Pick returns the index of the Client in clients to make the call.
+	// clients are the available Clients of the pool, which are connected and haven't failed the health check,
+	// or all of them if none is available, it's never empty.
+	// It's called concurrently and should not hold clients after it returns.
+	Pick(clients []*Client) int
+}
+
+// NewLeastPendingBalancer creates a Balancer which selects the Client with the least outstanding calls,
+// see Client.NumPendingCalls, so a Client whose calls are stuck gets no more calls.
+func NewLeastPendingBalancer() Balancer {
+	return leastPendingBalancer{}
+}
+
+type leastPendingBalancer struct{}
+
+func (leastPendingBalancer) Pick(clients []*Client) int {
+	index, least := 0, clients[0].NumPendingCalls()
+	for i := 1; i < len(clients) && least > 0; i++ {
+		if n := clients[i].NumPendingCalls(); n < least {
+			index, least = i, n
+		}
+	}
+	return index
+}
+
+// NewRandomTwoChoicesBalancer creates a Balancer which selects two random Clients and picks the one
+// with less outstanding calls, it's nearly as balanced as NewLeastPendingBalancer without checking all the Clients.
+func NewRandomTwoChoicesBalancer() Balancer {
+	return randomTwoChoicesBalancer{}
+}
+
+type randomTwoChoicesBalancer struct{}
+
+func (randomTwoChoicesBalancer) Pick(clients []*Client) int {
+	if len(clients) == 1 {
+		return 0
+	}
+	i := rand.Intn(len(clients))
+	j := rand.Intn(len(clients) - 1)
+	if j >= i {
+		j++
+	}
+	if clients[j].NumPendingCalls() < clients[i].NumPendingCalls() {
+		return j
+	}
+	return i
+}
+
+// pick selects the Client by the Balancer from the available Clients.
+func (pool *ClientPool) pick() *Client {
+	clients := pool.clients
+	for i, c := range pool.clients {
+		if !pool.available(c) {
+			// copy the available ones only if some are not
+			clients = append(make([]*Client, 0, len(pool.clients)), pool.clients[:i]...)
+			for _, c := range pool.clients[i+1:] {
+				if pool.available(c) {
+					clients = append(clients, c)
+				}
+			}
+			break
+		}
+	}
+	if len(clients) == 0 {
+		clients = pool.clients
+	}
+
+	index := pool.balancer.Pick(clients)
+	if index < 0 || index >= len(clients) {
+		index = 0
+	}
+	return clients[index]
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newBalancerTestPool(pendings []int64) *ClientPool {
+	pool := &ClientPool{size: uint64(len(pendings)), round: 0xFFFFFFFFFFFFFFFF}
+	for _, n := range pendings {
+		pool.clients = append(pool.clients, &Client{running: true, numSessions: n})
+	}
+	return pool
+}
+
+func TestClientPool_SetBalancer(t *testing.T) {
+	pool := newBalancerTestPool([]int64{3, 1, 2})
+	pool.SetBalancer(NewLeastPendingBalancer())
+	if c := pool.Next(); c != pool.clients[1] {
+		t.Fatalf("ClientPool.Next() = %p, want the Client with the least pending calls %p", c, pool.clients[1])
+	}
+
+	// the Client stuck reconnecting is skipped
+	pool.clients[1].reconnecting = true
+	if c := pool.Next(); c != pool.clients[2] {
+		t.Fatalf("ClientPool.Next() = %p, want the connected Client with the least pending calls %p", c, pool.clients[2])
+	}
+
+	// all of the Clients are selected from if none is connected
+	for _, c := range pool.clients {
+		c.reconnecting = true
+	}
+	if c := pool.Next(); c != pool.clients[1] {
+		t.Fatalf("ClientPool.Next() = %p, want %p", c, pool.clients[1])
+	}
+
+	pool = newBalancerTestPool([]int64{0, 5})
+	pool.SetBalancer(NewRandomTwoChoicesBalancer())
+	for i := 0; i < 10; i++ {
+		if c := pool.Next(); c != pool.clients[0] {
+			t.Fatalf("ClientPool.Next() = %p, want the Client with less pending calls %p", c, pool.clients[0])
+		}
+	}
+
+	// round robin is restored
+	pool.SetBalancer(nil)
+	if c0, c1 := pool.Next(), pool.Next(); c0 == c1 {
+		t.Fatalf("ClientPool.Next() = %p twice, want round robin", c0)
+	}
+}
+
+func TestClient_NumPendingCalls(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/sleep", func(ctx *Context) {
+		time.Sleep(time.Second / 10)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/sleep", nil, nil, time.Second) }()
+	if err = c.CallAsync("/sleep", nil, func(*Context) {}, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	time.Sleep(time.Second / 20)
+	if n := c.NumPendingCalls(); n != 2 {
+		t.Fatalf("Client.NumPendingCalls() = %v, want 2", n)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.DrainAsync(time.Second); err != nil {
+		t.Fatalf("Client.DrainAsync() error = %v", err)
+	}
+	if n := c.NumPendingCalls(); n != 0 {
+		t.Fatalf("Client.NumPendingCalls() = %v, want 0", n)
+	}
+}
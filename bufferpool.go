@@ -0,0 +1,63 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// syncBufferPoolMinBits is the size class of the smallest buffers in SyncBufferPool.
+	syncBufferPoolMinBits = 6
+	// syncBufferPoolMaxBits is the size class of the largest buffers in SyncBufferPool,
+	// the larger buffers are made and left to the gc.
+	syncBufferPoolMaxBits = 20
+)
+
+// SyncBufferPool is a BufferPool backed by sync.Pool, the buffers are pooled by the size classes
+// of the powers of 2, from 64 bytes to 1 MB.
+type SyncBufferPool struct {
+	pools [syncBufferPoolMaxBits - syncBufferPoolMinBits + 1]sync.Pool
+}
+
+// NewSyncBufferPool creates a SyncBufferPool.
+func NewSyncBufferPool() *SyncBufferPool {
+	p := &SyncBufferPool{}
+	for i := range p.pools {
+		size := 1 << uint(i+syncBufferPoolMinBits)
+		p.pools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+	return p
+}
+
+// Get implements BufferPool.
+func (p *SyncBufferPool) Get(size int) []byte {
+	index := sizeClass(size)
+	if index >= len(p.pools) {
+		return make([]byte, size)
+	}
+	return p.pools[index].Get().([]byte)[:size]
+}
+
+// Put implements BufferPool.
+func (p *SyncBufferPool) Put(buf []byte) {
+	index := sizeClass(cap(buf))
+	// the buffers not got from the pool are dropped
+	if index >= len(p.pools) || cap(buf) != 1<<uint(index+syncBufferPoolMinBits) {
+		return
+	}
+	p.pools[index].Put(buf[:cap(buf)])
+}
+
+// sizeClass returns the index of the smallest size class not less than size.
+func sizeClass(size int) int {
+	if size <= 1<<syncBufferPoolMinBits {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - syncBufferPoolMinBits
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncBufferPool(t *testing.T) {
+	p := NewSyncBufferPool()
+	for _, size := range []int{0, 1, 64, 65, 1000, 1 << 20, 1<<20 + 1} {
+		buf := p.Get(size)
+		if len(buf) != size {
+			t.Fatalf("SyncBufferPool.Get(%v) len = %v", size, len(buf))
+		}
+		if size > 0 && size <= 1<<20 && cap(buf)&(cap(buf)-1) != 0 {
+			t.Fatalf("SyncBufferPool.Get(%v) cap = %v, want a power of 2", size, cap(buf))
+		}
+		p.Put(buf)
+	}
+	// the buffers not got from the pool are dropped
+	p.Put(make([]byte, 100))
+	if buf := p.Get(100); cap(buf) != 128 {
+		t.Fatalf("SyncBufferPool.Get(100) cap = %v, want 128", cap(buf))
+	}
+}
+
+func TestClient_SetReuseResponseBuffer(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.Handler.SetBufferPool(NewSyncBufferPool())
+	c.SetReuseResponseBuffer(true)
+
+	for i := 0; i < 100; i++ {
+		req := &MessageTest{A: i, B: "hello"}
+		rsp := &MessageTest{}
+		if err = c.Call(methodCallStruct, req, rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		if rsp.A != req.A || rsp.B != req.B {
+			t.Fatalf("Client.Call() returns '%v', want '%v'", rsp, req)
+		}
+		var bytesRsp []byte
+		if err = c.Call(methodCallBytes, []byte("hello"), &bytesRsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		// the buffer held by rsp is not reused
+		if err = c.Call(methodCallStruct, req, rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		if string(bytesRsp) != "hello" {
+			t.Fatalf("Client.Call() returns '%v', want 'hello'", string(bytesRsp))
+		}
+	}
+}
+
+func benchmarkClientCallStruct(b *testing.B, reuse bool) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		b.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.Handler.SetBufferPool(NewSyncBufferPool())
+	c.SetReuseResponseBuffer(reuse)
+
+	req := &MessageTest{A: 1, B: strings.Repeat("hello", 200)}
+	rsp := &MessageTest{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = c.Call(methodCallStruct, req, rsp, time.Second); err != nil {
+			b.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+}
+
+// go test -run none -bench CallStruct -benchtime 100000x
+func BenchmarkClient_CallStruct(b *testing.B) {
+	benchmarkClientCallStruct(b, false)
+}
+
+func BenchmarkClient_CallStructReuseResponseBuffer(b *testing.B) {
+	benchmarkClientCallStruct(b, true)
+}
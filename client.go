@@ -6,6 +6,8 @@ package arpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -24,18 +26,83 @@ const (
 	TimeForever time.Duration = 1<<63 - 1
 )
 
+// clientID is the last ID assigned to a Client.
+var clientID uint64
+
 // DialerFunc defines the dialer used by arpc Client to connect to the server.
 type DialerFunc func() (net.Conn, error)
 
+// ClientOption configures a Client before its loops start, see NewClient, NewClientWithConn and Server.SetClientOptions.
+type ClientOption func(*Client)
+
+// WithConnectHandshake registers h like Client.SetOnConnectHandshake, and it's called for the connection
+// made by NewClient too, NewClient returns the error of h and the Client is stopped.
+func WithConnectHandshake(h func(*Client) error) ClientOption {
+	return func(c *Client) {
+		c.onConnectHandshake = h
+	}
+}
+
+// WithSendQueueSize sets the size of the send queue of the Client, it overrides Handler.SendQueueSize.
+// n <= 0 means the size of the Handler.
+func WithSendQueueSize(n int) ClientOption {
+	return func(c *Client) {
+		if n > 0 {
+			c.sendQueueSize = n
+		}
+	}
+}
+
+// CallFunc defines the calling func wrapped by Client's call middlewares.
+type CallFunc func(method string, req interface{}, rsp interface{}, timeout time.Duration) error
+
+// ClientState represents the connection state of a Client.
+type ClientState int
+
+const (
+	// StateStopped means the Client is stopped.
+	StateStopped ClientState = iota
+	// StateRunning means the Client is connected and running.
+	StateRunning
+	// StateReconnecting means the Client is disconnected and reconnecting.
+	StateReconnecting
+)
+
 // rpcSession represents an active calling session.
 type rpcSession struct {
-	seq  uint64
-	done chan *Message
+	seq   uint64
+	start time.Time
+	done  chan *Message
+	stop  chan util.Empty
 }
 
 // newSession creates rpcSession
 func newSession(seq uint64) *rpcSession {
-	return &rpcSession{seq: seq, done: make(chan *Message, 1)}
+	return &rpcSession{seq: seq, start: time.Now(), done: make(chan *Message, 1)}
+}
+
+// newStreamSession creates rpcSession which receives multiple responses
+func newStreamSession(seq uint64) *rpcSession {
+	return &rpcSession{seq: seq, start: time.Now(), done: make(chan *Message, streamQueueSize), stop: make(chan util.Empty)}
+}
+
+// sessionShardNum is the number of sessionShards of a Client, must be a power of 2.
+const sessionShardNum = 32
+
+// sessionShard holds the sessions and async handlers whose seq%sessionShardNum equals its index,
+// so concurrent Calls on a Client don't contend for a single lock.
+type sessionShard struct {
+	mux           sync.Mutex
+	sessions      map[uint64]*rpcSession
+	asyncHandlers map[uint64]asyncHandler
+	// closed is true after the sessions are cleared or the Client is stopped, the new ones are refused
+	closed bool
+}
+
+// asyncHandler is the handler of an async call, it's deleted by timer if the response doesn't arrive in time.
+type asyncHandler struct {
+	handler HandlerFunc
+	timer   *time.Timer
 }
 
 // Client represents an arpc Client.
@@ -45,7 +112,8 @@ func newSession(seq uint64) *rpcSession {
 type Client struct {
 	Conn     net.Conn
 	Reader   io.Reader
-	head     [4]byte
+	Writer   io.Writer
+	head     [HeadLen]byte
 	Head     Header
 	Codec    codec.Codec
 	Handler  Handler
@@ -54,20 +122,82 @@ type Client struct {
 
 	running      bool
 	reconnecting bool
-
-	mux             sync.Mutex
-	seq             uint64
-	sessionMap      map[uint64]*rpcSession
-	asyncHandlerMap map[uint64]HandlerFunc
-
-	chSend  chan *Message
-	chClose chan util.Empty
-
-	onStop func(*Client)
+	draining     bool
+	hijacked     bool
+	restarted    bool
+	// handshaking is 1 while the connect handshake is running on a new connection
+	handshaking int32
+
+	mux               sync.Mutex
+	id                uint64
+	seq               uint64
+	lastSendTime      int64
+	bytesSent         uint64
+	bytesReceived     uint64
+	codecValue        atomic.Value
+	expiredCount      uint64
+	inflight          int64
+	idleTimeout       time.Duration
+	readTimeout       int64
+	writeTimeout      int64
+	writeDeadlineSet  int32
+	checksum          int32
+	propagateDeadline int32
+	unhealthy         int32
+	reuseResponse     int32
+	traceLogging      int32
+	traceBody         int32
+	maxResponseSize   int64
+	version           uint32
+	features          uint32
+	sessionShards     [sessionShardNum]sessionShard
+	numSessions       int64
+
+	sendQueueSize int
+
+	chSend    chan *Message
+	chClose   chan util.Empty
+	chDrained chan util.Empty
+	// sendLoopDone is closed when the send loop exits
+	sendLoopDone chan util.Empty
+
+	// writeConn writes to Writer if it's not the Conn itself
+	writeConn net.Conn
+
+	onStop      func(*Client)
+	onQueueFull func()
+	stopErr     error
+
+	callMiddles  atomic.Value
+	tracerValue  atomic.Value
+	metricsValue atomic.Value
+	idempotents  map[string]util.Empty
+
+	defaultTimeout time.Duration
+	methodTimeouts map[string]time.Duration
+
+	maxReconnects     int
+	reconnectBackoff  func(attempt int) time.Duration
+	onReconnectFailed func(*Client, error)
+
+	onConnectHandshake func(*Client) error
+
+	seqGenerator func() uint64
+
+	// asyncMux guards asyncPending and asyncDrained only, it's not held with other locks
+	asyncMux     sync.Mutex
+	asyncPending int
+	asyncDrained []chan util.Empty
 
 	values map[string]interface{}
 }
 
+// ID returns the unique ID of the Client, it's assigned when the Client is created and
+// doesn't change after reconnecting, so it can be used as a map key of the per-client state.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
 // Get returns value for key.
 func (c *Client) Get(key string) (interface{}, bool) {
 	c.mux.Lock()
@@ -106,65 +236,677 @@ func (c *Client) Delete(key string) {
 	}
 }
 
+// ExpiredCount returns the number of messages dropped by the send loop because their deadline has passed.
+func (c *Client) ExpiredCount() uint64 {
+	return atomic.LoadUint64(&c.expiredCount)
+}
+
+// EnableChecksum sets whether a CRC32 checksum of the body is appended to every message sent,
+// the receiver drops the message if the checksum mismatches, and a Call gets ErrChecksumMismatch
+// if its response mismatches.
+// The checksum is appended only if the peer supports FeatureChecksum.
+func (c *Client) EnableChecksum(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.checksum, 1)
+	} else {
+		atomic.StoreInt32(&c.checksum, 0)
+	}
+}
+
+// QueueLen returns the number of messages waiting in the send queue.
+func (c *Client) QueueLen() int {
+	return len(c.chSend)
+}
+
+// QueueCap returns the capacity of the send queue.
+func (c *Client) QueueCap() int {
+	return cap(c.chSend)
+}
+
+// SetSendQueueSize sets the size of the send queue of the Client, it overrides Handler.SendQueueSize.
+// The send queue is created when the Client starts, so it returns ErrClientRunning if the Client is running,
+// use WithSendQueueSize to size it on creation, or set it after Stop to take effect on the next Restart.
+func (c *Client) SetSendQueueSize(n int) error {
+	if n <= 0 {
+		return ErrClientInvalidSendQueueSize
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.running {
+		return ErrClientRunning
+	}
+	c.sendQueueSize = n
+	return nil
+}
+
+// newSendQueue creates the send queue, the caller should hold c.mux if the Client has started.
+func (c *Client) newSendQueue() chan *Message {
+	size := c.sendQueueSize
+	if size <= 0 {
+		size = c.Handler.SendQueueSize()
+	}
+	return make(chan *Message, size)
+}
+
+// OnQueueFull registers handler which will be called when a message is dropped because the send queue is full.
+func (c *Client) OnQueueFull(h func()) {
+	c.mux.Lock()
+	c.onQueueFull = h
+	c.mux.Unlock()
+}
+
+// SetReuseResponseBuffer sets whether the buffer of the response of Call is put back to the BufferPool
+// of the Handler after it's parsed to rsp, so a BufferPool which reuses the buffers, e.g. SyncBufferPool,
+// avoids making a buffer for every response. The buffer is not put back if rsp is *[]byte, which holds it.
+// It should only be enabled if the Codec doesn't hold the data after Unmarshal returned, the JSON Codec doesn't.
+func (c *Client) SetReuseResponseBuffer(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.reuseResponse, 1)
+	} else {
+		atomic.StoreInt32(&c.reuseResponse, 0)
+	}
+}
+
+// SetTraceLogging sets whether every request of Call and its response are logged at the debug level,
+// the request with its method, seq and body size, the response with its seq, latency and error.
+// It's for diagnosing mismatched seqs or slow methods in development, and costs nothing but a flag check when disabled.
+// The bodies are not logged unless SetTraceBody is enabled.
+func (c *Client) SetTraceLogging(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.traceLogging, 1)
+	} else {
+		atomic.StoreInt32(&c.traceLogging, 0)
+	}
+}
+
+// SetTraceBody sets whether the bodies of the requests and responses are logged by SetTraceLogging.
+func (c *Client) SetTraceBody(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.traceBody, 1)
+	} else {
+		atomic.StoreInt32(&c.traceBody, 0)
+	}
+}
+
+func (c *Client) isTraceLogging() bool {
+	return atomic.LoadInt32(&c.traceLogging) == 1
+}
+
+func (c *Client) traceRequest(msg *Message) {
+	fields := []interface{}{"tag", c.Handler.LogTag(), "method", msg.Method(), "seq", msg.Seq(), "body_size", len(msg.Data())}
+	if atomic.LoadInt32(&c.traceBody) == 1 {
+		fields = append(fields, "body", string(msg.Data()))
+	}
+	log.Debugw("Call request", fields...)
+}
+
+func (c *Client) traceResponse(seq uint64, start time.Time, msg *Message, err error) {
+	fields := []interface{}{"tag", c.Handler.LogTag(), "seq", seq, "latency", time.Since(start)}
+	if err == nil {
+		if msg == nil {
+			err = ErrClientReconnecting
+		} else if msg.IsError() {
+			err = msg.Error()
+		}
+	}
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+	if msg != nil && atomic.LoadInt32(&c.traceBody) == 1 {
+		fields = append(fields, "body", string(msg.Data()))
+	}
+	log.Debugw("Call response", fields...)
+}
+
+// SetMaxResponseSize sets the max body length of the messages received by the Client, e.g. the responses,
+// a larger message is rejected before its body is read and the connection is dropped,
+// the waiting Call of a rejected response gets ErrResponseTooLarge.
+// The head is checked before the message coders decode it, if a coder rewrites the cmd or seq of the head,
+// the waiting Call gets the error of the dropped connection instead.
+// It's unlimited if n <= 0, which is the default, and Handler.MaxBodyLen still applies.
+func (c *Client) SetMaxResponseSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&c.maxResponseSize, int64(n))
+}
+
+// checkResponseSize returns ErrResponseTooLarge if the body of the message is larger than the max response size,
+// and fails the waiting Call if it's a response.
+func (c *Client) checkResponseSize(head Header) error {
+	max := atomic.LoadInt64(&c.maxResponseSize)
+	if max <= 0 || int64(head.BodyLen()) <= max {
+		return nil
+	}
+
+	if head.cmd() == CmdResponse {
+		seq := head.seq()
+		msg := newMessage(CmdResponse, "", nil, true, head.isAsync(), seq, c.Handler, nil, nil)
+		msg.err = ErrResponseTooLarge
+		if !msg.IsAsync() {
+			if session, ok := c.takeSession(seq); ok {
+				select {
+				case session.done <- msg:
+				case <-session.stop:
+				}
+			}
+		} else if handler, ok := c.getAndDeleteAsyncHandler(seq); ok {
+			handler(newContext(c, msg, nil))
+		}
+	}
+
+	return fmt.Errorf("%w: body length %v, should <= %v", ErrResponseTooLarge, head.BodyLen(), max)
+}
+
+// releaseResponse puts the buffer of the response back if SetReuseResponseBuffer is enabled.
+func (c *Client) releaseResponse(msg *Message) {
+	if atomic.LoadInt32(&c.reuseResponse) == 1 {
+		c.Handler.PutBuffer(msg.Buffer)
+	}
+}
+
+// SetReconnectBackoff registers the function used to compute the delay before the next reconnect attempt.
+// attempt starts from 1 and is reset after the Client reconnected successfully,
+// a negative delay stops reconnecting and the Client will be stopped.
+func (c *Client) SetReconnectBackoff(backoff func(attempt int) time.Duration) {
+	c.mux.Lock()
+	c.reconnectBackoff = backoff
+	c.mux.Unlock()
+}
+
+// SetMaxReconnects sets the max number of consecutive failed reconnect attempts,
+// the Client will be stopped after n failed attempts.
+// 0 means never reconnect, a negative value means reconnect forever.
+func (c *Client) SetMaxReconnects(n int) {
+	c.mux.Lock()
+	c.maxReconnects = n
+	c.mux.Unlock()
+}
+
+// OnReconnectFailed registers handler which will be called when the Client gives up reconnecting.
+func (c *Client) OnReconnectFailed(h func(*Client, error)) {
+	c.mux.Lock()
+	c.onReconnectFailed = h
+	c.mux.Unlock()
+}
+
+// SetOnConnectHandshake registers h which is called after the Client reconnected or restarted
+// and before the OnConnected handlers, e.g. to authenticate by a Call.
+// The Client reports StateReconnecting until h returns, but the calls are allowed so that h can make them,
+// the other goroutines should wait for the OnConnected handlers or IsConnected before calling.
+// If h returns an error, the connection is closed and the Client reconnects again after the reconnect delay,
+// the OnConnected handlers are only called after h succeeded.
+// It's not called for the connection made by NewClient, use WithConnectHandshake for that.
+func (c *Client) SetOnConnectHandshake(h func(*Client) error) {
+	c.mux.Lock()
+	c.onConnectHandshake = h
+	c.mux.Unlock()
+}
+
+// onConnected negotiates the protocol on the new connection, calls the handshake registered by
+// SetOnConnectHandshake and then the OnConnected handlers, it's called with handshaking set.
+func (c *Client) onConnected(conn net.Conn) {
+	c.handshake()
+	if err := c.connectHandshake(); err != nil {
+		log.Errorw("Connect Handshake failed", "tag", c.Handler.LogTag(), "remote_addr", conn.RemoteAddr(), "error", err)
+		// delay before closing, or else it would reconnect and fail again immediately
+		if delay := c.reconnectDelay(1); delay > 0 {
+			time.Sleep(delay)
+		}
+		conn.Close()
+		return
+	}
+	c.Handler.OnConnected(c)
+}
+
+// connectHandshake calls the handshake registered by SetOnConnectHandshake and clears handshaking after it succeeded.
+func (c *Client) connectHandshake() error {
+	c.mux.Lock()
+	h := c.onConnectHandshake
+	c.mux.Unlock()
+	if h != nil {
+		if err := h(c); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&c.handshaking, 0)
+	return nil
+}
+
+// SetReadDeadline sets the max duration to wait for every message from the Conn, it takes effect immediately.
+// If no message arrives in time, the connection is closed and reconnects, or the Client is stopped if it has no Dialer,
+// so the other side should send in time, e.g. by EnableKeepalive.
+// Zero means no deadline, which is the default.
+func (c *Client) SetReadDeadline(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&c.readTimeout, int64(d))
+	c.Conn.SetReadDeadline(c.nextReadDeadline())
+}
+
+// SetWriteDeadline sets the max duration of every write to the Conn,
+// if a write doesn't finish in time, the messages being written are dropped and the connection is closed,
+// because the rest of a partially written message can't be sent on it anymore.
+// Zero means no deadline, which is the default.
+func (c *Client) SetWriteDeadline(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&c.writeTimeout, int64(d))
+}
+
+// nextReadDeadline returns the deadline of the next read by the read deadline and the idle timeout of the Server,
+// the smaller one takes effect.
+func (c *Client) nextReadDeadline() time.Time {
+	timeout := time.Duration(atomic.LoadInt64(&c.readTimeout))
+	if c.idleTimeout > 0 && (timeout <= 0 || c.idleTimeout < timeout) {
+		timeout = c.idleTimeout
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// setWriteDeadline sets the deadline of the next write if SetWriteDeadline is set,
+// or clears the deadline set before it's reset to zero.
+func (c *Client) setWriteDeadline() {
+	if timeout := time.Duration(atomic.LoadInt64(&c.writeTimeout)); timeout > 0 {
+		atomic.StoreInt32(&c.writeDeadlineSet, 1)
+		c.writeConn.SetWriteDeadline(time.Now().Add(timeout))
+	} else if atomic.CompareAndSwapInt32(&c.writeDeadlineSet, 1, 0) {
+		c.writeConn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// onWriteError closes the Conn being written, the messages being written are dropped.
+// It's called in the send loop, which may still write to the old Conn after the recv loop reconnected.
+func (c *Client) onWriteError(err error) {
+	log.Errorw("Write failed, messages dropped", "tag", c.Handler.LogTag(), "remote_addr", c.writeConn.RemoteAddr(), "error", err)
+	c.writeConn.Close()
+}
+
+// EnableKeepalive sends a notify of method to the other side when nothing has been sent for interval,
+// the connection will be closed and reconnect if the keepalive notify failed twice continuously.
+// The keepalive goroutine exits when the Client is stopped.
+func (c *Client) EnableKeepalive(interval time.Duration, method string) {
+	if interval <= 0 {
+		return
+	}
+	c.mux.Lock()
+	chClose := c.chClose
+	c.mux.Unlock()
+	go util.Safe(func() {
+		c.keepaliveLoop(interval, method, chClose)
+	})
+}
+
+// codecHolder wraps the Codec so that different implementations can be stored in the same atomic.Value.
+type codecHolder struct {
+	codec.Codec
+}
+
+// SetCodec sets the Codec used by the Client, it's safe to be called after the Client is running,
+// for example, to switch the Codec after a capabilities exchange.
+// The Codec field is left unchanged, use GetCodec to get the Codec in use.
+// If the Codec implements MessageCoder too, it encodes every message sent before the coders of the Handler
+// and decodes every message received after them, e.g. to compress the whole body with a flag bit in the head.
+func (c *Client) SetCodec(cdc codec.Codec) {
+	c.mux.Lock()
+	c.codecValue.Store(codecHolder{cdc})
+	c.mux.Unlock()
+}
+
+// GetCodec returns the Codec used by the Client, which is the one set by SetCodec or the Codec field if SetCodec was never called.
+func (c *Client) GetCodec() codec.Codec {
+	if h, ok := c.codecValue.Load().(codecHolder); ok {
+		return h.Codec
+	}
+	return c.Codec
+}
+
 // NewMessage creates a Message by client's seq, handler and codec.
 func (c *Client) NewMessage(cmd byte, method string, v interface{}) *Message {
-	return newMessage(cmd, method, v, false, false, atomic.AddUint64(&c.seq, 1), c.Handler, c.Codec, nil)
+	return newMessage(cmd, method, v, false, false, c.nextSeq(), c.Handler, c.GetCodec(), nil)
+}
+
+// Use registers call middleware which wraps every call made by the Client, e.g. Call, CallWith,
+// CallWithHeader, CallAsync and Notify.
+// Middlewares are called in registration order and the innermost one makes the real call,
+// rsp is nil for the calls without a response to unmarshal, e.g. CallAsync and Notify,
+// and timeout of CallWith and NotifyWith is the time until the deadline of the context, 0 if it has none.
+// It's safe to be called concurrently with the calls, the calls made later are wrapped by middleware.
+func (c *Client) Use(middleware func(next CallFunc) CallFunc) {
+	if middleware == nil {
+		return
+	}
+	c.mux.Lock()
+	middles, _ := c.callMiddles.Load().([]func(next CallFunc) CallFunc)
+	c.callMiddles.Store(append(middles[:len(middles):len(middles)], middleware))
+	c.mux.Unlock()
+}
+
+// invoke wraps call by the call middlewares and calls it.
+func (c *Client) invoke(method string, req interface{}, rsp interface{}, timeout time.Duration, call CallFunc) error {
+	middles, _ := c.callMiddles.Load().([]func(next CallFunc) CallFunc)
+	for i := len(middles) - 1; i >= 0; i-- {
+		call = middles[i](call)
+	}
+	return call(method, req, rsp, timeout)
+}
+
+// contextTimeout returns the time until the deadline of ctx, 0 if it has none.
+func contextTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return 0
 }
 
 // Call makes an rpc call with a timeout.
 // Call will block waiting for the server's response until timeout.
+// A synchronous handler must not Call the Client which the message comes from, the response could never
+// be received by the recv loop blocked in the handler until timeout, use an asynchronous handler or CallAsync instead.
 func (c *Client) Call(method string, req interface{}, rsp interface{}, timeout time.Duration, args ...interface{}) error {
+	return c.invoke(method, req, rsp, timeout, func(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+		return c.doCall(method, req, rsp, timeout, args...)
+	})
+}
+
+func (c *Client) doCall(method string, req interface{}, rsp interface{}, timeout time.Duration, args ...interface{}) error {
 	if err := c.checkCallArgs(method, timeout); err != nil {
 		return err
 	}
+	var values map[string]interface{}
+	if len(args) > 0 {
+		values = args[0].(map[string]interface{})
+	}
+	return c.callWithHeader(context.Background(), method, req, rsp, nil, timeout, values)
+}
 
-	// if timeout < 0 {
-	// 	timeout = TimeForever
-	// }
+// SetSeqStart sets the seq of the next request to start+1, e.g. a timestamp based start keeps the seqs
+// unique across restarts of the process, which helps correlating the persisted request logs.
+// It should be called before the Client is used to make calls.
+func (c *Client) SetSeqStart(start uint64) {
+	atomic.StoreUint64(&c.seq, start)
+}
 
-	timer := time.NewTimer(timeout)
+// SetSeqGenerator sets the function which generates the seqs of the requests instead of the counter of the Client.
+// It's called for every request, so it must be cheap and safe for concurrent use, and the seqs must be monotonic
+// within the process, a seq reused by an outstanding call gets its response mismatched.
+// It should be called before the Client is used to make calls, a nil generator restores the counter.
+func (c *Client) SetSeqGenerator(generator func() uint64) {
+	c.seqGenerator = generator
+}
 
-	msg := c.newRequestMessage(CmdRequest, method, req, false, false, args...)
-	seq := msg.Seq()
-	sess := newSession(seq)
-	c.addSession(seq, sess)
-	defer func() {
-		timer.Stop()
-		c.deleteSession(seq)
-	}()
+func (c *Client) nextSeq() uint64 {
+	if c.seqGenerator != nil {
+		return c.seqGenerator()
+	}
+	return atomic.AddUint64(&c.seq, 1)
+}
 
-	select {
-	case c.chSend <- msg:
-	case <-timer.C:
-		// c.Handler.OnOverstock(c, msg)
-		return ErrClientTimeout
-	case <-c.chClose:
-		// c.Handler.OnOverstock(c, msg)
-		return ErrClientStopped
+// SetDefaultTimeout sets the timeout used by CallDefault for methods without their own timeout.
+func (c *Client) SetDefaultTimeout(timeout time.Duration) {
+	c.mux.Lock()
+	c.defaultTimeout = timeout
+	c.mux.Unlock()
+}
+
+// SetMethodTimeout sets the timeout used by CallDefault for method.
+func (c *Client) SetMethodTimeout(method string, timeout time.Duration) {
+	c.mux.Lock()
+	if c.methodTimeouts == nil {
+		c.methodTimeouts = map[string]time.Duration{}
 	}
+	c.methodTimeouts[method] = timeout
+	c.mux.Unlock()
+}
 
-	select {
-	case msg = <-sess.done:
-	case <-timer.C:
-		return ErrClientTimeout
-	case <-c.chClose:
-		return ErrClientStopped
+// CallDefault makes an rpc call with the timeout set by SetMethodTimeout,
+// or by SetDefaultTimeout if the method has no timeout set.
+func (c *Client) CallDefault(method string, req interface{}, rsp interface{}, args ...interface{}) error {
+	return c.Call(method, req, rsp, c.methodTimeout(method), args...)
+}
+
+// MarkIdempotent marks a method as idempotent, only idempotent methods are retried by CallRetry.
+func (c *Client) MarkIdempotent(method string) {
+	c.mux.Lock()
+	if c.idempotents == nil {
+		c.idempotents = map[string]util.Empty{}
+	}
+	c.idempotents[method] = util.Empty{}
+	c.mux.Unlock()
+}
+
+// CallRetry makes an rpc call like Call,
+// and retries at most maxRetries times on ErrClientTimeout, ErrClientReconnecting or ErrServerBusy
+// if the method has been marked by MarkIdempotent.
+// All the attempts share the timeout, every attempt uses an equal part of the remaining time,
+// and it backs off before retrying a call rejected by ErrServerBusy.
+func (c *Client) CallRetry(method string, req interface{}, rsp interface{}, timeout time.Duration, maxRetries int) error {
+	if timeout <= 0 || maxRetries <= 0 || !c.isIdempotent(method) {
+		return c.Call(method, req, rsp, timeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for i := 0; ; i++ {
+		err := c.Call(method, req, rsp, timeout/time.Duration(maxRetries-i+1))
+		busy := errors.Is(err, ErrServerBusy)
+		if err == nil || i >= maxRetries || (err != ErrClientTimeout && err != ErrClientReconnecting && !busy) {
+			return err
+		}
+		if err == ErrClientReconnecting {
+			time.Sleep(time.Second / 100)
+		} else if busy {
+			time.Sleep(time.Second / 100 * time.Duration(i+1))
+		}
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return err
+		}
+	}
+}
+
+// CallWithHeader makes an rpc call with key-value header and a timeout.
+// The header is carried between method and payload data,
+// and can be read by Context.Header on the other side.
+func (c *Client) CallWithHeader(method string, req interface{}, rsp interface{}, md map[string]string, timeout time.Duration) error {
+	return c.invoke(method, req, rsp, timeout, func(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+		if err := c.checkCallArgs(method, timeout); err != nil {
+			return err
+		}
+		return c.callWithHeader(context.Background(), method, req, rsp, md, timeout, nil)
+	})
+}
+
+// callWithHeader makes the call with the request built by newCallMessage, the client span is parented on ctx.
+func (c *Client) callWithHeader(ctx context.Context, method string, req interface{}, rsp interface{}, md map[string]string, timeout time.Duration, values map[string]interface{}) (err error) {
+	if done := c.startCall(method); done != nil {
+		defer func() { done(err) }()
+	}
+
+	msg, span, err := c.newCallMessage(ctx, method, req, md, timeout, false, values)
+	if err != nil {
+		return err
 	}
+	defer func() { endClientSpan(span, err) }()
 
+	msg, err = c.call(msg, timeout)
+	if err != nil {
+		return err
+	}
 	return c.parseResponse(msg, rsp)
 }
 
+// newCallMessage creates the request of a call with md as the header,
+// it starts a client span parented on ctx and injects the trace context into the header if the Client has a Tracer,
+// and adds timeout to the header if the deadline is propagated.
+// The returned span is nil if it's not traced, or it should be ended by endClientSpan after the call.
+func (c *Client) newCallMessage(ctx context.Context, method string, req interface{}, md map[string]string, timeout time.Duration, isAsync bool, values map[string]interface{}) (msg *Message, span Span, err error) {
+	if tracer := c.getTracer(); tracer != nil {
+		traced := make(map[string]string, len(md)+2)
+		for k, v := range md {
+			traced[k] = v
+		}
+		_, span = tracer.StartClientSpan(ctx, method, traced)
+		defer func() {
+			if err != nil {
+				endClientSpan(span, err)
+				span = nil
+			}
+		}()
+		md = traced
+	}
+	if c.isPropagatingDeadline() && c.HasFeature(FeatureDeadline) {
+		md = withTimeoutHeader(md, timeout)
+	}
+	if md == nil {
+		msg, err = c.newRequestMessage(CmdRequest, method, req, false, isAsync, values)
+		return msg, span, err
+	}
+
+	header, err := encodeHeader(md)
+	if err != nil {
+		return nil, span, err
+	}
+	data := util.ValueToBytes(c.GetCodec(), req)
+	if err = checkBodyLen(methodLenSize(method) + len(method) + 2 + len(header) + len(data)); err != nil {
+		return nil, span, err
+	}
+	msg = newMessageWithHeader(CmdRequest, method, header, data, false, isAsync, c.nextSeq(), c.Handler, c.GetCodec(), values)
+	msg.SetVersion(c.Version())
+	return msg, span, nil
+}
+
+// CallRaw makes an rpc call with a timeout and returns the response Message without unmarshalling.
+// If the response is an error Message, both the Message and the error are returned,
+// so that the Message can be forwarded as it is.
+func (c *Client) CallRaw(method string, req interface{}, timeout time.Duration, args ...interface{}) (msg *Message, err error) {
+	err = c.invoke(method, req, nil, timeout, func(method string, req interface{}, _ interface{}, timeout time.Duration) error {
+		msg, err = c.callRaw(method, req, timeout, args...)
+		return err
+	})
+	return msg, err
+}
+
+func (c *Client) callRaw(method string, req interface{}, timeout time.Duration, args ...interface{}) (*Message, error) {
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.newRequestMessage(CmdRequest, method, req, false, false, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = c.call(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrClientReconnecting
+	}
+	if msg.Cmd() != CmdResponse {
+		return nil, ErrInvalidRspMessage
+	}
+	return msg, msg.Error()
+}
+
+// CallReader makes an rpc call with a timeout, the request body of size bytes is read from r
+// directly into the send buffer without being encoded by the Codec.
+// r must supply at least size bytes, ErrInvalidBodySize is returned if it ends before that,
+// the bytes after size are left unread in r.
+func (c *Client) CallReader(method string, r io.Reader, size int, rsp interface{}, timeout time.Duration) error {
+	return c.invoke(method, r, rsp, timeout, func(method string, _ interface{}, rsp interface{}, timeout time.Duration) error {
+		return c.callReader(method, r, size, rsp, timeout)
+	})
+}
+
+func (c *Client) callReader(method string, r io.Reader, size int, rsp interface{}, timeout time.Duration) error {
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return err
+	}
+
+	msg, err := newMessageFromReader(CmdRequest, method, r, size, false, c.nextSeq(), c.Handler, nil)
+	if err != nil {
+		return err
+	}
+	msg.SetVersion(c.Version())
+
+	msg, err = c.call(msg, timeout)
+	if err != nil {
+		return err
+	}
+	return c.parseResponse(msg, rsp)
+}
+
+// CallStream makes an rpc call which receives multiple responses by Stream.Recv,
+// timeout is used by sending the request and every Stream.Recv.
+func (c *Client) CallStream(method string, req interface{}, timeout time.Duration, args ...interface{}) (stream *Stream, err error) {
+	err = c.invoke(method, req, nil, timeout, func(method string, req interface{}, _ interface{}, timeout time.Duration) error {
+		stream, err = c.callStream(method, req, timeout, args...)
+		return err
+	})
+	return stream, err
+}
+
+func (c *Client) callStream(method string, req interface{}, timeout time.Duration, args ...interface{}) (*Stream, error) {
+	if err := c.checkCallArgs(method, timeout); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.newRequestMessage(CmdRequest, method, req, false, false, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := msg.Seq()
+	sess := newStreamSession(seq)
+	if !c.addSession(seq, sess) {
+		return nil, c.sessionsClosedError()
+	}
+
+	timer := getTimer(timeout)
+	defer putTimer(timer)
+	if err := c.pushMessage(msg, timer); err != nil {
+		c.deleteSession(seq)
+		return nil, err
+	}
+
+	return &Stream{client: c, session: sess, timeout: timeout}, nil
+}
+
 // CallWith uses context to make rpc call.
 // CallWith blocks to wait for a response from the server until it times out.
+// The client span is parented on ctx if the Client has a Tracer, e.g. pass Context.TraceContext in a handler.
 func (c *Client) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}, args ...interface{}) error {
-	if err := c.checkStateAndMethod(method); err != nil {
+	return c.invoke(method, req, rsp, contextTimeout(ctx), func(method string, req interface{}, rsp interface{}, _ time.Duration) error {
+		return c.callWith(ctx, method, req, rsp, args...)
+	})
+}
+
+func (c *Client) callWith(ctx context.Context, method string, req interface{}, rsp interface{}, args ...interface{}) (err error) {
+	if err = c.checkStateAndMethod(method); err != nil {
 		return err
 	}
+	timeout := contextTimeout(ctx)
+	var values map[string]interface{}
+	if len(args) > 0 {
+		values = args[0].(map[string]interface{})
+	}
+	msg, span, err := c.newCallMessage(ctx, method, req, nil, timeout, false, values)
+	if err != nil {
+		return err
+	}
+	defer func() { endClientSpan(span, err) }()
 
-	msg := c.newRequestMessage(CmdRequest, method, req, false, false, args...)
 	seq := msg.Seq()
 	sess := newSession(seq)
-	c.addSession(seq, sess)
+	if !c.addSession(seq, sess) {
+		return c.sessionsClosedError()
+	}
 	defer c.deleteSession(seq)
 
 	select {
@@ -192,28 +934,60 @@ func (c *Client) CallWith(ctx context.Context, method string, req interface{}, r
 // CallAsync will not block waiting for the server's response,
 // But the handler will be called if the response arrives before the timeout.
 func (c *Client) CallAsync(method string, req interface{}, handler HandlerFunc, timeout time.Duration, args ...interface{}) error {
-	err := c.checkCallAsyncArgs(method, handler, timeout)
-	if err != nil {
+	_, err := c.CallAsyncSeq(method, req, handler, timeout, args...)
+	return err
+}
+
+// CallAsyncSeq is the same as CallAsync, but returns the seq of the request,
+// which can be passed to CancelAsync to cancel the call before the response arrives.
+func (c *Client) CallAsyncSeq(method string, req interface{}, handler HandlerFunc, timeout time.Duration, args ...interface{}) (seq uint64, err error) {
+	err = c.invoke(method, req, nil, timeout, func(method string, req interface{}, _ interface{}, timeout time.Duration) error {
+		seq, err = c.callAsync(method, req, handler, timeout, args...)
 		return err
+	})
+	return seq, err
+}
+
+func (c *Client) callAsync(method string, req interface{}, handler HandlerFunc, timeout time.Duration, args ...interface{}) (seq uint64, err error) {
+	err = c.checkCallAsyncArgs(method, handler, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	var values map[string]interface{}
+	if len(args) > 0 {
+		values = args[0].(map[string]interface{})
+	}
+	msg, span, err := c.newCallMessage(context.Background(), method, req, nil, timeout, true, values)
+	if err != nil {
+		return 0, err
+	}
+	endSpan, handler := asyncClientSpan(span, handler, timeout)
+	if endSpan != nil {
+		// the span of a call without the handler ends after the request is sent
+		defer func() {
+			if err != nil || handler == nil {
+				endSpan(err)
+			}
+		}()
 	}
 
-	var timer *time.Timer
+	done, handler := c.startAsyncCall(method, handler)
+	if done != nil {
+		defer func() { done(err) }()
+	}
 
-	msg := c.newRequestMessage(CmdRequest, method, req, false, true, args...)
-	seq := msg.Seq()
-	if handler != nil {
-		c.addAsyncHandler(seq, handler)
-		timer = time.AfterFunc(timeout, func() { c.deleteAsyncHandler(seq) })
-		defer timer.Stop()
-	} else if timeout > 0 {
-		timer = time.NewTimer(timeout)
-		defer timer.Stop()
+	seq = msg.Seq()
+	if handler != nil && !c.addAsyncHandler(seq, handler, timeout) {
+		return seq, c.sessionsClosedError()
 	}
 
 	switch timeout {
 	case TimeZero:
 		err = c.pushMessage(msg, nil)
 	default:
+		timer := getTimer(timeout)
+		defer putTimer(timer)
 		err = c.pushMessage(msg, timer)
 	}
 
@@ -221,25 +995,118 @@ func (c *Client) CallAsync(method string, req interface{}, handler HandlerFunc,
 		c.deleteAsyncHandler(seq)
 	}
 
-	return err
+	return seq, err
+}
 
+// CancelAsync cancels the async call of seq returned by CallAsyncSeq, its handler will not be called.
+// It returns false if the handler has been called, timed out or canceled.
+func (c *Client) CancelAsync(seq uint64) bool {
+	return c.deleteAsyncHandler(seq)
+}
+
+// CallChan makes an async rpc call with a timeout and returns a channel which receives the Context of the response,
+// the channel is closed after the response is received, or without receiving anything if it times out.
+//
+//	ch, err := client.CallChan(method, req, timeout)
+//	...
+//	select {
+//	case ctx, ok := <-ch:
+//		if !ok {
+//			// timeout
+//		}
+//	case <-other:
+//	}
+func (c *Client) CallChan(method string, req interface{}, timeout time.Duration, args ...interface{}) (ch <-chan *Context, err error) {
+	err = c.invoke(method, req, nil, timeout, func(method string, req interface{}, _ interface{}, timeout time.Duration) error {
+		ch, err = c.callChan(method, req, timeout, args...)
+		return err
+	})
+	return ch, err
+}
+
+func (c *Client) callChan(method string, req interface{}, timeout time.Duration, args ...interface{}) (<-chan *Context, error) {
+	err := c.checkCallArgs(method, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.newRequestMessage(CmdRequest, method, req, false, true, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		once sync.Once
+		seq  = msg.Seq()
+		ch   = make(chan *Context, 1)
+	)
+	finish := func(ctx *Context) {
+		once.Do(func() {
+			if ctx != nil {
+				ch <- ctx
+			}
+			close(ch)
+		})
+	}
+
+	// the async handler is deleted and the channel is closed if the response is not received in time,
+	// it also covers the handler cleared by reconnecting or stopping.
+	expire := time.AfterFunc(timeout, func() {
+		c.deleteAsyncHandler(seq)
+		finish(nil)
+	})
+	done, handler := c.startAsyncCall(method, func(ctx *Context) {
+		expire.Stop()
+		finish(ctx)
+	})
+	if !c.addAsyncHandler(seq, handler, 0) {
+		expire.Stop()
+		err = c.sessionsClosedError()
+		if done != nil {
+			done(err)
+		}
+		return nil, err
+	}
+
+	timer := getTimer(timeout)
+	defer putTimer(timer)
+	err = c.pushMessage(msg, timer)
+	if done != nil {
+		done(err)
+	}
+	if err != nil {
+		expire.Stop()
+		c.deleteAsyncHandler(seq)
+		return nil, err
+	}
+	return ch, nil
 }
 
 // Notify makes a notify with timeout.
 // A notify does not need a response from the server.
 func (c *Client) Notify(method string, data interface{}, timeout time.Duration, args ...interface{}) error {
+	return c.invoke(method, data, nil, timeout, func(method string, data interface{}, _ interface{}, timeout time.Duration) error {
+		return c.notify(method, data, timeout, args...)
+	})
+}
+
+func (c *Client) notify(method string, data interface{}, timeout time.Duration, args ...interface{}) error {
 	err := c.checkNotifyArgs(method, timeout)
 	if err != nil {
 		return err
 	}
 
-	msg := c.newRequestMessage(CmdNotify, method, data, false, true, args...)
+	msg, err := c.newRequestMessage(CmdNotify, method, data, false, true, args...)
+	if err != nil {
+		return err
+	}
+
 	switch timeout {
 	case TimeZero:
 		err = c.pushMessage(msg, nil)
 	default:
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+		timer := getTimer(timeout)
+		defer putTimer(timer)
 		err = c.pushMessage(msg, timer)
 	}
 
@@ -249,11 +1116,20 @@ func (c *Client) Notify(method string, data interface{}, timeout time.Duration,
 // NotifyWith use context to make rpc notify.
 // A notify does not need a response from the server.
 func (c *Client) NotifyWith(ctx context.Context, method string, data interface{}, args ...interface{}) error {
+	return c.invoke(method, data, nil, contextTimeout(ctx), func(method string, data interface{}, _ interface{}, _ time.Duration) error {
+		return c.notifyWith(ctx, method, data, args...)
+	})
+}
+
+func (c *Client) notifyWith(ctx context.Context, method string, data interface{}, args ...interface{}) error {
 	if err := c.checkStateAndMethod(method); err != nil {
 		return err
 	}
 
-	msg := c.newRequestMessage(CmdNotify, method, data, false, true, args...)
+	msg, err := c.newRequestMessage(CmdNotify, method, data, false, true, args...)
+	if err != nil {
+		return err
+	}
 
 	select {
 	case c.chSend <- msg:
@@ -284,6 +1160,7 @@ func (c *Client) PushMsg(msg *Message, timeout time.Duration) error {
 		select {
 		case c.chSend <- msg:
 		default:
+			c.queueFull()
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientOverstock
 		}
@@ -295,18 +1172,37 @@ func (c *Client) PushMsg(msg *Message, timeout time.Duration) error {
 			return ErrClientStopped
 		}
 	default:
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+		timer := getTimer(timeout)
+		defer putTimer(timer)
 		err = c.pushMessage(msg, timer)
 	}
 
 	return err
 }
 
+// PushMsgWithDeadline pushes a msg to Client's send queue and blocks until deadline at most,
+// the msg will be dropped instead of being sent if it's still in the queue when the deadline passed.
+func (c *Client) PushMsgWithDeadline(msg *Message, deadline time.Time) error {
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return ErrClientTimeout
+	}
+	msg.deadline = deadline.UnixNano()
+	return c.PushMsg(msg, timeout)
+}
+
 // Restart stops and restarts a Client.
 func (c *Client) Restart() error {
 	c.Stop()
 
+	// wait for the old send loop to exit before replacing the Writer and the queues it uses
+	c.mux.Lock()
+	sendLoopDone := c.sendLoopDone
+	c.mux.Unlock()
+	if sendLoopDone != nil {
+		<-sendLoopDone
+	}
+
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	if !c.running {
@@ -318,20 +1214,29 @@ func (c *Client) Restart() error {
 		preConn := c.Conn
 		c.Conn = conn
 
-		c.chSend = make(chan *Message, c.Handler.SendQueueSize())
+		c.chSend = c.newSendQueue()
 		c.chClose = make(chan util.Empty)
-		c.sessionMap = make(map[uint64]*rpcSession)
-		c.asyncHandlerMap = make(map[uint64]HandlerFunc)
+		c.clearSession()
+		c.clearAsyncHandler()
+		c.openSessions()
 		c.values = map[string]interface{}{}
+		// set before the recvLoop starts, which calls the connect handshake
+		c.restarted = true
+		atomic.StoreInt32(&c.handshaking, 1)
+		// the new server may be of another version
+		c.setProtocol(ProtocolVersion0, 0)
+
+		c.running = true
+		c.reconnecting = false
+		c.draining = false
 
 		c.initReader()
+		c.initWriter()
+		c.sendLoopDone = make(chan util.Empty)
 		go util.Safe(c.sendLoop)
 		go util.Safe(c.recvLoop)
 
-		c.running = true
-		c.reconnecting = false
-
-		log.Info("%v\t[%v] Restarted to [%v]", c.Handler.LogTag(), preConn.RemoteAddr(), conn.RemoteAddr())
+		log.Infow("Restarted", "tag", c.Handler.LogTag(), "remote_addr", conn.RemoteAddr(), "prev_remote_addr", preConn.RemoteAddr())
 	}
 
 	return nil
@@ -339,11 +1244,18 @@ func (c *Client) Restart() error {
 
 // Stop stops a Client.
 func (c *Client) Stop() {
+	c.stop(nil)
+}
+
+// stop stops a Client with the error which caused the disconnection, nil means stopped by the user.
+func (c *Client) stop(err error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
 	if c.running {
 		c.running = false
+		c.stopErr = err
+		c.closeSessions()
 		c.Conn.Close()
 		if c.chSend != nil {
 			close(c.chClose)
@@ -355,9 +1267,139 @@ func (c *Client) Stop() {
 	}
 }
 
+// StopGracefully stops a Client after all the messages already in the send queue have been sent.
+// New messages are rejected with ErrClientStopped once it is called,
+// if the send queue can't be drained before timeout, the Client is stopped anyway
+// and an error with the number of dropped messages is returned.
+func (c *Client) StopGracefully(timeout time.Duration) error {
+	c.mux.Lock()
+	if !c.running || c.draining {
+		c.mux.Unlock()
+		return ErrClientStopped
+	}
+	c.draining = true
+	chDrained := make(chan util.Empty)
+	c.chDrained = chDrained
+	c.mux.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// nil message is the mark of the end of send queue
+	select {
+	case c.chSend <- nil:
+	case <-timer.C:
+		return c.stopDrainTimeout()
+	case <-c.chClose:
+		return ErrClientStopped
+	}
+
+	select {
+	case <-chDrained:
+	case <-timer.C:
+		return c.stopDrainTimeout()
+	case <-c.chClose:
+		return ErrClientStopped
+	}
+
+	c.Stop()
+	return nil
+}
+
+// hijack drains the send queue and stops the Client without closing the Conn,
+// it should be called in the recv loop, which exits after the handler returns.
+func (c *Client) hijack() (net.Conn, error) {
+	c.mux.Lock()
+	if !c.running || c.draining {
+		c.mux.Unlock()
+		return nil, ErrClientStopped
+	}
+	c.draining = true
+	chDrained := make(chan util.Empty)
+	c.chDrained = chDrained
+	c.mux.Unlock()
+
+	// nil message is the mark of the end of send queue
+	select {
+	case c.chSend <- nil:
+	case <-c.chClose:
+		return nil, ErrClientStopped
+	}
+	select {
+	case <-chDrained:
+	case <-c.chClose:
+		return nil, ErrClientStopped
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.running {
+		return nil, ErrClientStopped
+	}
+	c.running = false
+	c.hijacked = true
+	c.Conn.SetReadDeadline(time.Time{})
+	close(c.chClose)
+	if c.onStop != nil {
+		c.onStop(c)
+	}
+	c.Handler.OnDisconnected(c)
+
+	log.Infow("Hijacked", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr())
+
+	if c.Reader != io.Reader(c.Conn) {
+		// the data already buffered by the Reader should be read first
+		return &hijackedConn{Conn: c.Conn, r: c.Reader}, nil
+	}
+	return c.Conn, nil
+}
+
+// hijackedConn reads from the Reader of the hijacked Client.
+type hijackedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Client) stopDrainTimeout() error {
+	dropped := len(c.chSend)
+	c.Stop()
+	return fmt.Errorf("%w: stop gracefully failed, %v messages dropped", ErrClientTimeout, dropped)
+}
+
+func (c *Client) drained() {
+	c.mux.Lock()
+	if c.chDrained != nil {
+		close(c.chDrained)
+		c.chDrained = nil
+	}
+	c.mux.Unlock()
+}
+
+// State returns Client's connection state.
+func (c *Client) State() ClientState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.running || c.draining {
+		return StateStopped
+	}
+	if c.reconnecting || atomic.LoadInt32(&c.handshaking) == 1 {
+		return StateReconnecting
+	}
+	return StateRunning
+}
+
+// IsConnected returns whether the Client is connected and running.
+func (c *Client) IsConnected() bool {
+	return c.State() == StateRunning
+}
+
 // CheckState checks Client's state.
 func (c *Client) CheckState() error {
-	if !c.running {
+	if !c.running || c.draining {
 		return ErrClientStopped
 	}
 	if c.reconnecting {
@@ -366,6 +1408,22 @@ func (c *Client) CheckState() error {
 	return nil
 }
 
+func (c *Client) methodTimeout(method string) time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if timeout, ok := c.methodTimeouts[method]; ok {
+		return timeout
+	}
+	return c.defaultTimeout
+}
+
+func (c *Client) isIdempotent(method string) bool {
+	c.mux.Lock()
+	_, ok := c.idempotents[method]
+	c.mux.Unlock()
+	return ok
+}
+
 func (c *Client) checkCallArgs(method string, timeout time.Duration) error {
 	if err := c.checkStateAndMethod(method); err != nil {
 		return err
@@ -408,7 +1466,52 @@ func (c *Client) checkStateAndMethod(method string) error {
 	if err != nil {
 		return err
 	}
-	return checkMethod(method)
+	if err = checkMethod(method); err != nil {
+		return err
+	}
+	if len(method) > MaxShortMethodLen && !c.HasFeature(FeatureLongMethod) {
+		return fmt.Errorf("invalid method length: %v, should <= %v for protocol version %v", len(method), MaxShortMethodLen, c.Version())
+	}
+	return nil
+}
+
+func (c *Client) call(msg *Message, timeout time.Duration) (rsp *Message, err error) {
+	seq := msg.Seq()
+	sess := newSession(seq)
+	if !c.addSession(seq, sess) {
+		return nil, c.sessionsClosedError()
+	}
+	timer := getTimer(timeout)
+	defer func() {
+		putTimer(timer)
+		c.deleteSession(seq)
+	}()
+
+	if c.isTraceLogging() && log.Enabled(log.LevelDebug) {
+		start := time.Now()
+		c.traceRequest(msg)
+		defer func() { c.traceResponse(seq, start, rsp, err) }()
+	}
+
+	select {
+	case c.chSend <- msg:
+	case <-timer.C:
+		// c.Handler.OnOverstock(c, msg)
+		return nil, ErrClientTimeout
+	case <-c.chClose:
+		// c.Handler.OnOverstock(c, msg)
+		return nil, ErrClientStopped
+	}
+
+	select {
+	case msg = <-sess.done:
+	case <-timer.C:
+		return nil, ErrClientTimeout
+	case <-c.chClose:
+		return nil, ErrClientStopped
+	}
+
+	return msg, nil
 }
 
 func (c *Client) pushMessage(msg *Message, timer *time.Timer) error {
@@ -419,6 +1522,7 @@ func (c *Client) pushMessage(msg *Message, timer *time.Timer) error {
 			// c.Handler.OnOverstock(c, msg)
 			return ErrClientStopped
 		default:
+			c.queueFull()
 			c.Handler.OnOverstock(c, msg)
 			return ErrClientOverstock
 		}
@@ -436,11 +1540,18 @@ func (c *Client) pushMessage(msg *Message, timer *time.Timer) error {
 	return nil
 }
 
-func (c *Client) newRequestMessage(cmd byte, method string, v interface{}, isError bool, isAsync bool, args ...interface{}) *Message {
-	if len(args) == 0 {
-		return newMessage(cmd, method, v, isError, isAsync, atomic.AddUint64(&c.seq, 1), c.Handler, c.Codec, nil)
+func (c *Client) newRequestMessage(cmd byte, method string, v interface{}, isError bool, isAsync bool, args ...interface{}) (*Message, error) {
+	data := util.ValueToBytes(c.GetCodec(), v)
+	if err := checkBodyLen(methodLenSize(method) + len(method) + len(data)); err != nil {
+		return nil, err
 	}
-	return newMessage(cmd, method, v, isError, isAsync, atomic.AddUint64(&c.seq, 1), c.Handler, c.Codec, args[0].(map[string]interface{}))
+	var values map[string]interface{}
+	if len(args) > 0 {
+		values = args[0].(map[string]interface{})
+	}
+	msg := newMessage(cmd, method, data, isError, isAsync, c.nextSeq(), c.Handler, c.GetCodec(), values)
+	msg.SetVersion(c.Version())
+	return msg, nil
 }
 
 func (c *Client) parseResponse(msg *Message, rsp interface{}) error {
@@ -459,48 +1570,129 @@ func (c *Client) parseResponse(msg *Message, rsp interface{}) error {
 				*vt = string(msg.Data())
 			case *[]byte:
 				*vt = msg.Data()
+				// the buffer is held by rsp
+				return nil
 			// case *error:
 			// 	*vt = msg.Error()
 			default:
-				return c.Codec.Unmarshal(msg.Data(), rsp)
+				err := c.GetCodec().Unmarshal(msg.Data(), rsp)
+				c.releaseResponse(msg)
+				return err
 			}
 		}
+		c.releaseResponse(msg)
 	default:
 		return ErrInvalidRspMessage
 	}
 	return nil
 }
 
-func (c *Client) addSession(seq uint64, session *rpcSession) {
-	c.mux.Lock()
-	if c.running {
-		c.sessionMap[seq] = session
+func (c *Client) sessionShard(seq uint64) *sessionShard {
+	return &c.sessionShards[seq&(sessionShardNum-1)]
+}
+
+// addSession adds the session of seq, it returns false if the sessions are closed by reconnecting or stopping.
+func (c *Client) addSession(seq uint64, session *rpcSession) bool {
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	if shard.closed {
+		return false
 	}
-	c.mux.Unlock()
+	if shard.sessions == nil {
+		shard.sessions = make(map[uint64]*rpcSession)
+	}
+	if _, ok := shard.sessions[seq]; !ok {
+		atomic.AddInt64(&c.numSessions, 1)
+	}
+	shard.sessions[seq] = session
+	return true
 }
 
 func (c *Client) deleteSession(seq uint64) *rpcSession {
-	c.mux.Lock()
-	session := c.sessionMap[seq]
-	delete(c.sessionMap, seq)
-	c.mux.Unlock()
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	session, ok := shard.sessions[seq]
+	if ok {
+		delete(shard.sessions, seq)
+		atomic.AddInt64(&c.numSessions, -1)
+	}
+	shard.mux.Unlock()
 	return session
 }
 
 func (c *Client) getSession(seq uint64) (*rpcSession, bool) {
-	c.mux.Lock()
-	session, ok := c.sessionMap[seq]
-	c.mux.Unlock()
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	session, ok := shard.sessions[seq]
+	shard.mux.Unlock()
+	return session, ok
+}
+
+// BytesSent returns the number of the bytes of the messages written by the Client, including the heads,
+// it's cumulative across reconnecting.
+func (c *Client) BytesSent() uint64 {
+	return atomic.LoadUint64(&c.bytesSent)
+}
+
+// BytesReceived returns the number of the bytes of the messages read by the Client, including the heads,
+// it's cumulative across reconnecting.
+func (c *Client) BytesReceived() uint64 {
+	return atomic.LoadUint64(&c.bytesReceived)
+}
+
+// NumPendingCalls returns the number of the outstanding calls of the Client, which are waiting for
+// their responses, including the async calls whose handlers have neither returned nor timed out.
+func (c *Client) NumPendingCalls() int {
+	return int(atomic.LoadInt64(&c.numSessions)) + c.PendingAsync()
+}
+
+// RangeSessions calls f with the seq of every outstanding Call and how long it has been pending,
+// the iteration stops if f returns false.
+// f is called under the lock of the sessions, it should not call other methods of the Client.
+func (c *Client) RangeSessions(f func(seq uint64, age time.Duration) bool) {
+	now := time.Now()
+	for i := range c.sessionShards {
+		shard := &c.sessionShards[i]
+		shard.mux.Lock()
+		for seq, sess := range shard.sessions {
+			if !f(seq, now.Sub(sess.start)) {
+				shard.mux.Unlock()
+				return
+			}
+		}
+		shard.mux.Unlock()
+	}
+}
+
+// takeSession returns the session of seq for a response, the session of a Call is deleted
+// because it receives only one response, so a replayed response is dropped as a session miss
+// instead of blocking on the full done channel.
+func (c *Client) takeSession(seq uint64) (*rpcSession, bool) {
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	session, ok := shard.sessions[seq]
+	if ok && session.stop == nil {
+		delete(shard.sessions, seq)
+		atomic.AddInt64(&c.numSessions, -1)
+	}
+	shard.mux.Unlock()
 	return session, ok
 }
 
+// clearSession closes the sessions and marks the shards closed, see openSessions.
 func (c *Client) clearSession() {
-	c.mux.Lock()
-	for _, sess := range c.sessionMap {
-		close(sess.done)
+	for i := range c.sessionShards {
+		shard := &c.sessionShards[i]
+		shard.mux.Lock()
+		shard.closed = true
+		for _, sess := range shard.sessions {
+			close(sess.done)
+		}
+		atomic.AddInt64(&c.numSessions, -int64(len(shard.sessions)))
+		shard.sessions = nil
+		shard.mux.Unlock()
 	}
-	c.sessionMap = make(map[uint64]*rpcSession)
-	c.mux.Unlock()
 }
 
 func (c *Client) dropMessage(msg *Message) {
@@ -516,37 +1708,242 @@ func (c *Client) dropMessage(msg *Message) {
 	}
 }
 
-func (c *Client) addAsyncHandler(seq uint64, h HandlerFunc) {
-	c.mux.Lock()
-	if c.running {
-		c.asyncHandlerMap[seq] = h
+// handle calls the handlers of ctx, inflight should be increased before it's called.
+// The panic of the handlers is recovered and passed to Handler.OnPanic.
+func (c *Client) handle(ctx *Context) {
+	defer atomic.AddInt64(&c.inflight, -1)
+	defer c.Handler.PutBuffer(ctx.Message.Buffer)
+	defer ctx.cancelContext()
+	ctx.initDeadline()
+	ctx.startSpan()
+	if metrics := c.Handler.Metrics(); metrics != nil {
+		method := ctx.Method()
+		metrics.AddActiveHandlers(method, 1)
+		defer metrics.AddActiveHandlers(method, -1)
 	}
-	c.mux.Unlock()
+	defer func() {
+		v := recover()
+		if v != nil {
+			c.Handler.OnPanic(ctx, v)
+		}
+		ctx.endSpan(v)
+	}()
+	ctx.Next()
 }
 
-func (c *Client) deleteAsyncHandler(seq uint64) {
-	c.mux.Lock()
-	delete(c.asyncHandlerMap, seq)
-	c.mux.Unlock()
+// onMessage calls Handler.OnMessage, the panic is recovered and passed to Handler.OnPanic,
+// so a bad message or handler doesn't stop the recvLoop.
+func (c *Client) onMessage(msg *Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			defer util.Recover()
+			c.Handler.OnPanic(newContext(c, msg, nil), v)
+		}
+	}()
+	c.Handler.OnMessage(c, msg)
+}
+
+// encode encodes msg by the Codec if it implements MessageCoder, and then by the coders.
+func (c *Client) encode(msg *Message, coders []MessageCoder) *Message {
+	if mc, ok := c.GetCodec().(MessageCoder); ok {
+		msg = mc.Encode(c, msg)
+	}
+	for j := 0; j < len(coders); j++ {
+		msg = coders[j].Encode(c, msg)
+	}
+	return msg
+}
+
+// withChecksum returns a copy of msg with the checksum appended if it's enabled,
+// it's called before the coders so the receiver verifies the checksum after decoding.
+func (c *Client) withChecksum(msg *Message) *Message {
+	if atomic.LoadInt32(&c.checksum) == 1 && c.HasFeature(FeatureChecksum) {
+		return &Message{Buffer: appendChecksum(msg.Buffer), values: msg.values}
+	}
+	return msg
+}
+
+func (c *Client) dropExpired(msg *Message) {
+	atomic.AddUint64(&c.expiredCount, 1)
+	c.dropMessage(msg)
+}
+
+func (c *Client) appendUnexpired(messages []*Message, msg *Message) []*Message {
+	if msg.expired() {
+		c.dropExpired(msg)
+		return messages
+	}
+	return append(messages, msg)
 }
 
+// addAsyncHandler adds the handler of seq, it's deleted after timeout if timeout > 0.
+// It returns false if the sessions are closed by reconnecting or stopping.
+func (c *Client) addAsyncHandler(seq uint64, h HandlerFunc, timeout time.Duration) bool {
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	if shard.closed {
+		return false
+	}
+	if shard.asyncHandlers == nil {
+		shard.asyncHandlers = make(map[uint64]asyncHandler)
+	}
+	ah := asyncHandler{handler: h}
+	if timeout > 0 {
+		ah.timer = time.AfterFunc(timeout, func() { c.deleteAsyncHandler(seq) })
+	}
+	if _, ok := shard.asyncHandlers[seq]; !ok {
+		c.addAsyncPending(1)
+	}
+	shard.asyncHandlers[seq] = ah
+	return true
+}
+
+// deleteAsyncHandler deletes the handler of seq and stops its timer, it returns false if not found.
+func (c *Client) deleteAsyncHandler(seq uint64) bool {
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	ah, ok := shard.asyncHandlers[seq]
+	if ok {
+		delete(shard.asyncHandlers, seq)
+	}
+	shard.mux.Unlock()
+	if ok {
+		if ah.timer != nil {
+			ah.timer.Stop()
+		}
+		c.addAsyncPending(-1)
+	}
+	return ok
+}
+
+// getAndDeleteAsyncHandler deletes the handler of seq and returns it, the async call
+// is pending until the returned handler returns.
 func (c *Client) getAndDeleteAsyncHandler(seq uint64) (HandlerFunc, bool) {
-	c.mux.Lock()
-	handler, ok := c.asyncHandlerMap[seq]
+	shard := c.sessionShard(seq)
+	shard.mux.Lock()
+	ah, ok := shard.asyncHandlers[seq]
 	if ok {
-		delete(c.asyncHandlerMap, seq)
-		c.mux.Unlock()
-	} else {
-		c.mux.Unlock()
+		delete(shard.asyncHandlers, seq)
+	}
+	shard.mux.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if ah.timer != nil {
+		ah.timer.Stop()
 	}
 
-	return handler, ok
+	return func(ctx *Context) {
+		defer c.addAsyncPending(-1)
+		ah.handler(ctx)
+	}, true
 }
 
+// clearAsyncHandler deletes the async handlers and marks the shards closed, see openSessions.
 func (c *Client) clearAsyncHandler() {
-	c.mux.Lock()
-	c.asyncHandlerMap = make(map[uint64]HandlerFunc)
-	c.mux.Unlock()
+	for i := range c.sessionShards {
+		shard := &c.sessionShards[i]
+		shard.mux.Lock()
+		shard.closed = true
+		for _, ah := range shard.asyncHandlers {
+			if ah.timer != nil {
+				ah.timer.Stop()
+			}
+		}
+		c.addAsyncPending(-len(shard.asyncHandlers))
+		shard.asyncHandlers = nil
+		shard.mux.Unlock()
+	}
+}
+
+// closeSessions marks the shards closed without clearing the sessions, the calls waiting for them
+// return ErrClientStopped by chClose.
+func (c *Client) closeSessions() {
+	for i := range c.sessionShards {
+		shard := &c.sessionShards[i]
+		shard.mux.Lock()
+		shard.closed = true
+		shard.mux.Unlock()
+	}
+}
+
+// openSessions marks the shards open after reconnected or restarted, so the new calls can add their sessions.
+func (c *Client) openSessions() {
+	for i := range c.sessionShards {
+		shard := &c.sessionShards[i]
+		shard.mux.Lock()
+		shard.closed = false
+		shard.mux.Unlock()
+	}
+}
+
+// sessionsClosedError returns the error of a call whose session is refused by the closed shards.
+func (c *Client) sessionsClosedError() error {
+	if err := c.CheckState(); err != nil {
+		return err
+	}
+	return ErrClientReconnecting
+}
+
+// addAsyncPending adds delta to the number of the pending async calls and wakes up DrainAsync when it's 0.
+func (c *Client) addAsyncPending(delta int) {
+	if delta == 0 {
+		return
+	}
+	c.asyncMux.Lock()
+	c.asyncPending += delta
+	if c.asyncPending == 0 {
+		for _, ch := range c.asyncDrained {
+			close(ch)
+		}
+		c.asyncDrained = nil
+	}
+	c.asyncMux.Unlock()
+}
+
+// PendingAsync returns the number of the async calls whose handlers have neither returned nor timed out.
+func (c *Client) PendingAsync() int {
+	c.asyncMux.Lock()
+	defer c.asyncMux.Unlock()
+	return c.asyncPending
+}
+
+// DrainAsync blocks until every pending async call of CallAsync has its handler returned or timed out,
+// e.g. before stopping the Client so the handlers are not abandoned.
+// If the timeout expires first, it returns an error wrapping ErrClientTimeout with the number still pending.
+// The handlers of the async calls without a timeout are waited for until the responses arrive.
+func (c *Client) DrainAsync(timeout time.Duration) error {
+	c.asyncMux.Lock()
+	if c.asyncPending == 0 {
+		c.asyncMux.Unlock()
+		return nil
+	}
+	chDrained := make(chan util.Empty)
+	c.asyncDrained = append(c.asyncDrained, chDrained)
+	c.asyncMux.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-chDrained:
+		return nil
+	case <-timer.C:
+	}
+
+	c.asyncMux.Lock()
+	defer c.asyncMux.Unlock()
+	for i, ch := range c.asyncDrained {
+		if ch == chDrained {
+			c.asyncDrained = append(c.asyncDrained[:i], c.asyncDrained[i+1:]...)
+			break
+		}
+	}
+	if c.asyncPending == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %v async calls pending", ErrClientTimeout, c.asyncPending)
 }
 
 func (c *Client) run() {
@@ -555,6 +1952,8 @@ func (c *Client) run() {
 	if !c.running {
 		c.running = true
 		c.initReader()
+		c.initWriter()
+		c.sendLoopDone = make(chan util.Empty)
 		go util.Safe(c.sendLoop)
 		go util.Safe(c.recvLoop)
 	}
@@ -566,17 +1965,105 @@ func (c *Client) runWebsocket() {
 	if !c.running {
 		c.running = true
 		c.initReader()
+		c.initWriter()
+		c.sendLoopDone = make(chan util.Empty)
 		go util.Safe(c.sendLoop)
 		c.Conn.(WebsocketConn).HandleWebsocket(c.recvLoop)
 	}
 }
 
+func (c *Client) reconnectLimited(attempt int) bool {
+	c.mux.Lock()
+	max := c.maxReconnects
+	c.mux.Unlock()
+	return max >= 0 && attempt >= max
+}
+
+func (c *Client) reconnectFailed(err error) {
+	c.stop(err)
+	c.mux.Lock()
+	onReconnectFailed := c.onReconnectFailed
+	c.mux.Unlock()
+	if onReconnectFailed != nil {
+		onReconnectFailed(c, err)
+	}
+}
+
+func (c *Client) queueFull() {
+	c.mux.Lock()
+	onQueueFull := c.onQueueFull
+	c.mux.Unlock()
+	if onQueueFull != nil {
+		onQueueFull()
+	}
+}
+
+func (c *Client) reconnectDelay(attempt int) time.Duration {
+	c.mux.Lock()
+	backoff := c.reconnectBackoff
+	c.mux.Unlock()
+	if backoff == nil {
+		return time.Second
+	}
+	return backoff(attempt)
+}
+
+// initWriter wraps Conn with Handler.WrapWriter, websocket connections are not wrapped
+// because every Write of them sends a websocket message.
+func (c *Client) initWriter() {
+	c.Writer = c.Conn
+	c.writeConn = c.Conn
+	if _, ok := c.Conn.(WebsocketConn); ok {
+		return
+	}
+	w := c.Handler.WrapWriter(c.Conn)
+	if conn, ok := w.(net.Conn); ok {
+		c.writeConn = conn
+	} else if w != nil {
+		c.writeConn = &writerConn{Conn: c.Conn, w: w}
+	} else {
+		w = c.Conn
+	}
+	c.Writer = w
+	if algo := c.Handler.StreamCompression(); algo != StreamCompressionNone {
+		sw := newStreamWriter(w, algo)
+		c.Writer = sw
+		c.writeConn = &writerConn{Conn: c.Conn, w: sw}
+	}
+}
+
+// flush flushes Writer if it's buffered.
+func (c *Client) flush() {
+	if f, ok := c.Writer.(interface{ Flush() error }); ok {
+		c.setWriteDeadline()
+		if err := f.Flush(); err != nil {
+			c.onWriteError(err)
+		}
+	}
+}
+
+// writerConn writes to the wrapped Writer of the Conn.
+type writerConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *writerConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
 func (c *Client) initReader() {
 	if c.Handler.BatchRecv() {
 		c.Reader = c.Handler.WrapReader(c.Conn)
 	} else {
 		c.Reader = c.Conn
 	}
+	if _, ok := c.Conn.(WebsocketConn); ok {
+		return
+	}
+	if algo := c.Handler.StreamCompression(); algo != StreamCompressionNone {
+		c.Reader = newStreamReader(c.Reader, algo)
+	}
 }
 
 func (c *Client) recvLoop() {
@@ -586,30 +2073,46 @@ func (c *Client) recvLoop() {
 		addr = c.Conn.RemoteAddr().String()
 	)
 
-	log.Debug("%v\t%v\trecvLoop start", c.Handler.LogTag(), addr)
-	defer log.Debug("%v\t%v\trecvLoop stop", c.Handler.LogTag(), addr)
+	log.Debugw("recvLoop start", "tag", c.Handler.LogTag(), "remote_addr", addr)
+	defer log.Debugw("recvLoop stop", "tag", c.Handler.LogTag(), "remote_addr", addr)
 
 	if c.Dialer == nil {
 		for c.running {
+			if c.idleTimeout > 0 || atomic.LoadInt64(&c.readTimeout) > 0 {
+				c.Conn.SetReadDeadline(c.nextReadDeadline())
+			}
 			msg, err = c.Handler.Recv(c)
 			if err != nil {
-				log.Error("%v\t%v\tDisconnected: %v", c.Handler.LogTag(), addr, err)
-				c.Stop()
+				log.Errorw("Disconnected", "tag", c.Handler.LogTag(), "remote_addr", addr, "error", err)
+				c.stop(err)
 				return
 			}
-			c.Handler.OnMessage(c, msg)
+			atomic.AddUint64(&c.bytesReceived, uint64(len(msg.Buffer)))
+			c.onMessage(msg)
 		}
 	} else {
-		go c.Handler.OnConnected(c)
+		// NewClient calls the handshake of WithConnectHandshake and then the OnConnected handlers itself
+		if c.restarted {
+			go c.onConnected(c.Conn)
+		} else if atomic.LoadInt32(&c.handshaking) == 0 {
+			go c.Handler.OnConnected(c)
+		}
 
 		for c.running {
 			for {
+				if atomic.LoadInt64(&c.readTimeout) > 0 {
+					c.Conn.SetReadDeadline(c.nextReadDeadline())
+				}
 				msg, err = c.Handler.Recv(c)
 				if err != nil {
-					log.Error("%v\t%v\tDisconnected: %v", c.Handler.LogTag(), addr, err)
+					log.Errorw("Disconnected", "tag", c.Handler.LogTag(), "remote_addr", addr, "error", err)
 					break
 				}
-				c.Handler.OnMessage(c, msg)
+				atomic.AddUint64(&c.bytesReceived, uint64(len(msg.Buffer)))
+				c.onMessage(msg)
+				if c.hijacked {
+					return
+				}
 			}
 
 			c.reconnecting = true
@@ -623,33 +2126,93 @@ func (c *Client) recvLoop() {
 			// }
 			i := 0
 			for c.running {
+				if c.reconnectLimited(i) {
+					log.Errorw("Reconnect Stopped", "tag", c.Handler.LogTag(), "remote_addr", addr, "attempts", i, "error", err)
+					c.reconnectFailed(err)
+					return
+				}
 				i++
-				log.Info("%v\t%v\tReconnect Trying %v", c.Handler.LogTag(), addr, i)
-				conn, err := c.Dialer()
+				log.Infow("Reconnect Trying", "tag", c.Handler.LogTag(), "remote_addr", addr, "attempt", i)
+				var conn net.Conn
+				conn, err = c.Dialer()
 				if err == nil {
 					c.Conn = conn
 
 					c.initReader()
+					// the send loop replaces the Writer itself, the messages after the mark are written to the new Conn
+					select {
+					case c.chSend <- writerResetMark:
+					case <-c.chClose:
+						return
+					}
+
+					// the new server may be of another version
+					c.setProtocol(ProtocolVersion0, 0)
 
+					c.openSessions()
+					atomic.StoreInt32(&c.handshaking, 1)
 					c.reconnecting = false
 
-					log.Info("%v\t%v\tReconnected", c.Handler.LogTag(), addr)
+					log.Infow("Reconnected", "tag", c.Handler.LogTag(), "remote_addr", addr)
 
-					go c.Handler.OnConnected(c)
+					go c.onConnected(conn)
 
 					break
 				}
 
-				time.Sleep(time.Second)
+				delay := c.reconnectDelay(i)
+				if delay < 0 {
+					log.Errorw("Reconnect Stopped", "tag", c.Handler.LogTag(), "remote_addr", addr, "attempts", i, "error", err)
+					c.reconnectFailed(err)
+					return
+				}
+				time.Sleep(delay)
+			}
+		}
+	}
+}
+
+func (c *Client) keepaliveLoop(interval time.Duration, method string, chClose chan util.Empty) {
+	failed := 0
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSendTime)))
+			if idle < interval {
+				timer.Reset(interval - idle)
+				continue
+			}
+			if !c.reconnecting {
+				if err := c.Notify(method, nil, interval); err != nil && err != ErrClientReconnecting {
+					failed++
+					log.Warnw("Keepalive failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "failures", failed, "error", err)
+					if failed >= 2 {
+						failed = 0
+						c.Conn.Close()
+					}
+				} else {
+					failed = 0
+				}
 			}
+			timer.Reset(interval)
+		case <-chClose:
+			return
 		}
 	}
 }
 
+// writerResetMark is queued by the recv loop after reconnected, the send loop wraps the new Conn
+// by initWriter when it reaches the mark, so the Writer is only replaced by the goroutine using it.
+// The bytes still buffered in the old Writer are dropped with its closed Conn.
+var writerResetMark = &Message{}
+
 func (c *Client) sendLoop() {
 	addr := c.Conn.RemoteAddr().String()
-	log.Debug("%v\t%v\tsendLoop start", c.Handler.LogTag(), addr)
-	defer log.Debug("%v\t%v\tsendLoop stop", c.Handler.LogTag(), addr)
+	log.Debugw("sendLoop start", "tag", c.Handler.LogTag(), "remote_addr", addr)
+	defer log.Debugw("sendLoop stop", "tag", c.Handler.LogTag(), "remote_addr", addr)
+	defer close(c.sendLoopDone)
 
 	if c.Handler.BatchSend() {
 		c.batchSendLoop()
@@ -660,21 +2223,32 @@ func (c *Client) sendLoop() {
 
 func (c *Client) normalSendLoop() {
 	var msg *Message
-	var coders []MessageCoder
 	for {
 		select {
 		case msg = <-c.chSend:
-			if !c.reconnecting {
-				coders = c.Handler.Coders()
-				for j := 0; j < len(coders); j++ {
-					msg = coders[j].Encode(c, msg)
-				}
-				if _, err := c.Handler.Send(c.Conn, msg.Buffer); err != nil {
-					c.Conn.Close()
+			if msg == nil {
+				c.flush()
+				c.drained()
+			} else if msg == writerResetMark {
+				c.initWriter()
+				continue
+			} else if msg.expired() {
+				c.dropExpired(msg)
+			} else if !c.reconnecting {
+				msg = c.encode(c.withChecksum(msg), c.Handler.Coders())
+				c.setWriteDeadline()
+				n, err := c.Handler.Send(c.writeConn, msg.Buffer)
+				atomic.AddUint64(&c.bytesSent, uint64(n))
+				if err != nil {
+					c.onWriteError(err)
 				}
+				atomic.StoreInt64(&c.lastSendTime, time.Now().UnixNano())
 			} else {
 				c.dropMessage(msg)
 			}
+			if len(c.chSend) == 0 {
+				c.flush()
+			}
 		case <-c.chClose:
 			return
 		}
@@ -684,103 +2258,180 @@ func (c *Client) normalSendLoop() {
 func (c *Client) batchSendLoop() {
 	var msg *Message
 	var coders []MessageCoder
-	var messages []*Message = make([]*Message, 10)[0:0]
-	var buffers net.Buffers = make([][]byte, 10)[0:0]
+	var batchSize = c.Handler.WriteBatchSize()
+	var messages []*Message = make([]*Message, batchSize)[0:0]
+	var buffers net.Buffers = make([][]byte, batchSize)[0:0]
 	for {
 		select {
 		case msg = <-c.chSend:
 		case <-c.chClose:
 			return
 		}
-		messages = append(messages, msg)
-		for i := 1; i < len(c.chSend) && i < 10; i++ {
+		if msg == writerResetMark {
+			c.initWriter()
+			continue
+		}
+		drained := msg == nil
+		if !drained {
+			messages = c.appendUnexpired(messages, msg)
+		}
+		// coalesce the queued messages, don't wait for more if the queue is empty,
+		// the Writer is reset after the messages before the mark have been handled
+		reset := false
+		batchSize = c.Handler.WriteBatchSize()
+		for i := 1; !drained && i < batchSize && len(c.chSend) > 0; i++ {
 			msg = <-c.chSend
-			messages = append(messages, msg)
+			if msg == nil {
+				drained = true
+				break
+			}
+			if msg == writerResetMark {
+				reset = true
+				break
+			}
+			messages = c.appendUnexpired(messages, msg)
 		}
-		if !c.reconnecting {
+		if len(messages) > 0 && !c.reconnecting {
 			coders = c.Handler.Coders()
 			if len(messages) == 1 {
-				for j := 0; j < len(coders); j++ {
-					messages[0] = coders[j].Encode(c, messages[0])
-				}
-				if _, err := c.Handler.Send(c.Conn, messages[0].Buffer); err != nil {
-					c.Conn.Close()
+				messages[0] = c.encode(c.withChecksum(messages[0]), coders)
+				c.setWriteDeadline()
+				n, err := c.Handler.Send(c.writeConn, messages[0].Buffer)
+				atomic.AddUint64(&c.bytesSent, uint64(n))
+				if err != nil {
+					c.onWriteError(err)
 				}
 			} else {
 				for i := 0; i < len(messages); i++ {
-					for j := 0; j < len(coders); j++ {
-						messages[i] = coders[j].Encode(c, messages[i])
-					}
+					messages[i] = c.encode(c.withChecksum(messages[i]), coders)
 					buffers = append(buffers, messages[i].Buffer)
 				}
-				if _, err := c.Handler.SendN(c.Conn, buffers); err != nil {
-					c.Conn.Close()
+				c.setWriteDeadline()
+				n, err := c.Handler.SendN(c.writeConn, buffers)
+				atomic.AddUint64(&c.bytesSent, uint64(n))
+				if err != nil {
+					c.onWriteError(err)
 				}
 				buffers = buffers[0:0]
 			}
+			atomic.StoreInt64(&c.lastSendTime, time.Now().UnixNano())
 		} else {
 			for _, m := range messages {
 				c.dropMessage(m)
 			}
 		}
 		messages = messages[0:0]
+		if reset {
+			// the old Conn is closed, nothing to flush
+			c.initWriter()
+		} else if drained || len(c.chSend) == 0 {
+			c.flush()
+		}
+		if drained {
+			c.drained()
+		}
 	}
 }
 
-func newClientWithConn(conn net.Conn, codec codec.Codec, handler Handler, onStop func(*Client)) *Client {
-	log.Info("%v\t%v\tConnected", handler.LogTag(), conn.RemoteAddr())
+func newClientWithConn(conn net.Conn, codec codec.Codec, handler Handler, onStop func(*Client), opts ...ClientOption) *Client {
+	log.Infow("Connected", "tag", handler.LogTag(), "remote_addr", conn.RemoteAddr())
 
 	c := &Client{}
+	c.id = atomic.AddUint64(&clientID, 1)
 	c.Conn = conn
 	c.Head = Header(c.head[:])
 	c.Codec = codec
 	c.Handler = handler
-	c.chSend = make(chan *Message, c.Handler.SendQueueSize())
-	c.chClose = make(chan util.Empty)
-	c.sessionMap = make(map[uint64]*rpcSession)
-	c.asyncHandlerMap = make(map[uint64]HandlerFunc)
 	c.onStop = onStop
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.chSend = c.newSendQueue()
+	c.chClose = make(chan util.Empty)
+
+	return c
+}
 
-	if _, ok := conn.(WebsocketConn); !ok {
+// start runs a Client created by newClientWithConn.
+func (c *Client) start() {
+	if _, ok := c.Conn.(WebsocketConn); !ok {
 		c.run()
 	} else {
 		c.runWebsocket()
 	}
+}
 
+// NewClientWithConn creates and runs a Client over an established conn, e.g. one from the user's own accept loop.
+// Unlike the Client created by NewClient, it has no Dialer and never reconnects: once the conn is closed or
+// fails, the Client is stopped, Handler.OnDisconnected is called and the calls fail with ErrClientStopped,
+// like the Clients of a Server. It doesn't start the protocol handshake either, the peer dialed by NewClient does.
+// The default Codec and a clone of DefaultHandler are used if cdc or handler is nil,
+// and handler.OnConnected is called before it returns.
+func NewClientWithConn(conn net.Conn, cdc codec.Codec, handler Handler, opts ...ClientOption) *Client {
+	if cdc == nil {
+		cdc = codec.DefaultCodec
+	}
+	if handler == nil {
+		handler = DefaultHandler.Clone()
+	}
+	c := newClientWithConn(conn, cdc, handler, nil, opts...)
+	c.start()
+	handler.OnConnected(c)
 	return c
 }
 
-// NewClient creates a Client.
-func NewClient(dialer DialerFunc) (*Client, error) {
+// NewClient creates a Client, opts are applied before it starts.
+func NewClient(dialer DialerFunc, opts ...ClientOption) (*Client, error) {
 	conn, err := dialer()
 	if err != nil {
 		return nil, err
 	}
 
 	c := &Client{}
+	c.id = atomic.AddUint64(&clientID, 1)
 	c.Conn = conn
 
 	c.Head = Header(c.head[:])
 	c.Codec = codec.DefaultCodec
 	c.Handler = DefaultHandler.Clone()
 	c.Dialer = dialer
-	c.chSend = make(chan *Message, c.Handler.SendQueueSize())
+	c.maxReconnects = -1
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.chSend = c.newSendQueue()
 	c.chClose = make(chan util.Empty)
-	c.sessionMap = make(map[uint64]*rpcSession)
-	c.asyncHandlerMap = make(map[uint64]HandlerFunc)
+	if c.onConnectHandshake != nil {
+		c.handshaking = 1
+	}
 
 	c.run()
 
-	log.Info("%v\t%v\tConnected", c.Handler.LogTag(), conn.RemoteAddr())
+	log.Infow("Connected", "tag", c.Handler.LogTag(), "remote_addr", conn.RemoteAddr())
+
+	c.handshake()
+
+	if c.onConnectHandshake != nil {
+		if err = c.connectHandshake(); err != nil {
+			log.Errorw("Connect Handshake failed", "tag", c.Handler.LogTag(), "remote_addr", conn.RemoteAddr(), "error", err)
+			c.Stop()
+			return nil, err
+		}
+		go c.Handler.OnConnected(c)
+	}
 
 	return c, nil
 }
 
 // ClientPool represents an arpc Client Pool.
 type ClientPool struct {
-	size    uint64
-	round   uint64
-	clients []*Client
+	size     uint64
+	round    uint64
+	clients  []*Client
+	balancer Balancer
+
+	healthMux    sync.Mutex
+	chHealthStop chan util.Empty
 }
 
 // Size returns Client number.
@@ -793,21 +2444,57 @@ func (pool *ClientPool) Get(index int) *Client {
 	return pool.clients[uint64(index)%pool.size]
 }
 
-// Next returns a Client by round robin.
+// SetBalancer sets the Balancer which selects the Client for every call, a nil Balancer restores round robin.
+// It should be called before the ClientPool is used to make calls.
+func (pool *ClientPool) SetBalancer(balancer Balancer) {
+	pool.balancer = balancer
+}
+
+// Next returns a Client selected by the Balancer, or by round robin if there's no Balancer.
+// The Clients which are not connected or failed the health check are skipped unless all of them are.
 func (pool *ClientPool) Next() *Client {
+	if pool.balancer != nil {
+		return pool.pick()
+	}
+
 	var client = pool.clients[atomic.AddUint64(&pool.round, 1)%pool.size]
-	if client.running && !client.reconnecting {
+	if pool.available(client) {
 		return client
 	}
 	for i := uint64(1); i < pool.size; i++ {
 		client = pool.clients[atomic.AddUint64(&pool.round, 1)%pool.size]
-		if client.running && !client.reconnecting {
+		if pool.available(client) {
 			return client
 		}
 	}
 	return client
 }
 
+// Call makes an rpc call by a Client selected by Next.
+func (pool *ClientPool) Call(method string, req interface{}, rsp interface{}, timeout time.Duration, args ...interface{}) error {
+	return pool.Next().Call(method, req, rsp, timeout, args...)
+}
+
+// CallWith uses context to make rpc call by a Client selected by Next.
+func (pool *ClientPool) CallWith(ctx context.Context, method string, req interface{}, rsp interface{}, args ...interface{}) error {
+	return pool.Next().CallWith(ctx, method, req, rsp, args...)
+}
+
+// CallAsync makes an asynchronous rpc call by a Client selected by Next.
+func (pool *ClientPool) CallAsync(method string, req interface{}, handler HandlerFunc, timeout time.Duration, args ...interface{}) error {
+	return pool.Next().CallAsync(method, req, handler, timeout, args...)
+}
+
+// Notify makes a notify by a Client selected by Next.
+func (pool *ClientPool) Notify(method string, data interface{}, timeout time.Duration, args ...interface{}) error {
+	return pool.Next().Notify(method, data, timeout, args...)
+}
+
+// NotifyWith use context to make rpc notify by a Client selected by Next.
+func (pool *ClientPool) NotifyWith(ctx context.Context, method string, data interface{}, args ...interface{}) error {
+	return pool.Next().NotifyWith(ctx, method, data, args...)
+}
+
 // Handler returns Handler.
 func (pool *ClientPool) Handler() Handler {
 	return pool.Next().Handler
@@ -815,6 +2502,7 @@ func (pool *ClientPool) Handler() Handler {
 
 // Stop stops all clients.
 func (pool *ClientPool) Stop() {
+	pool.SetHealthCheck("", 0, 0)
 	for _, c := range pool.clients {
 		c.Stop()
 	}
@@ -6,11 +6,22 @@ package arpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/lesismal/arpc/internal/codec"
+	alog "github.com/lesismal/arpc/internal/log"
+	"github.com/lesismal/arpc/internal/util"
 )
 
 var (
@@ -21,25 +32,14 @@ var (
 	methodCallBytes    = "/callbytes"
 	methodCallStruct   = "/callstruct"
 	methodCallWith     = "/callwith"
+	methodCallHeader   = "/callheader"
 	methodCallAsync    = "/callasync"
 	methodNotify       = "/notify"
 	methodNotifyWith   = "/notifywith"
 	methodCallError    = "/callerror"
 	methodCallNotFound = "/notfound"
 	methodCallTimeout  = "/timeout"
-	methodInvalidLong  = `1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890
-						1234567890`
+	methodInvalidLong  = strings.Repeat("1234567890", MaxMethodLen/10+1)
 
 	invalidMethodErrString = fmt.Sprintf("invalid method length: %v, should <= %v", len(methodInvalidLong), MaxMethodLen)
 )
@@ -125,6 +125,9 @@ func initServer() {
 	testServer.Handler.Handle(methodCallWith, func(ctx *Context) {
 		ctx.WriteWithTimeout(ctx.Message.Data(), time.Second)
 	}, true)
+	testServer.Handler.Handle(methodCallHeader, func(ctx *Context) {
+		ctx.Write(ctx.Header()["key"])
+	}, true)
 	testServer.Handler.Handle(methodCallAsync, func(ctx *Context) {
 		ctx.Write(ctx.Message.Data())
 	}, true)
@@ -149,6 +152,370 @@ func initServer() {
 	go testServer.Serve(ln)
 }
 
+func TestClient_ID(t *testing.T) {
+	chID := make(chan uint64, 2)
+	svr := NewServer()
+	svr.Handler.Handle("/id", func(ctx *Context) {
+		chID <- ctx.Client.ID()
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	ids := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", testServerAddr, time.Second)
+		})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		defer c.Stop()
+		if err = c.Call("/id", nil, nil, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		ids[c.ID()] = true
+		ids[<-chID] = true
+	}
+	if len(ids) != 4 || ids[0] {
+		t.Fatalf("Client.ID() = %v, want 4 different non-zero IDs", ids)
+	}
+}
+
+func TestClient_CancelAsync(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/sleep", func(ctx *Context) {
+		time.Sleep(time.Second / 20)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	called := make(chan struct{}, 2)
+	seq, err := c.CallAsyncSeq("/sleep", nil, func(ctx *Context) { called <- struct{}{} }, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsyncSeq() error = %v", err)
+	}
+	if !c.CancelAsync(seq) {
+		t.Fatalf("Client.CancelAsync() = false, want true")
+	}
+	if c.CancelAsync(seq) {
+		t.Fatalf("Client.CancelAsync() = true, want false")
+	}
+
+	// the handler is deleted after timeout
+	seq, err = c.CallAsyncSeq("/sleep", nil, func(ctx *Context) { called <- struct{}{} }, time.Second/50)
+	if err != nil {
+		t.Fatalf("Client.CallAsyncSeq() error = %v", err)
+	}
+	time.Sleep(time.Second / 10)
+	if c.CancelAsync(seq) {
+		t.Fatalf("Client.CancelAsync() = true, want false after timeout")
+	}
+	if len(called) != 0 {
+		t.Fatalf("canceled or expired handler called %v times", len(called))
+	}
+}
+
+func TestClient_DrainAsync(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/sleep", func(ctx *Context) {
+		time.Sleep(time.Second / 20)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	if err = c.DrainAsync(time.Second); err != nil {
+		t.Fatalf("Client.DrainAsync() error = %v", err)
+	}
+
+	var called int32
+	for i := 0; i < 10; i++ {
+		err = c.CallAsync("/sleep", nil, func(ctx *Context) {
+			time.Sleep(time.Second / 100)
+			atomic.AddInt32(&called, 1)
+		}, time.Second)
+		if err != nil {
+			t.Fatalf("Client.CallAsync() error = %v", err)
+		}
+	}
+	if err = c.DrainAsync(time.Second); err != nil {
+		t.Fatalf("Client.DrainAsync() error = %v", err)
+	}
+	// the handlers have returned, not only been taken
+	if n := atomic.LoadInt32(&called); n != 10 {
+		t.Fatalf("handlers called %v times, want 10", n)
+	}
+
+	seq, err := c.CallAsyncSeq("/sleep", nil, func(ctx *Context) {}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsyncSeq() error = %v", err)
+	}
+	if err = c.DrainAsync(time.Second / 100); !errors.Is(err, ErrClientTimeout) {
+		t.Fatalf("Client.DrainAsync() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if n := c.PendingAsync(); n != 1 {
+		t.Fatalf("Client.PendingAsync() = %v, want 1", n)
+	}
+	c.CancelAsync(seq)
+	if n := c.PendingAsync(); n != 0 {
+		t.Fatalf("Client.PendingAsync() = %v, want 0", n)
+	}
+
+	// the timed out handlers are not pending
+	c.CallAsync("/sleep", nil, func(ctx *Context) {}, time.Second/100)
+	if err = c.DrainAsync(time.Second); err != nil {
+		t.Fatalf("Client.DrainAsync() error = %v", err)
+	}
+}
+
+func TestClient_SetSeqGenerator(t *testing.T) {
+	svr := NewServer()
+	chSeq := make(chan uint64, 1)
+	svr.Handler.Handle("/seq", func(ctx *Context) {
+		chSeq <- ctx.Seq()
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	c.SetSeqStart(1000)
+	if err = c.Call("/seq", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if seq := <-chSeq; seq != 1001 {
+		t.Fatalf("seq = %v, want 1001", seq)
+	}
+
+	next := uint64(5000)
+	c.SetSeqGenerator(func() uint64 { return atomic.AddUint64(&next, 2) })
+	if err = c.Call("/seq", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if seq := <-chSeq; seq != 5002 {
+		t.Fatalf("seq = %v, want 5002", seq)
+	}
+
+	c.SetSeqGenerator(nil)
+	if err = c.Call("/seq", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if seq := <-chSeq; seq != 1002 {
+		t.Fatalf("seq = %v, want 1002", seq)
+	}
+}
+
+func TestClient_BytesSent(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	sent, received := c.BytesSent(), c.BytesReceived()
+	req := strings.Repeat("a", 1000)
+	least := uint64(10 * (HeadLen + len(req)))
+	for i := 0; i < 10; i++ {
+		if err = c.Call("/echo", req, nil, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if n := c.BytesSent() - sent; n < least {
+		t.Fatalf("Client.BytesSent() increased %v, want >= %v", n, least)
+	}
+	if n := c.BytesReceived() - received; n < least {
+		t.Fatalf("Client.BytesReceived() increased %v, want >= %v", n, least)
+	}
+
+	// the bytes sent by one side are received by the other
+	time.Sleep(time.Second / 100)
+	clients := svr.getClients()
+	if len(clients) != 1 {
+		t.Fatalf("%v server side Clients, want 1", len(clients))
+	}
+	if c.BytesSent() != clients[0].BytesReceived() || c.BytesReceived() != clients[0].BytesSent() {
+		t.Fatalf("Client sent %v, received %v, server side Client sent %v, received %v",
+			c.BytesSent(), c.BytesReceived(), clients[0].BytesSent(), clients[0].BytesReceived())
+	}
+}
+
+func TestClient_RangeSessions(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/sleep", func(ctx *Context) {
+		time.Sleep(time.Second / 5)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Call("/sleep", nil, nil, time.Second)
+	}()
+	time.Sleep(time.Second / 10)
+
+	n := 0
+	c.RangeSessions(func(seq uint64, age time.Duration) bool {
+		n++
+		if age < time.Second/20 {
+			t.Errorf("session %v age = %v, want >= %v", seq, age, time.Second/20)
+		}
+		return true
+	})
+	if n != 1 {
+		t.Fatalf("Client.RangeSessions() visited %v sessions, want 1", n)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	c.RangeSessions(func(seq uint64, age time.Duration) bool {
+		t.Fatalf("session %v not deleted after response", seq)
+		return false
+	})
+}
+
+func TestClient_SetSendQueueSize(t *testing.T) {
+	svr := NewServer()
+	svr.SetClientOptions(WithSendQueueSize(5))
+	chSvrCli := make(chan *Client, 1)
+	svr.HandleConnected(func(c *Client) {
+		chSvrCli <- c
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	}, WithSendQueueSize(3))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if c.QueueCap() != 3 {
+		t.Fatalf("Client.QueueCap() = %v, want 3", c.QueueCap())
+	}
+	if svrCli := <-chSvrCli; svrCli.QueueCap() != 5 {
+		t.Fatalf("Client.QueueCap() of the Server = %v, want 5", svrCli.QueueCap())
+	}
+
+	if err = c.SetSendQueueSize(0); err != ErrClientInvalidSendQueueSize {
+		t.Fatalf("Client.SetSendQueueSize(0) error = %v, want %v", err, ErrClientInvalidSendQueueSize)
+	}
+	if err = c.SetSendQueueSize(7); err != ErrClientRunning {
+		t.Fatalf("Client.SetSendQueueSize() error = %v, want %v", err, ErrClientRunning)
+	}
+	c.Stop()
+	if err = c.SetSendQueueSize(7); err != nil {
+		t.Fatalf("Client.SetSendQueueSize() error = %v", err)
+	}
+	if err = c.Restart(); err != nil {
+		t.Fatalf("Client.Restart() error = %v", err)
+	}
+	if c.QueueCap() != 7 {
+		t.Fatalf("Client.QueueCap() = %v, want 7", c.QueueCap())
+	}
+}
+
+func TestClient_CallChan(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/sleep", func(ctx *Context) {
+		time.Sleep(time.Second / 10)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	ch, err := c.CallChan("/echo", "hello", time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallChan() error = %v", err)
+	}
+	ctx, ok := <-ch
+	if !ok || string(ctx.Body()) != "hello" {
+		t.Fatalf("Client.CallChan() received %v, want hello", ok)
+	}
+	if _, ok = <-ch; ok {
+		t.Fatalf("Client.CallChan() channel not closed")
+	}
+
+	ch, err = c.CallChan("/sleep", nil, time.Second/50)
+	if err != nil {
+		t.Fatalf("Client.CallChan() error = %v", err)
+	}
+	if ctx, ok = <-ch; ok {
+		t.Fatalf("Client.CallChan() received %v, want closed by timeout", ctx)
+	}
+	for i := range c.sessionShards {
+		if n := len(c.sessionShards[i].asyncHandlers); n != 0 {
+			t.Fatalf("async handlers = %v, want 0", n)
+		}
+	}
+
+	if _, err = c.CallChan("/echo", nil, 0); err != ErrClientInvalidTimeoutZero {
+		t.Fatalf("Client.CallChan() error = %v, want %v", err, ErrClientInvalidTimeoutZero)
+	}
+}
+
 func TestClient_Get(t *testing.T) {
 	c := &Client{}
 	if v, ok := c.Get("key"); ok {
@@ -499,147 +866,415 @@ func testClientCallWithDisconnected(c *Client, t *testing.T) {
 	}
 }
 
-func TestClient_CallAsync(t *testing.T) {
+func TestClient_CallWithHeader(t *testing.T) {
 	initServer()
+	defer testServer.Stop()
 
 	c, err := NewClient(dialer)
 	if err != nil {
 		t.Fatalf("NewClient failed: %v", err)
 	}
+	defer c.Stop()
 
-	testClientCallAsyncMethodString(c, t)
-	testClientCallAsyncMethodBytes(c, t)
-	testClientCallAsyncMethodStruct(c, t)
-	testClientCallAsyncError(c, t)
-	testClientCallAsyncDisconnected(c, t)
-}
-
-func getAsyncHandler() (func(*Context), chan struct{}) {
-	done := make(chan struct{}, 1)
-	asyncHandler := func(*Context) {
-		done <- struct{}{}
+	rsp := ""
+	md := map[string]string{"key": "value"}
+	if err = c.CallWithHeader(methodCallHeader, "hello", &rsp, md, time.Second); err != nil {
+		t.Fatalf("Client.CallWithHeader() error = %v", err)
+	} else if rsp != md["key"] {
+		t.Fatalf("Client.CallWithHeader() error, returns '%v', want '%v'", rsp, md["key"])
 	}
-	return asyncHandler, done
 }
 
-func testClientCallAsyncMethodString(c *Client, t *testing.T) {
-	var (
-		err error
-		req = "hello"
-	)
-	asyncHandler, done := getAsyncHandler()
-	if err = c.CallAsync(methodCallAsync, req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+func TestClient_Use(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
 	}
-	<-done
-	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	defer c.Stop()
+
+	order := []int{}
+	for i := 1; i <= 2; i++ {
+		n := i
+		c.Use(func(next CallFunc) CallFunc {
+			return func(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+				order = append(order, n)
+				return next(method, req, rsp, timeout)
+			}
+		})
 	}
-	<-done
-	if err = c.CallAsync(methodCallAsync, &req, nil, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	c.Use(nil)
+
+	req := "hello"
+	rsp := ""
+	if err = c.Call(methodCallString, req, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, req)
 	}
-	if err = c.CallAsync(methodCallAsync, req, nil, 0); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Fatalf("Client.Use() middlewares called in order %v, want [1 2]", order)
 	}
-}
 
-func testClientCallAsyncMethodBytes(c *Client, t *testing.T) {
-	var (
-		err error
-		req = []byte{1}
-	)
-	asyncHandler, done := getAsyncHandler()
-	if err = c.CallAsync(methodCallAsync, req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	// the other calls are wrapped too, and Use is safe to be called concurrently with them
+	var mux sync.Mutex
+	methods := []string{}
+	c.Use(func(next CallFunc) CallFunc {
+		return func(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+			mux.Lock()
+			methods = append(methods, method)
+			mux.Unlock()
+			return next(method, req, rsp, timeout)
+		}
+	})
+	chUse := make(chan struct{})
+	go func() {
+		defer close(chUse)
+		c.Use(func(next CallFunc) CallFunc { return next })
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = c.CallWith(ctx, methodCallString, req, &rsp); err != nil {
+		t.Fatalf("Client.CallWith() error = %v", err)
 	}
-	<-done
-	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	if err = c.CallWithHeader(methodCallString, req, &rsp, map[string]string{"k": "v"}, time.Second); err != nil {
+		t.Fatalf("Client.CallWithHeader() error = %v", err)
 	}
-	<-done
-	if err = c.CallAsync(methodCallAsync, &req, nil, time.Second); err != nil {
+	chDone := make(chan struct{})
+	if err = c.CallAsync(methodCallString, req, func(*Context) { close(chDone) }, time.Second); err != nil {
 		t.Fatalf("Client.CallAsync() error = %v", err)
 	}
-}
-
-func testClientCallAsyncMethodStruct(c *Client, t *testing.T) {
-	var (
-		err error
-		req = MessageTest{A: 3, B: "4"}
-	)
-	asyncHandler, done := getAsyncHandler()
-	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	<-chDone
+	if err = c.Notify(methodNotify, req, time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
 	}
-	<-done
-	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
-		t.Fatalf("Client.CallAsync() error = %v", err)
+	<-chUse
+	want := []string{methodCallString, methodCallString, methodCallString, methodNotify}
+	if fmt.Sprint(methods) != fmt.Sprint(want) {
+		t.Fatalf("Client.Use() middleware called by %v, want %v", methods, want)
 	}
-	<-done
 }
 
-func testClientCallAsyncError(c *Client, t *testing.T) {
-	var err error
-	asyncHandler, _ := getAsyncHandler()
-	if err = c.CallAsync(methodCallAsync, "", asyncHandler, -1); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutLessThanZero.Error())
-	} else if err.Error() != ErrClientInvalidTimeoutLessThanZero.Error() {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutLessThanZero.Error())
-	}
-	if err = c.CallAsync(methodCallAsync, "", nil, -1); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutLessThanZero.Error())
-	} else if err.Error() != ErrClientInvalidTimeoutLessThanZero.Error() {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutLessThanZero.Error())
-	}
+func TestClient_CallDefault(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
 
-	asyncHandler, _ = getAsyncHandler()
-	if err = c.CallAsync(methodCallAsync, "", asyncHandler, 0); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutZeroWithNonNilCallback.Error())
-	} else if err.Error() != ErrClientInvalidTimeoutZeroWithNonNilCallback.Error() {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutZeroWithNonNilCallback.Error())
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
 	}
+	defer c.Stop()
 
-	invalidMethodErrString := fmt.Sprintf("invalid method length: %v, should <= %v", len(methodInvalidLong), MaxMethodLen)
-	if err = c.CallAsync(methodInvalidLong, "", nil, time.Second); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", invalidMethodErrString)
-	} else if err.Error() != invalidMethodErrString {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), invalidMethodErrString)
+	if err = c.CallDefault(methodCallString, "", nil); err != ErrClientInvalidTimeoutZero {
+		t.Fatalf("Client.CallDefault() error = %v, want %v", err, ErrClientInvalidTimeoutZero)
 	}
-}
 
-func testClientCallAsyncDisconnected(c *Client, t *testing.T) {
-	var err error
-	c.Stop()
-	if err = c.CallAsync(methodCallAsync, "", nil, time.Second); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientStopped)
-	} else if err.Error() != ErrClientStopped.Error() {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientStopped.Error())
+	c.SetDefaultTimeout(time.Second)
+	req := "hello"
+	rsp := ""
+	if err = c.CallDefault(methodCallString, req, &rsp); err != nil {
+		t.Fatalf("Client.CallDefault() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.CallDefault() error, returns '%v', want '%v'", rsp, req)
 	}
 
-	c.Restart()
-	testServer.Stop()
-	time.Sleep(time.Second / 10)
-	if err = c.CallAsync(methodCallAsync, "", nil, time.Second); err == nil {
-		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientReconnecting)
-	} else if err.Error() != ErrClientReconnecting.Error() {
-		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientReconnecting.Error())
+	c.SetMethodTimeout(methodCallTimeout, time.Second/100)
+	if err = c.CallDefault(methodCallTimeout, "", nil); err != ErrClientTimeout {
+		t.Fatalf("Client.CallDefault() error = %v, want %v", err, ErrClientTimeout)
 	}
 }
 
-func TestClient_Notify(t *testing.T) {
+func TestClient_CallRetry(t *testing.T) {
 	initServer()
+	defer testServer.Stop()
 
 	c, err := NewClient(dialer)
 	if err != nil {
 		t.Fatalf("NewClient failed: %v", err)
 	}
+	defer c.Stop()
 
-	testClientNotifyMethodString(c, t)
-	testClientNotifyMethodBytes(c, t)
-	testClientNotifyMethodStruct(c, t)
-	testClientNotifyError(c, t)
-	testClientNotifyDisconnected(c, t)
+	attempts := 0
+	c.Use(func(next CallFunc) CallFunc {
+		return func(method string, req interface{}, rsp interface{}, timeout time.Duration) error {
+			attempts++
+			return next(method, req, rsp, timeout)
+		}
+	})
+
+	if err = c.CallRetry(methodCallTimeout, "", nil, time.Second/10, 2); err != ErrClientTimeout {
+		t.Fatalf("Client.CallRetry() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if attempts != 1 {
+		t.Fatalf("Client.CallRetry() attempts = %v, want 1", attempts)
+	}
+
+	attempts = 0
+	c.MarkIdempotent(methodCallTimeout)
+	if err = c.CallRetry(methodCallTimeout, "", nil, time.Second/10*3, 2); err != ErrClientTimeout {
+		t.Fatalf("Client.CallRetry() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if attempts != 3 {
+		t.Fatalf("Client.CallRetry() attempts = %v, want 3", attempts)
+	}
+}
+
+func TestClient_CallRaw(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	req := "hello"
+	msg, err := c.CallRaw(methodCallString, req, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallRaw() error = %v", err)
+	} else if string(msg.Data()) != req {
+		t.Fatalf("Client.CallRaw() error, returns '%v', want '%v'", string(msg.Data()), req)
+	}
+
+	msg, err = c.CallRaw(methodCallError, req, time.Second)
+	if err == nil || err.Error() != req {
+		t.Fatalf("Client.CallRaw() error = %v, want '%v'", err, req)
+	} else if msg == nil || !msg.IsError() {
+		t.Fatalf("Client.CallRaw() returns %v, want error message", msg)
+	}
+}
+
+func TestClient_CallReader(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	req := "hello"
+	rsp := ""
+	if err = c.CallReader(methodCallString, strings.NewReader(req), len(req), &rsp, time.Second); err != nil {
+		t.Fatalf("Client.CallReader() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.CallReader() error, returns '%v', want '%v'", rsp, req)
+	}
+
+	if err = c.CallReader(methodCallString, strings.NewReader(req), len(req)+1, &rsp, time.Second); err != ErrInvalidBodySize {
+		t.Fatalf("Client.CallReader() error = %v, want %v", err, ErrInvalidBodySize)
+	}
+	// the bytes after size are left in the reader
+	r := strings.NewReader(req)
+	if err = c.CallReader(methodCallString, r, len(req)-1, &rsp, time.Second); err != nil || rsp != req[:len(req)-1] {
+		t.Fatalf("Client.CallReader() = %v, %v, want %v, nil", rsp, err, req[:len(req)-1])
+	}
+	if r.Len() != 1 {
+		t.Fatalf("unread bytes = %v, want 1", r.Len())
+	}
+	if err = c.CallReader(methodCallString, strings.NewReader(req), -1, &rsp, time.Second); err != ErrInvalidBodySize {
+		t.Fatalf("Client.CallReader() error = %v, want %v", err, ErrInvalidBodySize)
+	}
+}
+
+func TestClient_CallLongMethod(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	method := strings.Repeat("/long", MaxShortMethodLen)
+	testServer.Handler.Handle(method, func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	req := "hello"
+	rsp := ""
+	if err = c.Call(method, req, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, req)
+	}
+}
+
+func TestClient_SetCodec(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	if c.GetCodec() != c.Codec {
+		t.Fatalf("Client.GetCodec() = %v, want %v", c.GetCodec(), c.Codec)
+	}
+
+	cdc := &codec.JSONCodec{}
+	c.SetCodec(cdc)
+	if c.GetCodec() != cdc {
+		t.Fatalf("Client.GetCodec() = %v, want %v", c.GetCodec(), cdc)
+	}
+
+	req := "hello"
+	rsp := ""
+	if err = c.Call(methodCallString, req, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, req)
+	}
+}
+
+func TestClient_CallAsync(t *testing.T) {
+	initServer()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	testClientCallAsyncMethodString(c, t)
+	testClientCallAsyncMethodBytes(c, t)
+	testClientCallAsyncMethodStruct(c, t)
+	testClientCallAsyncError(c, t)
+	testClientCallAsyncDisconnected(c, t)
+}
+
+func getAsyncHandler() (func(*Context), chan struct{}) {
+	done := make(chan struct{}, 1)
+	asyncHandler := func(*Context) {
+		done <- struct{}{}
+	}
+	return asyncHandler, done
+}
+
+func testClientCallAsyncMethodString(c *Client, t *testing.T) {
+	var (
+		err error
+		req = "hello"
+	)
+	asyncHandler, done := getAsyncHandler()
+	if err = c.CallAsync(methodCallAsync, req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+	if err = c.CallAsync(methodCallAsync, &req, nil, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	if err = c.CallAsync(methodCallAsync, req, nil, 0); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+}
+
+func testClientCallAsyncMethodBytes(c *Client, t *testing.T) {
+	var (
+		err error
+		req = []byte{1}
+	)
+	asyncHandler, done := getAsyncHandler()
+	if err = c.CallAsync(methodCallAsync, req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+	if err = c.CallAsync(methodCallAsync, &req, nil, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+}
+
+func testClientCallAsyncMethodStruct(c *Client, t *testing.T) {
+	var (
+		err error
+		req = MessageTest{A: 3, B: "4"}
+	)
+	asyncHandler, done := getAsyncHandler()
+	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+	if err = c.CallAsync(methodCallAsync, &req, asyncHandler, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-done
+}
+
+func testClientCallAsyncError(c *Client, t *testing.T) {
+	var err error
+	asyncHandler, _ := getAsyncHandler()
+	if err = c.CallAsync(methodCallAsync, "", asyncHandler, -1); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutLessThanZero.Error())
+	} else if err.Error() != ErrClientInvalidTimeoutLessThanZero.Error() {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutLessThanZero.Error())
+	}
+	if err = c.CallAsync(methodCallAsync, "", nil, -1); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutLessThanZero.Error())
+	} else if err.Error() != ErrClientInvalidTimeoutLessThanZero.Error() {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutLessThanZero.Error())
+	}
+
+	asyncHandler, _ = getAsyncHandler()
+	if err = c.CallAsync(methodCallAsync, "", asyncHandler, 0); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientInvalidTimeoutZeroWithNonNilCallback.Error())
+	} else if err.Error() != ErrClientInvalidTimeoutZeroWithNonNilCallback.Error() {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientInvalidTimeoutZeroWithNonNilCallback.Error())
+	}
+
+	invalidMethodErrString := fmt.Sprintf("invalid method length: %v, should <= %v", len(methodInvalidLong), MaxMethodLen)
+	if err = c.CallAsync(methodInvalidLong, "", nil, time.Second); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", invalidMethodErrString)
+	} else if err.Error() != invalidMethodErrString {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), invalidMethodErrString)
+	}
+}
+
+func testClientCallAsyncDisconnected(c *Client, t *testing.T) {
+	var err error
+	c.Stop()
+	if err = c.CallAsync(methodCallAsync, "", nil, time.Second); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientStopped)
+	} else if err.Error() != ErrClientStopped.Error() {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientStopped.Error())
+	}
+
+	c.Restart()
+	testServer.Stop()
+	time.Sleep(time.Second / 10)
+	if err = c.CallAsync(methodCallAsync, "", nil, time.Second); err == nil {
+		t.Fatalf("Client.CallAsync() error is nil, want %v", ErrClientReconnecting)
+	} else if err.Error() != ErrClientReconnecting.Error() {
+		t.Fatalf("Client.CallAsync() error, returns '%v', want '%v'", err.Error(), ErrClientReconnecting.Error())
+	}
+}
+
+func TestClient_Notify(t *testing.T) {
+	initServer()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	testClientNotifyMethodString(c, t)
+	testClientNotifyMethodBytes(c, t)
+	testClientNotifyMethodStruct(c, t)
+	testClientNotifyError(c, t)
+	testClientNotifyDisconnected(c, t)
 }
 
 func testClientNotifyMethodString(c *Client, t *testing.T) {
@@ -862,6 +1497,771 @@ func TestClient_PushMsg(t *testing.T) {
 	testServer.Stop()
 }
 
+func TestClient_StopGracefully(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	for _, batch := range []bool{false, true} {
+		c, err := NewClient(dialer)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		c.Handler.SetBatchSend(batch)
+		for i := 0; i < 10; i++ {
+			if err = c.Notify(methodNotify, "hello", time.Second); err != nil {
+				t.Fatalf("Client.Notify() error = %v", err)
+			}
+		}
+		if err = c.StopGracefully(time.Second); err != nil {
+			t.Fatalf("Client.StopGracefully() error = %v", err)
+		}
+		if err = c.Notify(methodNotify, "hello", time.Second); err != ErrClientStopped {
+			t.Fatalf("Client.Notify() error = %v, want %v", err, ErrClientStopped)
+		}
+		if err = c.StopGracefully(time.Second); err != ErrClientStopped {
+			t.Fatalf("Client.StopGracefully() error = %v, want %v", err, ErrClientStopped)
+		}
+	}
+}
+
+func TestClient_State(t *testing.T) {
+	initServer()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if got := c.State(); got != StateRunning || !c.IsConnected() {
+		t.Fatalf("Client.State() = %v, want %v", got, StateRunning)
+	}
+
+	testServer.Stop()
+	time.Sleep(time.Second / 10)
+	if got := c.State(); got != StateReconnecting || c.IsConnected() {
+		t.Fatalf("Client.State() = %v, want %v", got, StateReconnecting)
+	}
+
+	c.Stop()
+	if got := c.State(); got != StateStopped || c.IsConnected() {
+		t.Fatalf("Client.State() = %v, want %v", got, StateStopped)
+	}
+}
+
+func TestClient_PushMsgWithDeadline(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c := &Client{
+		Conn:    conn,
+		Codec:   codec.DefaultCodec,
+		Handler: DefaultHandler,
+		running: true,
+		chSend:  make(chan *Message, 10),
+		chClose: make(chan util.Empty),
+	}
+
+	msg := c.NewMessage(CmdNotify, methodCallString, "hello")
+	if err := c.PushMsgWithDeadline(msg, time.Now().Add(-time.Second)); err != ErrClientTimeout {
+		t.Fatalf("Client.PushMsgWithDeadline() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if err := c.PushMsgWithDeadline(msg, time.Now().Add(time.Second/100)); err != nil {
+		t.Fatalf("Client.PushMsgWithDeadline() error = %v", err)
+	}
+	time.Sleep(time.Second / 50)
+
+	c.initWriter()
+	go c.normalSendLoop()
+	defer close(c.chClose)
+	time.Sleep(time.Second / 100)
+	if got := c.ExpiredCount(); got != 1 {
+		t.Fatalf("Client.ExpiredCount() = %v, want %v", got, 1)
+	}
+}
+
+func TestClient_WriteBatchSize(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	var writes int32
+	h := NewHandler()
+	h.SetWriteBatchSize(3)
+	h.BeforeSend(func(net.Conn) error {
+		atomic.AddInt32(&writes, 1)
+		return nil
+	})
+	c := &Client{
+		Conn:    conn,
+		Codec:   codec.DefaultCodec,
+		Handler: h,
+		running: true,
+		chSend:  make(chan *Message, 10),
+		chClose: make(chan util.Empty),
+	}
+	c.initWriter()
+	for i := 0; i < 5; i++ {
+		c.chSend <- c.NewMessage(CmdNotify, methodNotify, "hello")
+	}
+
+	go c.batchSendLoop()
+	defer close(c.chClose)
+	time.Sleep(time.Second / 50)
+	if got := atomic.LoadInt32(&writes); got != 2 {
+		t.Fatalf("writes = %v, want %v", got, 2)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestClient_WriteBuffered(t *testing.T) {
+	pipe, peer := net.Pipe()
+	defer pipe.Close()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	conn := &countingConn{Conn: pipe}
+	c := &Client{
+		Conn:    conn,
+		Codec:   codec.DefaultCodec,
+		Handler: NewHandler(),
+		running: true,
+		chSend:  make(chan *Message, 10),
+		chClose: make(chan util.Empty),
+	}
+	c.initWriter()
+	for i := 0; i < 5; i++ {
+		c.chSend <- c.NewMessage(CmdNotify, methodNotify, "hello")
+	}
+
+	go c.normalSendLoop()
+	defer close(c.chClose)
+	time.Sleep(time.Second / 50)
+	if got := atomic.LoadInt32(&conn.writes); got != 1 {
+		t.Fatalf("writes = %v, want %v", got, 1)
+	}
+
+	c.chSend <- c.NewMessage(CmdNotify, methodNotify, "hello")
+	time.Sleep(time.Second / 50)
+	if got := atomic.LoadInt32(&conn.writes); got != 2 {
+		t.Fatalf("writes = %v, want %v", got, 2)
+	}
+}
+
+func TestClient_WriteBufferedReconnect(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Second / 100
+	})
+	reconnected := make(chan util.Empty, 1)
+	c.SetOnConnectHandshake(func(*Client) error {
+		reconnected <- util.Empty{}
+		return nil
+	})
+
+	// keep sending while the Writer is replaced
+	chStop := make(chan util.Empty)
+	chStopped := make(chan util.Empty)
+	go func() {
+		defer close(chStopped)
+		for {
+			select {
+			case <-chStop:
+				return
+			default:
+				c.Notify(methodCallString, "hello", time.Second)
+			}
+		}
+	}()
+
+	c.Conn.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("not reconnected")
+	}
+	rsp := ""
+	if err = c.Call(methodCallString, "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() after reconnected = %v, %v, want hello, nil", rsp, err)
+	}
+	close(chStop)
+	<-chStopped
+
+	if err = c.Restart(); err != nil {
+		t.Fatalf("Client.Restart() error = %v", err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("handshake not called after restarted")
+	}
+	if err = c.Call(methodCallString, "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() after restarted = %v, %v, want hello, nil", rsp, err)
+	}
+}
+
+func TestClient_OnQueueFull(t *testing.T) {
+	c := &Client{
+		Handler: DefaultHandler,
+		running: true,
+		chSend:  make(chan *Message, 1),
+		chClose: make(chan util.Empty),
+	}
+	var cnt int32
+	c.OnQueueFull(func() {
+		atomic.AddInt32(&cnt, 1)
+	})
+
+	if got := c.QueueCap(); got != 1 {
+		t.Fatalf("Client.QueueCap() = %v, want %v", got, 1)
+	}
+	if err := c.PushMsg(&Message{}, TimeZero); err != nil {
+		t.Fatalf("Client.PushMsg() error = %v", err)
+	}
+	if got := c.QueueLen(); got != 1 {
+		t.Fatalf("Client.QueueLen() = %v, want %v", got, 1)
+	}
+	if err := c.PushMsg(&Message{}, TimeZero); err != ErrClientOverstock {
+		t.Fatalf("Client.PushMsg() error = %v, want %v", err, ErrClientOverstock)
+	}
+	if got := atomic.LoadInt32(&cnt); got != 1 {
+		t.Fatalf("OnQueueFull called %v times, want %v", got, 1)
+	}
+}
+
+func TestClient_EnableKeepalive(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	var cnt int32
+	methodKeepalive := "/keepalive"
+	testServer.Handler.Handle(methodKeepalive, func(ctx *Context) {
+		atomic.AddInt32(&cnt, 1)
+	})
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	c.EnableKeepalive(time.Second/100, methodKeepalive)
+	time.Sleep(time.Second / 10)
+	c.Stop()
+	if n := atomic.LoadInt32(&cnt); n < 2 {
+		t.Fatalf("keepalive received %v times, want >= 2", n)
+	}
+}
+
+func TestClient_SetReconnectBackoff(t *testing.T) {
+	initServer()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	attempts := make(chan int, 10)
+	c.SetReconnectBackoff(func(attempt int) time.Duration {
+		attempts <- attempt
+		return -1
+	})
+
+	testServer.Stop()
+	select {
+	case attempt := <-attempts:
+		if attempt != 1 {
+			t.Fatalf("backoff attempt = %v, want 1", attempt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("backoff not called")
+	}
+	time.Sleep(time.Second / 100)
+	if err = c.CheckState(); err != ErrClientStopped {
+		t.Fatalf("Client.CheckState() = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestClient_SetMaxReconnects(t *testing.T) {
+	initServer()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	failed := make(chan error, 1)
+	c.SetMaxReconnects(0)
+	c.OnReconnectFailed(func(c *Client, err error) {
+		failed <- err
+	})
+
+	testServer.Stop()
+	select {
+	case err = <-failed:
+		if err == nil {
+			t.Fatalf("OnReconnectFailed error = nil, want non-nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnReconnectFailed not called")
+	}
+	if err = c.CheckState(); err != ErrClientStopped {
+		t.Fatalf("Client.CheckState() = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestClient_SetOnConnectHandshake(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Second / 100
+	})
+	handshakes := make(chan error, 10)
+	c.SetOnConnectHandshake(func(c *Client) error {
+		err := c.Call(methodCallString, "hello", nil, time.Second)
+		if len(handshakes) == 0 && err == nil {
+			err = errors.New("rejected")
+		}
+		handshakes <- err
+		return err
+	})
+	connected := make(chan int, 10)
+	c.Handler.HandleConnected(func(*Client) {
+		connected <- len(handshakes)
+	})
+
+	// the first handshake fails and the Client reconnects again
+	c.Conn.Close()
+	select {
+	case n := <-connected:
+		if n != 2 {
+			t.Fatalf("OnConnected called after %v handshakes, want 2", n)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("OnConnected not called after reconnected")
+	}
+	if err = <-handshakes; err == nil {
+		t.Fatalf("the first handshake error = nil, want non-nil")
+	}
+	if err = <-handshakes; err != nil {
+		t.Fatalf("the second handshake error = %v", err)
+	}
+}
+
+func TestClient_WithConnectHandshake(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	// the Client reports reconnecting until the handshake returns
+	var state ClientState
+	c, err := NewClient(dialer, WithConnectHandshake(func(c *Client) error {
+		state = c.State()
+		return c.Call(methodCallString, "hello", nil, time.Second)
+	}))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if state != StateReconnecting {
+		t.Fatalf("Client.State() in the handshake = %v, want %v", state, StateReconnecting)
+	}
+	if state = c.State(); state != StateRunning {
+		t.Fatalf("Client.State() = %v, want %v", state, StateRunning)
+	}
+	if err = c.Call(methodCallString, "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+
+	rejected := errors.New("rejected")
+	if _, err = NewClient(dialer, WithConnectHandshake(func(*Client) error { return rejected })); err != rejected {
+		t.Fatalf("NewClient() error = %v, want %v", err, rejected)
+	}
+}
+
+func TestClient_SetMaxResponseSize(t *testing.T) {
+	// the test coder rewrites the seq of the head
+	defer SetHandler(DefaultHandler)
+	SetHandler(NewHandler())
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/size", func(ctx *Context) {
+		size := 0
+		ctx.Bind(&size)
+		ctx.Write(make([]byte, size))
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Second / 100
+	})
+	c.SetMaxResponseSize(1024)
+
+	rsp := []byte{}
+	if err = c.Call("/size", 512, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.Call("/size", 2048, &rsp, time.Second); err != ErrResponseTooLarge {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrResponseTooLarge)
+	}
+
+	// the connection is dropped and the Client reconnects
+	for i := 0; i < 100 && c.State() != StateRunning; i++ {
+		time.Sleep(time.Second / 100)
+	}
+	if err = c.Call("/size", 512, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+}
+
+func TestNewClientWithConn(t *testing.T) {
+	svrHandler := NewHandler()
+	svrHandler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	connected := make(chan *Client, 1)
+	svrHandler.HandleConnected(func(c *Client) {
+		connected <- c
+	})
+	disconnected := make(chan *Client, 1)
+	svrHandler.HandleDisconnected(func(c *Client) {
+		disconnected <- c
+	})
+
+	conn1, conn2 := net.Pipe()
+	svrCli := NewClientWithConn(conn1, nil, svrHandler)
+	if c := <-connected; c != svrCli {
+		t.Fatalf("OnConnected Client = %v, want %v", c, svrCli)
+	}
+	c := NewClientWithConn(conn2, nil, NewHandler())
+	defer c.Stop()
+
+	rsp := ""
+	if err := c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "hello" {
+		t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+	}
+
+	// no reconnecting after the conn is closed
+	conn2.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("OnDisconnected not called")
+	}
+	time.Sleep(time.Second / 100)
+	if state := c.State(); state != StateStopped {
+		t.Fatalf("Client.State() = %v, want %v", state, StateStopped)
+	}
+	if err := c.Call("/echo", "hello", &rsp, time.Second); err != ErrClientStopped {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestClient_SetReadDeadline(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.SetReconnectBackoff(func(attempt int) time.Duration {
+		return time.Second / 100
+	})
+	connected := make(chan struct{}, 10)
+	c.Handler.HandleConnected(func(*Client) {
+		connected <- struct{}{}
+	})
+
+	// nothing is received in time, the Client reconnects
+	c.SetReadDeadline(time.Second / 20)
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("Client not reconnected after the read deadline")
+	}
+	c.SetReadDeadline(0)
+
+	// a Client without Dialer is stopped
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	cli := NewClientWithConn(conn2, nil, NewHandler())
+	cli.SetReadDeadline(time.Second / 20)
+	time.Sleep(time.Second / 5)
+	if state := cli.State(); state != StateStopped {
+		t.Fatalf("Client.State() = %v, want %v", state, StateStopped)
+	}
+}
+
+func TestClient_SetWriteDeadline(t *testing.T) {
+	// nothing is read from the other side of the pipe, the write blocks
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	c := NewClientWithConn(conn2, nil, NewHandler())
+	c.SetWriteDeadline(time.Second / 20)
+	if err := c.Notify("/notify", "hello", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	time.Sleep(time.Second / 5)
+	if state := c.State(); state != StateStopped {
+		t.Fatalf("Client.State() = %v, want %v", state, StateStopped)
+	}
+}
+
+func TestClient_SetWriteDeadlineReset(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	c := NewClientWithConn(conn2, nil, NewHandler())
+	defer c.Stop()
+	read := func() {
+		buf := make([]byte, 1024)
+		conn1.Read(buf)
+	}
+
+	c.SetWriteDeadline(time.Second / 20)
+	go read()
+	if err := c.Notify("/notify", "hello", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	time.Sleep(time.Second / 100)
+
+	// the deadline set by the previous write has passed, the write after the reset waits for the reader
+	c.SetWriteDeadline(0)
+	time.Sleep(time.Second / 10)
+	if err := c.Notify("/notify", "hello", time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	time.Sleep(time.Second / 10)
+	read()
+	time.Sleep(time.Second / 100)
+	if state := c.State(); state != StateRunning {
+		t.Fatalf("Client.State() = %v, want %v", state, StateRunning)
+	}
+}
+
+// panicHandler panics in OnMessage for the first n messages.
+type panicHandler struct {
+	Handler
+	n int32
+}
+
+func (h *panicHandler) OnMessage(c *Client, msg *Message) {
+	if atomic.AddInt32(&h.n, -1) >= 0 {
+		panic("OnMessage")
+	}
+	h.Handler.OnMessage(c, msg)
+}
+
+func TestClient_OnMessagePanic(t *testing.T) {
+	svrHandler := NewHandler()
+	svrHandler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	conn1, conn2 := net.Pipe()
+	svrCli := NewClientWithConn(conn1, nil, svrHandler)
+	defer svrCli.Stop()
+
+	h := &panicHandler{Handler: NewHandler(), n: 1}
+	panics := make(chan interface{}, 2)
+	h.HandlePanic(func(ctx *Context, v interface{}) {
+		panics <- v
+	})
+	c := NewClientWithConn(conn2, nil, h)
+	defer c.Stop()
+
+	rsp := ""
+	if err := c.Call("/echo", "hello", &rsp, time.Second/10); err != ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if v := <-panics; v != "OnMessage" {
+		t.Fatalf("recovered = %v, want OnMessage", v)
+	}
+
+	err := c.CallAsync("/echo", "hello", func(*Context) {
+		panic("async")
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	select {
+	case v := <-panics:
+		if v != "async" {
+			t.Fatalf("recovered = %v, want async", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("panic handler not called")
+	}
+
+	// the Client keeps receiving
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "hello" {
+		t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+	}
+}
+
+func TestClient_CallInRecvLoop(t *testing.T) {
+	svrHandler := NewHandler()
+	callback := func(ctx *Context) {
+		// calls back the Client which the request comes from
+		rsp := ""
+		err := ctx.Client.Call("/echo", "hello", &rsp, time.Second/10)
+		if err != nil {
+			ctx.Write(err.Error())
+			return
+		}
+		ctx.Write(rsp)
+	}
+	svrHandler.Handle("/callback", callback)
+	svrHandler.Handle("/callbackAsync", callback, true)
+	conn1, conn2 := net.Pipe()
+	svrCli := NewClientWithConn(conn1, nil, svrHandler)
+	defer svrCli.Stop()
+
+	cliHandler := NewHandler()
+	cliHandler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	c := NewClientWithConn(conn2, nil, cliHandler)
+	defer c.Stop()
+
+	rsp := ""
+	// the synchronous handler blocks the recv loop which should receive the response
+	if err := c.Call("/callback", "", &rsp, time.Second); err != nil || rsp != ErrClientTimeout.Error() {
+		t.Fatalf("Client.Call() = %v, %v, want %v, nil", rsp, err, ErrClientTimeout)
+	}
+	if err := c.Call("/callbackAsync", "", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", rsp, err)
+	}
+}
+
+// traceLogger records the debug logs of the Call requests and responses.
+type traceLogger struct {
+	mux  sync.Mutex
+	logs []map[string]interface{}
+}
+
+func (l *traceLogger) SetLevel(lvl int) {}
+
+func (l *traceLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	if !strings.HasPrefix(msg, "Call ") {
+		return
+	}
+	fields := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.mux.Lock()
+	l.logs = append(l.logs, fields)
+	l.mux.Unlock()
+}
+
+func (l *traceLogger) Infow(msg string, keysAndValues ...interface{}) {}
+
+func (l *traceLogger) Warnw(msg string, keysAndValues ...interface{}) {}
+
+func (l *traceLogger) Errorw(msg string, keysAndValues ...interface{}) {}
+
+func (l *traceLogger) take() []map[string]interface{} {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	logs := l.logs
+	l.logs = nil
+	return logs
+}
+
+func TestClient_SetTraceLogging(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/error", func(ctx *Context) {
+		ctx.Error(errors.New("failed"))
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	l := &traceLogger{}
+	defer SetLogger(alog.DefaultLogger)
+	SetStructuredLogger(l)
+
+	// disabled by default
+	if err = c.Call("/echo", "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if logs := l.take(); len(logs) != 0 {
+		t.Fatalf("logs = %v, want none", logs)
+	}
+
+	c.SetTraceLogging(true)
+	if err = c.Call("/echo", "hello", nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	logs := l.take()
+	if len(logs) != 2 {
+		t.Fatalf("logs = %v, want request and response", logs)
+	}
+	req, rsp := logs[0], logs[1]
+	if req["msg"] != "Call request" || req["method"] != "/echo" || req["body_size"] != 5 || req["seq"] != rsp["seq"] {
+		t.Fatalf("request log = %v", req)
+	}
+	if rsp["msg"] != "Call response" || rsp["latency"] == nil || rsp["error"] != nil {
+		t.Fatalf("response log = %v", rsp)
+	}
+	if _, ok := req["body"]; ok {
+		t.Fatalf("request log = %v, want the body redacted", req)
+	}
+
+	c.SetTraceBody(true)
+	c.Call("/error", "hello", nil, time.Second)
+	logs = l.take()
+	if len(logs) != 2 || logs[0]["body"] != "hello" {
+		t.Fatalf("logs = %v, want the request body", logs)
+	}
+	if err, ok := logs[1]["error"].(error); !ok || err.Error() != "failed" {
+		t.Fatalf("response log = %v, want error failed", logs[1])
+	}
+}
+
 func TestClientPool(t *testing.T) {
 	initServer()
 	testNewClientPool(t)
@@ -902,6 +2302,27 @@ func testNewClientPool(t *testing.T) {
 			t.Fatalf("ClientPool.Next().Call() error, returns '%v', want '%v'", rsp, req)
 		}
 	}
+	for i := 0; i < poolSize*2; i++ {
+		req := "hello"
+		rsp := ""
+		if err = pool.Call(methodCallString, req, &rsp, time.Second); err != nil {
+			t.Fatalf("ClientPool.Call() error = '%v'", err)
+		} else if rsp != req {
+			t.Fatalf("ClientPool.Call() error, returns '%v', want '%v'", rsp, req)
+		}
+		if err = pool.CallWith(context.Background(), methodCallString, req, &rsp); err != nil {
+			t.Fatalf("ClientPool.CallWith() error = '%v'", err)
+		}
+		if err = pool.CallAsync(methodCallAsync, req, nil, time.Second); err != nil {
+			t.Fatalf("ClientPool.CallAsync() error = '%v'", err)
+		}
+		if err = pool.Notify(methodNotify, req, time.Second); err != nil {
+			t.Fatalf("ClientPool.Notify() error = '%v'", err)
+		}
+		if err = pool.NotifyWith(context.Background(), methodNotifyWith, req); err != nil {
+			t.Fatalf("ClientPool.NotifyWith() error = '%v'", err)
+		}
+	}
 }
 
 func testNewClientPoolFromDialers(t *testing.T) {
@@ -951,3 +2372,79 @@ func testNewClientPoolFromDialers(t *testing.T) {
 	testServer.Stop()
 	time.Sleep(time.Second / 10)
 }
+
+func TestClient_addSessionClosed(t *testing.T) {
+	c := &Client{running: true}
+	c.clearSession()
+	c.clearAsyncHandler()
+	if c.addSession(1, newSession(1)) {
+		t.Fatalf("Client.addSession() = true after the sessions are cleared, want false")
+	}
+	if c.addAsyncHandler(2, func(*Context) {}, 0) {
+		t.Fatalf("Client.addAsyncHandler() = true after the sessions are cleared, want false")
+	}
+	if n := c.NumPendingCalls(); n != 0 {
+		t.Fatalf("Client.NumPendingCalls() = %v, want 0", n)
+	}
+
+	c.openSessions()
+	if !c.addSession(1, newSession(1)) || !c.addAsyncHandler(2, func(*Context) {}, 0) {
+		t.Fatalf("the sessions are refused after reopened")
+	}
+	if n := c.NumPendingCalls(); n != 2 {
+		t.Fatalf("Client.NumPendingCalls() = %v, want 2", n)
+	}
+}
+
+// singleLockSessions is the single mutex protected session map used before sharding,
+// it's the baseline of BenchmarkClient_Sessions.
+type singleLockSessions struct {
+	mux      sync.Mutex
+	sessions map[uint64]*rpcSession
+}
+
+func benchmarkSessions(b *testing.B, add func(uint64, *rpcSession) bool, get func(uint64) (*rpcSession, bool), del func(uint64) *rpcSession) {
+	var seq uint64
+	// about 1000 concurrent callers
+	b.SetParallelism((1000 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		sess := newSession(0)
+		for pb.Next() {
+			s := atomic.AddUint64(&seq, 1)
+			add(s, sess)
+			get(s)
+			del(s)
+		}
+	})
+}
+
+func BenchmarkClient_Sessions(b *testing.B) {
+	c := &Client{running: true}
+	benchmarkSessions(b, c.addSession, c.getSession, c.deleteSession)
+}
+
+func BenchmarkClient_SessionsSingleLock(b *testing.B) {
+	m := &singleLockSessions{sessions: map[uint64]*rpcSession{}}
+	benchmarkSessions(b,
+		func(seq uint64, sess *rpcSession) bool {
+			m.mux.Lock()
+			m.sessions[seq] = sess
+			m.mux.Unlock()
+			return true
+		},
+		func(seq uint64) (*rpcSession, bool) {
+			m.mux.Lock()
+			sess, ok := m.sessions[seq]
+			m.mux.Unlock()
+			return sess, ok
+		},
+		func(seq uint64) *rpcSession {
+			m.mux.Lock()
+			sess := m.sessions[seq]
+			delete(m.sessions, seq)
+			m.mux.Unlock()
+			return sess
+		},
+	)
+}
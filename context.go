@@ -5,7 +5,14 @@
 package arpc
 
 import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/lesismal/arpc/internal/util"
 )
 
 // Context represents an arpc Call's context.
@@ -21,6 +28,17 @@ type Context struct {
 	done     bool
 	index    int
 	handlers []HandlerFunc
+	// sync is true if the handlers are called in the recv loop
+	sync bool
+
+	span     Span
+	traceCtx context.Context
+
+	deadline time.Time
+	ctxMux   sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	canceled bool
 }
 
 // Get returns value for key.
@@ -49,10 +67,42 @@ func (ctx *Context) Values() map[string]interface{} {
 }
 
 // Body returns body.
+// The returned slice aliases the buffer of the request Message,
+// use BodyCopy if it's held after the handler returns, e.g. for async processing.
 func (ctx *Context) Body() []byte {
 	return ctx.Message.Data()
 }
 
+// BodyCopy returns a copy of body.
+func (ctx *Context) BodyCopy() []byte {
+	return ctx.Message.DataCopy()
+}
+
+// RemoteAddr returns the remote address of the Client.
+func (ctx *Context) RemoteAddr() net.Addr {
+	return ctx.Client.Conn.RemoteAddr()
+}
+
+// Method returns the method of the request.
+func (ctx *Context) Method() string {
+	return ctx.Message.Method()
+}
+
+// Seq returns the sequence number of the request.
+func (ctx *Context) Seq() uint64 {
+	return ctx.Message.Seq()
+}
+
+// Header returns the key-value header sent with the request, nil if there's no header.
+func (ctx *Context) Header() map[string]string {
+	return ctx.Message.Header()
+}
+
+// PeerCred returns the credentials of the peer process of a unix socket connection, see Client.PeerCred.
+func (ctx *Context) PeerCred() (*Ucred, error) {
+	return ctx.Client.PeerCred()
+}
+
 // Bind parses the body data and stores the result
 // in the value pointed to by v.
 func (ctx *Context) Bind(v interface{}) error {
@@ -70,7 +120,7 @@ func (ctx *Context) Bind(v interface{}) error {
 		// case *error:
 		// 	*vt = errors.New(util.BytesToStr(data))
 		default:
-			return ctx.Client.Codec.Unmarshal(data, v)
+			return ctx.Client.GetCodec().Unmarshal(data, v)
 		}
 	}
 	return nil
@@ -86,11 +136,80 @@ func (ctx *Context) WriteWithTimeout(v interface{}, timeout time.Duration) error
 	return ctx.write(v, false, timeout)
 }
 
-// Error responses an error Message to the Client.
+// WriteStream responses a Message of a stream to the Client,
+// the stream is ended by the last response of Write, Error or WriteWithTimeout, or by CloseStream.
+func (ctx *Context) WriteStream(v interface{}) error {
+	rsp, err := ctx.newResponse(v, false)
+	if err != nil {
+		return err
+	}
+	rsp.SetHasMore(true)
+	return ctx.Client.PushMsg(rsp, ctx.timeout)
+}
+
+// CloseStream ends a stream of WriteStream without a last response,
+// Stream.Recv of the Client returns io.EOF.
+func (ctx *Context) CloseStream() error {
+	rsp, err := ctx.newResponse(nil, false)
+	if err != nil {
+		return err
+	}
+	rsp.SetStreamEnd(true)
+	return ctx.Client.PushMsg(rsp, ctx.timeout)
+}
+
+// Error responses an error Message to the Client,
+// if v is an error registered by RegisterError or wraps one, it's responded with the code by ErrorCode.
 func (ctx *Context) Error(v interface{}) error {
+	if err, ok := v.(error); ok && ctx.Client.HasFeature(FeatureErrorCode) {
+		if code, ok := registeredCode(err); ok {
+			return ctx.ErrorCode(code, err)
+		}
+	}
 	return ctx.write(v, true, TimeForever)
 }
 
+// ErrorCode responses an error Message with code to the Client,
+// the call of the Client returns an *RPCError with code and the text of err,
+// which unwraps to the error registered with code by RegisterError.
+// If the Client doesn't support FeatureErrorCode, it's the same as Error.
+func (ctx *Context) ErrorCode(code int, err error) error {
+	if !ctx.Client.HasFeature(FeatureErrorCode) {
+		return ctx.Error(err)
+	}
+	header, e := encodeHeader(map[string]string{errorCodeHeaderKey: strconv.Itoa(code)})
+	if e != nil {
+		return e
+	}
+	rsp, e := ctx.newResponseWithHeader(err, true, header)
+	if e != nil {
+		return e
+	}
+	return ctx.push(rsp)
+}
+
+// Notify sends a notify of method to the Client in the send queue the same as Write, e.g. to push the progress
+// of the request, it's not correlated to the request and can be sent after the response.
+func (ctx *Context) Notify(method string, v interface{}) error {
+	return ctx.Client.Notify(method, v, ctx.timeout)
+}
+
+// Hijack detaches the connection from the Client and returns it, the messages already in the
+// send queue are sent before that, then the Client is stopped without closing the connection,
+// and the caller is responsible for it.
+// It should be called by a synchronous handler because the connection is read by the recv loop
+// after an asynchronous handler returns, else ErrContextHijackAsync is returned.
+// The compressed stream can't be detached, so ErrContextHijackStreamCompression is returned if it's enabled.
+func (ctx *Context) Hijack() (net.Conn, error) {
+	if !ctx.sync {
+		return nil, ErrContextHijackAsync
+	}
+	if ctx.Client.Handler.StreamCompression() != StreamCompressionNone {
+		return nil, ErrContextHijackStreamCompression
+	}
+	return ctx.Client.hijack()
+}
+
 // Next calls next middleware or method/router handler.
 func (ctx *Context) Next() {
 	ctx.index++
@@ -103,22 +222,63 @@ func (ctx *Context) Next() {
 	// }
 }
 
-// Done stops the one-by-one-calling of middlewares and method/router handler.
+// Done stops the one-by-one-calling of middlewares and method/router handler, it's the same as Abort.
 func (ctx *Context) Done() {
 	ctx.done = true
 }
 
+// Abort stops the one-by-one-calling of middlewares and method/router handler, the handlers after
+// the current one are skipped, e.g. an auth middleware writes an error and aborts for an unauthenticated Client.
+// The handlers before the current one still run their code after their Next calls.
+func (ctx *Context) Abort() {
+	ctx.done = true
+}
+
+// IsAborted returns true if Abort or Done has been called.
+func (ctx *Context) IsAborted() bool {
+	return ctx.done
+}
+
 func (ctx *Context) write(v interface{}, isError bool, timeout time.Duration) error {
+	rsp, err := ctx.newResponse(v, isError)
+	if err != nil {
+		return err
+	}
+	return ctx.push(rsp)
+}
+
+func (ctx *Context) push(rsp *Message) error {
+	if ctx.span != nil && rsp.IsError() {
+		// copy the error text, the buffer may be encoded in place before it's sent
+		ctx.span.RecordError(errors.New(string(rsp.Data())))
+	}
+	return ctx.Client.PushMsg(rsp, ctx.timeout)
+}
+
+func (ctx *Context) newResponse(v interface{}, isError bool) (*Message, error) {
+	return ctx.newResponseWithHeader(v, isError, nil)
+}
+
+func (ctx *Context) newResponseWithHeader(v interface{}, isError bool, header []byte) (*Message, error) {
 	cli := ctx.Client
 	req := ctx.Message
 	if req.Cmd() != CmdRequest {
-		return ErrContextResponseToNotify
+		return nil, ErrContextResponseToNotify
 	}
 	if _, ok := v.(error); ok {
 		isError = true
 	}
-	rsp := newMessage(CmdResponse, req.method(), v, isError, req.IsAsync(), req.Seq(), cli.Handler, cli.Codec, ctx.values)
-	return cli.PushMsg(rsp, ctx.timeout)
+	data := util.ValueToBytes(cli.GetCodec(), v)
+	bodyLen := methodLenSize(req.method()) + req.MethodLen() + len(data)
+	if header != nil {
+		bodyLen += 2 + len(header)
+	}
+	if err := checkBodyLen(bodyLen); err != nil {
+		return nil, err
+	}
+	rsp := newMessageWithHeader(CmdResponse, req.method(), header, data, isError, req.IsAsync(), req.Seq(), cli.Handler, cli.GetCodec(), ctx.values)
+	rsp.SetVersion(cli.Version())
+	return rsp, nil
 }
 
 func newContext(cli *Client, msg *Message, handlers []HandlerFunc) *Context {
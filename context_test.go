@@ -5,7 +5,13 @@
 package arpc
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lesismal/arpc/internal/codec"
 )
@@ -51,6 +57,269 @@ func TestContext_Body(t *testing.T) {
 	if string(ctx.Body()) != bodyValue {
 		t.Fatalf("Context.Body() = %v, want %v", string(ctx.Body()), bodyValue)
 	}
+
+	body := ctx.BodyCopy()
+	ctx.Body()[0] = 'B'
+	if string(body) != bodyValue {
+		t.Fatalf("Context.BodyCopy() = %v, want %v", string(body), bodyValue)
+	}
+}
+
+func TestContext_MethodSeq(t *testing.T) {
+	ctx := &Context{
+		Client:  &Client{Codec: codec.DefaultCodec},
+		Message: newMessage(CmdRequest, "method", nil, false, false, 3, DefaultHandler, codec.DefaultCodec, nil),
+	}
+	if ctx.Method() != "method" {
+		t.Fatalf("Context.Method() = %v, want %v", ctx.Method(), "method")
+	}
+	if ctx.Seq() != 3 {
+		t.Fatalf("Context.Seq() = %v, want %v", ctx.Seq(), 3)
+	}
+}
+
+func TestContext_RemoteAddr(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx := &Context{Client: &Client{Conn: conn}}
+	if ctx.RemoteAddr() != conn.RemoteAddr() {
+		t.Fatalf("Context.RemoteAddr() = %v, want %v", ctx.RemoteAddr(), conn.RemoteAddr())
+	}
+}
+
+func TestContext_ErrorCode(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/code", func(ctx *Context) {
+		ctx.ErrorCode(404, errors.New("user not found"))
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	err = c.Call("/code", nil, nil, time.Second)
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("Client.Call() error = %#v, want *RPCError", err)
+	}
+	if rpcErr.Code != 404 || rpcErr.Message != "user not found" {
+		t.Fatalf("Client.Call() error = %+v, want {Code:404 Message:user not found}", rpcErr)
+	}
+
+	// the peer without FeatureErrorCode gets the text only
+	for _, cli := range svr.getClients() {
+		cli.setProtocol(ProtocolVersion1, SupportedFeatures&^FeatureErrorCode)
+	}
+	err = c.Call("/code", nil, nil, time.Second)
+	if _, ok = err.(*RPCError); ok || err == nil || err.Error() != "user not found" {
+		t.Fatalf("Client.Call() error = %#v, want plain error", err)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	errNotFound := errors.New("not found")
+	RegisterError(4040, errNotFound)
+	defer RegisterError(4040, nil)
+
+	svr := NewServer()
+	svr.Handler.Handle("/registered", func(ctx *Context) {
+		ctx.Error(fmt.Errorf("user 1: %w", errNotFound))
+	})
+	svr.Handler.Handle("/unregistered", func(ctx *Context) {
+		ctx.Error(errors.New("not found"))
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	err = c.Call("/registered", nil, nil, time.Second)
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("Client.Call() error = %#v, want %v", err, errNotFound)
+	}
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Code != 4040 || rpcErr.Message != "user 1: not found" {
+		t.Fatalf("Client.Call() error = %#v, want {Code:4040 Message:user 1: not found}", err)
+	}
+
+	err = c.Call("/unregistered", nil, nil, time.Second)
+	if err == nil || errors.Is(err, errNotFound) {
+		t.Fatalf("Client.Call() error = %#v, want an error not being %v", err, errNotFound)
+	}
+}
+
+func TestContext_Notify(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/task", func(ctx *Context) {
+		ctx.Write("accepted")
+		go func() {
+			for _, progress := range []string{"50%", "100%"} {
+				if err := ctx.Notify("/progress", progress); err != nil {
+					t.Errorf("Context.Notify() error = %v", err)
+				}
+			}
+		}()
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	chProgress := make(chan string, 2)
+	c.Handler.Handle("/progress", func(ctx *Context) {
+		chProgress <- string(ctx.Body())
+	})
+
+	rsp := ""
+	if err = c.Call("/task", nil, &rsp, time.Second); err != nil || rsp != "accepted" {
+		t.Fatalf("Client.Call() = %v, %v, want accepted", rsp, err)
+	}
+	for _, want := range []string{"50%", "100%"} {
+		select {
+		case progress := <-chProgress:
+			if progress != want {
+				t.Fatalf("progress = %v, want %v", progress, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("progress notify not received")
+		}
+	}
+}
+
+func TestContext_Hijack(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.Handle("/upgrade", func(ctx *Context) {
+		ctx.Write("ok")
+		conn, err := ctx.Hijack()
+		if err != nil {
+			t.Errorf("Context.Hijack() error = %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}, false)
+	svr.Handler.Handle("/async", func(ctx *Context) {
+		if _, err := ctx.Hijack(); err != ErrContextHijackAsync {
+			t.Errorf("Context.Hijack() error = %v, want %v", err, ErrContextHijackAsync)
+		}
+	}, true)
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	conn, err := net.DialTimeout("tcp", testServerAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	async := newMessage(CmdNotify, "/async", nil, false, false, 1, svr.Handler, nil, nil)
+	req := newMessage(CmdRequest, "/upgrade", nil, false, false, 2, svr.Handler, nil, nil)
+	// the raw data following the request may be buffered by the recv loop
+	if _, err = conn.Write(append(append(async.Buffer, req.Buffer...), "ping"...)); err != nil {
+		t.Fatalf("conn.Write() error = %v", err)
+	}
+
+	head := make(Header, HeadLen)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		t.Fatalf("read response head error = %v", err)
+	}
+	rsp := &Message{Buffer: make([]byte, HeadLen+head.BodyLen())}
+	copy(rsp.Buffer, head)
+	if _, err = io.ReadFull(conn, rsp.Buffer[HeadLen:]); err != nil {
+		t.Fatalf("read response body error = %v", err)
+	}
+	if rsp.Seq() != 2 || string(rsp.Data()) != "ok" {
+		t.Fatalf("response seq = %v, data = %v, want 2, ok", rsp.Seq(), string(rsp.Data()))
+	}
+
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read hijacked conn = %v, %v, want ping", string(buf), err)
+	}
+	if _, err = conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("conn.Write() error = %v", err)
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read hijacked conn = %v, %v, want pong", string(buf), err)
+	}
+	if n := svr.NumConnections(); n != 0 {
+		t.Fatalf("Server.NumConnections() = %v after hijacked, want 0", n)
+	}
+}
+
+func TestContext_Abort(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	var after, called int32
+	svr.Handler.Use(func(ctx *Context) {
+		ctx.Next()
+		if ctx.IsAborted() {
+			atomic.AddInt32(&after, 1)
+		}
+	})
+	svr.Handler.Use(func(ctx *Context) {
+		if string(ctx.Body()) != "token" {
+			ctx.Error(errors.New("unauthorized"))
+			ctx.Abort()
+		}
+	})
+	svr.Handler.Handle("/secret", func(ctx *Context) {
+		atomic.AddInt32(&called, 1)
+		ctx.Write("secret")
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	defer SetHandler(DefaultHandler)
+	SetHandler(NewHandler())
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/secret", "token", &rsp, time.Second); err != nil || rsp != "secret" {
+		t.Fatalf("Client.Call() = %v, %v, want secret", rsp, err)
+	}
+	if err = c.Call("/secret", "guess", &rsp, time.Second); err == nil || err.Error() != "unauthorized" {
+		t.Fatalf("Client.Call() error = %v, want unauthorized", err)
+	}
+	if n := atomic.LoadInt32(&called); n != 1 {
+		t.Fatalf("handler called %v times, want 1", n)
+	}
+	// the middleware before the aborting one still runs after its Next
+	if n := atomic.LoadInt32(&after); n != 1 {
+		t.Fatalf("aborted %v times, want 1", n)
+	}
 }
 
 func TestContext_Bind(t *testing.T) {
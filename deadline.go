@@ -0,0 +1,104 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutHeaderKey is the header key of the timeout of a request in nanoseconds,
+// the timeout rather than the deadline is sent so that the clocks of the peers don't need to be synchronized.
+const timeoutHeaderKey = "arpc-timeout"
+
+// PropagateDeadline sets whether the timeout of the calls is sent in the header of the request,
+// the handlers on the other side can get the deadline by Context.Deadline and Context.Context.
+// The timeout is sent only if the peer supports FeatureDeadline.
+func (c *Client) PropagateDeadline(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.propagateDeadline, 1)
+	} else {
+		atomic.StoreInt32(&c.propagateDeadline, 0)
+	}
+}
+
+func (c *Client) isPropagatingDeadline() bool {
+	return atomic.LoadInt32(&c.propagateDeadline) == 1
+}
+
+// withTimeoutHeader returns a copy of md with the timeout added.
+func withTimeoutHeader(md map[string]string, timeout time.Duration) map[string]string {
+	if timeout <= 0 || timeout == TimeForever {
+		return md
+	}
+	cp := make(map[string]string, len(md)+1)
+	for k, v := range md {
+		cp[k] = v
+	}
+	cp[timeoutHeaderKey] = strconv.FormatInt(int64(timeout), 10)
+	return cp
+}
+
+// Deadline returns the time when the caller stops waiting for the response,
+// ok is false if the caller didn't send its timeout, see Client.PropagateDeadline.
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+// Context returns a context.Context which is done when the deadline of the request passes,
+// the connection is closed or the handlers return, so long-running handlers can bail early.
+// It's derived from TraceContext, and it's safe to be called by the goroutines started by the handlers,
+// the context returned after the handlers returned is done already.
+func (ctx *Context) Context() context.Context {
+	ctx.ctxMux.Lock()
+	defer ctx.ctxMux.Unlock()
+	if ctx.ctx != nil {
+		return ctx.ctx
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ctx.ctx, ctx.cancel = context.WithDeadline(ctx.TraceContext(), deadline)
+	} else {
+		ctx.ctx, ctx.cancel = context.WithCancel(ctx.TraceContext())
+	}
+	if ctx.canceled {
+		ctx.cancel()
+		return ctx.ctx
+	}
+	// the goroutine exits when the context is canceled by cancelContext at the latest
+	done, chClose, cancel := ctx.ctx.Done(), ctx.Client.chClose, ctx.cancel
+	go func() {
+		select {
+		case <-chClose:
+			cancel()
+		case <-done:
+		}
+	}()
+	return ctx.ctx
+}
+
+// initDeadline sets the deadline of the request by the timeout in its header.
+func (ctx *Context) initDeadline() {
+	if !ctx.Message.HasHeader() {
+		return
+	}
+	if s, ok := ctx.Header()[timeoutHeaderKey]; ok {
+		if timeout, err := strconv.ParseInt(s, 10, 64); err == nil && timeout > 0 {
+			ctx.deadline = time.Now().Add(time.Duration(timeout))
+		}
+	}
+}
+
+// cancelContext cancels the context returned by Context after the handlers returned,
+// the context created by Context later is canceled on creation.
+func (ctx *Context) cancelContext() {
+	ctx.ctxMux.Lock()
+	ctx.canceled = true
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+	ctx.ctxMux.Unlock()
+}
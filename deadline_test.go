@@ -0,0 +1,121 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContext_Deadline(t *testing.T) {
+	chErr := make(chan error, 1)
+	svr := NewServer()
+	svr.Handler.Handle("/wait", func(ctx *Context) {
+		if _, ok := ctx.Deadline(); !ok {
+			chErr <- nil
+			return
+		}
+		<-ctx.Context().Done()
+		chErr <- ctx.Context().Err()
+	}, true)
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	c.Call("/wait", nil, nil, time.Second/10)
+	if err = <-chErr; err != nil {
+		t.Fatalf("Context.Deadline() ok = true without PropagateDeadline, err = %v", err)
+	}
+
+	c.PropagateDeadline(true)
+	if err = c.Call("/wait", nil, nil, time.Second/10); err != ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrClientTimeout)
+	}
+	select {
+	case err = <-chErr:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Context.Context().Err() = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Context.Context() not done after the deadline")
+	}
+
+	// the context is canceled when the connection is closed
+	go c.Call("/wait", nil, nil, time.Second*10)
+	time.Sleep(time.Second / 20)
+	c.Stop()
+	select {
+	case err = <-chErr:
+		if err != context.Canceled {
+			t.Fatalf("Context.Context().Err() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Context.Context() not done after the connection closed")
+	}
+}
+
+func TestContext_ContextAfterHandlers(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	c := NewClientWithConn(conn2, nil, NewHandler())
+	defer c.Stop()
+
+	ctx := newContext(c, newMessage(CmdRequest, "/wait", nil, false, false, 1, c.Handler, nil, nil), nil)
+	ctx.cancelContext()
+	select {
+	case <-ctx.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Context.Context() created after the handlers returned is not done")
+	}
+}
+
+func TestClient_PropagateDeadlineFeature(t *testing.T) {
+	chOK := make(chan bool, 1)
+	svr := NewServer()
+	svr.Handler.Handle("/deadline", func(ctx *Context) {
+		_, ok := ctx.Deadline()
+		chOK <- ok
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.PropagateDeadline(true)
+
+	// the timeout is not sent to the peer without FeatureDeadline
+	c.setProtocol(ProtocolVersion1, SupportedFeatures&^FeatureDeadline)
+	if err = c.Call("/deadline", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if <-chOK {
+		t.Fatalf("Context.Deadline() ok = true, want false")
+	}
+
+	c.setProtocol(ProtocolVersion1, SupportedFeatures)
+	if err = c.Call("/deadline", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if !<-chOK {
+		t.Fatalf("Context.Deadline() ok = false, want true")
+	}
+}
@@ -4,7 +4,10 @@
 
 package arpc
 
-import "errors"
+import (
+	"errors"
+	"sync"
+)
 
 // client error
 var (
@@ -29,8 +32,39 @@ var (
 	// ErrClientStopped represents an error that Client is stopped.
 	ErrClientStopped = errors.New("client stopped")
 
+	// ErrClientRunning represents an error that the setting can't be changed while Client is running.
+	ErrClientRunning = errors.New("client running")
+
+	// ErrClientInvalidSendQueueSize represents an error of non-positive send queue size.
+	ErrClientInvalidSendQueueSize = errors.New("invalid send queue size, should be > 0")
+
 	// ErrClientInvalidPoolDialers represents an error of empty dialer array.
 	ErrClientInvalidPoolDialers = errors.New("invalid dialers: empty array")
+
+	// ErrMultiClientInvalidClients represents an error of empty client array.
+	ErrMultiClientInvalidClients = errors.New("invalid clients: empty array")
+)
+
+// server error
+var (
+	// ErrServerOverload represents an error that the Server has reached the max number of connections.
+	ErrServerOverload = errors.New("server overload: too many connections")
+
+	// ErrServerNilTLSConfig represents ListenAndServeTLS is called without TLSConfig.
+	ErrServerNilTLSConfig = errors.New("server: nil TLSConfig")
+
+	// ErrServerBusy represents an error that the request is rejected because the dispatch pool of the Handler is full,
+	// see OverloadPolicyReject, the handler has not run and the Client may retry it after backing off.
+	ErrServerBusy = errors.New("server busy")
+
+	// ErrRateLimited represents an error that the requests of a method exceeded the rate limit.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrNotUnixConn represents an error that the peer credentials are read from a connection which is not a unix socket.
+	ErrNotUnixConn = errors.New("not a unix socket connection")
+
+	// ErrPeerCredUnsupported represents an error that reading the peer credentials is not supported on this platform.
+	ErrPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
 )
 
 // message error
@@ -41,14 +75,111 @@ var (
 	// ErrMethodNotFound represents an error of method not found.
 	ErrMethodNotFound = errors.New("method not found")
 
+	// ErrInvalidBodySize represents an error that the size of the body read does not match the declared size.
+	ErrInvalidBodySize = errors.New("invalid body size: declared size mismatch with bytes read")
+
+	// ErrBodyTooLarge represents an error that the body length exceeds the limit.
+	ErrBodyTooLarge = errors.New("body too large")
+
+	// ErrResponseTooLarge represents an error that the body length of a response exceeds the max response size of the Client.
+	ErrResponseTooLarge = errors.New("response too large")
+
+	// ErrInvalidMethodLen represents an error that the method length of a received message exceeds its body.
+	ErrInvalidMethodLen = errors.New("invalid method length: exceeds body length")
+
+	// ErrInvalidHeaderLen represents an error that the header length of a received message exceeds its body.
+	ErrInvalidHeaderLen = errors.New("invalid header length: exceeds body length")
+
+	// ErrChecksumMismatch represents an error that the checksum of the received message body mismatched.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrUnsupportedVersion represents an error that the protocol version of the request is newer than the supported.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrStreamCompressionMismatch represents an error that the peer doesn't enable the same stream compression.
+	ErrStreamCompressionMismatch = errors.New("stream compression mismatch")
+
+	// ErrMultiValuesCount represents an error that the count of the values responded by Context.WriteMulti
+	// mismatches the count of the rsps of Client.CallMulti.
+	ErrMultiValuesCount = errors.New("multiple values count mismatch")
+
+	// ErrInvalidMultiValues represents an error that the body is not encoded by Context.WriteMulti.
+	ErrInvalidMultiValues = errors.New("invalid multiple values body")
+
 	// ErrInvalidFlagBitIndex represents an error of invlaid flag bit index.
 	ErrInvalidFlagBitIndex = errors.New("invalid index, should be 0-7")
 )
 
+// errorCodeHeaderKey is the header key of the code of an error response.
+const errorCodeHeaderKey = "arpc-error-code"
+
+// RPCError represents an error response with a code, see Context.ErrorCode.
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+// Error returns the error message.
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error registered with the code by RegisterError, so errors.Is works with it.
+func (e *RPCError) Unwrap() error {
+	return registeredError(e.Code)
+}
+
+// ErrorCodeServerBusy is the code ErrServerBusy is registered with, the negative codes are reserved by arpc.
+const ErrorCodeServerBusy = -503
+
+var (
+	registeredErrorsMux sync.RWMutex
+	registeredErrors    = map[int]error{ErrorCodeServerBusy: ErrServerBusy}
+)
+
+// RegisterError registers err with code to keep its identity across the wire, it should be registered by both sides:
+// Context.Error responses the code if the error is err or wraps it, and the *RPCError returned by the call
+// of the Client unwraps to err, so errors.Is(callErr, err) is true.
+// A nil err unregisters the code.
+func RegisterError(code int, err error) {
+	registeredErrorsMux.Lock()
+	defer registeredErrorsMux.Unlock()
+	if err == nil {
+		delete(registeredErrors, code)
+		return
+	}
+	registeredErrors[code] = err
+}
+
+// registeredError returns the error registered with code.
+func registeredError(code int) error {
+	registeredErrorsMux.RLock()
+	defer registeredErrorsMux.RUnlock()
+	return registeredErrors[code]
+}
+
+// registeredCode returns the code of the registered error which err is or wraps.
+func registeredCode(err error) (int, bool) {
+	registeredErrorsMux.RLock()
+	defer registeredErrorsMux.RUnlock()
+	for code, registered := range registeredErrors {
+		if errors.Is(err, registered) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
 // context error
 var (
 	// ErrContextResponseToNotify represents an error that response to a notify message.
 	ErrContextResponseToNotify = errors.New("should not response to a context with notify message")
+
+	// ErrContextHijackAsync represents an error that Hijack is called by an asynchronous handler.
+	ErrContextHijackAsync = errors.New("should not hijack the connection in an asynchronous handler")
+
+	// ErrContextHijackStreamCompression represents an error that Hijack is called with the stream compression enabled.
+	ErrContextHijackStreamCompression = errors.New("should not hijack the connection with the stream compression enabled")
 )
 
 // general errors
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/extension/gateway"
+)
+
+// HelloReq .
+type HelloReq struct {
+	Msg string `json:"msg"`
+}
+
+// HelloRsp .
+type HelloRsp struct {
+	Msg string `json:"msg"`
+}
+
+func main() {
+	svr := arpc.NewServer()
+
+	// register router
+	svr.Handler.Handle("/hello", func(ctx *arpc.Context) {
+		req := &HelloReq{}
+		if err := ctx.Bind(req); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(&HelloRsp{Msg: req.Msg})
+	})
+	go svr.Run("localhost:8888")
+	time.Sleep(time.Second / 10)
+
+	client, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", "localhost:8888", time.Second*3)
+	})
+	if err != nil {
+		log.Fatalf("NewClient failed: %v", err)
+	}
+	defer client.Stop()
+
+	// curl -X POST -d '{"msg":"hello"}' "http://localhost:8080/rpc/hello?timeout=1s"
+	http.Handle(gateway.DefaultPrefix+"/", gateway.New(client))
+	log.Fatal(http.ListenAndServe("localhost:8080", nil))
+}
@@ -7,21 +7,27 @@ import (
 	"time"
 
 	"github.com/lesismal/arpc"
-	"github.com/xtaci/kcp-go"
+	"github.com/lesismal/arpc/extension/protocol/kcp"
+	kcpgo "github.com/xtaci/kcp-go"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 func main() {
+	arpc.SetHandler(kcp.NewHandler(0))
+
 	client, err := arpc.NewClient(func() (net.Conn, error) {
 		key := pbkdf2.Key([]byte("demo pass"), []byte("demo salt"), 1024, 32, sha1.New)
-		block, _ := kcp.NewAESBlockCrypt(key)
-		return kcp.DialWithOptions("localhost:8888", block, 10, 3)
+		block, _ := kcpgo.NewAESBlockCrypt(key)
+		return kcp.Dial("localhost:8888", block, 10, 3)
 	})
 	if err != nil {
 		panic(err)
 	}
 	defer client.Stop()
 
+	// keep the session alive shorter than kcp.DefaultReadTimeout of the server
+	client.EnableKeepalive(time.Second*10, "/keepalive")
+
 	req := "hello"
 	rsp := ""
 	err = client.Call("/echo", &req, &rsp, time.Second*5)
@@ -5,24 +5,28 @@ import (
 	"log"
 
 	"github.com/lesismal/arpc"
-	"github.com/xtaci/kcp-go"
+	"github.com/lesismal/arpc/extension/protocol/kcp"
+	kcpgo "github.com/xtaci/kcp-go"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 func main() {
 	key := pbkdf2.Key([]byte("demo pass"), []byte("demo salt"), 1024, 32, sha1.New)
-	block, _ := kcp.NewAESBlockCrypt(key)
-	ln, err := kcp.ListenWithOptions(":8888", block, 10, 3)
+	block, _ := kcpgo.NewAESBlockCrypt(key)
+	ln, err := kcp.Listen(":8888", block, 10, 3)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
 	svr := arpc.NewServer()
+	svr.Handler = kcp.NewHandler(0)
+	svr.Handler.SetLogTag("[ARPC SVR]")
 
 	// register router
+	svr.Handler.Handle("/keepalive", func(ctx *arpc.Context) {})
 	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
 		str := ""
-		ctx.Bind(&str)
+		err := ctx.Bind(&str)
 		ctx.Write(str)
 		log.Printf("/echo: \"%v\", error: %v", str, err)
 	})
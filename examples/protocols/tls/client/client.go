@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/tls"
 	"log"
-	"net"
 	"time"
 
 	"github.com/lesismal/arpc"
@@ -13,9 +12,7 @@ func main() {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 	}
-	client, err := arpc.NewClient(func() (net.Conn, error) {
-		return tls.Dial("tcp", "localhost:8888", tlsConfig)
-	})
+	client, err := arpc.NewTLSClient("localhost:8888", tlsConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -69,11 +69,9 @@ func main() {
 		InsecureSkipVerify: true,
 	}
 	tlsConfig.BuildNameToCertificate()
-	ln, err := tls.Listen("tcp", ":8888", tlsConfig)
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
-	}
-	svr := arpc.NewServer()
+	// set tlsConfig.ClientAuth and tlsConfig.ClientCAs to verify the client certificates,
+	// the handlers get the verified certificate by ctx.PeerCertificate()
+	svr := arpc.NewTLSServer(tlsConfig)
 
 	// register router
 	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
@@ -83,5 +81,5 @@ func main() {
 		log.Printf("/echo: \"%v\", error: %v", str, err)
 	})
 
-	svr.Serve(ln)
+	svr.ListenAndServeTLS(":8888")
 }
@@ -21,10 +21,15 @@ func main() {
 
 	// register router
 	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		cred, err := ctx.PeerCred()
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
 		str := ""
-		err := ctx.Bind(&str)
+		err = ctx.Bind(&str)
 		ctx.Write(str)
-		log.Printf("/echo: \"%v\", error: %v", str, err)
+		log.Printf("/echo: \"%v\", error: %v, from pid: %v, uid: %v, gid: %v", str, err, cred.Pid, cred.Uid, cred.Gid)
 	})
 
 	svr.Serve(ln)
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"net"
 	"time"
 
 	"github.com/lesismal/arpc"
@@ -16,9 +15,7 @@ func main() {
 		log.Printf("/server/notify: \"%v\", error: %v", str, err)
 	})
 
-	client, err := arpc.NewClient(func() (net.Conn, error) {
-		return websocket.Dial("ws://localhost:8888/ws")
-	})
+	client, err := websocket.NewClient("ws://localhost:8888/ws")
 	if err != nil {
 		panic(err)
 	}
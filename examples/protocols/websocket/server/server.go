@@ -11,7 +11,7 @@ import (
 
 func main() {
 	ln, _ := websocket.Listen(":8888", nil)
-	http.HandleFunc("/ws", ln.(*websocket.Listener).Handler)
+	http.Handle("/ws", ln.(*websocket.Listener))
 	go func() {
 		err := http.ListenAndServe(":8888", nil)
 		if err != nil {
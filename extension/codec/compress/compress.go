@@ -0,0 +1,112 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/extension/middleware/coder"
+	"github.com/lesismal/arpc/internal/codec"
+	"github.com/lesismal/arpc/internal/log"
+)
+
+// ErrInvalidLevel represents an error of invalid gzip compression level.
+var ErrInvalidLevel = errors.New("invalid compression level")
+
+// CompressCodec wraps a Codec and gzip-compresses the body of every message, whatever the type of the value is,
+// including string, []byte and error, which are not marshalled by the Codec.
+//
+// Marshal and Unmarshal are the wrapped Codec's, the body is compressed by Encode and inflated by Decode,
+// which the Client calls for the Codec set by Client.SetCodec or the Codec field of the Server,
+// the compressed body is marked by coder.FlagBitCompress in the head so the peer knows whether to inflate it.
+// Both sides should use CompressCodec if any body reaches the threshold, a peer without it reads the
+// compressed body as it is, while the CompressCodec side reads the bodies of such a peer as they are.
+type CompressCodec struct {
+	codec     codec.Codec
+	level     int
+	threshold int
+}
+
+// Marshal implements arpc Codec.
+func (c *CompressCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.codec.Marshal(v)
+}
+
+// Unmarshal implements arpc Codec.
+func (c *CompressCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.codec.Unmarshal(data, v)
+}
+
+// Encode implements arpc MessageCoder, it returns a compressed copy of msg if the body reaches the threshold
+// and gets shorter, msg is not modified since it may be pushed to other clients too.
+func (c *CompressCodec) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	if len(msg.Buffer)-arpc.HeadLen < c.threshold || msg.IsFlagBitSet(coder.FlagBitCompress) {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	buf.Write(msg.Buffer[:arpc.HeadLen])
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return msg
+	}
+	w.Write(msg.Buffer[arpc.HeadLen:])
+	w.Close()
+	if buf.Len() >= len(msg.Buffer) {
+		return msg
+	}
+
+	compressed := &arpc.Message{Buffer: buf.Bytes()}
+	compressed.SetBodyLen(buf.Len() - arpc.HeadLen)
+	compressed.SetFlagBit(coder.FlagBitCompress, true)
+	return compressed
+}
+
+// Decode implements arpc MessageCoder, it inflates the body of msg if it's compressed.
+func (c *CompressCodec) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	if !msg.IsFlagBitSet(coder.FlagBitCompress) {
+		return msg
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(msg.Buffer[arpc.HeadLen:]))
+	if err != nil {
+		log.Errorw("CompressCodec: invalid compressed body", "seq", msg.Seq(), "error", err)
+		return msg
+	}
+	defer r.Close()
+	// limit the inflated body, a small compressed body could be inflated to be huge
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(arpc.MaxBodyLen)+1))
+	if err != nil || len(body) > arpc.MaxBodyLen {
+		log.Errorw("CompressCodec: invalid compressed body", "seq", msg.Seq(), "body_len", len(body), "error", err)
+		return msg
+	}
+
+	buf := make([]byte, arpc.HeadLen+len(body))
+	copy(buf, msg.Buffer[:arpc.HeadLen])
+	copy(buf[arpc.HeadLen:], body)
+	msg.Buffer = buf
+	msg.SetBodyLen(len(body))
+	msg.SetFlagBit(coder.FlagBitCompress, false)
+	return msg
+}
+
+// New returns a CompressCodec which wraps cdc, or the default Codec if cdc is nil,
+// the bodies shorter than threshold are not compressed,
+// level is the gzip compression level, e.g. flate.DefaultCompression.
+func New(cdc codec.Codec, level int, threshold int) (*CompressCodec, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, ErrInvalidLevel
+	}
+	if cdc == nil {
+		cdc = codec.DefaultCodec
+	}
+	return &CompressCodec{codec: cdc, level: level, threshold: threshold}, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/extension/middleware/coder"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil, flate.BestCompression+1, 0); err != ErrInvalidLevel {
+		t.Fatalf("New() error = %v, want %v", err, ErrInvalidLevel)
+	}
+	cc, err := New(nil, flate.DefaultCompression, 0)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	data, err := cc.Marshal(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatalf("CompressCodec.Marshal() error = %v", err)
+	}
+	v := map[string]int{}
+	if err = cc.Unmarshal(data, &v); err != nil || v["a"] != 1 {
+		t.Fatalf("CompressCodec.Unmarshal() = %v, %v, want map[a:1], nil", v, err)
+	}
+}
+
+func TestCompressCodec_EncodeDecode(t *testing.T) {
+	cc, err := New(nil, flate.BestSpeed, 64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	svr := arpc.NewServer()
+
+	for _, v := range []interface{}{strings.Repeat("hello", 100), bytes.Repeat([]byte("hello"), 100), errors.New(strings.Repeat("hello", 100))} {
+		msg := svr.NewMessage(arpc.CmdRequest, "/echo", v)
+		raw := append([]byte{}, msg.Buffer...)
+		encoded := cc.Encode(nil, msg)
+		if !encoded.IsFlagBitSet(coder.FlagBitCompress) || len(encoded.Buffer) >= len(raw) {
+			t.Fatalf("CompressCodec.Encode() of %T: compressed = %v, len = %v, want compressed shorter than %v",
+				v, encoded.IsFlagBitSet(coder.FlagBitCompress), len(encoded.Buffer), len(raw))
+		}
+		if !bytes.Equal(msg.Buffer, raw) {
+			t.Fatalf("CompressCodec.Encode() of %T modified the message", v)
+		}
+		decoded := cc.Decode(nil, encoded)
+		if decoded.IsFlagBitSet(coder.FlagBitCompress) || !bytes.Equal(decoded.Buffer, raw) {
+			t.Fatalf("CompressCodec.Decode() of %T mismatch with the message encoded", v)
+		}
+	}
+
+	// the body shorter than the threshold is not compressed
+	msg := svr.NewMessage(arpc.CmdRequest, "/echo", "hello")
+	if encoded := cc.Encode(nil, msg); encoded != msg || encoded.IsFlagBitSet(coder.FlagBitCompress) {
+		t.Fatalf("CompressCodec.Encode() compressed the short body")
+	}
+	if decoded := cc.Decode(nil, msg); decoded != msg {
+		t.Fatalf("CompressCodec.Decode() modified the uncompressed body")
+	}
+}
+
+// flagCounter counts the compressed messages received.
+type flagCounter struct {
+	compressed int32
+}
+
+func (fc *flagCounter) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	return msg
+}
+
+func (fc *flagCounter) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
+	if msg.IsFlagBitSet(coder.FlagBitCompress) {
+		atomic.AddInt32(&fc.compressed, 1)
+	}
+	return msg
+}
+
+func newServer(t *testing.T, addr string, cdc *CompressCodec) (*arpc.Server, *flagCounter) {
+	fc := &flagCounter{}
+	svr := arpc.NewServer()
+	if cdc != nil {
+		svr.Codec = cdc
+	}
+	svr.Handler.UseCoder(fc)
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/error", func(ctx *arpc.Context) {
+		ctx.Error(errors.New(string(ctx.Body())))
+	})
+	svr.Handler.Handle("/map", func(ctx *arpc.Context) {
+		v := map[string]string{}
+		if err := ctx.Bind(&v); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(v)
+	})
+	go svr.Run(addr)
+	time.Sleep(time.Second / 100)
+	return svr, fc
+}
+
+func newClient(t *testing.T, addr string, cdc *CompressCodec) *arpc.Client {
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if cdc != nil {
+		c.SetCodec(cdc)
+	}
+	return c
+}
+
+func TestCompressCodec_Call(t *testing.T) {
+	cc, err := New(nil, flate.DefaultCompression, 64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	addr := "localhost:13101"
+	svr, fc := newServer(t, addr, cc)
+	defer svr.Stop()
+	c := newClient(t, addr, cc)
+	defer c.Stop()
+
+	long := strings.Repeat("hello", 100)
+	str := ""
+	if err = c.Call("/echo", long, &str, time.Second); err != nil || str != long {
+		t.Fatalf("Client.Call() string = %v, %v, want %v, nil", len(str), err, len(long))
+	}
+	buf := []byte{}
+	if err = c.Call("/echo", []byte(long), &buf, time.Second); err != nil || string(buf) != long {
+		t.Fatalf("Client.Call() []byte = %v, %v, want %v, nil", len(buf), err, len(long))
+	}
+	if err = c.Call("/error", long, nil, time.Second); err == nil || err.Error() != long {
+		t.Fatalf("Client.Call() error = %v, want the long error", err)
+	}
+	m := map[string]string{"key": long}
+	rsp := map[string]string{}
+	if err = c.Call("/map", m, &rsp, time.Second); err != nil || rsp["key"] != long {
+		t.Fatalf("Client.Call() map = %v, %v, want the long value, nil", len(rsp["key"]), err)
+	}
+	if n := atomic.LoadInt32(&fc.compressed); n != 4 {
+		t.Fatalf("compressed requests = %v, want 4", n)
+	}
+}
+
+func TestCompressCodec_MixedPeers(t *testing.T) {
+	cc, err := New(nil, flate.DefaultCompression, 1024)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// the CompressCodec side reads the bodies of a peer without it, and sends the bodies shorter
+	// than the threshold as they are
+	addr := "localhost:13102"
+	svr, fc := newServer(t, addr, nil)
+	defer svr.Stop()
+	c := newClient(t, addr, cc)
+	defer c.Stop()
+
+	str := ""
+	if err = c.Call("/echo", "hello", &str, time.Second); err != nil || str != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", str, err)
+	}
+	rsp := map[string]string{}
+	if err = c.Call("/map", map[string]string{"key": "value"}, &rsp, time.Second); err != nil || rsp["key"] != "value" {
+		t.Fatalf("Client.Call() = %v, %v, want map[key:value], nil", rsp, err)
+	}
+	if n := atomic.LoadInt32(&fc.compressed); n != 0 {
+		t.Fatalf("compressed requests = %v, want 0", n)
+	}
+
+	// and the other way round
+	addr = "localhost:13103"
+	svr2, _ := newServer(t, addr, cc)
+	defer svr2.Stop()
+	c2 := newClient(t, addr, nil)
+	defer c2.Stop()
+	if err = c2.Call("/echo", "hello", &str, time.Second); err != nil || str != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", str, err)
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gateway
+
+import "errors"
+
+var (
+	// ErrInvalidTimeout represents an error of a timeout which is not a positive duration.
+	ErrInvalidTimeout = errors.New("invalid timeout, should be a positive duration, e.g. 500ms")
+
+	// ErrInvalidJSON represents an error of a request body which is not valid JSON.
+	ErrInvalidJSON = errors.New("invalid json body")
+)
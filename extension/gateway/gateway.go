@@ -0,0 +1,137 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gateway exposes arpc methods to HTTP clients with JSON.
+//
+// "POST /rpc/{method}" calls the arpc method "/{method}" with the request body and writes the response as JSON,
+// e.g. "POST /rpc/user/get" calls "/user/get". The request body is passed to the method as it is,
+// so the arpc server should use the default JSON codec.
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+const (
+	// DefaultPrefix is the path prefix of the rpc requests.
+	DefaultPrefix = "/rpc"
+	// DefaultTimeout is used if the request doesn't have a timeout.
+	DefaultTimeout = time.Second * 5
+	// DefaultMaxBodySize is the max size of a request body.
+	DefaultMaxBodySize = 1024 * 1024 * 4
+
+	// TimeoutParam is the query param of the request timeout, e.g. "?timeout=500ms".
+	TimeoutParam = "timeout"
+	// TimeoutHeader is the header of the request timeout, it's used if TimeoutParam is not set.
+	TimeoutHeader = "X-Arpc-Timeout"
+)
+
+// Gateway is an http.Handler which forwards the requests to the arpc methods by Client.
+type Gateway struct {
+	Client *arpc.Client
+
+	// Prefix is the path prefix of the rpc requests.
+	Prefix string
+	// Timeout is used if the request doesn't have a timeout.
+	Timeout time.Duration
+	// MaxBodySize is the max size of a request body.
+	MaxBodySize int64
+}
+
+// ServeHTTP implements http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, g.Prefix)
+	if len(method) == len(r.URL.Path) || len(method) <= 1 || method[0] != '/' {
+		http.NotFound(w, r)
+		return
+	}
+
+	timeout, err := g.timeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var req interface{}
+	if len(body) > 0 {
+		if !json.Valid(body) {
+			http.Error(w, ErrInvalidJSON.Error(), http.StatusBadRequest)
+			return
+		}
+		req = body
+	}
+
+	var rsp []byte
+	err = g.Client.Call(method, req, &rsp, timeout)
+	if err != nil {
+		http.Error(w, err.Error(), statusCode(err))
+		return
+	}
+
+	// the response is not JSON if the handler writes a string or []byte
+	if len(rsp) == 0 {
+		rsp = []byte("null")
+	} else if !json.Valid(rsp) {
+		rsp, _ = json.Marshal(string(rsp))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rsp)
+}
+
+func (g *Gateway) timeout(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get(TimeoutParam)
+	if s == "" {
+		s = r.Header.Get(TimeoutHeader)
+	}
+	if s == "" {
+		return g.Timeout, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil || timeout <= 0 {
+		return 0, ErrInvalidTimeout
+	}
+	return timeout, nil
+}
+
+// statusCode maps the errors of the Client to http status codes,
+// the others, including the error responses of the handlers, are mapped to 500.
+func statusCode(err error) int {
+	switch err {
+	case arpc.ErrClientTimeout, arpc.ErrClientOverstock:
+		return http.StatusGatewayTimeout
+	case arpc.ErrClientReconnecting, arpc.ErrClientStopped:
+		return http.StatusServiceUnavailable
+	}
+	if err.Error() == arpc.ErrMethodNotFound.Error() {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// New creates a Gateway with client.
+func New(client *arpc.Client) *Gateway {
+	return &Gateway{
+		Client:      client,
+		Prefix:      DefaultPrefix,
+		Timeout:     DefaultTimeout,
+		MaxBodySize: DefaultMaxBodySize,
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package gateway
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestGateway(t *testing.T) {
+	address := "localhost:8890"
+
+	type user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/user/echo", func(ctx *arpc.Context) {
+		u := &user{}
+		if err := ctx.Bind(u); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(u)
+	})
+	svr.Handler.Handle("/hello", func(ctx *arpc.Context) {
+		ctx.Write("hello")
+	})
+	svr.Handler.Handle("/fail", func(ctx *arpc.Context) {
+		ctx.Error("failed")
+	})
+	svr.Handler.Handle("/sleep", func(ctx *arpc.Context) {
+		time.Sleep(time.Second / 5)
+		ctx.Write(nil)
+	})
+	go svr.Run(address)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	client, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer client.Stop()
+
+	ts := httptest.NewServer(New(client))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header string
+		code   int
+		want   string
+	}{
+		{"json", http.MethodPost, "/rpc/user/echo", `{"name":"arpc","age":3}`, "", http.StatusOK, `{"name":"arpc","age":3}`},
+		{"string", http.MethodPost, "/rpc/hello", "", "", http.StatusOK, `"hello"`},
+		{"error", http.MethodPost, "/rpc/fail", "", "", http.StatusInternalServerError, "failed\n"},
+		{"not found", http.MethodPost, "/rpc/notfound", "", "", http.StatusNotFound, arpc.ErrMethodNotFound.Error() + "\n"},
+		{"empty method", http.MethodPost, "/rpc/", "", "", http.StatusNotFound, "404 page not found\n"},
+		{"get", http.MethodGet, "/rpc/hello", "", "", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+		{"invalid json", http.MethodPost, "/rpc/user/echo", `{"name":`, "", http.StatusBadRequest, ErrInvalidJSON.Error() + "\n"},
+		{"invalid timeout", http.MethodPost, "/rpc/hello?timeout=abc", "", "", http.StatusBadRequest, ErrInvalidTimeout.Error() + "\n"},
+		{"timeout param", http.MethodPost, "/rpc/sleep?timeout=50ms", "", "", http.StatusGatewayTimeout, arpc.ErrClientTimeout.Error() + "\n"},
+		{"timeout header", http.MethodPost, "/rpc/sleep", "", "50ms", http.StatusGatewayTimeout, arpc.ErrClientTimeout.Error() + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("http.NewRequest() error = %v", err)
+			}
+			if tt.header != "" {
+				req.Header.Set(TimeoutHeader, tt.header)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("http.Client.Do() error = %v", err)
+			}
+			defer res.Body.Close()
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != tt.code || string(body) != tt.want {
+				t.Fatalf("Gateway.ServeHTTP() = %v, %q, want %v, %q", res.StatusCode, body, tt.code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+// Package slogger implements arpc.StructuredLogger with log/slog.
+//
+//	arpc.SetStructuredLogger(slogger.New(slog.New(slog.NewJSONHandler(os.Stdout, nil))))
+package slogger
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/lesismal/arpc/internal/log"
+)
+
+// Logger wraps slog.Logger to arpc.StructuredLogger.
+type Logger struct {
+	logger *slog.Logger
+	level  int
+}
+
+// Level returns the priority of arpc logs.
+func (l *Logger) Level() int {
+	return l.level
+}
+
+// SetLevel sets the priority of arpc logs, the logs are filtered by the slog.Handler too.
+func (l *Logger) SetLevel(lvl int) {
+	l.level = lvl
+}
+
+// Debugw logs a message with fields at slog.LevelDebug.
+func (l *Logger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.log(log.LevelDebug, slog.LevelDebug, msg, keysAndValues)
+}
+
+// Infow logs a message with fields at slog.LevelInfo.
+func (l *Logger) Infow(msg string, keysAndValues ...interface{}) {
+	l.log(log.LevelInfo, slog.LevelInfo, msg, keysAndValues)
+}
+
+// Warnw logs a message with fields at slog.LevelWarn.
+func (l *Logger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.log(log.LevelWarn, slog.LevelWarn, msg, keysAndValues)
+}
+
+// Errorw logs a message with fields at slog.LevelError.
+func (l *Logger) Errorw(msg string, keysAndValues ...interface{}) {
+	l.log(log.LevelError, slog.LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) log(lvl int, slogLevel slog.Level, msg string, keysAndValues []interface{}) {
+	if lvl < l.level {
+		return
+	}
+	// copy the fields before converting the values, the caller's slice may be reused
+	fields := make([]interface{}, len(keysAndValues))
+	copy(fields, keysAndValues)
+	for i := 0; i+1 < len(fields); i += 2 {
+		// error and fmt.Stringer values such as net.Addr are logged as strings
+		switch v := fields[i+1].(type) {
+		case error:
+			fields[i+1] = v.Error()
+		case interface{ String() string }:
+			fields[i+1] = v.String()
+		}
+	}
+	l.logger.Log(context.Background(), slogLevel, msg, fields...)
+}
+
+// New creates a Logger with l, slog.Default() is used if l is nil.
+func New(l *slog.Logger) *Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &Logger{logger: l, level: log.LevelInfo}
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package slogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/internal/log"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	defer arpc.SetLogger(log.DefaultLogger)
+	arpc.SetStructuredLogger(New(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8888}
+	log.Errorw("Disconnected", "remote_addr", addr, "seq", 3, "error", errors.New("EOF"))
+	log.Debugw("filtered")
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v, log: %s", err, buf.Bytes())
+	}
+	want := map[string]interface{}{"level": "ERROR", "msg": "Disconnected", "remote_addr": "127.0.0.1:8888", "seq": float64(3), "error": "EOF"}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Fatalf("field %v = %v, want %v", k, fields[k], v)
+		}
+	}
+
+	// the fields of the caller are not modified
+	buf.Reset()
+	keysAndValues := []interface{}{"remote_addr", addr}
+	log.DefaultStructuredLogger.Errorw("Disconnected", keysAndValues...)
+	if keysAndValues[1] != addr {
+		t.Fatalf("keysAndValues[1] = %v, want %v", keysAndValues[1], addr)
+	}
+
+	buf.Reset()
+	log.Info("printf %v", "log")
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil || fields["msg"] != "printf log" {
+		t.Fatalf("printf log = %s, want msg: printf log", buf.Bytes())
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package prometheus implements arpc.Collector with Prometheus.
+//
+//	metrics := prometheus.NewCollector("arpc")
+//	promclient.MustRegister(metrics)
+//	client.SetMetrics(metrics)
+//	server.SetMetrics(metrics)
+package prometheus
+
+import (
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ arpc.Collector = (*Collector)(nil)
+
+// Collector implements both arpc.Collector and prometheus.Collector.
+type Collector struct {
+	calls          *prometheus.CounterVec
+	errors         *prometheus.CounterVec
+	inflight       *prometheus.GaugeVec
+	latency        *prometheus.HistogramVec
+	connections    prometheus.Gauge
+	activeHandlers *prometheus.GaugeVec
+}
+
+// IncCall implements arpc.Collector.
+func (c *Collector) IncCall(method string) {
+	c.calls.WithLabelValues(method).Inc()
+}
+
+// IncError implements arpc.Collector.
+func (c *Collector) IncError(method string) {
+	c.errors.WithLabelValues(method).Inc()
+}
+
+// AddInflight implements arpc.Collector.
+func (c *Collector) AddInflight(method string, delta int) {
+	c.inflight.WithLabelValues(method).Add(float64(delta))
+}
+
+// ObserveLatency implements arpc.Collector.
+func (c *Collector) ObserveLatency(method string, latency time.Duration) {
+	c.latency.WithLabelValues(method).Observe(latency.Seconds())
+}
+
+// AddConnections implements arpc.Collector.
+func (c *Collector) AddConnections(delta int) {
+	c.connections.Add(float64(delta))
+}
+
+// AddActiveHandlers implements arpc.Collector.
+func (c *Collector) AddActiveHandlers(method string, delta int) {
+	c.activeHandlers.WithLabelValues(method).Add(float64(delta))
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.calls.Describe(ch)
+	c.errors.Describe(ch)
+	c.inflight.Describe(ch)
+	c.latency.Describe(ch)
+	c.connections.Describe(ch)
+	c.activeHandlers.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.calls.Collect(ch)
+	c.errors.Collect(ch)
+	c.inflight.Collect(ch)
+	c.latency.Collect(ch)
+	c.connections.Collect(ch)
+	c.activeHandlers.Collect(ch)
+}
+
+// NewCollector creates a Collector, the metrics are named with namespace,
+// the latency histogram uses prometheus.DefBuckets.
+func NewCollector(namespace string) *Collector {
+	methodLabel := []string{"method"}
+	return &Collector{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "calls_total",
+			Help:      "Number of calls made by the clients.",
+		}, methodLabel),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "errors_total",
+			Help:      "Number of calls failed or responded with an error.",
+		}, methodLabel),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "inflight_calls",
+			Help:      "Number of calls waiting for the responses.",
+		}, methodLabel),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "call_latency_seconds",
+			Help:      "Latency of the calls.",
+			Buckets:   prometheus.DefBuckets,
+		}, methodLabel),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "connections",
+			Help:      "Number of connections of the servers.",
+		}),
+		activeHandlers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "active_handlers",
+			Help:      "Number of handlers running.",
+		}, methodLabel),
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package prometheus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCollector(t *testing.T) {
+	metrics := NewCollector("arpc")
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatalf("Registry.Register() error = %v", err)
+	}
+
+	addr := "localhost:15680"
+	svr := arpc.NewServer()
+	svr.SetMetrics(metrics)
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/fail", func(ctx *arpc.Context) {
+		ctx.Error("failed")
+	})
+	go svr.Run(addr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.SetMetrics(metrics)
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.Call("/fail", "hello", &rsp, time.Second); err == nil {
+		t.Fatalf("Client.Call() error = nil, want failed")
+	}
+
+	if n := testutil.ToFloat64(metrics.calls.WithLabelValues("/echo")); n != 1 {
+		t.Fatalf("calls_total{method=/echo} = %v, want 1", n)
+	}
+	if n := testutil.ToFloat64(metrics.errors.WithLabelValues("/echo")); n != 0 {
+		t.Fatalf("errors_total{method=/echo} = %v, want 0", n)
+	}
+	if n := testutil.ToFloat64(metrics.errors.WithLabelValues("/fail")); n != 1 {
+		t.Fatalf("errors_total{method=/fail} = %v, want 1", n)
+	}
+	if n := testutil.ToFloat64(metrics.inflight.WithLabelValues("/echo")); n != 0 {
+		t.Fatalf("inflight_calls{method=/echo} = %v, want 0", n)
+	}
+	if n := testutil.ToFloat64(metrics.connections); n != 1 {
+		t.Fatalf("connections = %v, want 1", n)
+	}
+	if n := testutil.ToFloat64(metrics.activeHandlers.WithLabelValues("/echo")); n != 0 {
+		t.Fatalf("active_handlers{method=/echo} = %v, want 0", n)
+	}
+	m := &dto.Metric{}
+	if err = metrics.latency.WithLabelValues("/echo").(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("Histogram.Write() error = %v", err)
+	}
+	if n := m.GetHistogram().GetSampleCount(); n != 1 {
+		t.Fatalf("call_latency_seconds{method=/echo} count = %v, want 1", n)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Registry.Gather() error = %v", err)
+	}
+	if len(families) != 6 {
+		t.Fatalf("Registry.Gather() got %v metric families, want 6", len(families))
+	}
+}
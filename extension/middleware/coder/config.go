@@ -3,6 +3,8 @@ package coder
 const (
 	// FlagBitTracer .
 	FlagBitTracer = 0
+	// FlagBitCompress is set for the body compressed by the CompressCodec of extension/codec/compress.
+	FlagBitCompress = 6
 	// FlagBitGZip .
 	FlagBitGZip = 7
 )
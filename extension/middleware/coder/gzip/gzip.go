@@ -9,9 +9,12 @@ import (
 	"github.com/lesismal/arpc/extension/middleware/coder"
 )
 
-func gzipCompress(data []byte) []byte {
+func gzipCompress(data []byte, level int) []byte {
 	var in bytes.Buffer
-	w := gzip.NewWriter(&in)
+	w, err := gzip.NewWriterLevel(&in, level)
+	if err != nil {
+		w = gzip.NewWriter(&in)
+	}
 	w.Write(data)
 	w.Close()
 	return in.Bytes()
@@ -34,12 +37,13 @@ func gzipUnCompress(data []byte) ([]byte, error) {
 // Gzip represents a gzip coding middleware.
 type Gzip struct {
 	critical int
+	level    int
 }
 
 // Encode implements arpc MessageCoder.
 func (c *Gzip) Encode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
 	if len(msg.Buffer) > c.critical && !msg.IsFlagBitSet(coder.FlagBitGZip) {
-		buf := gzipCompress(msg.Buffer[arpc.HeaderIndexReserved+1:])
+		buf := gzipCompress(msg.Buffer[arpc.HeaderIndexReserved+1:], c.level)
 		total := len(buf) + arpc.HeaderIndexReserved + 1
 		if total < len(msg.Buffer) {
 			copy(msg.Buffer[arpc.HeaderIndexReserved+1:], buf)
@@ -66,5 +70,10 @@ func (c *Gzip) Decode(client *arpc.Client, msg *arpc.Message) *arpc.Message {
 
 // New returns the gzip coding middleware.
 func New() *Gzip {
-	return &Gzip{critical: 1024}
+	return &Gzip{critical: 1024, level: gzip.DefaultCompression}
+}
+
+// NewWithConfig returns the gzip coding middleware which compresses the messages longer than critical with level.
+func NewWithConfig(level int, critical int) *Gzip {
+	return &Gzip{critical: critical, level: level}
 }
@@ -0,0 +1,79 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package kcp runs arpc over KCP sessions.
+//
+// A KCP session may return an arpc message in several reads or several messages in one read,
+// arpc.Handler.Recv reads the head and body with io.ReadFull, so the frames are reassembled
+// the same as TCP. The sessions are switched to stream mode to pack the batched writes into
+// as few segments as possible.
+//
+// UDP has no FIN or RST, a Client doesn't know that the peer is gone until a read times out,
+// use NewHandler to set the read deadline and arpc.Client.EnableKeepalive to keep the idle
+// sessions alive, then the Client reconnects by its Dialer as it does with TCP.
+package kcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/lesismal/arpc"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// DefaultReadTimeout is used by NewHandler if readTimeout <= 0.
+var DefaultReadTimeout = time.Second * 30
+
+// Listener wraps kcp.Listener to net.Listener
+type Listener struct {
+	*kcp.Listener
+}
+
+// Accept waits for and returns the next session to the listener.
+func (ln *Listener) Accept() (net.Conn, error) {
+	sess, err := ln.Listener.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	setupSession(sess)
+	return sess, nil
+}
+
+// Listen wraps kcp listen
+func Listen(addr string, block kcp.BlockCrypt, dataShards, parityShards int) (net.Listener, error) {
+	ln, err := kcp.ListenWithOptions(addr, block, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln}, nil
+}
+
+// Dial wraps kcp dial
+func Dial(addr string, block kcp.BlockCrypt, dataShards, parityShards int) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, block, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	setupSession(sess)
+	return sess, nil
+}
+
+// NewHandler returns an arpc.Handler which sets the read deadline before every Recv,
+// a session without any message for readTimeout is closed, and the Client reconnects if it has a Dialer.
+func NewHandler(readTimeout time.Duration) arpc.Handler {
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	h := arpc.NewHandler()
+	h.BeforeRecv(func(conn net.Conn) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+	return h
+}
+
+func setupSession(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetNoDelay(1, 10, 2, 1)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package kcp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
+)
+
+func TestCall(t *testing.T) {
+	addr := "localhost:15679"
+	ln, err := Listen(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	svr := arpc.NewServer()
+	svr.Handler = NewHandler(time.Second * 5)
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := arpc.NewClient(func() (net.Conn, error) {
+		return Dial(addr, nil, 0, 0)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", rsp, err)
+	}
+
+	// the message larger than a KCP segment is read in several reads
+	large := strings.Repeat("hello", 1024*10)
+	if err = c.Call("/echo", large, &rsp, time.Second*5); err != nil || rsp != large {
+		t.Fatalf("Client.Call() = %v bytes, %v, want %v bytes, nil", len(rsp), err, len(large))
+	}
+
+	// the batched messages are read in one read
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp := ""
+			if err := c.Call("/echo", "hello", &rsp, time.Second*5); err != nil || rsp != "hello" {
+				t.Errorf("Client.Call() = %v, %v, want hello, nil", rsp, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lesismal/arpc"
 )
 
 var (
@@ -49,6 +50,12 @@ func (ln *Listener) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServeHTTP implements http.Handler, it upgrades the request and passes the connection to Accept,
+// so the Listener can be registered by http.Handle and served by arpc.Server.Serve.
+func (ln *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ln.Handler(w, r)
+}
+
 // Close .
 func (ln *Listener) Close() error {
 	close(ln.acceptQueue)
@@ -154,3 +161,11 @@ func Dial(url string) (net.Conn, error) {
 	}
 	return &Conn{Conn: c}, nil
 }
+
+// NewClient creates an arpc.Client connected to the websocket server at url,
+// every arpc message is sent as a websocket binary message.
+func NewClient(url string) (*arpc.Client, error) {
+	return arpc.NewClient(func() (net.Conn, error) {
+		return Dial(url)
+	})
+}
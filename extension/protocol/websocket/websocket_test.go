@@ -8,11 +8,14 @@ import (
 	"log"
 	"net/http"
 	"testing"
+	"time"
+
+	"github.com/lesismal/arpc"
 )
 
 func TestAll(t *testing.T) {
-	ln, _ := NewListener(":8888", nil)
-	http.HandleFunc("/ws", ln.(*Listener).Handler)
+	ln, _ := Listen(":8888", nil)
+	http.Handle("/ws", ln.(*Listener))
 	go func() {
 		err := http.ListenAndServe(":8888", nil)
 		if err != nil {
@@ -52,3 +55,32 @@ func TestAll(t *testing.T) {
 		t.Fatalf("failed to listen: %v", err)
 	}
 }
+
+func TestClient(t *testing.T) {
+	ln, _ := Listen(":8889", nil)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", ln.(*Listener))
+	go http.ListenAndServe(":8889", mux)
+
+	svr := arpc.NewServer()
+	svr.Handler.Handle("/echo", func(ctx *arpc.Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	client, err := NewClient("ws://localhost:8889/ws")
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer client.Stop()
+
+	rsp := ""
+	if err = client.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "hello" {
+		t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+	}
+}
@@ -20,9 +20,17 @@ type Client struct {
 
 	Password string
 
+	// Compression advertises that the Client accepts the compressed topics when subscribing,
+	// see Server.SetTopicCompression. The Client inflates them before calling the handlers anyway.
+	Compression bool
+
 	psmux sync.Mutex
 
 	topicHandlerMap map[string]TopicHandler
+	// patternHandlerMap saves the handlers of wildcard subscriptions
+	patternHandlerMap map[string]TopicHandler
+	// groupMap saves the group names of the shared subscriptions
+	groupMap map[string]string
 
 	onPublishHandler TopicHandler
 }
@@ -34,19 +42,47 @@ func (c *Client) Authenticate() error {
 	}
 	err := c.Call(routeAuthenticate, c.Password, nil, time.Second*5)
 	if err == nil {
-		log.Info("%v [Authenticate] success from\t%v", c.Handler.LogTag(), c.Conn.RemoteAddr())
+		log.Infow("[Authenticate] success", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr())
 	} else {
-		log.Error("%v [Authenticate] failed: %v, from\t%v", c.Handler.LogTag(), err, c.Conn.RemoteAddr())
+		log.Errorw("[Authenticate] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "error", err)
 	}
 	return err
 }
 
+// AuthenticateWith sets Password and authenticates, the Password is also used to authenticate
+// again after the Client reconnected.
+func (c *Client) AuthenticateWith(password string) error {
+	c.Password = password
+	return c.Authenticate()
+}
+
 // Subscribe .
+// topicName could be a pattern with wildcards, '+' matches exactly one level and '#' matches any number of levels at the end,
+// e.g. "sensors/+/temp" or "sensors/#".
 func (c *Client) Subscribe(topicName string, h TopicHandler, timeout time.Duration) error {
-	topic, err := newTopic(topicName, nil)
+	return c.subscribe(topicName, "", h, timeout)
+}
+
+// SubscribeGroup subscribes topicName as a member of the shared subscription group,
+// every topic published is pushed to only one member of the group in turn, while the other
+// subscribers of topicName still receive it.
+// Subscribing the same topicName again, with Subscribe or another group, leaves the group.
+func (c *Client) SubscribeGroup(topicName string, group string, h TopicHandler, timeout time.Duration) error {
+	if group == "" {
+		return ErrInvalidGroupEmpty
+	}
+	return c.subscribe(topicName, group, h, timeout)
+}
+
+func (c *Client) subscribe(topicName string, group string, h TopicHandler, timeout time.Duration) error {
+	topic, err := newTopic(topicName, []byte(group))
 	if err != nil {
 		return err
 	}
+	if err = checkPattern(topicName); err != nil {
+		return err
+	}
+	topic.Compressed = c.Compression
 	bs, err := topic.toBytes()
 	if err != nil {
 		return err
@@ -56,21 +92,48 @@ func (c *Client) Subscribe(topicName string, h TopicHandler, timeout time.Durati
 	// if _, ok := c.topicHandlerMap[topicName]; ok {
 	// 	panic(fmt.Errorf("handler exist for topic [%v]", topicName))
 	// }
-	c.topicHandlerMap[topicName] = h
+	c.handlerMap(topicName)[topicName] = h
+	prevGroup, hadGroup := c.groupMap[topicName]
+	if group != "" {
+		c.groupMap[topicName] = group
+	} else {
+		delete(c.groupMap, topicName)
+	}
 	c.psmux.Unlock()
 
-	err = c.Call(routeSubscribe, bs, nil, timeout)
+	err = c.Call(subscribeRoute(group), bs, nil, timeout)
 	if err == nil {
-		log.Info("%v [Subscribe] [topic: '%v'] success from\t%v", c.Handler.LogTag(), topicName, c.Conn.RemoteAddr())
+		log.Infow("[Subscribe] success", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName)
 	} else {
 		c.psmux.Lock()
-		delete(c.topicHandlerMap, topicName)
+		delete(c.handlerMap(topicName), topicName)
+		if hadGroup {
+			c.groupMap[topicName] = prevGroup
+		} else {
+			delete(c.groupMap, topicName)
+		}
 		c.psmux.Unlock()
-		log.Error("%v [Subscribe] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
+		log.Errorw("[Subscribe] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "error", err)
 	}
 	return err
 }
 
+// subscribeRoute returns the route to subscribe with group.
+func subscribeRoute(group string) string {
+	if group != "" {
+		return routeSubscribeGroup
+	}
+	return routeSubscribe
+}
+
+// SubscribeFunc is the same as Subscribe, but onMessage is called with the name and data of the topic.
+// data is only valid until onMessage returns, it should be copied if it's held after that.
+func (c *Client) SubscribeFunc(topicName string, onMessage func(topic string, data []byte), timeout time.Duration) error {
+	return c.Subscribe(topicName, func(tp *Topic) {
+		onMessage(tp.Name, tp.Data)
+	}, timeout)
+}
+
 // Unsubscribe .
 func (c *Client) Unsubscribe(topicName string, timeout time.Duration) error {
 	topic, err := newTopic(topicName, nil)
@@ -84,21 +147,69 @@ func (c *Client) Unsubscribe(topicName string, timeout time.Duration) error {
 	err = c.Call(routeUnsubscribe, bs, nil, timeout)
 	if err == nil {
 		c.psmux.Lock()
-		delete(c.topicHandlerMap, topic.Name)
+		delete(c.handlerMap(topic.Name), topic.Name)
+		delete(c.groupMap, topic.Name)
+		c.psmux.Unlock()
+		log.Infow("[Unsubscribe] success", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName)
+	} else {
+		log.Errorw("[Unsubscribe] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "error", err)
+	}
+	return err
+}
+
+// UnsubscribeAll unsubscribes all the topics.
+func (c *Client) UnsubscribeAll(timeout time.Duration) error {
+	err := c.Call(routeUnsubscribeAll, nil, nil, timeout)
+	if err == nil {
+		c.psmux.Lock()
+		c.topicHandlerMap = map[string]TopicHandler{}
+		c.patternHandlerMap = map[string]TopicHandler{}
+		c.groupMap = map[string]string{}
 		c.psmux.Unlock()
-		log.Info("%v[Unsubscribe] [topic: '%v'] success from\t%v", c.Handler.LogTag(), topicName, c.Conn.RemoteAddr())
+		log.Infow("[UnsubscribeAll] success", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr())
 	} else {
-		log.Error("%v[Unsubscribe] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
+		log.Errorw("[UnsubscribeAll] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "error", err)
 	}
 	return err
 }
 
 // Publish .
 func (c *Client) Publish(topicName string, v interface{}, timeout time.Duration) error {
-	topic, err := newTopic(topicName, util.ValueToBytes(c.Codec, v))
+	return c.publish(topicName, v, false, QoS0, 0, timeout)
+}
+
+// PublishRetained publishes topic and the server keeps it for the clients subscribing later,
+// publishing an empty value clears the kept one.
+func (c *Client) PublishRetained(topicName string, v interface{}, timeout time.Duration) error {
+	return c.publish(topicName, v, true, QoS0, 0, timeout)
+}
+
+// PublishQoS publishes topic with the delivery guarantee qos,
+// it returns after the server received the topic rather than the subscribers.
+func (c *Client) PublishQoS(topicName string, v interface{}, qos QoS, timeout time.Duration) error {
+	return c.publish(topicName, v, false, qos, 0, timeout)
+}
+
+// PublishTTL publishes topic which the server drops instead of pushing it to the subscribers after ttl,
+// so a slow or recovering subscriber doesn't get a flood of stale topics.
+func (c *Client) PublishTTL(topicName string, v interface{}, ttl time.Duration, timeout time.Duration) error {
+	return c.publish(topicName, v, false, QoS0, ttl, timeout)
+}
+
+func (c *Client) publish(topicName string, v interface{}, retain bool, qos QoS, ttl time.Duration, timeout time.Duration) error {
+	if isPattern(topicName) {
+		return ErrInvalidTopicPattern
+	}
+	if qos > QoS1 {
+		return ErrInvalidQoS
+	}
+	topic, err := newTopic(topicName, util.ValueToBytes(c.GetCodec(), v))
 	if err != nil {
 		return err
 	}
+	topic.Retain = retain
+	topic.QoS = qos
+	topic.TTL = ttl
 	bs, err := topic.toBytes()
 	if err != nil {
 		return err
@@ -106,14 +217,39 @@ func (c *Client) Publish(topicName string, v interface{}, timeout time.Duration)
 
 	err = c.Call(routePublish, bs, nil, timeout)
 	if err != nil {
-		log.Error("%v [Publish] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
+		log.Errorw("[Publish] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "error", err)
 	}
 	return err
 }
 
+// PublishCount publishes topic and returns the number of the subscribers the server pushed it to.
+func (c *Client) PublishCount(topicName string, v interface{}, timeout time.Duration) (int, error) {
+	if isPattern(topicName) {
+		return 0, ErrInvalidTopicPattern
+	}
+	topic, err := newTopic(topicName, util.ValueToBytes(c.GetCodec(), v))
+	if err != nil {
+		return 0, err
+	}
+	bs, err := topic.toBytes()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = c.Call(routePublishCount, bs, &n, timeout)
+	if err != nil {
+		log.Errorw("[PublishCount] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "error", err)
+	}
+	return n, err
+}
+
 // PublishToOne .
 func (c *Client) PublishToOne(topicName string, v interface{}, timeout time.Duration) error {
-	topic, err := newTopic(topicName, util.ValueToBytes(c.Codec, v))
+	if isPattern(topicName) {
+		return ErrInvalidTopicPattern
+	}
+	topic, err := newTopic(topicName, util.ValueToBytes(c.GetCodec(), v))
 	if err != nil {
 		return err
 	}
@@ -124,7 +260,7 @@ func (c *Client) PublishToOne(topicName string, v interface{}, timeout time.Dura
 
 	err = c.Call(routePublishToOne, bs, nil, timeout)
 	if err != nil {
-		log.Error("%v [PublishToOne] [topic: '%v'] failed: %v, from\t%v", c.Handler.LogTag(), topicName, err, c.Conn.RemoteAddr())
+		log.Errorw("[PublishToOne] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "error", err)
 	}
 	return err
 }
@@ -142,20 +278,37 @@ func (c *Client) OnPublish(h TopicHandler) {
 // 	return !ok
 // }
 
+// handlerMap returns the map which saves the handler of topicName.
+func (c *Client) handlerMap(topicName string) map[string]TopicHandler {
+	if isPattern(topicName) {
+		return c.patternHandlerMap
+	}
+	return c.topicHandlerMap
+}
+
 func (c *Client) initTopics() {
 	c.psmux.Lock()
+	names := make([]string, 0, len(c.topicHandlerMap)+len(c.patternHandlerMap))
 	for name := range c.topicHandlerMap {
+		names = append(names, name)
+	}
+	for name := range c.patternHandlerMap {
+		names = append(names, name)
+	}
+	for _, name := range names {
 		topicName := name
+		group := c.groupMap[topicName]
 		go util.Safe(func() {
 			for i := 0; i < 10; i++ {
-				topic, _ := newTopic(topicName, util.ValueToBytes(c.Codec, nil))
+				topic, _ := newTopic(topicName, []byte(group))
+				topic.Compressed = c.Compression
 				bs, _ := topic.toBytes()
-				err := c.Call(routeSubscribe, bs, nil, time.Second*10)
+				err := c.Call(subscribeRoute(group), bs, nil, time.Second*10)
 				if err == nil {
-					log.Info("%v [Subscribe] [topic: '%v'] success from\t%v", c.Handler.LogTag(), topicName, c.Conn.RemoteAddr())
+					log.Infow("[Subscribe] success", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName)
 					break
 				} else {
-					log.Error("%v [Subscribe] [topic: '%v'] %v times failed: %v, from\t%v", c.Handler.LogTag(), topicName, i+1, err, c.Conn.RemoteAddr())
+					log.Errorw("[Subscribe] failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topicName, "attempt", i+1, "error", err)
 				}
 				time.Sleep(time.Second)
 			}
@@ -170,12 +323,15 @@ func (c *Client) onPublish(ctx *arpc.Context) {
 	topic := &Topic{}
 	msg := ctx.Message
 	if msg.IsError() {
-		log.Error("%v [Publish IN] failed [%v], to\t%v", c.Handler.LogTag(), msg.Error(), ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Publish IN] failed", "tag", c.Handler.LogTag(), "remote_addr", ctx.Client.Conn.RemoteAddr(), "error", msg.Error())
 		return
 	}
 	err := topic.fromBytes(ctx.Body())
+	if err == nil && topic.Compressed {
+		err = topic.inflate()
+	}
 	if err != nil {
-		log.Error("%v [Publish IN] failed [%v], to\t%v", c.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Publish IN] failed", "tag", c.Handler.LogTag(), "remote_addr", ctx.Client.Conn.RemoteAddr(), "error", err)
 		return
 	}
 
@@ -183,13 +339,21 @@ func (c *Client) onPublish(ctx *arpc.Context) {
 		c.psmux.Lock()
 		if h, ok := c.topicHandlerMap[topic.Name]; ok {
 			h(topic)
-			c.psmux.Unlock()
-		} else {
-			c.psmux.Unlock()
 		}
+		for pattern, h := range c.patternHandlerMap {
+			if matchTopic(pattern, topic.Name) {
+				h(topic)
+			}
+		}
+		c.psmux.Unlock()
 	} else {
 		c.onPublishHandler(topic)
 	}
+
+	// the topic of QoS1 is sent as a request, acknowledge it after the handlers returned
+	if msg.Cmd() == arpc.CmdRequest {
+		ctx.Write(nil)
+	}
 }
 
 // NewClient .
@@ -200,15 +364,19 @@ func NewClient(dialer func() (net.Conn, error)) (*Client, error) {
 	}
 	c.Handler.SetLogTag("[APS CLI]")
 	cli := &Client{
-		Client:          c,
-		topicHandlerMap: map[string]TopicHandler{},
+		Client:            c,
+		topicHandlerMap:   map[string]TopicHandler{},
+		patternHandlerMap: map[string]TopicHandler{},
+		groupMap:          map[string]string{},
 	}
 	cli.Handler = cli.Handler.Clone()
 	cli.Handler.Handle(routePublish, cli.onPublish)
+	// authenticate before the topics are subscribed again after reconnected
+	cli.SetOnConnectHandshake(func(*arpc.Client) error {
+		return cli.Authenticate()
+	})
 	cli.Handler.HandleConnected(func(c *arpc.Client) {
-		if cli.Authenticate() == nil {
-			cli.initTopics()
-		}
+		cli.initTopics()
 	})
 	return cli, nil
 }
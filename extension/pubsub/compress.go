@@ -0,0 +1,91 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/lesismal/arpc"
+	"github.com/lesismal/arpc/internal/util"
+)
+
+// SetTopicCompression sets whether the data of topic is compressed before pushed to the subscribers,
+// the data is compressed once for all the subscribers which accept the compressed topics,
+// see Client.Compression, and the others still receive the data as it is.
+// It's not used for wildcard patterns, topic should be the exact name published to.
+func (s *Server) SetTopicCompression(topic string, enabled bool) {
+	s.psmux.Lock()
+	if enabled {
+		s.compression[topic] = util.Empty{}
+	} else {
+		delete(s.compression, topic)
+	}
+	s.psmux.Unlock()
+}
+
+// compress makes the compressed copy of topic if the compression of its name is enabled,
+// the copy is not made if the compressed data is not shorter.
+func (s *Server) compress(topic *Topic) {
+	s.psmux.RLock()
+	_, ok := s.compression[topic.Name]
+	s.psmux.RUnlock()
+	if !ok || topic.Compressed || len(topic.Data) == 0 {
+		return
+	}
+
+	data := gzipCompress(topic.Data)
+	if len(data) >= len(topic.Data) {
+		return
+	}
+	cp := &Topic{
+		Name:       topic.Name,
+		Data:       data,
+		Timestamp:  topic.Timestamp,
+		Retain:     topic.Retain,
+		QoS:        topic.QoS,
+		ID:         topic.ID,
+		TTL:        topic.TTL,
+		Compressed: true,
+		expireAt:   topic.expireAt,
+	}
+	if _, err := cp.toBytes(); err != nil {
+		return
+	}
+	topic.compressed = cp
+	topic.compressedMsg = s.newTopicMessage(cp)
+}
+
+// acceptsCompression returns true if c advertised that it accepts the compressed topics.
+func acceptsCompression(c *arpc.Client) bool {
+	cts, ok := c.UserData.(*clientTopics)
+	return ok && atomic.LoadInt32(&cts.compression) == 1
+}
+
+// inflate decompresses the data of the topic.
+func (tp *Topic) inflate() error {
+	r, err := gzip.NewReader(bytes.NewReader(tp.Data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tp.Data = data
+	tp.Compressed = false
+	return nil
+}
+
+func gzipCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
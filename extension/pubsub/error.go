@@ -18,4 +18,16 @@ var (
 
 	// ErrInvalidTopicNameLength .
 	ErrInvalidTopicNameLength = errors.New("invalid topic name length, should not be more than 1024")
+
+	// ErrInvalidGroupEmpty .
+	ErrInvalidGroupEmpty = errors.New("invalid group, should not be \"\"")
+
+	// ErrTopicForbidden .
+	ErrTopicForbidden = errors.New("topic forbidden")
+
+	// ErrInvalidQoS .
+	ErrInvalidQoS = errors.New("invalid qos, should be QoS0 or QoS1")
+
+	// ErrInvalidTopicPattern .
+	ErrInvalidTopicPattern = errors.New("invalid topic pattern, wildcards should occupy a whole level, '#' should be the last level and publishing to a pattern is not allowed")
 )
@@ -7,9 +7,12 @@ package pubsub
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/lesismal/arpc"
 	"github.com/lesismal/arpc/internal/log"
 )
 
@@ -86,3 +89,856 @@ func producer(c *Client, topicName string, chDone chan int) {
 		}
 	}
 }
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		topicName string
+		want      bool
+	}{
+		{"sensors/+/temp", "sensors/a/temp", true},
+		{"sensors/+/temp", "sensors/a/b/temp", false},
+		{"sensors/+/temp", "sensors/a/humidity", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/a/b", true},
+		{"sensors/#", "other/a", false},
+		{"#", "sensors/a", true},
+		{"sensors/a", "sensors/a", true},
+		{"sensors/a", "sensors/b", false},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.topicName); got != tt.want {
+			t.Fatalf("matchTopic(%v, %v) = %v, want %v", tt.pattern, tt.topicName, got, tt.want)
+		}
+		var trie topicTrie
+		agent := trie.getOrMake(tt.pattern)
+		matched := trie.match(strings.Split(tt.topicName, TopicSeparator), nil)
+		if got := len(matched) == 1 && matched[0] == agent; isPattern(tt.pattern) && got != tt.want {
+			t.Fatalf("topicTrie.match(%v, %v) = %v, want %v", tt.pattern, tt.topicName, got, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{"sensors/#/temp", "sensors/a+/temp", "sensors/#a"} {
+		if err := checkPattern(pattern); err != ErrInvalidTopicPattern {
+			t.Fatalf("checkPattern(%v) = %v, want %v", pattern, err, ErrInvalidTopicPattern)
+		}
+	}
+}
+
+func TestPubSubWildcard(t *testing.T) {
+	var (
+		address  = "localhost:8889"
+		password = "123qwe"
+		chTopic  = make(chan string, 10)
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	consumer := newClient(t, address, password)
+	defer consumer.Stop()
+	for _, pattern := range []string{"sensors/+/temp", "sensors/#"} {
+		err := consumer.Subscribe(pattern, func(topic *Topic) {
+			chTopic <- topic.Name
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	if err := producer.Publish("sensors/+/temp", "data", time.Second); err != ErrInvalidTopicPattern {
+		t.Fatalf("Client.Publish() error = %v, want %v", err, ErrInvalidTopicPattern)
+	}
+	for _, topicName := range []string{"sensors/a/temp", "other/a/temp"} {
+		if err := producer.Publish(topicName, "data", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the consumer receives the topic once from the server and calls both of the matched handlers
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-chTopic:
+			if name != "sensors/a/temp" {
+				t.Fatalf("received topic %v, want %v", name, "sensors/a/temp")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("topic not received")
+		}
+	}
+	select {
+	case name := <-chTopic:
+		t.Fatalf("received unexpected topic %v", name)
+	case <-time.After(time.Second / 10):
+	}
+}
+
+func TestPubSubRetained(t *testing.T) {
+	var (
+		address   = "localhost:8890"
+		password  = "123qwe"
+		topicName = "retained"
+		chTopic   = make(chan *Topic, 10)
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	if err := producer.PublishRetained(topicName, "first", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.PublishRetained(topicName, "last", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := newClient(t, address, password)
+	defer consumer.Stop()
+	err := consumer.Subscribe(topicName, func(topic *Topic) {
+		chTopic <- topic
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-chTopic:
+		if string(topic.Data) != "last" || !topic.Retain {
+			t.Fatalf("received retained topic %v, %v, want %v, %v", string(topic.Data), topic.Retain, "last", true)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("retained topic not received")
+	}
+
+	if err = producer.PublishRetained(topicName, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	<-chTopic
+	if err = s.PublishRetained(topicName, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-chTopic
+	s.psmux.RLock()
+	_, ok := s.retained[topicName]
+	s.psmux.RUnlock()
+	if ok {
+		t.Fatalf("retained topic not cleared")
+	}
+}
+
+func TestServerTopics(t *testing.T) {
+	var (
+		address     = "localhost:8891"
+		password    = "123qwe"
+		chConnected = make(chan *arpc.Client, 1)
+	)
+
+	s := NewServer()
+	s.Password = password
+	s.Handler.HandleConnected(func(c *arpc.Client) {
+		chConnected <- c
+	})
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	if topics := s.ClientTopics(&arpc.Client{}); topics != nil {
+		t.Fatalf("Server.ClientTopics() = %v, want nil", topics)
+	}
+
+	client := newClient(t, address, password)
+	defer client.Stop()
+	for _, topicName := range []string{"a", "b/#"} {
+		if err := client.Subscribe(topicName, func(topic *Topic) {}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topics := s.Topics()
+	sort.Strings(topics)
+	if fmt.Sprint(topics) != fmt.Sprint([]string{"a", "b/#"}) {
+		t.Fatalf("Server.Topics() = %v, want %v", topics, []string{"a", "b/#"})
+	}
+	for _, topicName := range []string{"a", "b/#"} {
+		if n := s.SubscriberCount(topicName); n != 1 {
+			t.Fatalf("Server.SubscriberCount(%v) = %v, want %v", topicName, n, 1)
+		}
+	}
+	if n := s.SubscriberCount("c"); n != 0 {
+		t.Fatalf("Server.SubscriberCount(%v) = %v, want %v", "c", n, 0)
+	}
+
+	cli := <-chConnected
+	topics = s.ClientTopics(cli)
+	sort.Strings(topics)
+	if fmt.Sprint(topics) != fmt.Sprint([]string{"a", "b/#"}) {
+		t.Fatalf("Server.ClientTopics() = %v, want %v", topics, []string{"a", "b/#"})
+	}
+
+	for topicName, want := range map[string]int{"a": 1, "b/c": 1, "c": 0} {
+		n, err := client.PublishCount(topicName, "data", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("Client.PublishCount(%v) = %v, want %v", topicName, n, want)
+		}
+	}
+
+	if err := client.UnsubscribeAll(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if topics = s.ClientTopics(cli); len(topics) != 0 {
+		t.Fatalf("Server.ClientTopics() = %v, want []", topics)
+	}
+	for _, topicName := range []string{"a", "b/#"} {
+		if n := s.SubscriberCount(topicName); n != 0 {
+			t.Fatalf("Server.SubscriberCount(%v) = %v, want %v", topicName, n, 0)
+		}
+	}
+}
+
+func TestServerTopicACL(t *testing.T) {
+	var (
+		address  = "localhost:8892"
+		password = "123qwe"
+	)
+
+	s := NewServer()
+	s.Password = password
+	s.SetTopicACL(func(client *arpc.Client, topic string, op Operation) bool {
+		return op == OpSubscribe || topic != "readonly"
+	})
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, password)
+	defer client.Stop()
+	if err := client.Subscribe("readonly", func(topic *Topic) {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("readonly", "data", time.Second); err == nil || err.Error() != ErrTopicForbidden.Error() {
+		t.Fatalf("Client.Publish() error = %v, want %v", err, ErrTopicForbidden)
+	}
+	if err := client.PublishToOne("readonly", "data", time.Second); err == nil || err.Error() != ErrTopicForbidden.Error() {
+		t.Fatalf("Client.PublishToOne() error = %v, want %v", err, ErrTopicForbidden)
+	}
+	if err := client.Publish("writable", "data", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientResubscribe(t *testing.T) {
+	var (
+		address   = "localhost:8893"
+		password  = "123qwe"
+		topicName = "resubscribe"
+		chData    = make(chan string, 10)
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	consumer, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second*3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop()
+	if err = consumer.AuthenticateWith(password); err != nil {
+		t.Fatal(err)
+	}
+	err = consumer.SubscribeFunc(topicName, func(topic string, data []byte) {
+		chData <- topic + ":" + string(data)
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	if err = producer.Publish(topicName, "before", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-chData; data != "resubscribe:before" {
+		t.Fatalf("received %v, want resubscribe:before", data)
+	}
+
+	// the consumer reconnects, authenticates and subscribes again
+	consumer.Conn.Close()
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Second / 10)
+		if n, _ := producer.PublishCount(topicName, "after", time.Second); n > 0 {
+			break
+		}
+	}
+	select {
+	case data := <-chData:
+		if data != "resubscribe:after" {
+			t.Fatalf("received %v, want resubscribe:after", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("topic not received after reconnected")
+	}
+}
+
+func TestPubSubQoS1(t *testing.T) {
+	var (
+		address   = "localhost:8894"
+		password  = "123qwe"
+		topicName = "qos"
+		chTopic   = make(chan *Topic, 10)
+	)
+
+	s := NewServer()
+	s.Password = password
+	s.QoSAckTimeout = time.Second / 10
+	s.QoSMaxRetries = 2
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	consumer := newClient(t, address, password)
+	defer consumer.Stop()
+	err := consumer.Subscribe(topicName, func(topic *Topic) {
+		chTopic <- topic
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	if err = producer.PublishQoS(topicName, "hello", QoS1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-chTopic:
+		if string(topic.Data) != "hello" || topic.QoS != QoS1 || topic.ID == 0 {
+			t.Fatalf("received topic %v, %v, %v, want hello, QoS1 and an ID", string(topic.Data), topic.QoS, topic.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("topic of QoS1 not received")
+	}
+	// acknowledged, not sent again
+	select {
+	case topic := <-chTopic:
+		t.Fatalf("topic %v sent again after acknowledged", topic.ID)
+	case <-time.After(time.Second / 2):
+	}
+
+	// a subscriber which never acknowledges is stopped after the retries
+	dead, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Stop()
+	chDeadTopic := make(chan uint64, 10)
+	dead.Handler.Handle(routePublish, func(ctx *arpc.Context) {
+		topic := &Topic{}
+		if topic.fromBytes(ctx.Body()) == nil {
+			chDeadTopic <- topic.ID
+		}
+	})
+	if err = dead.Call(routeAuthenticate, password, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := newTopic(topicName, nil)
+	bs, _ := sub.toBytes()
+	if err = dead.Call(routeSubscribe, bs, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PublishQoS(topicName, "world", QoS1); err != nil {
+		t.Fatal(err)
+	}
+	<-chTopic
+	time.Sleep(time.Second / 2)
+	if n := len(chDeadTopic); n != s.QoSMaxRetries+1 {
+		t.Fatalf("topic sent %v times to the subscriber not acknowledging, want %v", n, s.QoSMaxRetries+1)
+	}
+	id := <-chDeadTopic
+	for i := 0; i < s.QoSMaxRetries; i++ {
+		if retry := <-chDeadTopic; retry != id {
+			t.Fatalf("retried topic id = %v, want %v", retry, id)
+		}
+	}
+	if n := s.SubscriberCount(topicName); n != 1 {
+		t.Fatalf("SubscriberCount() = %v after the subscriber not acknowledging stopped, want 1", n)
+	}
+}
+
+func TestPubSubTTL(t *testing.T) {
+	var (
+		address   = "localhost:8895"
+		password  = "123qwe"
+		topicName = "ttl"
+		chTopic   = make(chan *Topic, 10)
+	)
+
+	topic, _ := newTopic(topicName, []byte("hello"))
+	topic.QoS = QoS1
+	topic.ID = 3
+	topic.TTL = time.Second
+	bs, err := topic.toBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Topic{}
+	if err = decoded.fromBytes(append([]byte{}, bs...)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != topicName || string(decoded.Data) != "hello" || decoded.QoS != QoS1 || decoded.ID != 3 || decoded.TTL != time.Second {
+		t.Fatalf("decoded topic %v, %v, %v, %v, %v, want %v, hello, QoS1, 3, 1s", decoded.Name, string(decoded.Data), decoded.QoS, decoded.ID, decoded.TTL, topicName)
+	}
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	consumer := newClient(t, address, password)
+	defer consumer.Stop()
+	err = consumer.Subscribe(topicName, func(topic *Topic) {
+		chTopic <- topic
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	// expired as soon as the server received it
+	if err = producer.PublishTTL(topicName, "stale", time.Nanosecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = producer.PublishTTL(topicName, "fresh", time.Second, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-chTopic:
+		if string(topic.Data) != "fresh" || topic.TTL != time.Second {
+			t.Fatalf("received topic %v, %v, want fresh, 1s", string(topic.Data), topic.TTL)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("topic with TTL not received")
+	}
+	select {
+	case topic := <-chTopic:
+		t.Fatalf("received topic %v, want nothing", string(topic.Data))
+	case <-time.After(time.Second / 10):
+	}
+}
+
+func TestPubSubGroup(t *testing.T) {
+	var (
+		address   = "localhost:8896"
+		password  = "123qwe"
+		topicName = "group"
+		group     = "workers"
+		count     = 10
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	chWorker := make(chan int, count*2)
+	for i := 0; i < 2; i++ {
+		worker := newClient(t, address, password)
+		defer worker.Stop()
+		id := i
+		err := worker.SubscribeGroup(topicName, group, func(topic *Topic) {
+			chWorker <- id
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	chFanout := make(chan *Topic, count)
+	subscriber := newClient(t, address, password)
+	defer subscriber.Stop()
+	err := subscriber.Subscribe(topicName, func(topic *Topic) {
+		chFanout <- topic
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.SubscriberCount(topicName); n != 3 {
+		t.Fatalf("SubscriberCount() = %v, want 3", n)
+	}
+
+	producer := newClient(t, address, password)
+	defer producer.Stop()
+	for i := 0; i < count; i++ {
+		n, err := producer.PublishCount(topicName, i, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("PublishCount() = %v, want 2", n)
+		}
+	}
+	time.Sleep(time.Second / 10)
+
+	if n := len(chFanout); n != count {
+		t.Fatalf("subscriber received %v topics, want %v", n, count)
+	}
+	if n := len(chWorker); n != count {
+		t.Fatalf("group received %v topics, want %v", n, count)
+	}
+	received := map[int]int{}
+	for i := 0; i < count; i++ {
+		received[<-chWorker]++
+	}
+	if received[0] != count/2 || received[1] != count/2 {
+		t.Fatalf("group members received %v and %v topics, want %v each", received[0], received[1], count/2)
+	}
+
+	if err = producer.SubscribeGroup(topicName, "", func(*Topic) {}, time.Second); err != ErrInvalidGroupEmpty {
+		t.Fatalf("SubscribeGroup() error = %v, want %v", err, ErrInvalidGroupEmpty)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	var (
+		address  = "localhost:8897"
+		password = "123qwe"
+		chTopic  = make(chan *Topic, 10)
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	c := newClient(t, address, password)
+	defer c.Stop()
+	for _, name := range []string{"stats/a", "stats/#"} {
+		err := c.Subscribe(name, func(topic *Topic) {
+			chTopic <- topic
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Publish("stats/a", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Publish("stats/b", 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		<-chTopic
+	}
+
+	stats := s.Stats()
+	if stats.Published != 4 || stats.Fanout != 4 || stats.Dropped != 0 {
+		t.Fatalf("Stats() = %+v, want 4 published, 4 fanout and 0 dropped", stats)
+	}
+	if ts := stats.Topics["stats/a"]; ts.Published != 3 || ts.Delivered != 3 {
+		t.Fatalf("Stats() of stats/a = %+v, want 3 published and 3 delivered", ts)
+	}
+	if ts := stats.Topics["stats/#"]; ts.Published != 0 || ts.Delivered != 1 {
+		t.Fatalf("Stats() of stats/# = %+v, want 0 published and 1 delivered", ts)
+	}
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	var (
+		address   = "localhost:8898"
+		password  = "123qwe"
+		topicName = "slow"
+		chBlock   = make(chan struct{})
+		data      = make([]byte, 1024*256)
+	)
+
+	s := NewServer()
+	s.Password = password
+	s.Handler.SetSendQueueSize(1)
+	s.SlowConsumerTimeout = time.Second / 10
+	s.SetSlowConsumerPolicy(PolicyDisconnect)
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	// the handler blocks the reading of the subscriber, so the send queue of it on the server gets full
+	slow := newClient(t, address, password)
+	defer slow.Stop()
+	defer close(chBlock)
+	err := slow.Subscribe(topicName, func(topic *Topic) {
+		<-chBlock
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the publishing never waits for the full send queue, the slow consumer is disconnected
+	// by a later publishing after the queue has stayed full for SlowConsumerTimeout
+	for i := 0; i < 100 && s.SubscriberCount(topicName) > 0; i++ {
+		begin := time.Now()
+		if err = s.Publish(topicName, data); err != nil {
+			t.Fatal(err)
+		}
+		if used := time.Since(begin); used >= s.SlowConsumerTimeout {
+			t.Fatalf("Publish() took %v, want not waiting for the slow consumer", used)
+		}
+		time.Sleep(time.Second / 100)
+	}
+	time.Sleep(time.Second / 10)
+	if n := s.SubscriberCount(topicName); n != 0 {
+		t.Fatalf("SubscriberCount() = %v, want the slow consumer disconnected", n)
+	}
+	if stats := s.Stats(); stats.Dropped == 0 {
+		t.Fatalf("Stats().Dropped = 0, want the topic failed to push to the slow consumer counted")
+	}
+}
+
+func TestPubSubCompression(t *testing.T) {
+	var (
+		address   = "localhost:8899"
+		password  = "123qwe"
+		topicName = "zip"
+		data      = strings.Repeat(`{"key":"value"}`, 100)
+	)
+
+	s := NewServer()
+	s.Password = password
+	s.SetTopicCompression(topicName, true)
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	// the topic is received as it's sent on the wire
+	raw, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Stop()
+	chRaw := make(chan *Topic, 1)
+	raw.Handler.Handle(routePublish, func(ctx *arpc.Context) {
+		topic := &Topic{}
+		if topic.fromBytes(append([]byte{}, ctx.Body()...)) == nil {
+			chRaw <- topic
+		}
+	})
+	if err = raw.Call(routeAuthenticate, password, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := newTopic(topicName, nil)
+	sub.Compressed = true
+	bs, _ := sub.toBytes()
+	if err = raw.Call(routeSubscribe, bs, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	chTopic := make(chan *Topic, 2)
+	for _, compression := range []bool{true, false} {
+		c := newClient(t, address, password)
+		defer c.Stop()
+		c.Compression = compression
+		err = c.Subscribe(topicName, func(topic *Topic) {
+			chTopic <- topic
+		}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = s.Publish(topicName, data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-chRaw:
+		if !topic.Compressed || len(topic.Data) >= len(data) {
+			t.Fatalf("received topic compressed %v, %v bytes, want compressed less than %v bytes", topic.Compressed, len(topic.Data), len(data))
+		}
+		if err = topic.inflate(); err != nil || string(topic.Data) != data {
+			t.Fatalf("inflated topic %v, %v, want %v", string(topic.Data), err, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("compressed topic not received")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case topic := <-chTopic:
+			if topic.Compressed || string(topic.Data) != data {
+				t.Fatalf("received topic compressed %v, %v, want %v", topic.Compressed, string(topic.Data), data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("topic not received")
+		}
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	var (
+		address = "localhost:8900"
+		tokens  = map[string]string{"token-a": "tenant-a", "token-b": "tenant-b"}
+	)
+
+	s := NewServer()
+	s.SetAuthenticator(func(credentials []byte) (interface{}, error) {
+		tenant, ok := tokens[string(credentials)]
+		if !ok {
+			return nil, ErrInvalidPassword
+		}
+		return tenant, nil
+	})
+	s.SetTopicACL(func(client *arpc.Client, topic string, op Operation) bool {
+		return strings.HasPrefix(topic, s.Identity(client).(string)+"/")
+	})
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	client := newClient(t, address, "token-a")
+	defer client.Stop()
+	if err := client.Subscribe("tenant-a/events", func(topic *Topic) {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Subscribe("tenant-b/events", func(topic *Topic) {}, time.Second); err == nil || err.Error() != ErrTopicForbidden.Error() {
+		t.Fatalf("Client.Subscribe() error = %v, want %v", err, ErrTopicForbidden)
+	}
+
+	client.Password = "token-c"
+	if err := client.Authenticate(); err == nil || err.Error() != ErrInvalidPassword.Error() {
+		t.Fatalf("Client.Authenticate() error = %v, want %v", err, ErrInvalidPassword)
+	}
+
+	// the routes of the Client which is not authenticated are aborted before their handlers
+	raw, err := arpc.NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Stop()
+	topic, _ := newTopic("tenant-a/events", []byte("data"))
+	bs, _ := topic.toBytes()
+	if err = raw.Call(routePublish, bs, nil, time.Second/10); err != arpc.ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, arpc.ErrClientTimeout)
+	}
+	if stats := s.Stats(); stats.Published != 0 {
+		t.Fatalf("Stats().Published = %v, want 0", stats.Published)
+	}
+}
+
+func TestServerTopicCleanup(t *testing.T) {
+	var (
+		address  = "localhost:8901"
+		password = "123qwe"
+	)
+
+	s := NewServer()
+	s.Password = password
+	go s.Run(address)
+	defer s.Stop()
+	time.Sleep(time.Second / 10)
+
+	hasTopic := func(name string) bool {
+		for _, topic := range s.Topics() {
+			if topic == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	c := newClient(t, address, password)
+	defer c.Stop()
+	if err := s.Publish("nobody", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if hasTopic("nobody") {
+		t.Fatalf("topic without subscribers kept after published")
+	}
+
+	if err := c.Subscribe("transient", func(topic *Topic) {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unsubscribe("transient", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if hasTopic("transient") {
+		t.Fatalf("topic kept after the last subscriber left")
+	}
+
+	// kept for the retained topic until it's cleared
+	if err := c.Subscribe("retained", func(topic *Topic) {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishRetained("retained", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unsubscribe("retained", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !hasTopic("retained") {
+		t.Fatalf("topic with a retained topic removed")
+	}
+	if err := s.PublishRetained("retained", ""); err != nil {
+		t.Fatal(err)
+	}
+	if hasTopic("retained") {
+		t.Fatalf("topic kept after the retained topic cleared")
+	}
+
+	// subscribing again after removed
+	chTopic := make(chan *Topic, 1)
+	if err := c.Subscribe("transient", func(topic *Topic) { chTopic <- topic }, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("transient", "data"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-chTopic:
+	case <-time.After(time.Second):
+		t.Fatalf("topic not received after subscribed again")
+	}
+}
+
+func TestTopicAgentRemoved(t *testing.T) {
+	s := NewServer()
+	c := &arpc.Client{}
+	tp := s.getOrMakeTopic("race")
+	// the cleanup wins the race, the subscriber is added to a new TopicAgent
+	s.removeTopicIfUnused(tp)
+	if tp.add(c, "") {
+		t.Fatalf("TopicAgent.add() = true after removed, want false")
+	}
+	got := s.subscribe(c, "race", tp, "")
+	if got == tp || got.Len() != 1 {
+		t.Fatalf("Server.subscribe() returned the removed TopicAgent or no subscriber added")
+	}
+	if cur, ok := s.getTopic("race"); !ok || cur != got {
+		t.Fatalf("Server.subscribe() returned a TopicAgent not saved by the Server")
+	}
+	s.removeTopicIfUnused(got)
+	if _, ok := s.getTopic("race"); !ok {
+		t.Fatalf("TopicAgent with a subscriber removed")
+	}
+}
@@ -5,9 +5,23 @@
 package pubsub
 
 const (
-	routeAuthenticate = "in_A"
-	routeSubscribe    = "in_S"
-	routeUnsubscribe  = "in_U"
-	routePublish      = "in_P"
-	routePublishToOne = "in_P1"
+	routeAuthenticate   = "in_A"
+	routeSubscribe      = "in_S"
+	routeSubscribeGroup = "in_SG"
+	routeUnsubscribe    = "in_U"
+	routeUnsubscribeAll = "in_UA"
+	routePublish        = "in_P"
+	routePublishCount   = "in_PC"
+	routePublishToOne   = "in_P1"
 )
+
+// authRouteNames names the routes which require the Client to be authenticated.
+var authRouteNames = map[string]string{
+	routeSubscribe:      "Subscribe",
+	routeSubscribeGroup: "Subscribe",
+	routeUnsubscribe:    "Unsubscribe",
+	routeUnsubscribeAll: "UnsubscribeAll",
+	routePublish:        "Publish",
+	routePublishCount:   "Publish",
+	routePublishToOne:   "PublishToOne",
+}
@@ -5,7 +5,10 @@
 package pubsub
 
 import (
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lesismal/arpc"
 	"github.com/lesismal/arpc/internal/log"
@@ -16,40 +19,147 @@ var (
 	addClient interface{} = true
 )
 
+const (
+	// DefaultQoSAckTimeout is the default Server.QoSAckTimeout.
+	DefaultQoSAckTimeout = time.Second * 5
+	// DefaultQoSMaxRetries is the default Server.QoSMaxRetries.
+	DefaultQoSMaxRetries = 3
+	// DefaultSlowConsumerTimeout is the default Server.SlowConsumerTimeout.
+	DefaultSlowConsumerTimeout = time.Second
+)
+
 type clientTopics struct {
 	mux         sync.RWMutex
 	topicAgents map[string]*TopicAgent
+	// compression is set to 1 if the client accepts the compressed topics
+	compression int32
+	// identity is returned by the authenticator
+	identity interface{}
+	// queueFullSince is the unix nano time when the send queue of the client was first found full
+	// with PolicyDisconnect, 0 if it's not full, and -1 after the client is disconnected
+	queueFullSince int64
 }
 
+// Operation represents the operation on a topic checked by the topic ACL.
+type Operation int
+
+const (
+	// OpSubscribe .
+	OpSubscribe Operation = iota
+	// OpPublish .
+	OpPublish
+)
+
+// SlowConsumerPolicy decides what the Server does when the send queue of a subscriber is full.
+type SlowConsumerPolicy int32
+
+const (
+	// PolicyDrop drops the topic for the subscriber whose send queue is full, the topic is
+	// pushed by Client.PushMsg with TimeZero. It's the default policy.
+	PolicyDrop SlowConsumerPolicy = iota
+	// PolicyDisconnect drops the topic like PolicyDrop without waiting, and stops the subscriber
+	// whose send queue has stayed full for SlowConsumerTimeout since it was first found full,
+	// which unsubscribes all the topics of it. The queue is checked when the topics are pushed to it.
+	PolicyDisconnect
+	// PolicyBlock waits until the send queue of the subscriber has room or the subscriber is stopped,
+	// the topic is pushed by Client.PushMsg with TimeForever, so a slow subscriber delays the
+	// publishing to all the other subscribers.
+	PolicyBlock
+)
+
 // Server .
 type Server struct {
 	*arpc.Server
 
 	Password string
 
+	// QoSAckTimeout is how long the Server waits for a subscriber to acknowledge a topic of QoS1
+	// before sending it again.
+	QoSAckTimeout time.Duration
+	// QoSMaxRetries is the max number of times a topic of QoS1 is sent again,
+	// the subscriber which doesn't acknowledge it after that is stopped.
+	QoSMaxRetries int
+
+	// SlowConsumerTimeout is how long the send queue of a subscriber could stay full
+	// before the subscriber is stopped with PolicyDisconnect.
+	SlowConsumerTimeout time.Duration
+
+	slowConsumerPolicy int32
+
+	qosID uint64
+	// the total numbers of the topics published, pushed to the subscribers and failed to push
+	published uint64
+	delivered uint64
+	dropped   uint64
+
 	psmux sync.RWMutex
 
 	topics map[string]*TopicAgent
 
+	// patterns saves the TopicAgents of wildcard subscriptions
+	patterns topicTrie
+
+	// retained saves the last retained Topic of every topic name
+	retained map[string]*Topic
+
+	// compression saves the names of the topics compressed before pushed to the subscribers
+	compression map[string]util.Empty
+
+	topicACL func(client *arpc.Client, topic string, op Operation) bool
+
+	authenticator func(credentials []byte) (identity interface{}, err error)
+
 	clients map[*arpc.Client]map[string]*TopicAgent
 }
 
 // Publish topic
 func (s *Server) Publish(topicName string, v interface{}) error {
+	return s.publishTopic(topicName, v, false, QoS0, 0)
+}
+
+// PublishRetained publishes topic and keeps it for the clients subscribing later,
+// publishing an empty value clears the kept one.
+func (s *Server) PublishRetained(topicName string, v interface{}) error {
+	return s.publishTopic(topicName, v, true, QoS0, 0)
+}
+
+// PublishQoS publishes topic with the delivery guarantee qos.
+func (s *Server) PublishQoS(topicName string, v interface{}, qos QoS) error {
+	return s.publishTopic(topicName, v, false, qos, 0)
+}
+
+// PublishTTL publishes topic which is dropped instead of being pushed to the subscribers after ttl.
+func (s *Server) PublishTTL(topicName string, v interface{}, ttl time.Duration) error {
+	return s.publishTopic(topicName, v, false, QoS0, ttl)
+}
+
+func (s *Server) publishTopic(topicName string, v interface{}, retain bool, qos QoS, ttl time.Duration) error {
+	if isPattern(topicName) {
+		return ErrInvalidTopicPattern
+	}
+	if qos > QoS1 {
+		return ErrInvalidQoS
+	}
 	topic, err := newTopic(topicName, util.ValueToBytes(s.Codec, v))
 	if err != nil {
 		return err
 	}
+	topic.Retain = retain
+	topic.QoS = qos
+	topic.TTL = ttl
 	_, err = topic.toBytes()
 	if err != nil {
 		return err
 	}
-	s.getOrMakeTopic(topic.Name).Publish(s, nil, topic)
+	s.publish(nil, topic)
 	return nil
 }
 
-// PublishToOne topic
+// PublishToOne topic, only the exact subscribers of topicName are chosen, wildcard subscriptions are not matched.
 func (s *Server) PublishToOne(topicName string, v interface{}) error {
+	if isPattern(topicName) {
+		return ErrInvalidTopicPattern
+	}
 	topic, err := newTopic(topicName, util.ValueToBytes(s.Codec, v))
 	if err != nil {
 		return err
@@ -58,85 +168,271 @@ func (s *Server) PublishToOne(topicName string, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	s.getOrMakeTopic(topic.Name).PublishToOne(s, nil, topic)
+	atomic.AddUint64(&s.published, 1)
+	if tp, ok := s.getTopic(topic.Name); ok {
+		tp.PublishToOne(s, nil, topic)
+	}
 	return nil
 }
 
+// SetSlowConsumerPolicy sets what the Server does when the send queue of a subscriber is full,
+// see PolicyDrop, PolicyDisconnect and PolicyBlock.
+// The topics of QoS1 are not affected, they are sent again until acknowledged, see QoSMaxRetries.
+func (s *Server) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	atomic.StoreInt32(&s.slowConsumerPolicy, int32(policy))
+}
+
+// pushMsg pushes msg to the subscriber c by the slow consumer policy.
+func (s *Server) pushMsg(c *arpc.Client, msg *arpc.Message) error {
+	switch SlowConsumerPolicy(atomic.LoadInt32(&s.slowConsumerPolicy)) {
+	case PolicyDisconnect:
+		// never wait here, the publishing holds the lock of the topic and would delay the other subscribers
+		err := c.PushMsg(msg, arpc.TimeZero)
+		cts, ok := c.UserData.(*clientTopics)
+		if !ok {
+			return err
+		}
+		if err == nil {
+			if atomic.LoadInt64(&cts.queueFullSince) > 0 {
+				atomic.StoreInt64(&cts.queueFullSince, 0)
+			}
+		} else if err == arpc.ErrClientOverstock && s.slowConsumerTimedOut(cts) {
+			log.Errorw("[Publish] send queue full, disconnect slow consumer", "tag", s.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "timeout", s.SlowConsumerTimeout)
+			// stopped asynchronously, since the disconnected handler unsubscribes the topics of c,
+			// which would wait for the publishing holding the lock of the topic
+			go c.Stop()
+		}
+		return err
+	case PolicyBlock:
+		return c.PushMsg(msg, arpc.TimeForever)
+	default:
+		return c.PushMsg(msg, arpc.TimeZero)
+	}
+}
+
+// slowConsumerTimedOut records when the send queue of the client was first found full,
+// and returns true only once if it has stayed full for SlowConsumerTimeout.
+func (s *Server) slowConsumerTimedOut(cts *clientTopics) bool {
+	now := time.Now().UnixNano()
+	since := atomic.LoadInt64(&cts.queueFullSince)
+	if since < 0 {
+		return false
+	}
+	if since == 0 {
+		if !atomic.CompareAndSwapInt64(&cts.queueFullSince, 0, now) {
+			return false
+		}
+		since = now
+	}
+	if time.Duration(now-since) < s.SlowConsumerTimeout {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&cts.queueFullSince, since, -1)
+}
+
+// SetAuthenticator sets the function which validates the credentials, the Password sent by Client.Authenticate,
+// e.g. a token or an API key, the client is authenticated if it returns a nil error, and the identity
+// returned is saved for the client, which could be fetched by Server.Identity, e.g. in the topic ACL.
+// The error returned is responded to the client.
+// The default authenticator compares the credentials with Password, and setting nil restores it.
+func (s *Server) SetAuthenticator(authenticator func(credentials []byte) (identity interface{}, err error)) {
+	s.psmux.Lock()
+	s.authenticator = authenticator
+	s.psmux.Unlock()
+}
+
+// Identity returns the identity returned by the authenticator for c, nil if c is not authenticated.
+func (s *Server) Identity(c *arpc.Client) interface{} {
+	cts, ok := c.UserData.(*clientTopics)
+	if !ok {
+		return nil
+	}
+	return cts.identity
+}
+
+// SetTopicACL sets the function which decides whether client is allowed to do op on topic,
+// ErrTopicForbidden is responded if it returns false.
+// The identity of the client returned by the authenticator could be fetched by Server.Identity in acl,
+// see SetAuthenticator.
+func (s *Server) SetTopicACL(acl func(client *arpc.Client, topic string, op Operation) bool) {
+	s.psmux.Lock()
+	s.topicACL = acl
+	s.psmux.Unlock()
+}
+
+func (s *Server) allowed(c *arpc.Client, topic string, op Operation) bool {
+	s.psmux.RLock()
+	acl := s.topicACL
+	s.psmux.RUnlock()
+	return acl == nil || acl(c, topic, op)
+}
+
+// Topics returns the names of all the topics, including the wildcard patterns subscribed.
+func (s *Server) Topics() []string {
+	s.psmux.RLock()
+	defer s.psmux.RUnlock()
+	names := make([]string, 0, len(s.topics))
+	for name := range s.topics {
+		names = append(names, name)
+	}
+	return s.patterns.patterns(names)
+}
+
+// SubscriberCount returns the number of subscribers of topic, topic could be a wildcard pattern.
+func (s *Server) SubscriberCount(topic string) int {
+	var (
+		tp *TopicAgent
+		ok bool
+	)
+	if isPattern(topic) {
+		s.psmux.RLock()
+		tp, ok = s.patterns.get(topic)
+		s.psmux.RUnlock()
+	} else {
+		tp, ok = s.getTopic(topic)
+	}
+	if !ok {
+		return 0
+	}
+	return tp.Len()
+}
+
+// ClientTopics returns the topics subscribed by c, nil if c is not authenticated.
+func (s *Server) ClientTopics(c *arpc.Client) []string {
+	cts, ok := c.UserData.(*clientTopics)
+	if !ok {
+		return nil
+	}
+	cts.mux.RLock()
+	defer cts.mux.RUnlock()
+	names := make([]string, 0, len(cts.topicAgents))
+	for name := range cts.topicAgents {
+		names = append(names, name)
+	}
+	return names
+}
+
 func (s *Server) invalid(ctx *arpc.Context) bool {
 	return ctx.Client.UserData == nil
 }
 
+// checkAuthenticated is the middleware which aborts the pubsub routes except the authentication
+// for the Clients which are not authenticated, so their handlers are not called.
+func (s *Server) checkAuthenticated(ctx *arpc.Context) {
+	name, ok := authRouteNames[ctx.Method()]
+	if ok && s.invalid(ctx) {
+		log.Errorw("invalid ctx", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "route", name)
+		ctx.Abort()
+	}
+}
+
 func (s *Server) onAuthenticate(ctx *arpc.Context) {
 	defer util.Recover()
 
-	passwd := ""
-	err := ctx.Bind(&passwd)
-	if err != nil {
-		ctx.Error(ErrInvalidPassword)
-		log.Error("%v [Authenticate] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
-		return
+	s.psmux.RLock()
+	authenticate := s.authenticator
+	s.psmux.RUnlock()
+	if authenticate == nil {
+		authenticate = s.authenticatePassword
 	}
 
-	if passwd == s.Password {
-		s.addClient(ctx.Client)
+	identity, err := authenticate(ctx.Body())
+	if err == nil {
+		s.addClient(ctx.Client, identity)
 		ctx.Write(nil)
-		log.Info("%v [Authenticate] success from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
+		log.Infow("[Authenticate] success", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "identity", identity)
 	} else {
-		ctx.Error(ErrInvalidPassword)
-		log.Error("%v [Authenticate] failed: %v, from\t%v", s.Handler.LogTag(), ErrInvalidPassword, ctx.Client.Conn.RemoteAddr())
+		ctx.Error(err)
+		log.Errorw("[Authenticate] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
 	}
 }
 
+// authenticatePassword is the default authenticator, credentials should be the same as Password.
+func (s *Server) authenticatePassword(credentials []byte) (interface{}, error) {
+	if string(credentials) != s.Password {
+		return nil, ErrInvalidPassword
+	}
+	return nil, nil
+}
+
 func (s *Server) onSubscribe(ctx *arpc.Context) {
-	defer util.Recover()
+	s.handleSubscribe(ctx, false)
+}
 
-	if s.invalid(ctx) {
-		log.Error("%v [Subscribe] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
-		return
-	}
+// onSubscribeGroup joins the shared subscription group named by the data of the topic.
+func (s *Server) onSubscribeGroup(ctx *arpc.Context) {
+	s.handleSubscribe(ctx, true)
+}
+
+func (s *Server) handleSubscribe(ctx *arpc.Context, withGroup bool) {
+	defer util.Recover()
 
 	topic := &Topic{}
 	err := topic.fromBytes(ctx.Body())
 	if err != nil {
 		ctx.Error(err)
-		log.Error("%v [Subscribe] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Subscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
 		return
 	}
 	topicName := topic.Name
+	if isPattern(topicName) {
+		if err = checkPattern(topicName); err != nil {
+			ctx.Error(err)
+			log.Errorw("[Subscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
+			return
+		}
+	}
+	group := ""
+	if withGroup {
+		group = string(topic.Data)
+		if group == "" {
+			ctx.Error(ErrInvalidGroupEmpty)
+			log.Errorw("[Subscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topicName, "error", ErrInvalidGroupEmpty)
+			return
+		}
+	}
+	if !s.allowed(ctx.Client, topicName, OpSubscribe) {
+		ctx.Error(ErrTopicForbidden)
+		log.Errorw("[Subscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topic.Name, "error", ErrTopicForbidden)
+		return
+	}
 	if topicName != "" {
 		cts := ctx.Client.UserData.(*clientTopics)
-		cts.mux.Lock()
+		if topic.Compressed {
+			atomic.StoreInt32(&cts.compression, 1)
+		}
+		cts.mux.RLock()
 		tp, ok := cts.topicAgents[topicName]
+		cts.mux.RUnlock()
 		if !ok {
-			tp = s.getOrMakeTopic(topicName)
-			cts.topicAgents[topicName] = tp
-			cts.mux.Unlock()
-			tp.Add(ctx.Client)
+			s.deliverRetained(ctx.Client, topicName)
+		}
+		cts.mux.Lock()
+		cts.topicAgents[topicName] = s.subscribe(ctx.Client, topicName, tp, group)
+		cts.mux.Unlock()
+		if group != "" {
 			ctx.Write(nil)
-			log.Info("%v [Subscribe] [topic: '%v'] success from\t%v", s.Handler.LogTag(), topicName, ctx.Client.Conn.RemoteAddr())
+			log.Infow("[Subscribe] success", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topicName, "group", group)
 		} else {
-			cts.mux.Unlock()
 			ctx.Write(nil)
+			if !ok {
+				log.Infow("[Subscribe] success", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topicName)
+			}
 		}
 	} else {
 		ctx.Error(ErrInvalidTopicEmpty)
-		log.Error("%v [Subscribe] failed: %v, from\t%v", s.Handler.LogTag(), ErrInvalidTopicEmpty, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Subscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicEmpty)
 	}
 }
 
 func (s *Server) onUnsubscribe(ctx *arpc.Context) {
 	defer util.Recover()
 
-	if s.invalid(ctx) {
-		log.Error("%v [Unsubscribe] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
-		return
-	}
-
 	topic := &Topic{}
 	err := topic.fromBytes(ctx.Body())
 	if err != nil {
 		ctx.Error(err)
-		log.Error("%v [Unsubscribe] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Unsubscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
 		return
 	}
 	topicName := topic.Name
@@ -147,68 +443,118 @@ func (s *Server) onUnsubscribe(ctx *arpc.Context) {
 			delete(cts.topicAgents, topicName)
 			cts.mux.Unlock()
 			ta.Delete(ctx.Client)
+			s.removeTopicIfUnused(ta)
 			ctx.Write(nil)
-			log.Info("%v [Unsubscribe] [topic: '%v'] success from\t%v", s.Handler.LogTag(), ta.Name, ctx.Client.Conn.RemoteAddr())
+			log.Infow("[Unsubscribe] success", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", ta.Name)
 		} else {
 			cts.mux.Unlock()
 			ctx.Write(nil)
 		}
 	} else {
 		ctx.Error(ErrInvalidTopicEmpty)
-		log.Error("%v [Unsubscribe] failed: %v, from\t%v", s.Handler.LogTag(), ErrInvalidTopicEmpty, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Unsubscribe] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicEmpty)
 	}
 }
 
-func (s *Server) onPublish(ctx *arpc.Context) {
+func (s *Server) onUnsubscribeAll(ctx *arpc.Context) {
 	defer util.Recover()
 
-	if s.invalid(ctx) {
-		log.Error("%v [Publish] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
-		return
+	cts := ctx.Client.UserData.(*clientTopics)
+	cts.mux.Lock()
+	topicAgents := cts.topicAgents
+	cts.topicAgents = map[string]*TopicAgent{}
+	cts.mux.Unlock()
+	for _, tp := range topicAgents {
+		tp.Delete(ctx.Client)
+		s.removeTopicIfUnused(tp)
 	}
+	ctx.Write(nil)
+	log.Infow("[UnsubscribeAll] success", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topics", len(topicAgents))
+}
+
+func (s *Server) onPublish(ctx *arpc.Context) {
+	s.handlePublish(ctx, false)
+}
+
+// onPublishCount responds with the number of the subscribers the topic was pushed to.
+func (s *Server) onPublishCount(ctx *arpc.Context) {
+	s.handlePublish(ctx, true)
+}
+
+func (s *Server) handlePublish(ctx *arpc.Context, withCount bool) {
+	defer util.Recover()
 
 	topic := &Topic{}
 	err := topic.fromBytes(ctx.Body())
+	if err == nil && topic.Compressed {
+		// the subscribers which don't accept compression should receive the data inflated
+		if err = topic.inflate(); err == nil {
+			_, err = topic.toBytes()
+		}
+	}
 	if err != nil {
 		ctx.Error(err)
-		log.Error("%v [Publish] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
+		return
+	}
+	if isPattern(topic.Name) {
+		ctx.Error(ErrInvalidTopicPattern)
+		log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicPattern)
+		return
+	}
+	if !s.allowed(ctx.Client, topic.Name, OpPublish) {
+		ctx.Error(ErrTopicForbidden)
+		log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topic.Name, "error", ErrTopicForbidden)
 		return
 	}
 
 	topicName := topic.Name
 	if topicName != "" {
-		ctx.Write(nil)
-		s.getOrMakeTopic(topic.Name).Publish(s, ctx.Client, topic)
-		// log.Debug("%v [Publish] [%v], %v from\t%v", s.Handler.LogTag(), topicName, ctx.Client.Conn.RemoteAddr())
+		if withCount {
+			ctx.Write(s.publish(ctx.Client, topic))
+		} else {
+			ctx.Write(nil)
+			s.publish(ctx.Client, topic)
+		}
+		// log.Debug("%v [Publish] [%v], %v from\t%v", s.Handler.LogTag(), topicName, ctx.RemoteAddr())
 	} else {
 		ctx.Error(ErrInvalidTopicEmpty)
-		log.Error("%v [Publish] failed: %v, from\t%v", s.Handler.LogTag(), ErrInvalidTopicEmpty, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicEmpty)
 	}
 }
 
 func (s *Server) onPublishToOne(ctx *arpc.Context) {
 	defer util.Recover()
 
-	if s.invalid(ctx) {
-		log.Error("%v [PublishToOne] invalid ctx from\t%v", s.Handler.LogTag(), ctx.Client.Conn.RemoteAddr())
-		return
-	}
 	topic := &Topic{}
 	err := topic.fromBytes(ctx.Body())
 	if err != nil {
 		ctx.Error(err)
-		log.Error("%v [PublishToOne] failed: %v, from\t%v", s.Handler.LogTag(), err, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", err)
+		return
+	}
+	if isPattern(topic.Name) {
+		ctx.Error(ErrInvalidTopicPattern)
+		log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicPattern)
+		return
+	}
+	if !s.allowed(ctx.Client, topic.Name, OpPublish) {
+		ctx.Error(ErrTopicForbidden)
+		log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "topic", topic.Name, "error", ErrTopicForbidden)
 		return
 	}
 
 	topicName := topic.Name
 	if topicName != "" {
 		ctx.Write(nil)
-		s.getOrMakeTopic(topic.Name).PublishToOne(s, ctx.Client, topic)
-		// log.Debug("%v [Publish] [%v], %v from\t%v", s.Handler.LogTag(), topicName, ctx.Client.Conn.RemoteAddr())
+		atomic.AddUint64(&s.published, 1)
+		if tp, ok := s.getTopic(topic.Name); ok {
+			tp.PublishToOne(s, ctx.Client, topic)
+		}
+		// log.Debug("%v [Publish] [%v], %v from\t%v", s.Handler.LogTag(), topicName, ctx.RemoteAddr())
 	} else {
 		ctx.Error(ErrInvalidTopicEmpty)
-		log.Error("%v [PublishToOne] failed: %v, from\t%v", s.Handler.LogTag(), ErrInvalidTopicEmpty, ctx.Client.Conn.RemoteAddr())
+		log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", ctx.RemoteAddr(), "error", ErrInvalidTopicEmpty)
 	}
 }
 
@@ -219,7 +565,193 @@ func (s *Server) getTopic(topic string) (*TopicAgent, bool) {
 	return tp, ok
 }
 
+// publish publishes topic to the subscribers of topic name and the subscribers of the matched patterns,
+// every subscriber receives the topic only once, the number of the subscribers pushed to is returned.
+func (s *Server) publish(from *arpc.Client, topic *Topic) int {
+	topic.initExpiry()
+	if topic.Retain {
+		s.retain(topic)
+	}
+	if topic.QoS == QoS1 {
+		topic = s.newQoS1Topic(topic)
+	}
+	s.compress(topic)
+	atomic.AddUint64(&s.published, 1)
+
+	// the TopicAgent is not made for the topic without subscribers, see removeTopicIfUnused
+	tp, ok := s.getTopic(topic.Name)
+
+	var agents []*TopicAgent
+	s.psmux.RLock()
+	if len(s.patterns.children) > 0 {
+		agents = s.patterns.match(strings.Split(topic.Name, TopicSeparator), nil)
+	}
+	s.psmux.RUnlock()
+	if len(agents) == 0 {
+		if !ok {
+			return 0
+		}
+		return tp.Publish(s, from, topic)
+	}
+
+	msg := s.newTopicMessage(topic)
+	sent := map[*arpc.Client]util.Empty{}
+	n := 0
+	if ok {
+		atomic.AddUint64(&tp.published, 1)
+		n = tp.publish(s, from, topic, msg, sent)
+	}
+	for _, agent := range agents {
+		n += agent.publish(s, from, topic, msg, sent)
+	}
+	if from != nil {
+		log.Debugw("[Publish]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", from.Conn.RemoteAddr())
+	} else {
+		log.Debugw("[Publish]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", "Server")
+	}
+	return n
+}
+
+// retain saves a copy of topic as the retained one of its name, or clears the retained one if topic.Data is empty.
+func (s *Server) retain(topic *Topic) {
+	s.psmux.Lock()
+	defer s.psmux.Unlock()
+	if len(topic.Data) == 0 {
+		delete(s.retained, topic.Name)
+		// the TopicAgent kept for the retained topic
+		if tp, ok := s.topics[topic.Name]; ok && tp.markRemovedIfEmpty() {
+			delete(s.topics, topic.Name)
+		}
+		return
+	}
+	cp := &Topic{}
+	cp.fromBytes(append([]byte{}, topic.raw...))
+	cp.expireAt = topic.expireAt
+	s.retained[topic.Name] = cp
+}
+
+// deliverRetained pushes the retained topics matching topicName to c.
+func (s *Server) deliverRetained(c *arpc.Client, topicName string) {
+	var topics []*Topic
+	s.psmux.RLock()
+	if !isPattern(topicName) {
+		if topic, ok := s.retained[topicName]; ok {
+			topics = append(topics, topic)
+		}
+	} else {
+		for name, topic := range s.retained {
+			if matchTopic(topicName, name) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	s.psmux.RUnlock()
+
+	for _, topic := range topics {
+		if topic.expired() {
+			continue
+		}
+		msg := s.newTopicMessage(topic)
+		if err := s.pushMsg(c, msg); err != nil {
+			log.Errorw("[Retained] failed", "tag", s.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topic.Name, "error", err)
+		}
+	}
+}
+
+// newQoS1Topic returns a copy of topic with a new ID, the copy is kept until all the subscribers
+// acknowledged it, so it should not share the buffer of the request.
+func (s *Server) newQoS1Topic(topic *Topic) *Topic {
+	cp := &Topic{}
+	cp.fromBytes(append([]byte{}, topic.raw...))
+	cp.ID = atomic.AddUint64(&s.qosID, 1)
+	cp.expireAt = topic.expireAt
+	cp.toBytes()
+	return cp
+}
+
+// newTopicMessage creates the message of topic, it's dropped by the send loop if topic expired before it's sent.
+func (s *Server) newTopicMessage(topic *Topic) *arpc.Message {
+	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
+	msg.SetDeadline(topic.expireAt)
+	return msg
+}
+
+// deliverQoS1 sends topic to c as a request, c acknowledges it by the response.
+// The topic is sent again if it isn't acknowledged in QoSAckTimeout, and c is stopped if it still
+// isn't acknowledged after QoSMaxRetries retries, which unsubscribes all the topics of c.
+func (s *Server) deliverQoS1(c *arpc.Client, topic *Topic, retries int) error {
+	var acked int32
+	seq, err := c.CallAsyncSeq(routePublish, topic.raw, func(*arpc.Context) {
+		atomic.StoreInt32(&acked, 1)
+	}, s.QoSAckTimeout)
+	if err != nil && (retries == 0 || c.CheckState() != nil) {
+		return err
+	}
+	time.AfterFunc(s.QoSAckTimeout, func() {
+		if atomic.LoadInt32(&acked) == 1 {
+			return
+		}
+		if err == nil {
+			c.CancelAsync(seq)
+		}
+		if topic.expired() {
+			log.Debugw("[Publish] expired before acknowledged", "tag", s.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topic.Name, "id", topic.ID)
+			return
+		}
+		if retries >= s.QoSMaxRetries {
+			log.Errorw("[Publish] not acknowledged, stop", "tag", s.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", topic.Name, "id", topic.ID, "retries", retries)
+			c.Stop()
+			return
+		}
+		s.deliverQoS1(c, topic, retries+1)
+	})
+	return nil
+}
+
+// subscribe adds c to the TopicAgent of topicName as a subscriber or a member of group,
+// tp is the TopicAgent c subscribed before, or nil. If the TopicAgent is removed concurrently
+// because its last subscriber left, c is added to a new one.
+func (s *Server) subscribe(c *arpc.Client, topicName string, tp *TopicAgent, group string) *TopicAgent {
+	for {
+		if tp == nil {
+			tp = s.getOrMakeTopic(topicName)
+		}
+		if tp.add(c, group) {
+			return tp
+		}
+		tp = nil
+	}
+}
+
+// removeTopicIfUnused removes the TopicAgent of tp from s.topics if it has no subscribers
+// and no retained topic, so the transient topic names don't leak.
+// The TopicAgents of the wildcard patterns are kept.
+func (s *Server) removeTopicIfUnused(tp *TopicAgent) {
+	if isPattern(tp.Name) {
+		return
+	}
+	s.psmux.Lock()
+	defer s.psmux.Unlock()
+	if s.topics[tp.Name] != tp {
+		return
+	}
+	if _, ok := s.retained[tp.Name]; ok {
+		return
+	}
+	if tp.markRemovedIfEmpty() {
+		delete(s.topics, tp.Name)
+	}
+}
+
+// getOrMakeTopic returns the TopicAgent of topic, the wildcard patterns are saved in the trie.
 func (s *Server) getOrMakeTopic(topic string) *TopicAgent {
+	if isPattern(topic) {
+		s.psmux.Lock()
+		tp := s.patterns.getOrMake(topic)
+		s.psmux.Unlock()
+		return tp
+	}
+
 	s.psmux.RLock()
 	tp, ok := s.topics[topic]
 	s.psmux.RUnlock()
@@ -236,9 +768,10 @@ func (s *Server) getOrMakeTopic(topic string) *TopicAgent {
 }
 
 // addClient .
-func (s *Server) addClient(c *arpc.Client) {
+func (s *Server) addClient(c *arpc.Client, identity interface{}) {
 	c.UserData = &clientTopics{
 		topicAgents: map[string]*TopicAgent{},
+		identity:    identity,
 	}
 }
 
@@ -254,7 +787,8 @@ func (s *Server) deleteClient(c *arpc.Client) {
 	defer cts.mux.RUnlock()
 	for _, tp := range cts.topicAgents {
 		tp.Delete(c)
-		log.Info("%v [Disconnected Unsubscribe] [topic: '%v'] from\t%v", s.Handler.LogTag(), tp.Name, c.Conn.RemoteAddr())
+		s.removeTopicIfUnused(tp)
+		log.Infow("[Disconnected Unsubscribe]", "tag", s.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "topic", tp.Name)
 	}
 }
 
@@ -262,15 +796,25 @@ func (s *Server) deleteClient(c *arpc.Client) {
 func NewServer() *Server {
 	s := arpc.NewServer()
 	svr := &Server{
-		Server:  s,
-		topics:  map[string]*TopicAgent{},
-		clients: map[*arpc.Client]map[string]*TopicAgent{},
+		Server:              s,
+		QoSAckTimeout:       DefaultQoSAckTimeout,
+		QoSMaxRetries:       DefaultQoSMaxRetries,
+		SlowConsumerTimeout: DefaultSlowConsumerTimeout,
+		topics:              map[string]*TopicAgent{},
+		retained:            map[string]*Topic{},
+		compression:         map[string]util.Empty{},
+		clients:             map[*arpc.Client]map[string]*TopicAgent{},
 	}
 	s.Handler.SetLogTag("[APS SVR]")
+	// registered before the routes, it's called before their handlers
+	svr.Handler.Use(svr.checkAuthenticated)
 	svr.Handler.Handle(routeAuthenticate, svr.onAuthenticate)
 	svr.Handler.Handle(routeSubscribe, svr.onSubscribe)
+	svr.Handler.Handle(routeSubscribeGroup, svr.onSubscribeGroup)
 	svr.Handler.Handle(routeUnsubscribe, svr.onUnsubscribe)
+	svr.Handler.Handle(routeUnsubscribeAll, svr.onUnsubscribeAll)
 	svr.Handler.Handle(routePublish, svr.onPublish)
+	svr.Handler.Handle(routePublishCount, svr.onPublishCount)
 	svr.Handler.Handle(routePublishToOne, svr.onPublishToOne)
 
 	svr.Handler.HandleDisconnected(svr.deleteClient)
@@ -0,0 +1,73 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import "sync/atomic"
+
+// TopicStats represents the statistics of a topic or a wildcard pattern.
+type TopicStats struct {
+	// Published is the number of times the topic was published, it's always 0 for a pattern.
+	Published uint64
+	// Delivered is the number of times the topic was pushed to a subscriber.
+	Delivered uint64
+	// Dropped is the number of times pushing the topic to a subscriber failed, mostly because
+	// the send queue of the subscriber was full, a growing Dropped usually means a slow subscriber.
+	Dropped uint64
+}
+
+// BrokerStats represents the statistics of a Server.
+type BrokerStats struct {
+	// Published is the total number of the topics published, including the topics without subscribers.
+	Published uint64
+	// Fanout is the total number of the topics pushed to the subscribers.
+	Fanout uint64
+	// Dropped is the total number of the topics failed to push to the subscribers.
+	Dropped uint64
+	// Topics saves the statistics of every topic and wildcard pattern subscribed,
+	// the statistics of a topic are cleared after its last subscriber left.
+	Topics map[string]TopicStats
+}
+
+// Stats returns the statistics of the topics published by the Server.
+func (s *Server) Stats() BrokerStats {
+	s.psmux.RLock()
+	agents := make([]*TopicAgent, 0, len(s.topics))
+	for _, tp := range s.topics {
+		agents = append(agents, tp)
+	}
+	agents = s.patterns.agents(agents)
+	s.psmux.RUnlock()
+
+	stats := BrokerStats{
+		Published: atomic.LoadUint64(&s.published),
+		Fanout:    atomic.LoadUint64(&s.delivered),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		Topics:    make(map[string]TopicStats, len(agents)),
+	}
+	for _, tp := range agents {
+		stats.Topics[tp.Name] = tp.Stats()
+	}
+	return stats
+}
+
+// countDelivery counts a push of the topic of t to a subscriber, err is the result of the push.
+func (s *Server) countDelivery(t *TopicAgent, err error) {
+	if err != nil {
+		atomic.AddUint64(&t.dropped, 1)
+		atomic.AddUint64(&s.dropped, 1)
+	} else {
+		atomic.AddUint64(&t.delivered, 1)
+		atomic.AddUint64(&s.delivered, 1)
+	}
+}
+
+// Stats returns the statistics of the topic.
+func (t *TopicAgent) Stats() TopicStats {
+	return TopicStats{
+		Published: atomic.LoadUint64(&t.published),
+		Delivered: atomic.LoadUint64(&t.delivered),
+		Dropped:   atomic.LoadUint64(&t.dropped),
+	}
+}
@@ -7,6 +7,7 @@ package pubsub
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lesismal/arpc"
@@ -17,6 +18,29 @@ import (
 const (
 	// MaxTopicNameLen .
 	MaxTopicNameLen = 1024
+
+	// topicFlagRetain is saved in the high bit of the name length.
+	topicFlagRetain = 0x8000
+	// topicFlagQoS1 is saved in the second high bit of the name length,
+	// the ID of the topic is saved after the name if it's set.
+	topicFlagQoS1 = 0x4000
+	// topicFlagTTL is saved in the third high bit of the name length,
+	// the TTL of the topic is saved before the name length if it's set.
+	topicFlagTTL = 0x2000
+	// topicFlagCompressed is saved in the fourth high bit of the name length, it means the data is gzip compressed.
+	// For the subscribing requests, it means the subscriber accepts the compressed data.
+	topicFlagCompressed = 0x1000
+)
+
+// QoS represents the delivery guarantee of a published topic.
+type QoS byte
+
+const (
+	// QoS0 delivers the topic at most once, the topic is dropped if a subscriber's send queue is full.
+	QoS0 QoS = iota
+	// QoS1 delivers the topic at least once, the topic is sent again if a subscriber doesn't acknowledge it
+	// in Server.QoSAckTimeout, so a subscriber may receive it more than once with the same ID.
+	QoS1
 )
 
 // TopicHandler .
@@ -27,15 +51,71 @@ type Topic struct {
 	Name      string
 	Data      []byte
 	Timestamp int64
-	raw       []byte
+	// Retain means the server keeps the topic as the last value of Name and
+	// delivers it to the clients subscribing later, an empty Data clears the kept one.
+	Retain bool
+	// QoS is the delivery guarantee of the topic.
+	QoS QoS
+	// ID is set by the server for the topic of QoS1, it's the same for every delivery of the topic.
+	ID uint64
+	// TTL is how long the topic is valid after the server received it, the topic which hasn't been
+	// sent to a subscriber before that is dropped. 0 means no limit.
+	TTL time.Duration
+	// Compressed means Data is gzip compressed, the Client inflates the data before calling the handlers.
+	Compressed bool
+	raw        []byte
+	// expireAt is set by the server if TTL is not 0
+	expireAt time.Time
+
+	// compressed is the compressed copy of the topic made by the server once for all the subscribers
+	// accepting compression, and compressedMsg is the message of it.
+	compressed    *Topic
+	compressedMsg *arpc.Message
+}
+
+// initExpiry sets the time when the topic expires by TTL, it's called by the server after received the topic.
+func (tp *Topic) initExpiry() {
+	if tp.TTL > 0 && tp.expireAt.IsZero() {
+		tp.expireAt = time.Now().Add(tp.TTL)
+	}
+}
+
+// expired returns true if the topic has a TTL and it has passed.
+func (tp *Topic) expired() bool {
+	return !tp.expireAt.IsZero() && time.Now().After(tp.expireAt)
 }
 
 func (tp *Topic) toBytes() ([]byte, error) {
-	nameLen := uint16(len(tp.Name))
-	tail := make([]byte, len(tp.Name)+10)
+	nameLen := len(tp.Name)
+	flagAndLen := uint16(nameLen)
+	if tp.Retain {
+		flagAndLen |= topicFlagRetain
+	}
+	if tp.Compressed {
+		flagAndLen |= topicFlagCompressed
+	}
+	tailLen := nameLen + 10
+	if tp.QoS == QoS1 {
+		flagAndLen |= topicFlagQoS1
+		tailLen += 8
+	}
+	if tp.TTL > 0 {
+		flagAndLen |= topicFlagTTL
+		tailLen += 8
+	}
+	tail := make([]byte, tailLen)
 	copy(tail, tp.Name)
-	binary.LittleEndian.PutUint16(tail[nameLen:], nameLen)
-	binary.LittleEndian.PutUint64(tail[nameLen+2:], uint64(tp.Timestamp))
+	index := nameLen
+	if tp.QoS == QoS1 {
+		binary.LittleEndian.PutUint64(tail[index:], tp.ID)
+		index += 8
+	}
+	if tp.TTL > 0 {
+		binary.LittleEndian.PutUint64(tail[index:], uint64(tp.TTL))
+		index += 8
+	}
+	binary.LittleEndian.PutUint16(tail[index:], flagAndLen)
+	binary.LittleEndian.PutUint64(tail[index+2:], uint64(tp.Timestamp))
 	dataLen := len(tp.Data)
 	tp.Data = append(tp.Data, tail...)
 	tp.raw = tp.Data
@@ -47,13 +127,35 @@ func (tp *Topic) fromBytes(data []byte) error {
 	if len(data) < 10 {
 		return ErrInvalidTopicBytes
 	}
-	nameLen := int(binary.LittleEndian.Uint16(data[len(data)-10:]))
+	flagAndLen := binary.LittleEndian.Uint16(data[len(data)-10:])
+	tp.Retain = flagAndLen&topicFlagRetain != 0
+	tp.Compressed = flagAndLen&topicFlagCompressed != 0
+	nameLen := int(flagAndLen &^ (topicFlagRetain | topicFlagQoS1 | topicFlagTTL | topicFlagCompressed))
 	if nameLen == 0 || nameLen > MaxTopicNameLen {
 		return ErrInvalidTopicNameLength
 	}
+	tail := len(data) - 10
+	if flagAndLen&topicFlagTTL != 0 {
+		tail -= 8
+		if tail < 0 {
+			return ErrInvalidTopicBytes
+		}
+		tp.TTL = time.Duration(binary.LittleEndian.Uint64(data[tail:]))
+	}
+	if flagAndLen&topicFlagQoS1 != 0 {
+		tail -= 8
+		if tail < 0 {
+			return ErrInvalidTopicBytes
+		}
+		tp.QoS = QoS1
+		tp.ID = binary.LittleEndian.Uint64(data[tail:])
+	}
+	if tail-nameLen < 0 {
+		return ErrInvalidTopicBytes
+	}
 	tp.Timestamp = int64(binary.LittleEndian.Uint64(data[len(data)-8:]))
-	tp.Name = string(data[len(data)-nameLen-10 : len(data)-10])
-	tp.Data = data[:len(data)-nameLen-10]
+	tp.Name = string(data[tail-nameLen : tail])
+	tp.Data = data[:tail-nameLen]
 	tp.raw = data
 	return nil
 }
@@ -68,68 +170,232 @@ func newTopic(topicName string, data []byte) (*Topic, error) {
 	return &Topic{Name: topicName, Data: data, Timestamp: time.Now().UnixNano()}, nil
 }
 
+// subscriberGroup is a shared subscription, every topic is pushed to only one of the members in turn.
+type subscriberGroup struct {
+	next    uint64
+	members []*arpc.Client
+}
+
 // TopicAgent .
 type TopicAgent struct {
+	// the counters are accessed atomically and kept first for the alignment on 32-bit platforms
+	published uint64
+	delivered uint64
+	dropped   uint64
+
 	Name string
 
 	mux sync.RWMutex
 
 	clients map[*arpc.Client]util.Empty
+
+	// groups saves the shared subscriptions by the group names
+	groups map[string]*subscriberGroup
+
+	// removed is set when the TopicAgent is removed from the Server after the last subscriber left
+	removed bool
 }
 
 // Add .
 func (t *TopicAgent) Add(c *arpc.Client) {
+	t.add(c, "")
+}
+
+// AddToGroup adds c to the shared subscription group, a client is either a subscriber
+// or a member of one group of a topic, so c is removed from where it was first.
+func (t *TopicAgent) AddToGroup(c *arpc.Client, group string) {
+	t.add(c, group)
+}
+
+// add adds c as a subscriber, or a member of group if it's not empty,
+// it returns false if the TopicAgent has been removed from the Server.
+func (t *TopicAgent) add(c *arpc.Client, group string) bool {
 	t.mux.Lock()
-	t.clients[c] = util.Empty{}
-	t.mux.Unlock()
+	defer t.mux.Unlock()
+	if t.removed {
+		return false
+	}
+	delete(t.clients, c)
+	t.deleteFromGroups(c)
+	if group == "" {
+		t.clients[c] = util.Empty{}
+		return true
+	}
+	g, ok := t.groups[group]
+	if !ok {
+		g = &subscriberGroup{}
+		t.groups[group] = g
+	}
+	g.members = append(g.members, c)
+	return true
 }
 
 // Delete .
 func (t *TopicAgent) Delete(c *arpc.Client) {
 	t.mux.Lock()
 	delete(t.clients, c)
+	t.deleteFromGroups(c)
 	t.mux.Unlock()
 }
 
-// Publish .
-func (t *TopicAgent) Publish(s *Server, from *arpc.Client, topic *Topic) {
-	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
+// deleteFromGroups removes c from the groups and removes the empty groups, it must be called with t.mux locked.
+func (t *TopicAgent) deleteFromGroups(c *arpc.Client) {
+	for name, g := range t.groups {
+		for i, member := range g.members {
+			if member == c {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+		if len(g.members) == 0 {
+			delete(t.groups, name)
+		}
+	}
+}
+
+// markRemovedIfEmpty marks the TopicAgent removed if it has no subscribers,
+// it's called with the lock of the Server held before removing the TopicAgent.
+func (t *TopicAgent) markRemovedIfEmpty() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.clients) > 0 || len(t.groups) > 0 {
+		return false
+	}
+	t.removed = true
+	return true
+}
+
+// Len returns the number of subscribers, including the members of the groups.
+func (t *TopicAgent) Len() int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	n := len(t.clients)
+	for _, g := range t.groups {
+		n += len(g.members)
+	}
+	return n
+}
+
+// Groups returns the number of the members of every shared subscription group.
+func (t *TopicAgent) Groups() map[string]int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	groups := make(map[string]int, len(t.groups))
+	for name, g := range t.groups {
+		groups[name] = len(g.members)
+	}
+	return groups
+}
+
+// Publish pushes topic to the subscribers and returns the number of the subscribers pushed to.
+func (t *TopicAgent) Publish(s *Server, from *arpc.Client, topic *Topic) int {
+	topic.initExpiry()
+	atomic.AddUint64(&t.published, 1)
+	msg := s.newTopicMessage(topic)
+	n := t.publish(s, from, topic, msg, nil)
+	if from != nil {
+		log.Debugw("[Publish]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", from.Conn.RemoteAddr())
+	} else {
+		log.Debugw("[Publish]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", "Server")
+	}
+	return n
+}
+
+// publish pushes msg to the clients and returns the number of the clients pushed to,
+// the clients in sent are skipped and the others are added to sent if it's not nil.
+func (t *TopicAgent) publish(s *Server, from *arpc.Client, topic *Topic, msg *arpc.Message, sent map[*arpc.Client]util.Empty) int {
+	if topic.expired() {
+		log.Debugw("[Publish] expired, dropped", "tag", s.Handler.LogTag(), "topic", topic.Name)
+		return 0
+	}
+	n := 0
 	t.mux.RLock()
 	for to := range t.clients {
-		err := to.PushMsg(msg, arpc.TimeZero)
-		if err != nil {
-			if from != nil {
-				log.Error("[Publish] [topic: '%v'] failed %v, from\t%v\tto\t%v", topic.Name, err, from.Conn.RemoteAddr(), to.Conn.RemoteAddr())
-			} else {
-				log.Error("[Publish] [topic: '%v'] failed %v, from Server to\t%v", topic.Name, err, to.Conn.RemoteAddr())
+		if sent != nil {
+			if _, ok := sent[to]; ok {
+				continue
 			}
+			sent[to] = util.Empty{}
+		}
+		if t.deliver(s, from, to, topic, msg) == nil {
+			n++
+		}
+	}
+	for _, g := range t.groups {
+		if t.publishToGroup(s, from, g, topic, msg, sent) {
+			n++
 		}
 	}
 	t.mux.RUnlock()
-	if from != nil {
-		log.Debug("%v [Publish] [topic: '%v'] from\t%v", s.Handler.LogTag(), topic.Name, from.Conn.RemoteAddr())
+	return n
+}
+
+// publishToGroup pushes msg to the next member of g in round-robin order,
+// the members failed to push to are skipped, it returns false if msg isn't pushed to any member.
+func (t *TopicAgent) publishToGroup(s *Server, from *arpc.Client, g *subscriberGroup, topic *Topic, msg *arpc.Message, sent map[*arpc.Client]util.Empty) bool {
+	next := atomic.AddUint64(&g.next, 1)
+	for i := 0; i < len(g.members); i++ {
+		to := g.members[(next+uint64(i))%uint64(len(g.members))]
+		if sent != nil {
+			if _, ok := sent[to]; ok {
+				continue
+			}
+		}
+		if t.deliver(s, from, to, topic, msg) == nil {
+			if sent != nil {
+				sent[to] = util.Empty{}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// deliver pushes msg to the client, or sends topic as a request if it's QoS1.
+func (t *TopicAgent) deliver(s *Server, from *arpc.Client, to *arpc.Client, topic *Topic, msg *arpc.Message) error {
+	if topic.compressed != nil && acceptsCompression(to) {
+		topic, msg = topic.compressed, topic.compressedMsg
+	}
+	var err error
+	if topic.QoS == QoS1 {
+		err = s.deliverQoS1(to, topic, 0)
 	} else {
-		log.Debug("%v [Publish] [topic: '%v'] from Server", s.Handler.LogTag(), topic.Name)
+		err = s.pushMsg(to, msg)
 	}
+	s.countDelivery(t, err)
+	if err != nil {
+		if from != nil {
+			log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", to.Conn.RemoteAddr(), "topic", topic.Name, "from", from.Conn.RemoteAddr(), "error", err)
+		} else {
+			log.Errorw("[Publish] failed", "tag", s.Handler.LogTag(), "remote_addr", to.Conn.RemoteAddr(), "topic", topic.Name, "from", "Server", "error", err)
+		}
+	}
+	return err
 }
 
 // PublishToOne .
 func (t *TopicAgent) PublishToOne(s *Server, from *arpc.Client, topic *Topic) {
-	msg := s.NewMessage(arpc.CmdNotify, routePublish, topic.raw)
+	topic.initExpiry()
+	if topic.expired() {
+		return
+	}
+	atomic.AddUint64(&t.published, 1)
+	msg := s.newTopicMessage(topic)
 	t.mux.RLock()
 	for to := range t.clients {
-		err := to.PushMsg(msg, arpc.TimeZero)
+		err := s.pushMsg(to, msg)
+		s.countDelivery(t, err)
 		if err != nil {
 			if from != nil {
-				log.Error("[PublishToOne] [topic: '%v'] failed %v, from\t%v\tto\t%v", topic.Name, err, from.Conn.RemoteAddr(), to.Conn.RemoteAddr())
+				log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", to.Conn.RemoteAddr(), "topic", topic.Name, "from", from.Conn.RemoteAddr(), "error", err)
 			} else {
-				log.Error("[PublishToOne] [topic: '%v'] failed %v, from Server to\t%v", topic.Name, err, to.Conn.RemoteAddr())
+				log.Errorw("[PublishToOne] failed", "tag", s.Handler.LogTag(), "remote_addr", to.Conn.RemoteAddr(), "topic", topic.Name, "from", "Server", "error", err)
 			}
 		} else {
 			if from != nil {
-				log.Debug("%v [PublishToOne] [topic: '%v'] from\t%v", s.Handler.LogTag(), topic.Name, from.Conn.RemoteAddr())
+				log.Debugw("[PublishToOne]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", from.Conn.RemoteAddr())
 			} else {
-				log.Debug("%v [PublishToOne] [topic: '%v'] from Server", s.Handler.LogTag(), topic.Name)
+				log.Debugw("[PublishToOne]", "tag", s.Handler.LogTag(), "topic", topic.Name, "from", "Server")
 			}
 			break
 		}
@@ -141,5 +407,6 @@ func newTopicAgent(topic string) *TopicAgent {
 	return &TopicAgent{
 		Name:    topic,
 		clients: map[*arpc.Client]util.Empty{},
+		groups:  map[string]*subscriberGroup{},
 	}
 }
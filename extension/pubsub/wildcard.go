@@ -0,0 +1,138 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"strings"
+)
+
+const (
+	// TopicSeparator separates the levels of a topic name.
+	TopicSeparator = "/"
+	// WildcardSingle matches exactly one level of a topic name.
+	WildcardSingle = "+"
+	// WildcardMulti matches any number of levels at the end of a topic name, it must be the last level.
+	WildcardMulti = "#"
+)
+
+// isPattern returns true if the topic name contains wildcards.
+func isPattern(topicName string) bool {
+	return strings.ContainsAny(topicName, WildcardSingle+WildcardMulti)
+}
+
+// checkPattern checks that every wildcard occupies a whole level and '#' is the last level.
+func checkPattern(pattern string) error {
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == WildcardMulti:
+			if i != len(levels)-1 {
+				return ErrInvalidTopicPattern
+			}
+		case level == WildcardSingle:
+		case strings.ContainsAny(level, WildcardSingle+WildcardMulti):
+			return ErrInvalidTopicPattern
+		}
+	}
+	return nil
+}
+
+// matchTopic returns true if the topic name matches the pattern.
+func matchTopic(pattern, topicName string) bool {
+	if !isPattern(pattern) {
+		return pattern == topicName
+	}
+	patterns := strings.Split(pattern, TopicSeparator)
+	levels := strings.Split(topicName, TopicSeparator)
+	for i, p := range patterns {
+		if p == WildcardMulti {
+			return true
+		}
+		if i >= len(levels) || (p != WildcardSingle && p != levels[i]) {
+			return false
+		}
+	}
+	return len(patterns) == len(levels)
+}
+
+// topicTrie saves the TopicAgents of wildcard subscriptions by levels.
+type topicTrie struct {
+	agent    *TopicAgent
+	children map[string]*topicTrie
+}
+
+func (t *topicTrie) getOrMake(pattern string) *TopicAgent {
+	node := t
+	for _, level := range strings.Split(pattern, TopicSeparator) {
+		if node.children == nil {
+			node.children = map[string]*topicTrie{}
+		}
+		child, ok := node.children[level]
+		if !ok {
+			child = &topicTrie{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	if node.agent == nil {
+		node.agent = newTopicAgent(pattern)
+	}
+	return node.agent
+}
+
+// match appends the TopicAgents whose pattern matches levels.
+func (t *topicTrie) match(levels []string, agents []*TopicAgent) []*TopicAgent {
+	if child, ok := t.children[WildcardMulti]; ok && child.agent != nil {
+		agents = append(agents, child.agent)
+	}
+	if len(levels) == 0 {
+		if t.agent != nil {
+			agents = append(agents, t.agent)
+		}
+		return agents
+	}
+	if child, ok := t.children[WildcardSingle]; ok {
+		agents = child.match(levels[1:], agents)
+	}
+	if child, ok := t.children[levels[0]]; ok {
+		agents = child.match(levels[1:], agents)
+	}
+	return agents
+}
+
+// get returns the TopicAgent of pattern.
+func (t *topicTrie) get(pattern string) (*TopicAgent, bool) {
+	node := t
+	for _, level := range strings.Split(pattern, TopicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node.agent, node.agent != nil
+}
+
+// patterns appends the patterns of all the TopicAgents in the trie.
+func (t *topicTrie) patterns(names []string) []string {
+	if t.agent != nil {
+		names = append(names, t.agent.Name)
+	}
+	for _, child := range t.children {
+		names = child.patterns(names)
+	}
+	return names
+}
+
+// agents appends all the TopicAgents in the trie.
+func (t *topicTrie) agents(agents []*TopicAgent) []*TopicAgent {
+	if t.agent != nil {
+		agents = append(agents, t.agent)
+	}
+	for _, child := range t.children {
+		agents = child.agents(agents)
+	}
+	return agents
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package opentelemetry implements arpc.Tracer with OpenTelemetry.
+//
+//	tracer := opentelemetry.NewTracer(otel.Tracer("arpc"))
+//	client.SetTracer(tracer)
+//	server.SetTracer(tracer)
+package opentelemetry
+
+import (
+	"context"
+
+	"github.com/lesismal/arpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer wraps trace.Tracer to arpc.Tracer, the trace context is carried by the header of the requests.
+type Tracer struct {
+	Tracer     trace.Tracer
+	Propagator propagation.TextMapPropagator
+}
+
+// StartClientSpan implements arpc.Tracer.
+func (t *Tracer) StartClientSpan(ctx context.Context, method string, header map[string]string) (context.Context, arpc.Span) {
+	ctx, span := t.Tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient))
+	t.Propagator.Inject(ctx, propagation.MapCarrier(header))
+	return ctx, &Span{span}
+}
+
+// StartServerSpan implements arpc.Tracer.
+func (t *Tracer) StartServerSpan(ctx context.Context, method string, header map[string]string) (context.Context, arpc.Span) {
+	ctx = t.Propagator.Extract(ctx, propagation.MapCarrier(header))
+	ctx, span := t.Tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer))
+	return ctx, &Span{span}
+}
+
+// Span wraps trace.Span to arpc.Span.
+type Span struct {
+	trace.Span
+}
+
+// RecordError implements arpc.Span.
+func (sp *Span) RecordError(err error) {
+	sp.Span.RecordError(err)
+	sp.Span.SetStatus(codes.Error, err.Error())
+}
+
+// End implements arpc.Span.
+func (sp *Span) End() {
+	sp.Span.End()
+}
+
+// NewTracer creates a Tracer with tracer and the global TextMapPropagator.
+func NewTracer(tracer trace.Tracer) *Tracer {
+	return &Tracer{Tracer: tracer, Propagator: otel.GetTextMapPropagator()}
+}
@@ -9,23 +9,51 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
 
 	"github.com/lesismal/arpc/internal/log"
 	"github.com/lesismal/arpc/internal/util"
 )
 
+// OverloadPolicy represents what to do with a message when the dispatch pool of Handler.SetAsyncDispatch is full.
+type OverloadPolicy int
+
+const (
+	// OverloadPolicyBlock makes the recv loop wait until there's room in the pool, it's the default.
+	OverloadPolicyBlock OverloadPolicy = iota
+	// OverloadPolicyReject responses ErrServerBusy to a request without calling its handlers, so the Client
+	// knows to back off, a notify is dropped.
+	OverloadPolicyReject
+)
+
 // DefaultHandler is the default Handler used by arpc
 var DefaultHandler Handler = NewHandler()
 
+const (
+	// DefaultRecvBufferSize is the default size of the bufio.Reader a connection is wrapped with.
+	DefaultRecvBufferSize = 8192
+	// MinRecvBufferSize is the minimum read buffer size, a smaller size is raised to it.
+	MinRecvBufferSize = 512
+)
+
 // HandlerFunc defines message handler of arpc middleware and method/router.
 type HandlerFunc func(*Context)
 
+// HandlerWrapper defines middleware which wraps method/router handler.
+type HandlerWrapper func(next HandlerFunc) HandlerFunc
+
 // routerHandler saves all middleware and method/router handler funcs
 // for every method by register order,
 // all the funcs will be called one by one for every message.
 type routerHandler struct {
 	async    bool
 	handlers []HandlerFunc
+
+	// cb is the method/router handler before being wrapped, cbIndex is its index in handlers
+	cb      HandlerFunc
+	cbIndex int
 }
 
 // Handler defines net message handler interface.
@@ -45,6 +73,9 @@ type Handler interface {
 
 	// HandleDisconnected registers handler which will be called when client is disconnected.
 	HandleDisconnected(onDisConnected func(*Client))
+	// HandleDisconnectedWithError registers handler which will be called when client is disconnected,
+	// err is the error which caused the disconnection, nil if the client was stopped by Stop.
+	HandleDisconnectedWithError(onDisConnected func(c *Client, err error))
 	// OnDisconnected will be called when client is disconnected.
 	OnDisconnected(c *Client)
 
@@ -58,6 +89,14 @@ type Handler interface {
 	// OnOverstock will be called when message is dropped.
 	OnMessageDropped(c *Client, m *Message)
 
+	// HandlePanic registers handler which will be called when a method/router handler panics,
+	// ctx.Error can be used to respond to the caller.
+	// It's also called when OnMessage panics out of the handlers, e.g. in a coder or an async response handler,
+	// with ctx.Message being the message dispatched, and the Client keeps receiving.
+	HandlePanic(onPanic func(ctx *Context, recovered interface{}))
+	// OnPanic will be called when a method/router handler or OnMessage panics.
+	OnPanic(ctx *Context, recovered interface{})
+
 	// HandleSessionMiss registers handler which will be called when async message seq not found.
 	HandleSessionMiss(onSessionMiss func(c *Client, m *Message))
 	// OnSessionMiss will be called when async message seq not found.
@@ -82,10 +121,33 @@ type Handler interface {
 	// SetAsyncResponse sets AsyncResponse flag.
 	SetAsyncResponse(async bool)
 
+	// AsyncDispatch returns the max number of the synchronous method/router handlers running concurrently
+	// by SetAsyncDispatch, it's 0 if they're called in the recv loop.
+	AsyncDispatch() int
+	// SetAsyncDispatch makes the synchronous method/router handlers run in goroutines, at most poolSize
+	// of them run concurrently for all the connections of the Handler, so a slow handler, e.g. blocking on
+	// a DB call, doesn't block the recv loop of its connection from reading the next message.
+	// The recv loop waits when poolSize handlers are running, which keeps the memory bounded.
+	// The messages of a connection are not handled in the order they're received, the responses are
+	// matched by seq so the calls are not affected, but the handlers relying on the order of the notifies
+	// should be registered on another Handler. Context.Hijack returns ErrContextHijackAsync for them.
+	// The asynchronous handlers and the response handlers are not affected, poolSize <= 0 disables it,
+	// which is the default. It should be called before the Handler is used, the Clones share the pool.
+	SetAsyncDispatch(poolSize int)
+	// OverloadPolicy returns the OverloadPolicy of the dispatch pool.
+	OverloadPolicy() OverloadPolicy
+	// SetOverloadPolicy sets what to do with a message when the dispatch pool of SetAsyncDispatch is full.
+	SetOverloadPolicy(policy OverloadPolicy)
+
 	// WrapReader wraps net.Conn to Read data with io.Reader.
 	WrapReader(conn net.Conn) io.Reader
 	// SetReaderWrapper registers reader wrapper for net.Conn.
 	SetReaderWrapper(wrapper func(conn net.Conn) io.Reader)
+	// WrapWriter wraps net.Conn to Write data with io.Writer,
+	// the send loop flushes it when the send queue is empty if it implements Flush() error.
+	WrapWriter(conn net.Conn) io.Writer
+	// SetWriterWrapper registers writer wrapper for net.Conn, nil disables buffered writing.
+	SetWriterWrapper(wrapper func(conn net.Conn) io.Writer)
 
 	// Recv reads a message from a client.
 	Recv(c *Client) (*Message, error)
@@ -96,17 +158,47 @@ type Handler interface {
 
 	// RecvBufferSize returns client's read buffer size.
 	RecvBufferSize() int
-	// SetRecvBufferSize sets client's read buffer size.
+	// SetRecvBufferSize sets client's read buffer size used by the default reader wrapper,
+	// it's DefaultRecvBufferSize by default and a size smaller than MinRecvBufferSize is raised to it.
+	// A larger size saves read syscalls for large frames, a smaller one saves memory for many connections with tiny frames.
 	SetRecvBufferSize(size int)
 
+	// SendBufferSize returns client's write buffer size.
+	SendBufferSize() int
+	// SetSendBufferSize sets client's write buffer size.
+	SetSendBufferSize(size int)
+
 	// SendQueueSize returns client's send queue channel capacity.
 	SendQueueSize() int
 	// SetSendQueueSize sets client's send queue channel capacity.
 	SetSendQueueSize(size int)
 
+	// WriteBatchSize returns the max number of queued messages written by a single SendN if BatchSend is true.
+	WriteBatchSize() int
+	// SetWriteBatchSize sets the max number of queued messages written by a single SendN if BatchSend is true.
+	SetWriteBatchSize(n int)
+
+	// MaxBodyLen returns the max body length of the received message.
+	MaxBodyLen() uint32
+	// SetMaxBodyLen sets the max body length of the received message,
+	// the connection is closed before allocating the buffer if a message's body length exceeds it.
+	SetMaxBodyLen(n uint32)
+
+	// StreamCompression returns the algorithm of the whole stream compression.
+	StreamCompression() StreamCompression
+	// EnableStreamCompression compresses the whole stream of the connections by algo, StreamCompressionNone disables it.
+	// It amortizes the compression dictionary across the messages, both sides must enable the same algo before connecting:
+	// a preamble of the algo is exchanged on every connection and it's closed if the algos mismatch.
+	// It doesn't work with the websocket connections or Context.Hijack.
+	EnableStreamCompression(algo StreamCompression)
+
 	// Use registers method/router handler middleware.
 	Use(h HandlerFunc)
 
+	// UseWrapper registers middleware which wraps every method/router handler,
+	// including the ones registered before, wrappers are called in registration order.
+	UseWrapper(w HandlerWrapper)
+
 	// UseCoder registers message coding middleware,
 	// coder.Encode will be called before message send,
 	// coder.Decode will be called after message recv.
@@ -122,41 +214,94 @@ type Handler interface {
 	Handle(m string, h HandlerFunc, args ...interface{})
 
 	// HandleNotFound registers "" method/router handler,
-	// It will be called when mothod/router is not found.
+	// It will be called for the requests and notifies whose method/router is not found,
+	// by default it responds the requests with ErrMethodNotFound.
 	HandleNotFound(h HandlerFunc)
 
+	// Routes returns the sorted methods of the registered method/router handlers,
+	// the "" not found handler is not included.
+	Routes() []string
+	// HasRoute returns whether a handler is registered for method.
+	HasRoute(method string) bool
+
 	// OnMessage finds method/router middlewares and handler, then call them one by one.
 	OnMessage(c *Client, m *Message)
 
 	// GetBuffer makes a buffer by size.
 	GetBuffer(size int) []byte
+	// PutBuffer puts a buffer made by GetBuffer back to the BufferPool.
+	PutBuffer(buf []byte)
 
 	// SetBufferFactory registers buffer maker.
 	SetBufferFactory(f func(int) []byte)
+	// SetBufferPool registers BufferPool, it's used by GetBuffer if no buffer factory is registered.
+	SetBufferPool(pool BufferPool)
+
+	// Tracer returns the Tracer which starts a server span for every request handled.
+	Tracer() Tracer
+	// SetTracer sets the Tracer, nil disables tracing.
+	SetTracer(tracer Tracer)
+
+	// Metrics returns the Collector of the connections and the handlers.
+	Metrics() Collector
+	// SetMetrics sets the Collector, nil disables it.
+	SetMetrics(metrics Collector)
+}
+
+// BufferPool defines the allocator of Message buffers.
+// The buffer of a received request or notify Message is put back after its handlers returned,
+// so the handlers should copy the body if it's held after that, see Context.BodyCopy.
+type BufferPool interface {
+	// Get returns a buffer of size.
+	Get(size int) []byte
+	// Put puts a buffer back.
+	Put(buf []byte)
+}
+
+// defaultBufferPool makes buffers and leaves the buffers put back to the gc.
+type defaultBufferPool struct{}
+
+func (defaultBufferPool) Get(size int) []byte {
+	return make([]byte, size)
 }
 
+func (defaultBufferPool) Put(buf []byte) {}
+
 // handler represents a default Handler implementation.
 type handler struct {
 	logtag         string
 	batchRecv      bool
 	batchSend      bool
 	asyncResponse  bool
+	dispatchSem    chan util.Empty
+	overload       OverloadPolicy
 	recvBufferSize int
+	sendBufferSize int
 	sendQueueSize  int
+	writeBatchSize int
+	maxBodyLen     uint32
+
+	streamCompression StreamCompression
 
 	onConnected      func(*Client)
 	onDisConnected   func(*Client)
 	onOverstock      func(c *Client, m *Message)
 	onMessageDropped func(c *Client, m *Message)
 	onSessionMiss    func(c *Client, m *Message)
+	onPanic          func(ctx *Context, recovered interface{})
 
 	beforeRecv    func(net.Conn) error
 	beforeSend    func(net.Conn) error
 	bufferFactory func(int) []byte
+	bufferPool    BufferPool
+	tracer        Tracer
+	metrics       Collector
 
 	wrapReader func(conn net.Conn) io.Reader
+	wrapWriter func(conn net.Conn) io.Writer
 
 	middles   []HandlerFunc
+	wrappers  []HandlerWrapper
 	msgCoders []MessageCoder
 
 	routes map[string]*routerHandler
@@ -167,6 +312,9 @@ func (h *handler) Clone() Handler {
 	cp.middles = make([]HandlerFunc, len(h.middles))
 	copy(cp.middles, h.middles)
 
+	cp.wrappers = make([]HandlerWrapper, len(h.wrappers))
+	copy(cp.wrappers, h.wrappers)
+
 	cp.msgCoders = make([]MessageCoder, len(h.msgCoders))
 	copy(cp.msgCoders, h.msgCoders)
 
@@ -175,6 +323,8 @@ func (h *handler) Clone() Handler {
 		rh := &routerHandler{
 			async:    v.async,
 			handlers: make([]HandlerFunc, len(v.handlers)),
+			cb:       v.cb,
+			cbIndex:  v.cbIndex,
 		}
 		copy(rh.handlers, v.handlers)
 		cp.routes[k] = rh
@@ -223,6 +373,15 @@ func (h *handler) HandleDisconnected(onDisConnected func(*Client)) {
 	}
 }
 
+func (h *handler) HandleDisconnectedWithError(onDisConnected func(c *Client, err error)) {
+	if onDisConnected == nil {
+		return
+	}
+	h.HandleDisconnected(func(c *Client) {
+		onDisConnected(c, c.stopErr)
+	})
+}
+
 func (h *handler) OnDisconnected(c *Client) {
 	if h.onDisConnected != nil {
 		h.onDisConnected(c)
@@ -249,6 +408,26 @@ func (h *handler) OnMessageDropped(c *Client, m *Message) {
 	}
 }
 
+func (h *handler) HandlePanic(onPanic func(ctx *Context, recovered interface{})) {
+	h.onPanic = onPanic
+}
+
+func (h *handler) OnPanic(ctx *Context, recovered interface{}) {
+	if h.onPanic != nil {
+		h.onPanic(ctx, recovered)
+		return
+	}
+	// the stack is expensive, skip it if error logs are disabled
+	if !log.Enabled(log.LevelError) {
+		return
+	}
+	if ctx == nil {
+		log.Errorw("runtime error", "tag", h.LogTag(), "error", recovered, "stack", string(debug.Stack()))
+		return
+	}
+	log.Errorw("runtime error", "tag", h.LogTag(), "remote_addr", ctx.Client.Conn.RemoteAddr(), "method", ctx.Method(), "seq", ctx.Seq(), "error", recovered, "stack", string(debug.Stack()))
+}
+
 func (h *handler) HandleSessionMiss(onSessionMiss func(c *Client, m *Message)) {
 	h.onSessionMiss = onSessionMiss
 }
@@ -291,6 +470,45 @@ func (h *handler) SetAsyncResponse(async bool) {
 	h.asyncResponse = async
 }
 
+func (h *handler) AsyncDispatch() int {
+	return cap(h.dispatchSem)
+}
+
+func (h *handler) SetAsyncDispatch(poolSize int) {
+	if poolSize <= 0 {
+		h.dispatchSem = nil
+		return
+	}
+	h.dispatchSem = make(chan util.Empty, poolSize)
+}
+
+func (h *handler) OverloadPolicy() OverloadPolicy {
+	return h.overload
+}
+
+func (h *handler) SetOverloadPolicy(policy OverloadPolicy) {
+	h.overload = policy
+}
+
+// dispatch calls the handlers of ctx in a goroutine after there's room in sem, which is released
+// after they return. If sem is full, it waits or rejects ctx by the OverloadPolicy.
+func (h *handler) dispatch(sem chan util.Empty, c *Client, ctx *Context) {
+	if h.overload == OverloadPolicyReject {
+		select {
+		case sem <- util.Empty{}:
+		default:
+			h.reject(c, ctx)
+			return
+		}
+	} else {
+		sem <- util.Empty{}
+	}
+	go func() {
+		defer func() { <-sem }()
+		c.handle(ctx)
+	}()
+}
+
 func (h *handler) WrapReader(conn net.Conn) io.Reader {
 	if h.wrapReader != nil {
 		return h.wrapReader(conn)
@@ -302,14 +520,36 @@ func (h *handler) SetReaderWrapper(wrapper func(conn net.Conn) io.Reader) {
 	h.wrapReader = wrapper
 }
 
+func (h *handler) WrapWriter(conn net.Conn) io.Writer {
+	if h.wrapWriter != nil {
+		return h.wrapWriter(conn)
+	}
+	return conn
+}
+
+func (h *handler) SetWriterWrapper(wrapper func(conn net.Conn) io.Writer) {
+	h.wrapWriter = wrapper
+}
+
 func (h *handler) RecvBufferSize() int {
 	return h.recvBufferSize
 }
 
 func (h *handler) SetRecvBufferSize(size int) {
+	if size < MinRecvBufferSize {
+		size = MinRecvBufferSize
+	}
 	h.recvBufferSize = size
 }
 
+func (h *handler) SendBufferSize() int {
+	return h.sendBufferSize
+}
+
+func (h *handler) SetSendBufferSize(size int) {
+	h.sendBufferSize = size
+}
+
 func (h *handler) SendQueueSize() int {
 	return h.sendQueueSize
 }
@@ -318,6 +558,33 @@ func (h *handler) SetSendQueueSize(size int) {
 	h.sendQueueSize = size
 }
 
+func (h *handler) WriteBatchSize() int {
+	return h.writeBatchSize
+}
+
+func (h *handler) SetWriteBatchSize(n int) {
+	if n <= 0 {
+		n = 1
+	}
+	h.writeBatchSize = n
+}
+
+func (h *handler) MaxBodyLen() uint32 {
+	return h.maxBodyLen
+}
+
+func (h *handler) SetMaxBodyLen(n uint32) {
+	h.maxBodyLen = n
+}
+
+func (h *handler) StreamCompression() StreamCompression {
+	return h.streamCompression
+}
+
+func (h *handler) EnableStreamCompression(algo StreamCompression) {
+	h.streamCompression = algo
+}
+
 func (h *handler) Use(cb HandlerFunc) {
 	if cb == nil {
 		return
@@ -331,6 +598,8 @@ func (h *handler) Use(cb HandlerFunc) {
 		rh := &routerHandler{
 			async:    v.async,
 			handlers: make([]HandlerFunc, len(v.handlers)+1),
+			cb:       v.cb,
+			cbIndex:  v.cbIndex,
 		}
 		copy(rh.handlers, v.handlers)
 		rh.handlers[len(v.handlers)] = cbWithNext
@@ -338,6 +607,27 @@ func (h *handler) Use(cb HandlerFunc) {
 	}
 }
 
+func (h *handler) UseWrapper(w HandlerWrapper) {
+	if w == nil {
+		return
+	}
+	h.wrappers = append(h.wrappers, w)
+	for _, rh := range h.routes {
+		rh.handlers[rh.cbIndex] = h.wrap(rh.cb)
+	}
+}
+
+// wrap wraps cb by wrappers, the first registered wrapper is the outermost.
+func (h *handler) wrap(cb HandlerFunc) HandlerFunc {
+	for i := len(h.wrappers) - 1; i >= 0; i-- {
+		cb = h.wrappers[i](cb)
+	}
+	return func(ctx *Context) {
+		cb(ctx)
+		ctx.Next()
+	}
+}
+
 func (h *handler) UseCoder(coder MessageCoder) {
 	if coder != nil {
 		h.msgCoders = append(h.msgCoders, coder)
@@ -359,6 +649,33 @@ func (h *handler) HandleNotFound(cb HandlerFunc) {
 	h.handle("", cb)
 }
 
+// methodNotFound is the default "" method/router handler.
+func (h *handler) methodNotFound(ctx *Context) {
+	log.Warnw("OnMessage: invalid method, no handler", "tag", h.LogTag(), "remote_addr", ctx.Client.Conn.RemoteAddr(), "method", ctx.Method(), "seq", ctx.Seq())
+	if ctx.Message.Cmd() == CmdRequest {
+		ctx.Error(ErrMethodNotFound)
+	}
+}
+
+func (h *handler) Routes() []string {
+	routes := make([]string, 0, len(h.routes))
+	for method := range h.routes {
+		if method != "" {
+			routes = append(routes, method)
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+func (h *handler) HasRoute(method string) bool {
+	if method == "" {
+		return false
+	}
+	_, ok := h.routes[method]
+	return ok
+}
+
 func (h *handler) handle(method string, cb HandlerFunc, args ...interface{}) {
 	if h.routes == nil {
 		h.routes = map[string]*routerHandler{}
@@ -371,12 +688,11 @@ func (h *handler) handle(method string, cb HandlerFunc, args ...interface{}) {
 		rh := &routerHandler{
 			async:    false,
 			handlers: make([]HandlerFunc, len(h.middles)+1),
+			cb:       h.methodNotFound,
+			cbIndex:  len(h.middles),
 		}
 		copy(rh.handlers, h.middles)
-		rh.handlers[len(h.middles)] = func(ctx *Context) {
-			ctx.Error(ErrMethodNotFound)
-			ctx.Next()
-		}
+		rh.handlers[rh.cbIndex] = h.wrap(rh.cb)
 		h.routes[""] = rh
 	}
 
@@ -393,12 +709,11 @@ func (h *handler) handle(method string, cb HandlerFunc, args ...interface{}) {
 	rh := &routerHandler{
 		async:    async,
 		handlers: make([]HandlerFunc, len(h.middles)+1),
+		cb:       cb,
+		cbIndex:  len(h.middles),
 	}
 	copy(rh.handlers, h.middles)
-	rh.handlers[len(h.middles)] = func(ctx *Context) {
-		cb(ctx)
-		ctx.Next()
-	}
+	rh.handlers[rh.cbIndex] = h.wrap(cb)
 	h.routes[method] = rh
 }
 
@@ -414,19 +729,21 @@ func (h *handler) Recv(c *Client) (*Message, error) {
 		}
 	}
 
-	_, err = io.ReadFull(c.Reader, c.Head[:HeaderIndexBodyLenEnd])
+	_, err = io.ReadFull(c.Reader, c.Head[:HeadLen])
 	if err != nil {
 		return nil, err
 	}
 
+	if err = c.checkResponseSize(c.Head); err != nil {
+		return nil, err
+	}
+
 	message, err = c.Head.message(h)
 	if err != nil {
 		return nil, err
 	}
 
-	if message.Len() > HeadLen {
-		_, err = io.ReadFull(c.Reader, message.Buffer[HeaderIndexBodyLenEnd:])
-	}
+	_, err = io.ReadFull(c.Reader, message.Buffer[HeadLen:])
 
 	return message, err
 }
@@ -453,15 +770,60 @@ func (h *handler) SendN(conn net.Conn, buffers net.Buffers) (int, error) {
 }
 
 func (h *handler) OnMessage(c *Client, msg *Message) {
-	defer util.Recover()
-
 	for i := len(h.msgCoders) - 1; i >= 0; i-- {
 		msg = h.msgCoders[i].Decode(c, msg)
 	}
+	if mc, ok := c.GetCodec().(MessageCoder); ok {
+		msg = mc.Decode(c, msg)
+	}
+
+	// the checksum is verified here instead of in Recv: it's appended before the coders encoded the message,
+	// so it covers the body the handlers see and is checked after decoding, and a corrupted response still
+	// fails its waiting call by the seq instead of being dropped with the connection
+	if msg.HasChecksum() && !msg.verifyChecksum() {
+		log.Errorw("OnMessage: checksum mismatch", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "cmd", msg.Cmd(), "seq", msg.Seq())
+		if msg.Cmd() != CmdResponse {
+			// drop the corrupted request/notify
+			return
+		}
+		// pass an error response to the caller
+		method := ""
+		if ml := msg.MethodLen(); ml > 0 && msg.methodIndex()+ml <= msg.Len() {
+			method = msg.method()
+		}
+		msg = newMessage(CmdResponse, method, nil, true, msg.IsAsync(), msg.Seq(), h, nil, nil)
+		msg.err = ErrChecksumMismatch
+	}
+
+	if msg.Version() > ProtocolVersion {
+		log.Warnw("OnMessage: unsupported protocol version, dropped", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "version", msg.Version(), "seq", msg.Seq())
+		if msg.Cmd() == CmdRequest {
+			// respond an error so that the caller doesn't wait until timeout
+			method := ""
+			if ml := msg.MethodLen(); ml > 0 && msg.methodIndex()+ml <= msg.Len() {
+				method = msg.method()
+			}
+			rsp := newMessage(CmdResponse, method, ErrUnsupportedVersion, true, msg.IsAsync(), msg.Seq(), h, nil, nil)
+			rsp.SetVersion(c.Version())
+			c.PushMsg(rsp, TimeZero)
+		}
+		return
+	}
+
+	// the lengths are checked after the coders decoded the message, a corrupted one means the stream can't be trusted
+	if err := msg.validate(); err != nil {
+		log.Errorw("OnMessage: invalid message, disconnecting", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "seq", msg.Seq(), "error", err)
+		if c.Dialer == nil {
+			c.stop(err)
+		} else {
+			c.Conn.Close()
+		}
+		return
+	}
 
 	ml := msg.MethodLen()
-	if ml <= 0 || ml > MaxMethodLen || ml > (msg.Len()-HeadLen) {
-		log.Warn("%v OnMessage: invalid request method length %v, dropped", h.LogTag(), ml)
+	if ml <= 0 || ml > MaxMethodLen {
+		log.Warnw("OnMessage: invalid request method length, dropped", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "method_len", ml, "seq", msg.Seq())
 		return
 	}
 
@@ -469,35 +831,42 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 	switch cmd {
 	case CmdRequest, CmdNotify:
 		method := msg.method()
-		if rh, ok := h.routes[method]; ok {
+		if cmd == CmdRequest && method == MethodHandshake {
+			c.onHandshake(msg)
+			break
+		}
+		rh, ok := h.routes[method]
+		if !ok {
+			rh, ok = h.routes[""]
+		}
+		if ok {
 			ctx := newContext(c, msg, rh.handlers)
-			if !rh.async {
-				ctx.Next()
+			atomic.AddInt64(&c.inflight, 1)
+			if rh.async {
+				go c.handle(ctx)
+			} else if sem := h.dispatchSem; sem != nil {
+				h.dispatch(sem, c, ctx)
 			} else {
-				go ctx.Next()
+				ctx.sync = true
+				c.handle(ctx)
 			}
 		} else {
-			if cmd == CmdRequest {
-				if rh, ok = h.routes[""]; ok {
-					ctx := newContext(c, msg, rh.handlers)
-					ctx.Next()
-				} else {
-					ctx := newContext(c, msg, rh.handlers)
-					ctx.Error(ErrMethodNotFound)
-				}
-			}
-			log.Warn("%v OnMessage: invalid method: [%v], no handler", h.LogTag(), method)
+			// no handler has been registered
+			h.methodNotFound(newContext(c, msg, nil))
 		}
 		break
 	case CmdResponse:
 		if !msg.IsAsync() {
 			seq := msg.Seq()
-			session, ok := c.getSession(seq)
+			session, ok := c.takeSession(seq)
 			if ok {
-				session.done <- msg
+				select {
+				case session.done <- msg:
+				case <-session.stop:
+				}
 			} else {
 				h.OnSessionMiss(c, msg)
-				log.Warn("%v OnMessage: session not exist or expired", h.LogTag())
+				log.Warnw("OnMessage: session not exist, expired or responded, dropped", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "seq", msg.Seq())
 			}
 		} else {
 			handler, ok := c.getAndDeleteAsyncHandler(msg.Seq())
@@ -506,27 +875,76 @@ func (h *handler) OnMessage(c *Client, msg *Message) {
 				handler(ctx)
 			} else {
 				h.OnSessionMiss(c, msg)
-				log.Warn("%v OnMessage: async handler not exist or expired", h.LogTag())
+				log.Warnw("OnMessage: async handler not exist or expired", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "seq", msg.Seq())
 			}
 		}
 		break
 	default:
-		log.Warn("%v OnMessage: invalid cmd [%v]", h.LogTag(), msg.Cmd())
+		log.Warnw("OnMessage: invalid cmd", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "cmd", msg.Cmd(), "seq", msg.Seq())
 		break
 	}
 }
 
+// reject responses ErrServerBusy to a request without calling its handlers.
+func (h *handler) reject(c *Client, ctx *Context) {
+	defer atomic.AddInt64(&c.inflight, -1)
+	defer h.PutBuffer(ctx.Message.Buffer)
+	if ctx.Message.Cmd() == CmdRequest {
+		ctx.Error(ErrServerBusy)
+	}
+	log.Warnw("OnMessage: dispatch pool full, rejected", "tag", h.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "method", ctx.Method(), "seq", ctx.Seq())
+}
+
 func (h *handler) GetBuffer(size int) []byte {
+	var buf []byte
 	if h.bufferFactory != nil {
-		return h.bufferFactory(size)
+		buf = h.bufferFactory(size)
+	} else {
+		buf = h.bufferPool.Get(size)
 	}
-	return make([]byte, size)
+	if poolDebugEnabled() {
+		debugGetBuffer(buf)
+	}
+	return buf
+}
+
+func (h *handler) PutBuffer(buf []byte) {
+	if poolDebugEnabled() {
+		debugPutBuffer(buf)
+	}
+	if h.bufferFactory != nil {
+		return
+	}
+	h.bufferPool.Put(buf)
 }
 
 func (h *handler) SetBufferFactory(f func(int) []byte) {
 	h.bufferFactory = f
 }
 
+func (h *handler) SetBufferPool(pool BufferPool) {
+	if pool == nil {
+		pool = defaultBufferPool{}
+	}
+	h.bufferPool = pool
+}
+
+func (h *handler) Tracer() Tracer {
+	return h.tracer
+}
+
+func (h *handler) SetTracer(tracer Tracer) {
+	h.tracer = tracer
+}
+
+func (h *handler) Metrics() Collector {
+	return h.metrics
+}
+
+func (h *handler) SetMetrics(metrics Collector) {
+	h.metrics = metrics
+}
+
 // NewHandler returns a default Handler implementation.
 func NewHandler() Handler {
 	h := &handler{
@@ -534,12 +952,19 @@ func NewHandler() Handler {
 		batchRecv:      true,
 		batchSend:      true,
 		asyncResponse:  false,
-		recvBufferSize: 8192,
+		recvBufferSize: DefaultRecvBufferSize,
+		sendBufferSize: 8192,
 		sendQueueSize:  4096,
+		writeBatchSize: 10,
+		maxBodyLen:     uint32(MaxBodyLen),
+		bufferPool:     defaultBufferPool{},
 	}
 	h.wrapReader = func(conn net.Conn) io.Reader {
 		return bufio.NewReaderSize(conn, h.recvBufferSize)
 	}
+	h.wrapWriter = func(conn net.Conn) io.Writer {
+		return bufio.NewWriterSize(conn, h.sendBufferSize)
+	}
 	return h
 }
 
@@ -563,6 +988,11 @@ func HandleDisconnected(onDisConnected func(*Client)) {
 	DefaultHandler.HandleDisconnected(onDisConnected)
 }
 
+// HandleDisconnectedWithError registers default handler which will be called with the error when client disconnected.
+func HandleDisconnectedWithError(onDisConnected func(c *Client, err error)) {
+	DefaultHandler.HandleDisconnectedWithError(onDisConnected)
+}
+
 // HandleOverstock registers default handler which will be called when client send queue is overstock.
 func HandleOverstock(onOverstock func(c *Client, m *Message)) {
 	DefaultHandler.HandleOverstock(onOverstock)
@@ -573,6 +1003,11 @@ func HandleMessageDropped(onOverstock func(c *Client, m *Message)) {
 	DefaultHandler.HandleMessageDropped(onOverstock)
 }
 
+// HandlePanic registers default handler which will be called when a method/router handler panics.
+func HandlePanic(onPanic func(ctx *Context, recovered interface{})) {
+	DefaultHandler.HandlePanic(onPanic)
+}
+
 // HandleSessionMiss registers default handler which will be called when async message seq not found.
 func HandleSessionMiss(onSessionMiss func(c *Client, m *Message)) {
 	DefaultHandler.HandleSessionMiss(onSessionMiss)
@@ -618,11 +1053,31 @@ func SetAsyncResponse(async bool) {
 	DefaultHandler.SetAsyncResponse(async)
 }
 
+// AsyncDispatch returns the size of the dispatch pool of the default Handler.
+func AsyncDispatch() int {
+	return DefaultHandler.AsyncDispatch()
+}
+
+// SetAsyncDispatch sets the size of the dispatch pool of the default Handler.
+func SetAsyncDispatch(poolSize int) {
+	DefaultHandler.SetAsyncDispatch(poolSize)
+}
+
+// SetOverloadPolicy sets the OverloadPolicy of the dispatch pool of the default Handler.
+func SetOverloadPolicy(policy OverloadPolicy) {
+	DefaultHandler.SetOverloadPolicy(policy)
+}
+
 // SetReaderWrapper registers default reader wrapper for net.Conn.
 func SetReaderWrapper(wrapper func(conn net.Conn) io.Reader) {
 	DefaultHandler.SetReaderWrapper(wrapper)
 }
 
+// SetWriterWrapper registers default writer wrapper for net.Conn.
+func SetWriterWrapper(wrapper func(conn net.Conn) io.Writer) {
+	DefaultHandler.SetWriterWrapper(wrapper)
+}
+
 // RecvBufferSize returns default client's read buffer size.
 func RecvBufferSize() int {
 	return DefaultHandler.RecvBufferSize()
@@ -633,6 +1088,16 @@ func SetRecvBufferSize(size int) {
 	DefaultHandler.SetRecvBufferSize(size)
 }
 
+// SendBufferSize returns default client's write buffer size.
+func SendBufferSize() int {
+	return DefaultHandler.SendBufferSize()
+}
+
+// SetSendBufferSize sets default client's write buffer size.
+func SetSendBufferSize(size int) {
+	DefaultHandler.SetSendBufferSize(size)
+}
+
 // SendQueueSize returns default client's send queue channel capacity.
 func SendQueueSize() int {
 	return DefaultHandler.SendQueueSize()
@@ -643,11 +1108,36 @@ func SetSendQueueSize(size int) {
 	DefaultHandler.SetSendQueueSize(size)
 }
 
+// WriteBatchSize returns default max number of queued messages written by a single SendN.
+func WriteBatchSize() int {
+	return DefaultHandler.WriteBatchSize()
+}
+
+// SetWriteBatchSize sets default max number of queued messages written by a single SendN.
+func SetWriteBatchSize(n int) {
+	DefaultHandler.SetWriteBatchSize(n)
+}
+
+// SetMaxBodyLen sets default max body length of the received message.
+func SetMaxBodyLen(n uint32) {
+	DefaultHandler.SetMaxBodyLen(n)
+}
+
+// EnableStreamCompression sets default algorithm of the whole stream compression.
+func EnableStreamCompression(algo StreamCompression) {
+	DefaultHandler.EnableStreamCompression(algo)
+}
+
 // Use registers default method/router handler middleware.
 func Use(h HandlerFunc) {
 	DefaultHandler.Use(h)
 }
 
+// UseWrapper registers default middleware which wraps every method/router handler.
+func UseWrapper(w HandlerWrapper) {
+	DefaultHandler.UseWrapper(w)
+}
+
 // UseCoder registers default message coding middleware,
 // coder.Encode will be called before message send,
 // coder.Decode will be called after message recv.
@@ -669,7 +1159,32 @@ func HandleNotFound(h HandlerFunc) {
 	DefaultHandler.HandleNotFound(h)
 }
 
+// Routes returns the sorted methods of the default method/router handlers.
+func Routes() []string {
+	return DefaultHandler.Routes()
+}
+
+// HasRoute returns whether a default handler is registered for method.
+func HasRoute(method string) bool {
+	return DefaultHandler.HasRoute(method)
+}
+
 // SetBufferFactory registers default buffer maker.
 func SetBufferFactory(f func(int) []byte) {
 	DefaultHandler.SetBufferFactory(f)
 }
+
+// SetBufferPool registers default BufferPool.
+func SetBufferPool(pool BufferPool) {
+	DefaultHandler.SetBufferPool(pool)
+}
+
+// SetTracer sets default Tracer.
+func SetTracer(tracer Tracer) {
+	DefaultHandler.SetTracer(tracer)
+}
+
+// SetMetrics sets default Collector.
+func SetMetrics(metrics Collector) {
+	DefaultHandler.SetMetrics(metrics)
+}
@@ -5,11 +5,49 @@
 package arpc
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/lesismal/arpc/internal/codec"
 )
 
+func Test_handler_UseWrapper(t *testing.T) {
+	h := DefaultHandler.Clone()
+	calls := []string{}
+	wrapper := func(name string) HandlerWrapper {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context) {
+				calls = append(calls, name)
+				next(ctx)
+			}
+		}
+	}
+	h.Handle("/before", func(ctx *Context) { calls = append(calls, "/before") })
+	h.UseWrapper(wrapper("1"))
+	h.UseWrapper(wrapper("2"))
+	h.Handle("/after", func(ctx *Context) { calls = append(calls, "/after") })
+
+	for _, method := range []string{"/before", "/after"} {
+		calls = calls[:0]
+		msg := newMessage(CmdNotify, method, nil, false, false, 0, h, nil, nil)
+		ctx := newContext(nil, msg, h.(*handler).routes[method].handlers)
+		ctx.Next()
+		if want := []string{"1", "2", method}; fmt.Sprint(calls) != fmt.Sprint(want) {
+			t.Fatalf("handler.UseWrapper() calls = %v, want %v", calls, want)
+		}
+	}
+}
+
 func Test_handler_Clone(t *testing.T) {
 	if got := DefaultHandler.Clone(); got == nil {
 		t.Errorf("handler.Clone() = nil")
@@ -42,6 +80,11 @@ func Test_handler_HandleDisconnected(t *testing.T) {
 	DefaultHandler.HandleDisconnected(func(*Client) {})
 }
 
+func Test_handler_HandleDisconnectedWithError(t *testing.T) {
+	DefaultHandler.HandleDisconnectedWithError(nil)
+	DefaultHandler.Clone().HandleDisconnectedWithError(func(*Client, error) {})
+}
+
 func Test_handler_OnDisconnected(t *testing.T) {
 	DefaultHandler.OnDisconnected(nil)
 }
@@ -54,6 +97,20 @@ func Test_handler_OnOverstock(t *testing.T) {
 	DefaultHandler.OnOverstock(nil, nil)
 }
 
+func Test_handler_OnPanic(t *testing.T) {
+	h := DefaultHandler.Clone()
+	h.OnPanic(nil, "test")
+
+	var recovered interface{}
+	h.HandlePanic(func(ctx *Context, v interface{}) {
+		recovered = v
+	})
+	h.OnPanic(nil, "test")
+	if recovered != "test" {
+		t.Fatalf("handler.OnPanic() recovered = %v, want %v", recovered, "test")
+	}
+}
+
 func Test_handler_HandleSessionMiss(t *testing.T) {
 	DefaultHandler.HandleSessionMiss(func(c *Client, m *Message) {})
 }
@@ -62,6 +119,108 @@ func Test_handler_OnSessionMiss(t *testing.T) {
 	DefaultHandler.OnSessionMiss(nil, nil)
 }
 
+func Test_handler_Routes(t *testing.T) {
+	h := NewHandler()
+	if routes := h.Routes(); len(routes) != 0 {
+		t.Fatalf("handler.Routes() = %v, want empty", routes)
+	}
+	h.Handle("/b", func(*Context) {})
+	h.Handle("/a", func(*Context) {})
+	h.HandleNotFound(func(*Context) {})
+	if routes := h.Routes(); fmt.Sprint(routes) != "[/a /b]" {
+		t.Fatalf("handler.Routes() = %v, want [/a /b]", routes)
+	}
+	if !h.HasRoute("/a") {
+		t.Fatalf("handler.HasRoute(/a) = false, want true")
+	}
+	if h.HasRoute("/c") || h.HasRoute("") {
+		t.Fatalf("handler.HasRoute() = true for unregistered method")
+	}
+}
+
+func Test_handler_HandleNotFound(t *testing.T) {
+	chNotify := make(chan string, 1)
+	svr := NewServer()
+	svr.Handler.HandleNotFound(func(ctx *Context) {
+		if ctx.Message.Cmd() == CmdNotify {
+			chNotify <- ctx.Method()
+			return
+		}
+		ctx.Write("forwarded " + ctx.Method())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/unknown", nil, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "forwarded /unknown" {
+		t.Fatalf("Client.Call() rsp = %v, want forwarded /unknown", rsp)
+	}
+	if err = c.Notify("/unknown/notify", nil, time.Second); err != nil {
+		t.Fatalf("Client.Notify() error = %v", err)
+	}
+	select {
+	case method := <-chNotify:
+		if method != "/unknown/notify" {
+			t.Fatalf("not found handler method = %v, want /unknown/notify", method)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not found handler not called for notify")
+	}
+}
+
+func Test_handler_OnMessageReplayedResponse(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/replay", func(ctx *Context) {
+		// respond twice with the same seq
+		for i := 0; i < 2; i++ {
+			rsp := newMessage(CmdResponse, ctx.Method(), ctx.Body(), false, false, ctx.Seq(), ctx.Client.Handler, ctx.Client.Codec, nil)
+			ctx.Client.PushMsg(rsp, TimeForever)
+		}
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	chMiss := make(chan uint64, 4)
+	c.Handler.HandleSessionMiss(func(c *Client, m *Message) {
+		chMiss <- m.Seq()
+	})
+
+	for i := 0; i < 2; i++ {
+		rsp := ""
+		if err = c.Call("/replay", "hello", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		if rsp != "hello" {
+			t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+		}
+		select {
+		case <-chMiss:
+		case <-time.After(time.Second):
+			t.Fatalf("replayed response not dropped as session miss")
+		}
+	}
+}
+
 func Test_handler_BeforeRecv(t *testing.T) {
 	DefaultHandler.BeforeRecv(func(net.Conn) error { return nil })
 }
@@ -96,6 +255,124 @@ func Test_handler_SetBatchSend(t *testing.T) {
 	}
 }
 
+func Test_handler_SetAsyncDispatch(t *testing.T) {
+	h := NewHandler()
+	if got := h.AsyncDispatch(); got != 0 {
+		t.Fatalf("handler.AsyncDispatch() = %v, want 0", got)
+	}
+
+	svr := NewServer()
+	svr.Handler = h
+	svr.Handler.SetAsyncDispatch(2)
+	var running, maxRunning int32
+	svr.Handler.Handle("/slow", func(ctx *Context) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Second / 20)
+		atomic.AddInt32(&running, -1)
+		ctx.Write(nil)
+	})
+	svr.Handler.Handle("/fast", func(ctx *Context) {
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	defer SetHandler(DefaultHandler)
+	SetHandler(NewHandler())
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	// the fast call is not blocked by the slow one on the same connection
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/slow", nil, nil, time.Second) }()
+	time.Sleep(time.Second / 100)
+	t0 := time.Now()
+	if err = c.Call("/fast", nil, nil, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if used := time.Since(t0); used >= time.Second/40 {
+		t.Fatalf("Client.Call() took %v, blocked by the slow handler", used)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+
+	// the handlers running concurrently are bounded by the pool size
+	chErr := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		go func() { chErr <- c.Call("/slow", nil, nil, time.Second) }()
+	}
+	for i := 0; i < 6; i++ {
+		if err = <-chErr; err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if max := atomic.LoadInt32(&maxRunning); max != 2 {
+		t.Fatalf("max running handlers = %v, want 2", max)
+	}
+}
+
+func Test_handler_SetOverloadPolicy(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.SetAsyncDispatch(1)
+	svr.SetOverloadPolicy(OverloadPolicyReject)
+	if got := svr.Handler.OverloadPolicy(); got != OverloadPolicyReject {
+		t.Fatalf("handler.OverloadPolicy() = %v, want %v", got, OverloadPolicyReject)
+	}
+	svr.Handler.Handle("/slow", func(ctx *Context) {
+		time.Sleep(time.Second / 20)
+		ctx.Write(nil)
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	defer SetHandler(DefaultHandler)
+	SetHandler(NewHandler())
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	done := make(chan error, 1)
+	go func() { done <- c.Call("/slow", nil, nil, time.Second) }()
+	time.Sleep(time.Second / 100)
+	err = c.Call("/slow", nil, nil, time.Second)
+	if !errors.Is(err, ErrServerBusy) || err == ErrClientTimeout {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrServerBusy)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+
+	// the idempotent call is retried after backing off
+	c.MarkIdempotent("/slow")
+	go func() { done <- c.Call("/slow", nil, nil, time.Second) }()
+	time.Sleep(time.Second / 100)
+	if err = c.CallRetry("/slow", nil, nil, time.Second, 5); err != nil {
+		t.Fatalf("Client.CallRetry() error = %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+}
+
 func Test_handler_WrapReader(t *testing.T) {
 	DefaultHandler.SetReaderWrapper(nil)
 	if got := DefaultHandler.WrapReader(nil); got != nil {
@@ -107,6 +384,28 @@ func Test_handler_SetReaderWrapper(t *testing.T) {
 	Test_handler_WrapReader(t)
 }
 
+func Test_handler_WrapWriter(t *testing.T) {
+	h := NewHandler()
+	if _, ok := h.WrapWriter(nil).(*bufio.Writer); !ok {
+		t.Errorf("handler.WrapWriter() is not a *bufio.Writer")
+	}
+	h.SetWriterWrapper(nil)
+	if got := h.WrapWriter(nil); got != nil {
+		t.Errorf("handler.WrapWriter() = %v, want %v", got, nil)
+	}
+}
+
+func Test_handler_SendBufferSize(t *testing.T) {
+	h := NewHandler()
+	if got := h.SendBufferSize(); got != 8192 {
+		t.Errorf("handler.SendBufferSize() = %v, want %v", got, 8192)
+	}
+	h.SetSendBufferSize(1024)
+	if got := h.SendBufferSize(); got != 1024 {
+		t.Errorf("handler.SendBufferSize() = %v, want %v", got, 1024)
+	}
+}
+
 func Test_handler_RecvBufferSize(t *testing.T) {
 	if got := DefaultHandler.RecvBufferSize(); got != 8192 {
 		t.Errorf("handler.RecvBufferSize() = %v, want %v", got, 8192)
@@ -119,6 +418,109 @@ func Test_handler_SetRecvBufferSize(t *testing.T) {
 	if got := DefaultHandler.RecvBufferSize(); got != size {
 		t.Errorf("handler.RecvBufferSize() = %v, want %v", got, size)
 	}
+
+	h := NewHandler()
+	h.SetRecvBufferSize(1)
+	if got := h.RecvBufferSize(); got != MinRecvBufferSize {
+		t.Errorf("handler.RecvBufferSize() = %v, want %v", got, MinRecvBufferSize)
+	}
+}
+
+// loopConn replays a frame forever and counts the reads, which are syscalls for a real net.Conn.
+type loopConn struct {
+	net.Conn
+	frame  []byte
+	offset int
+	reads  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	c.reads++
+	n := 0
+	for n < len(b) {
+		copied := copy(b[n:], c.frame[c.offset:])
+		c.offset = (c.offset + copied) % len(c.frame)
+		n += copied
+	}
+	return n, nil
+}
+
+func benchmarkHandlerRecvBufferSize(b *testing.B, size int) {
+	h := NewHandler()
+	h.SetRecvBufferSize(size)
+	frame := newMessage(CmdNotify, "/large", make([]byte, 1024*16), false, false, 0, h, nil, nil).Buffer
+	conn := &loopConn{frame: frame}
+	c := &Client{Conn: conn, Handler: h}
+	c.Head = Header(c.head[:])
+	c.initReader()
+
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Recv(c); err != nil {
+			b.Fatalf("handler.Recv() error = %v", err)
+		}
+	}
+	b.ReportMetric(float64(conn.reads)/float64(b.N), "reads/op")
+}
+
+// go test -run none -bench RecvBufferSize
+func Benchmark_handler_RecvBufferSize4K(b *testing.B) {
+	benchmarkHandlerRecvBufferSize(b, 4096)
+}
+
+func Benchmark_handler_RecvBufferSize64K(b *testing.B) {
+	benchmarkHandlerRecvBufferSize(b, 65536)
+}
+
+// benchMethod is longer than 32 bytes, a shorter string converted from bytes doesn't escape may not allocate.
+const benchMethod = "/service/v1/user/profile/get_by_id"
+
+func benchmarkHandlerRouteLookup(b *testing.B, copyMethod bool) {
+	h := NewHandler()
+	h.Handle(benchMethod, func(ctx *Context) {})
+	msg := newMessage(CmdRequest, benchMethod, nil, false, false, 1, h, nil, nil)
+	routes := h.(*handler).routes
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var method string
+		if copyMethod {
+			method = msg.Method()
+		} else {
+			method = msg.method()
+		}
+		if method == MethodHandshake {
+			b.Fatalf("invalid method %v", method)
+		}
+		if _, ok := routes[method]; !ok {
+			b.Fatalf("route of %v not found", method)
+		}
+	}
+}
+
+// go test -run none -bench RouteLookup
+func Benchmark_handler_RouteLookupCopy(b *testing.B) {
+	benchmarkHandlerRouteLookup(b, true)
+}
+
+func Benchmark_handler_RouteLookupNoCopy(b *testing.B) {
+	benchmarkHandlerRouteLookup(b, false)
+}
+
+// Benchmark_handler_OnMessage allocates the Context only.
+func Benchmark_handler_OnMessage(b *testing.B) {
+	h := NewHandler()
+	h.Handle(benchMethod, func(ctx *Context) {})
+	c := &Client{Handler: h}
+	msg := newMessage(CmdNotify, benchMethod, nil, false, false, 1, h, nil, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.OnMessage(c, msg)
+	}
 }
 
 func Test_handler_SendQueueSize(t *testing.T) {
@@ -135,6 +537,192 @@ func Test_handler_SetSendQueueSize(t *testing.T) {
 	}
 }
 
+type countingBufferPool struct {
+	gets int64
+	puts int64
+}
+
+func (p *countingBufferPool) Get(size int) []byte {
+	atomic.AddInt64(&p.gets, 1)
+	return make([]byte, size)
+}
+
+func (p *countingBufferPool) Put(buf []byte) {
+	atomic.AddInt64(&p.puts, 1)
+}
+
+func Test_handler_SetBufferPool(t *testing.T) {
+	pool := &countingBufferPool{}
+	h := NewHandler()
+	h.SetBufferPool(pool)
+	h.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+
+	c := &Client{Handler: h, Codec: codec.DefaultCodec, chSend: make(chan *Message, 1)}
+	c.running = true
+	msg := newMessage(CmdRequest, "/echo", "hello", false, false, 1, h, codec.DefaultCodec, nil)
+	h.OnMessage(c, msg)
+
+	if gets := atomic.LoadInt64(&pool.gets); gets != 2 {
+		t.Fatalf("BufferPool.Get() called %v times, want %v", gets, 2)
+	}
+	if puts := atomic.LoadInt64(&pool.puts); puts != 1 {
+		t.Fatalf("BufferPool.Put() called %v times, want %v", puts, 1)
+	}
+	if rsp := <-c.chSend; string(rsp.Data()) != "hello" {
+		t.Fatalf("response data = %v, want hello", string(rsp.Data()))
+	}
+
+	h.SetBufferPool(nil)
+	if buf := h.GetBuffer(8); len(buf) != 8 {
+		t.Fatalf("handler.GetBuffer() len = %v, want %v", len(buf), 8)
+	}
+}
+
+// fragmentConn returns at most n bytes for every Read, as a datagram transport like KCP may do.
+type fragmentConn struct {
+	net.Conn
+	r *bytes.Reader
+	n int
+}
+
+func (c *fragmentConn) Read(b []byte) (int, error) {
+	if len(b) > c.n {
+		b = b[:c.n]
+	}
+	return c.r.Read(b)
+}
+
+func Test_handler_RecvFragmented(t *testing.T) {
+	h := NewHandler()
+	bodies := []string{"a", "hello", string(make([]byte, 1024))}
+	buf := []byte{}
+	for i, v := range bodies {
+		buf = append(buf, newMessage(CmdRequest, "/echo", v, false, false, uint64(i), h, nil, nil).Buffer...)
+	}
+
+	for _, batch := range []bool{true, false} {
+		h.SetBatchRecv(batch)
+		c := &Client{Conn: &fragmentConn{r: bytes.NewReader(buf), n: 3}, Handler: h}
+		c.Head = Header(c.head[:])
+		c.initReader()
+		for i, v := range bodies {
+			msg, err := h.Recv(c)
+			if err != nil {
+				t.Fatalf("handler.Recv() error = %v", err)
+			}
+			if msg.Seq() != uint64(i) || msg.Method() != "/echo" || string(msg.Data()) != v {
+				t.Fatalf("handler.Recv() = %v, %v, %v, want %v, /echo, %v", msg.Seq(), msg.Method(), len(msg.Data()), i, len(v))
+			}
+		}
+		if _, err := h.Recv(c); err != io.EOF {
+			t.Fatalf("handler.Recv() error = %v, want %v", err, io.EOF)
+		}
+	}
+}
+
+func Test_handler_RecvOneByteReader(t *testing.T) {
+	h := NewHandler()
+	h.SetBatchRecv(true)
+	h.SetReaderWrapper(func(conn net.Conn) io.Reader {
+		return iotest.OneByteReader(conn)
+	})
+
+	// the frame without method and data has an empty body
+	frames := []struct{ method, body string }{{"/echo", "a"}, {"", ""}, {"/echo", string(make([]byte, 1024*64))}}
+	buf := []byte{}
+	for i, v := range frames {
+		buf = append(buf, newMessage(CmdRequest, v.method, v.body, false, false, uint64(i), h, nil, nil).Buffer...)
+	}
+
+	c := &Client{Conn: &fragmentConn{r: bytes.NewReader(buf), n: len(buf)}, Handler: h}
+	c.Head = Header(c.head[:])
+	c.initReader()
+	for i, v := range frames {
+		msg, err := h.Recv(c)
+		if err != nil {
+			t.Fatalf("handler.Recv() error = %v", err)
+		}
+		if msg.Seq() != uint64(i) || msg.Method() != v.method || string(msg.Data()) != v.body {
+			t.Fatalf("handler.Recv() = %v, %v, %v, want %v, %v, %v", msg.Seq(), msg.Method(), len(msg.Data()), i, v.method, len(v.body))
+		}
+	}
+	if _, err := h.Recv(c); err != io.EOF {
+		t.Fatalf("handler.Recv() error = %v, want %v", err, io.EOF)
+	}
+
+	// a frame truncated in the middle of the body
+	truncated := buf[:len(buf)-1]
+	c = &Client{Conn: &fragmentConn{r: bytes.NewReader(truncated), n: len(truncated)}, Handler: h}
+	c.Head = Header(c.head[:])
+	c.initReader()
+	for range frames[:len(frames)-1] {
+		if _, err := h.Recv(c); err != nil {
+			t.Fatalf("handler.Recv() error = %v", err)
+		}
+	}
+	if _, err := h.Recv(c); err != io.ErrUnexpectedEOF {
+		t.Fatalf("handler.Recv() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func Test_handler_OnMessageInvalidLength(t *testing.T) {
+	h := NewHandler()
+
+	onMessage := func(msg *Message) error {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		c := &Client{Conn: conn, Handler: h, running: true}
+		h.OnMessage(c, msg)
+		return c.stopErr
+	}
+
+	msg := newMessage(CmdRequest, "/echo", "hello", false, false, 1, h, nil, nil)
+	msg.Buffer[HeaderIndexMethodLen] = byte(msg.BodyLen() + 1)
+	if err := onMessage(msg); !errors.Is(err, ErrInvalidMethodLen) {
+		t.Fatalf("handler.OnMessage() error = %v, want %v", err, ErrInvalidMethodLen)
+	}
+
+	msg = newMessage(CmdRequest, "/echo", nil, false, false, 1, h, nil, nil)
+	msg.Buffer[HeaderIndexFlag] |= HeaderFlagMaskHeader
+	if err := onMessage(msg); !errors.Is(err, ErrInvalidHeaderLen) {
+		t.Fatalf("handler.OnMessage() error = %v, want %v", err, ErrInvalidHeaderLen)
+	}
+}
+
+func Test_handler_RecvRandomHead(t *testing.T) {
+	h := NewHandler()
+	h.SetBatchRecv(false)
+	h.SetMaxBodyLen(1024)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		buf := make([]byte, HeadLen+r.Intn(64))
+		r.Read(buf)
+		if i%2 == 0 {
+			// make the body length match the bytes sent to reach the method and header checks
+			binary.LittleEndian.PutUint32(buf, uint32(len(buf)-HeadLen))
+		}
+		c := &Client{Conn: &fragmentConn{r: bytes.NewReader(buf), n: len(buf)}, Handler: h}
+		c.Head = Header(c.head[:])
+		c.initReader()
+		msg, err := h.Recv(c)
+		if err != nil {
+			if msg != nil && uint64(msg.BodyLen()) > uint64(h.MaxBodyLen()) {
+				t.Fatalf("handler.Recv() body length %v > %v", msg.BodyLen(), h.MaxBodyLen())
+			}
+			continue
+		}
+		if msg.validate() != nil {
+			continue
+		}
+		msg.Method()
+		msg.Header()
+		msg.Data()
+	}
+}
+
 func Test_handler_Handle(t *testing.T) {
 	DefaultHandler.Handle("/hello", func(*Context) {})
 }
@@ -157,18 +745,24 @@ func TestSetHandler(t *testing.T) {
 	HandleOverstock(func(c *Client, m *Message) {})
 	HandleMessageDropped(func(c *Client, m *Message) {})
 	HandleSessionMiss(func(c *Client, m *Message) {})
+	HandlePanic(nil)
 	BeforeRecv(func(net.Conn) error { return nil })
 	BeforeSend(func(net.Conn) error { return nil })
 	SetBatchRecv(true)
 	SetBatchSend(true)
 	SetAsyncResponse(true)
 	SetReaderWrapper(func(c net.Conn) io.Reader { return c })
+	SetWriterWrapper(func(c net.Conn) io.Writer { return c })
 	SetRecvBufferSize(4096)
+	SetSendBufferSize(4096)
 	SetSendQueueSize(4096)
+	SetWriteBatchSize(10)
 	Use(func(*Context) {})
+	UseWrapper(nil)
 	UseCoder(nil)
 	Handle("nothing", func(*Context) {}, true)
 	HandleNotFound(func(*Context) {})
 	SetBufferFactory(func(int) []byte { return nil })
+	SetBufferPool(nil)
 	SetHandler(d)
 }
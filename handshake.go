@@ -0,0 +1,111 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/internal/log"
+)
+
+const (
+	// ProtocolVersion0 is the original frame layout, it's used with the peers which don't support handshake.
+	ProtocolVersion0 byte = 0
+	// ProtocolVersion1 supports the features exchanged by handshake.
+	ProtocolVersion1 byte = 1
+	// ProtocolVersion is the latest version supported.
+	ProtocolVersion = ProtocolVersion1
+)
+
+const (
+	// FeatureLongMethod represents that methods longer than MaxShortMethodLen are supported.
+	FeatureLongMethod uint32 = 1 << 0
+	// FeatureChecksum represents that CRC32 body checksum is supported.
+	FeatureChecksum uint32 = 1 << 1
+	// FeatureErrorCode represents that the code of the error responses is supported, see Context.ErrorCode.
+	FeatureErrorCode uint32 = 1 << 2
+	// FeatureDeadline represents that the timeout of the requests in the header is supported, see Client.PropagateDeadline.
+	FeatureDeadline uint32 = 1 << 3
+
+	// SupportedFeatures represents all the features supported.
+	SupportedFeatures = FeatureLongMethod | FeatureChecksum | FeatureErrorCode | FeatureDeadline
+)
+
+const (
+	// MethodHandshake is the builtin method used to negotiate the protocol version and features on connect.
+	MethodHandshake = "/arpc/handshake"
+
+	handshakeLen = 5
+)
+
+// HandshakeTimeout limits how long a Client waits for the handshake response,
+// the Client falls back to ProtocolVersion0 if it times out.
+var HandshakeTimeout = time.Second
+
+// Version returns the negotiated protocol version.
+func (c *Client) Version() byte {
+	return byte(atomic.LoadUint32(&c.version))
+}
+
+// HasFeature returns true if feature is supported by both sides.
+func (c *Client) HasFeature(feature uint32) bool {
+	return atomic.LoadUint32(&c.features)&feature == feature
+}
+
+func (c *Client) setProtocol(version byte, features uint32) {
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version == ProtocolVersion0 {
+		features = 0
+	}
+	atomic.StoreUint32(&c.features, features&SupportedFeatures)
+	atomic.StoreUint32(&c.version, uint32(version))
+}
+
+// handshake advertises the supported version and features to the server,
+// an old server responds ErrMethodNotFound and the Client falls back to ProtocolVersion0.
+func (c *Client) handshake() {
+	msg := newMessage(CmdRequest, MethodHandshake, encodeHandshake(ProtocolVersion, SupportedFeatures), false, false, c.nextSeq(), c.Handler, nil, nil)
+	rsp, err := c.call(msg, HandshakeTimeout)
+	if err == nil && rsp == nil {
+		err = ErrClientReconnecting
+	}
+	if err == nil {
+		err = rsp.Error()
+	}
+	if err != nil {
+		log.Infow("Handshake failed, fall back to protocol version 0", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "error", err)
+		c.setProtocol(ProtocolVersion0, 0)
+		return
+	}
+	version, features := decodeHandshake(rsp.Data())
+	c.setProtocol(version, features)
+}
+
+// onHandshake negotiates with the client and responds the version and features supported.
+func (c *Client) onHandshake(msg *Message) {
+	version, features := decodeHandshake(msg.Data())
+	c.setProtocol(version, features)
+
+	rsp := newMessage(CmdResponse, MethodHandshake, encodeHandshake(ProtocolVersion, SupportedFeatures), false, msg.IsAsync(), msg.Seq(), c.Handler, nil, nil)
+	c.PushMsg(rsp, TimeZero)
+}
+
+func encodeHandshake(version byte, features uint32) []byte {
+	buf := make([]byte, handshakeLen)
+	buf[0] = version
+	binary.LittleEndian.PutUint32(buf[1:], features)
+	return buf
+}
+
+func decodeHandshake(data []byte) (byte, uint32) {
+	if len(data) < handshakeLen {
+		return ProtocolVersion0, 0
+	}
+	return data[0], binary.LittleEndian.Uint32(data[1:])
+}
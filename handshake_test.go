@@ -0,0 +1,125 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v0Handler responds the handshake as a server of ProtocolVersion0 does.
+type v0Handler struct {
+	Handler
+}
+
+func (h *v0Handler) OnMessage(c *Client, msg *Message) {
+	m := &Message{Buffer: append([]byte{}, msg.Buffer...)}
+	coders := h.Coders()
+	for i := len(coders) - 1; i >= 0; i-- {
+		m = coders[i].Decode(c, m)
+	}
+	if m.Cmd() == CmdRequest && m.Method() == MethodHandshake {
+		c.PushMsg(newMessage(CmdResponse, MethodHandshake, ErrMethodNotFound, true, m.IsAsync(), m.Seq(), h, nil, nil), TimeZero)
+		return
+	}
+	h.Handler.OnMessage(c, msg)
+}
+
+func TestClient_Handshake(t *testing.T) {
+	chVersion := make(chan byte, 1)
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		chVersion <- ctx.Client.Version()
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	if c.Version() != ProtocolVersion {
+		t.Fatalf("Client.Version() = %v, want %v", c.Version(), ProtocolVersion)
+	}
+	if !c.HasFeature(SupportedFeatures) {
+		t.Fatalf("Client.HasFeature() = false, want true")
+	}
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if v := <-chVersion; v != ProtocolVersion {
+		t.Fatalf("server side Client.Version() = %v, want %v", v, ProtocolVersion)
+	}
+}
+
+func TestClient_HandshakeFallback(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = &v0Handler{svr.Handler}
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.EnableChecksum(true)
+
+	if c.Version() != ProtocolVersion0 {
+		t.Fatalf("Client.Version() = %v, want %v", c.Version(), ProtocolVersion0)
+	}
+	if c.HasFeature(FeatureChecksum) {
+		t.Fatalf("Client.HasFeature() = true, want false")
+	}
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "hello" {
+		t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+	}
+	if err = c.Call(strings.Repeat("m", MaxShortMethodLen+1), "hello", &rsp, time.Second); err == nil {
+		t.Fatalf("Client.Call() error = nil, want invalid method length")
+	}
+}
+
+func TestHandler_OnMessageUnsupportedVersion(t *testing.T) {
+	svrHandler := NewHandler()
+	svrHandler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	conn1, conn2 := net.Pipe()
+	svrCli := NewClientWithConn(conn1, nil, svrHandler)
+	defer svrCli.Stop()
+	c := NewClientWithConn(conn2, nil, NewHandler())
+	defer c.Stop()
+
+	msg := newMessage(CmdRequest, "/echo", "hello", false, false, c.nextSeq(), c.Handler, nil, nil)
+	msg.SetVersion(ProtocolVersion + 1)
+	rsp, err := c.call(msg, time.Second)
+	if err != nil {
+		t.Fatalf("Client.call() error = %v", err)
+	}
+	if err = rsp.Error(); err == nil || err.Error() != ErrUnsupportedVersion.Error() {
+		t.Fatalf("Message.Error() = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/arpc/internal/log"
+	"github.com/lesismal/arpc/internal/util"
+)
+
+// SetHealthCheck calls method by every Client of the pool every interval, a Client whose call fails in timeout
+// is skipped by Next until a later call succeeds, and its Conn is closed to reconnect if it's connected,
+// so a half-dead connection whose socket hasn't errored yet is not selected repeatedly.
+// The method should be handled by the servers, an error response fails the health check too.
+// The previous health check is stopped, and interval <= 0 disables it, which is the default.
+func (pool *ClientPool) SetHealthCheck(method string, interval, timeout time.Duration) {
+	pool.healthMux.Lock()
+	defer pool.healthMux.Unlock()
+
+	if pool.chHealthStop != nil {
+		close(pool.chHealthStop)
+		pool.chHealthStop = nil
+	}
+	if interval <= 0 {
+		for _, c := range pool.clients {
+			atomic.StoreInt32(&c.unhealthy, 0)
+		}
+		return
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	chStop := make(chan util.Empty)
+	pool.chHealthStop = chStop
+	go util.Safe(func() {
+		pool.healthCheckLoop(method, interval, timeout, chStop)
+	})
+}
+
+// available returns true if the Client is connected and hasn't failed the health check.
+func (pool *ClientPool) available(c *Client) bool {
+	return c.IsConnected() && atomic.LoadInt32(&c.unhealthy) == 0
+}
+
+func (pool *ClientPool) healthCheckLoop(method string, interval, timeout time.Duration, chStop chan util.Empty) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.checkHealth(method, timeout)
+		case <-chStop:
+			return
+		}
+	}
+}
+
+// checkHealth calls method by all the Clients concurrently and waits for them.
+func (pool *ClientPool) checkHealth(method string, timeout time.Duration) {
+	wg := sync.WaitGroup{}
+	for _, c := range pool.clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			err := c.Call(method, nil, nil, timeout)
+			if err == nil {
+				if atomic.CompareAndSwapInt32(&c.unhealthy, 1, 0) {
+					log.Infow("Health check recovered", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr())
+				}
+				return
+			}
+			if atomic.CompareAndSwapInt32(&c.unhealthy, 0, 1) {
+				log.Warnw("Health check failed", "tag", c.Handler.LogTag(), "remote_addr", c.Conn.RemoteAddr(), "error", err)
+			}
+			if c.IsConnected() {
+				c.Conn.Close()
+			}
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientPool_SetHealthCheck(t *testing.T) {
+	// the pings of the connection from blocked are not responded, like a half-dead connection
+	var blocked atomic.Value
+	blocked.Store("")
+	svr := NewServer()
+	svr.Handler.Handle("/ping", func(ctx *Context) {
+		if ctx.Client.Conn.RemoteAddr().String() != blocked.Load().(string) {
+			ctx.Write(nil)
+		}
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	pool, err := NewClientPool(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	}, 2)
+	if err != nil {
+		t.Fatalf("NewClientPool() error = %v", err)
+	}
+	defer pool.Stop()
+	sick := pool.Get(0)
+	sick.SetReconnectBackoff(func(int) time.Duration { return time.Second / 100 })
+	sickAddr := sick.Conn.LocalAddr().String()
+	blocked.Store(sickAddr)
+
+	pool.SetHealthCheck("/ping", time.Second/10, time.Second/50)
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(time.Second / 200)
+		}
+		return false
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&sick.unhealthy) == 1 }) {
+		t.Fatalf("the Client failed the health check is not marked")
+	}
+	for i := 0; i < 4; i++ {
+		if c := pool.Next(); c == sick {
+			t.Fatalf("ClientPool.Next() selected the Client failed the health check")
+		}
+	}
+
+	// it's reconnected by another connection and recovers at the next health check
+	if !waitFor(func() bool { return atomic.LoadInt32(&sick.unhealthy) == 0 }) {
+		t.Fatalf("the Client is not recovered")
+	}
+	if !sick.IsConnected() || sick.Conn.LocalAddr().String() == sickAddr {
+		t.Fatalf("the Client failed the health check is not reconnected")
+	}
+
+	pool.SetHealthCheck("", 0, 0)
+	if pool.chHealthStop != nil {
+		t.Fatalf("the health check is not stopped")
+	}
+}
@@ -7,6 +7,7 @@ package log
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -19,6 +20,10 @@ var (
 
 	// DefaultLogger is the default logger and is used by arpc
 	DefaultLogger Logger = &logger{level: LevelInfo}
+
+	// DefaultStructuredLogger is used by Debugw, Infow, Warnw and Errorw if it's not nil,
+	// else the fields are formatted into the message of DefaultLogger.
+	DefaultStructuredLogger StructuredLogger
 )
 
 const (
@@ -34,6 +39,9 @@ const (
 	LevelError
 	// LevelNone disables all logs.
 	LevelNone
+
+	// LevelOff is the same as LevelNone.
+	LevelOff = LevelNone
 )
 
 // Logger defines log interface
@@ -45,9 +53,27 @@ type Logger interface {
 	Error(format string, v ...interface{})
 }
 
+// StructuredLogger defines structured log interface,
+// keysAndValues are alternating keys and values, e.g. "remote_addr", addr, "seq", seq.
+type StructuredLogger interface {
+	SetLevel(lvl int)
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
 // SetLogger sets default logger.
 func SetLogger(l Logger) {
 	DefaultLogger = l
+	DefaultStructuredLogger = nil
+}
+
+// SetStructuredLogger sets default structured logger, which is used by the printf style logs too,
+// they are sent to it as messages without fields.
+func SetStructuredLogger(l StructuredLogger) {
+	DefaultStructuredLogger = l
+	DefaultLogger = &printfLogger{l}
 }
 
 // SetLevel sets default logger's priority.
@@ -66,6 +92,11 @@ type logger struct {
 	level int
 }
 
+// Level returns logs priority.
+func (l *logger) Level() int {
+	return l.level
+}
+
 // SetLevel sets logs priority.
 func (l *logger) SetLevel(lvl int) {
 	switch lvl {
@@ -105,6 +136,112 @@ func (l *logger) Error(format string, v ...interface{}) {
 	}
 }
 
+// printfLogger implements Logger by a StructuredLogger.
+type printfLogger struct {
+	l StructuredLogger
+}
+
+// Level returns logs priority if the StructuredLogger has a Level method, else LevelAll.
+func (l *printfLogger) Level() int {
+	if lv, ok := l.l.(leveler); ok {
+		return lv.Level()
+	}
+	return LevelAll
+}
+
+// SetLevel sets logs priority.
+func (l *printfLogger) SetLevel(lvl int) {
+	l.l.SetLevel(lvl)
+}
+
+// Debug logs a formatted message at LevelDebug.
+func (l *printfLogger) Debug(format string, v ...interface{}) {
+	l.l.Debugw(fmt.Sprintf(format, v...))
+}
+
+// Info logs a formatted message at LevelInfo.
+func (l *printfLogger) Info(format string, v ...interface{}) {
+	l.l.Infow(fmt.Sprintf(format, v...))
+}
+
+// Warn logs a formatted message at LevelWarn.
+func (l *printfLogger) Warn(format string, v ...interface{}) {
+	l.l.Warnw(fmt.Sprintf(format, v...))
+}
+
+// Error logs a formatted message at LevelError.
+func (l *printfLogger) Error(format string, v ...interface{}) {
+	l.l.Errorw(fmt.Sprintf(format, v...))
+}
+
+// leveler is implemented by the loggers which report their priority.
+type leveler interface {
+	Level() int
+}
+
+// Enabled returns true if the logs of lvl are output by the default logger, it's used to skip
+// the evaluation of expensive arguments. The loggers without a Level method are assumed to output all logs.
+func Enabled(lvl int) bool {
+	var l interface{} = DefaultLogger
+	if DefaultStructuredLogger != nil {
+		l = DefaultStructuredLogger
+	}
+	if l == nil {
+		return false
+	}
+	if lv, ok := l.(leveler); ok {
+		return lvl >= lv.Level()
+	}
+	return true
+}
+
+// formatFields formats msg with the fields in the text format of the printf style logs, e.g.
+// "[ARPC CLI]\t127.0.0.1:8888\tDisconnected: EOF\tseq=1": the values of "tag" and "remote_addr" lead
+// the message, the value of "error" follows it, and the other fields are appended as "\tkey=value".
+func formatFields(msg string, keysAndValues []interface{}) string {
+	var tag, addr, err interface{}
+	var hasTag, hasAddr, hasErr bool
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		switch k, _ := keysAndValues[i].(string); k {
+		case "tag":
+			tag, hasTag = keysAndValues[i+1], true
+		case "remote_addr":
+			addr, hasAddr = keysAndValues[i+1], true
+		case "error":
+			err, hasErr = keysAndValues[i+1], true
+		}
+	}
+
+	b := strings.Builder{}
+	if hasTag {
+		fmt.Fprintf(&b, "%v", tag)
+		if hasAddr {
+			b.WriteString("\t")
+		} else {
+			b.WriteString(" ")
+		}
+	}
+	if hasAddr {
+		fmt.Fprintf(&b, "%v\t", addr)
+	}
+	b.WriteString(msg)
+	if hasErr {
+		fmt.Fprintf(&b, ": %v", err)
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 >= len(keysAndValues) {
+			fmt.Fprintf(&b, "\t%v", keysAndValues[i])
+			break
+		}
+		switch k, _ := keysAndValues[i].(string); k {
+		case "tag", "remote_addr", "error":
+		default:
+			fmt.Fprintf(&b, "\t%v=%v", keysAndValues[i], keysAndValues[i+1])
+		}
+	}
+	return b.String()
+}
+
 // Debug uses DefaultLogger to log a message at LevelDebug.
 func Debug(format string, v ...interface{}) {
 	if DefaultLogger != nil {
@@ -132,3 +269,55 @@ func Error(format string, v ...interface{}) {
 		DefaultLogger.Error(format, v...)
 	}
 }
+
+// Debugw uses DefaultStructuredLogger to log a message with fields at LevelDebug,
+// if it's nil, the fields are formatted into the message of DefaultLogger.
+func Debugw(msg string, keysAndValues ...interface{}) {
+	if !Enabled(LevelDebug) {
+		return
+	}
+	if DefaultStructuredLogger != nil {
+		DefaultStructuredLogger.Debugw(msg, keysAndValues...)
+	} else if DefaultLogger != nil {
+		DefaultLogger.Debug("%s", formatFields(msg, keysAndValues))
+	}
+}
+
+// Infow uses DefaultStructuredLogger to log a message with fields at LevelInfo,
+// if it's nil, the fields are formatted into the message of DefaultLogger.
+func Infow(msg string, keysAndValues ...interface{}) {
+	if !Enabled(LevelInfo) {
+		return
+	}
+	if DefaultStructuredLogger != nil {
+		DefaultStructuredLogger.Infow(msg, keysAndValues...)
+	} else if DefaultLogger != nil {
+		DefaultLogger.Info("%s", formatFields(msg, keysAndValues))
+	}
+}
+
+// Warnw uses DefaultStructuredLogger to log a message with fields at LevelWarn,
+// if it's nil, the fields are formatted into the message of DefaultLogger.
+func Warnw(msg string, keysAndValues ...interface{}) {
+	if !Enabled(LevelWarn) {
+		return
+	}
+	if DefaultStructuredLogger != nil {
+		DefaultStructuredLogger.Warnw(msg, keysAndValues...)
+	} else if DefaultLogger != nil {
+		DefaultLogger.Warn("%s", formatFields(msg, keysAndValues))
+	}
+}
+
+// Errorw uses DefaultStructuredLogger to log a message with fields at LevelError,
+// if it's nil, the fields are formatted into the message of DefaultLogger.
+func Errorw(msg string, keysAndValues ...interface{}) {
+	if !Enabled(LevelError) {
+		return
+	}
+	if DefaultStructuredLogger != nil {
+		DefaultStructuredLogger.Errorw(msg, keysAndValues...)
+	} else if DefaultLogger != nil {
+		DefaultLogger.Error("%s", formatFields(msg, keysAndValues))
+	}
+}
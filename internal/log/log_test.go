@@ -59,3 +59,85 @@ func Test_Warn(t *testing.T) {
 func Test_Error(t *testing.T) {
 	Error("log.Error")
 }
+
+type testStructuredLogger struct {
+	msg    string
+	fields []interface{}
+}
+
+func (l *testStructuredLogger) SetLevel(lvl int) {}
+
+func (l *testStructuredLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.msg, l.fields = msg, keysAndValues
+}
+
+func (l *testStructuredLogger) Infow(msg string, keysAndValues ...interface{}) {
+	l.msg, l.fields = msg, keysAndValues
+}
+
+func (l *testStructuredLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.msg, l.fields = msg, keysAndValues
+}
+
+func (l *testStructuredLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	l.msg, l.fields = msg, keysAndValues
+}
+
+func TestSetLogger_Structured(t *testing.T) {
+	defer SetLogger(DefaultLogger)
+
+	l := &testStructuredLogger{}
+	SetStructuredLogger(l)
+	Infow("Connected", "remote_addr", "127.0.0.1:8888")
+	if l.msg != "Connected" || len(l.fields) != 2 || l.fields[1] != "127.0.0.1:8888" {
+		t.Fatalf("Infow() = %v %v, want Connected [remote_addr 127.0.0.1:8888]", l.msg, l.fields)
+	}
+	Error("printf %v", "log")
+	if l.msg != "printf log" || len(l.fields) != 0 {
+		t.Fatalf("Error() = %v %v, want printf log []", l.msg, l.fields)
+	}
+}
+
+func Test_formatFields(t *testing.T) {
+	// the same as the printf style log "%v\t%v\tDisconnected: %v"
+	got := formatFields("Disconnected", []interface{}{"tag", "[ARPC CLI]", "remote_addr", "127.0.0.1:8888", "error", "EOF"})
+	if got != "[ARPC CLI]\t127.0.0.1:8888\tDisconnected: EOF" {
+		t.Fatalf("formatFields() = %q", got)
+	}
+	// the same as the printf style log "%v Accept error: %v"
+	if got = formatFields("Accept error", []interface{}{"tag", "[ARPC SVR]", "error", "EOF"}); got != "[ARPC SVR] Accept error: EOF" {
+		t.Fatalf("formatFields() = %q", got)
+	}
+	if got = formatFields("Disconnected", []interface{}{"seq", 1, "error", "EOF", "odd"}); got != "Disconnected: EOF\tseq=1\todd" {
+		t.Fatalf("formatFields() = %q", got)
+	}
+}
+
+type countingStringer int
+
+func (s *countingStringer) String() string {
+	*s++
+	return "counted"
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetLogger(DefaultLogger)
+
+	l := &logger{level: LevelWarn}
+	SetLogger(l)
+	if Enabled(LevelInfo) || !Enabled(LevelWarn) {
+		t.Fatalf("Enabled() = %v, %v, want false, true", Enabled(LevelInfo), Enabled(LevelWarn))
+	}
+
+	// the fields are not formatted if the level is disabled
+	cnt := countingStringer(0)
+	Infow("Connected", "remote_addr", &cnt)
+	if cnt != 0 {
+		t.Fatalf("Infow() formatted %v times, want 0", cnt)
+	}
+
+	l.SetLevel(LevelOff)
+	if Enabled(LevelError) {
+		t.Fatalf("Enabled() = true, want false")
+	}
+}
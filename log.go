@@ -0,0 +1,49 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"github.com/lesismal/arpc/internal/log"
+)
+
+const (
+	// LogLevelAll enables all logs.
+	LogLevelAll = log.LevelAll
+	// LogLevelDebug logs are usually disabled in production.
+	LogLevelDebug = log.LevelDebug
+	// LogLevelInfo is the default logging priority.
+	LogLevelInfo = log.LevelInfo
+	// LogLevelWarn .
+	LogLevelWarn = log.LevelWarn
+	// LogLevelError .
+	LogLevelError = log.LevelError
+	// LogLevelNone disables all logs.
+	LogLevelNone = log.LevelNone
+	// LogLevelOff is the same as LogLevelNone.
+	LogLevelOff = log.LevelOff
+)
+
+// Logger defines printf style log interface.
+type Logger = log.Logger
+
+// StructuredLogger defines log interface with key-value fields, such as "remote_addr", "method" and "seq".
+type StructuredLogger = log.StructuredLogger
+
+// SetLogger sets the printf style logger used by arpc.
+func SetLogger(l Logger) {
+	log.SetLogger(l)
+}
+
+// SetStructuredLogger sets the logger used by arpc which gets the fields of the logs,
+// the printf style logs are sent to it as messages without fields.
+func SetStructuredLogger(l StructuredLogger) {
+	log.SetStructuredLogger(l)
+}
+
+// SetLogLevel sets the priority of the logger used by arpc, e.g. LogLevelWarn silences
+// the connected and disconnected logs of every connection.
+func SetLogLevel(lvl int) {
+	log.SetLevel(lvl)
+}
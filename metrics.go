@@ -0,0 +1,96 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"time"
+)
+
+// Collector collects the metrics of Clients and Servers,
+// see extension/metrics/prometheus for the Prometheus implementation.
+// A nil Collector collects nothing.
+type Collector interface {
+	// IncCall increases the calls of method made by the Client.
+	IncCall(method string)
+	// IncError increases the calls of method failed or responded with an error.
+	IncError(method string)
+	// AddInflight adds delta to the calls of method waiting for the responses.
+	AddInflight(method string, delta int)
+	// ObserveLatency observes the duration from a call of method is sent to its response is received.
+	ObserveLatency(method string, latency time.Duration)
+
+	// AddConnections adds delta to the connections of the Server.
+	AddConnections(delta int)
+	// AddActiveHandlers adds delta to the handlers of method running.
+	AddActiveHandlers(method string, delta int)
+}
+
+// metricsHolder wraps the Collector so that different implementations can be stored in the same atomic.Value.
+type metricsHolder struct {
+	Collector
+}
+
+// SetMetrics sets the Collector of the calls made by the Client, nil disables it.
+func (c *Client) SetMetrics(metrics Collector) {
+	c.metricsValue.Store(metricsHolder{metrics})
+}
+
+func (c *Client) getMetrics() Collector {
+	if h, ok := c.metricsValue.Load().(metricsHolder); ok {
+		return h.Collector
+	}
+	return nil
+}
+
+// SetMetrics sets the Collector of the connections and the handlers, it's the same as Handler.SetMetrics.
+func (s *Server) SetMetrics(metrics Collector) {
+	s.Handler.SetMetrics(metrics)
+}
+
+// startCall reports a call of method started if the Client has a Collector,
+// the returned function reports the call finished with err.
+func (c *Client) startCall(method string) func(err error) {
+	metrics := c.getMetrics()
+	if metrics == nil {
+		return nil
+	}
+	metrics.IncCall(method)
+	metrics.AddInflight(method, 1)
+	t := time.Now()
+	return func(err error) {
+		metrics.AddInflight(method, -1)
+		metrics.ObserveLatency(method, time.Since(t))
+		if err != nil {
+			metrics.IncError(method)
+		}
+	}
+}
+
+// startAsyncCall reports an async call of method started if the Client has a Collector,
+// the latency and error response are reported by the returned handler wrapping handler.
+// The async calls are not counted as in-flight, because a response may never arrive.
+func (c *Client) startAsyncCall(method string, handler HandlerFunc) (func(err error), HandlerFunc) {
+	metrics := c.getMetrics()
+	if metrics == nil {
+		return nil, handler
+	}
+	metrics.IncCall(method)
+	done := func(err error) {
+		if err != nil {
+			metrics.IncError(method)
+		}
+	}
+	if handler == nil {
+		return done, nil
+	}
+	t := time.Now()
+	return done, func(ctx *Context) {
+		metrics.ObserveLatency(method, time.Since(t))
+		if ctx.Message.IsError() {
+			metrics.IncError(method)
+		}
+		handler(ctx)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCollector struct {
+	mux         sync.Mutex
+	calls       map[string]int
+	errors      map[string]int
+	inflight    map[string]int
+	latencies   map[string]int
+	connections int
+	handlers    map[string]int
+	maxHandlers map[string]int
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{
+		calls:       map[string]int{},
+		errors:      map[string]int{},
+		inflight:    map[string]int{},
+		latencies:   map[string]int{},
+		handlers:    map[string]int{},
+		maxHandlers: map[string]int{},
+	}
+}
+
+func (m *testCollector) IncCall(method string) {
+	m.mux.Lock()
+	m.calls[method]++
+	m.mux.Unlock()
+}
+
+func (m *testCollector) IncError(method string) {
+	m.mux.Lock()
+	m.errors[method]++
+	m.mux.Unlock()
+}
+
+func (m *testCollector) AddInflight(method string, delta int) {
+	m.mux.Lock()
+	m.inflight[method] += delta
+	m.mux.Unlock()
+}
+
+func (m *testCollector) ObserveLatency(method string, latency time.Duration) {
+	m.mux.Lock()
+	m.latencies[method]++
+	m.mux.Unlock()
+}
+
+func (m *testCollector) AddConnections(delta int) {
+	m.mux.Lock()
+	m.connections += delta
+	m.mux.Unlock()
+}
+
+func (m *testCollector) AddActiveHandlers(method string, delta int) {
+	m.mux.Lock()
+	m.handlers[method] += delta
+	if m.handlers[method] > m.maxHandlers[method] {
+		m.maxHandlers[method] = m.handlers[method]
+	}
+	m.mux.Unlock()
+}
+
+func (m *testCollector) get(f func() int) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return f()
+}
+
+func TestClient_SetMetrics(t *testing.T) {
+	cliMetrics, svrMetrics := newTestCollector(), newTestCollector()
+
+	svr := NewServer()
+	svr.SetMetrics(svrMetrics)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/fail", func(ctx *Context) {
+		ctx.Error("failed")
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	c.SetMetrics(cliMetrics)
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.Call("/fail", "hello", &rsp, time.Second); err == nil {
+		t.Fatalf("Client.Call() error = nil, want failed")
+	}
+	chDone := make(chan struct{})
+	if err = c.CallAsync("/fail", "hello", func(ctx *Context) { close(chDone) }, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-chDone
+
+	m := cliMetrics
+	if n := m.get(func() int { return m.calls["/echo"] }); n != 1 {
+		t.Fatalf("calls[/echo] = %v, want 1", n)
+	}
+	if n := m.get(func() int { return m.calls["/fail"] }); n != 2 {
+		t.Fatalf("calls[/fail] = %v, want 2", n)
+	}
+	if n := m.get(func() int { return m.errors["/echo"] }); n != 0 {
+		t.Fatalf("errors[/echo] = %v, want 0", n)
+	}
+	if n := m.get(func() int { return m.errors["/fail"] }); n != 2 {
+		t.Fatalf("errors[/fail] = %v, want 2", n)
+	}
+	if n := m.get(func() int { return m.inflight["/echo"] }); n != 0 {
+		t.Fatalf("inflight[/echo] = %v, want 0", n)
+	}
+	if n := m.get(func() int { return m.inflight["/fail"] }); n != 0 {
+		t.Fatalf("inflight[/fail] = %v, want 0", n)
+	}
+	if n := m.get(func() int { return m.latencies["/echo"] }); n != 1 {
+		t.Fatalf("latencies[/echo] = %v, want 1", n)
+	}
+	if n := m.get(func() int { return m.latencies["/fail"] }); n != 2 {
+		t.Fatalf("latencies[/fail] = %v, want 2", n)
+	}
+
+	m = svrMetrics
+	if n := m.get(func() int { return m.connections }); n != 1 {
+		t.Fatalf("connections = %v, want 1", n)
+	}
+	if n := m.get(func() int { return m.maxHandlers["/echo"] }); n != 1 {
+		t.Fatalf("maxHandlers[/echo] = %v, want 1", n)
+	}
+	if n := m.get(func() int { return m.handlers["/echo"] }); n != 0 {
+		t.Fatalf("handlers[/echo] = %v, want 0", n)
+	}
+
+	c.Stop()
+	time.Sleep(time.Second / 20)
+	if n := m.get(func() int { return m.connections }); n != 0 {
+		t.Fatalf("connections = %v, want 0", n)
+	}
+}
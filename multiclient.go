@@ -0,0 +1,186 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Result represents the response of a Client to MultiClient.CallAll.
+type Result struct {
+	// Client is the Client which made the call.
+	Client *Client
+	// Data is the data of the response.
+	Data []byte
+	// Error is the error of making the call or the error responded, Data is nil if it's not nil.
+	Error error
+}
+
+// Bind parses Data to v by the Codec of Client, the same as Context.Bind.
+func (r *Result) Bind(v interface{}) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	if v != nil {
+		switch vt := v.(type) {
+		case *[]byte:
+			*vt = r.Data
+		case *string:
+			*vt = string(r.Data)
+		default:
+			return r.Client.GetCodec().Unmarshal(r.Data, v)
+		}
+	}
+	return nil
+}
+
+// MultiClient makes the same call to several Clients, e.g. the Clients of the replicas for quorum reads.
+type MultiClient struct {
+	clients []*Client
+}
+
+// NewMultiClient creates a MultiClient of clients.
+func NewMultiClient(clients ...*Client) (*MultiClient, error) {
+	if len(clients) == 0 {
+		return nil, ErrMultiClientInvalidClients
+	}
+	return &MultiClient{clients: append([]*Client{}, clients...)}, nil
+}
+
+// Clients returns the Clients.
+func (mc *MultiClient) Clients() []*Client {
+	return mc.clients
+}
+
+// CallAny makes the call by all the Clients and parses the first successful response to rsp,
+// the handlers of the other calls are cancelled by Client.CancelAsync, so their responses are dropped,
+// but the calls still run on the servers.
+// The error of the first Client is returned if all the calls failed, and ErrClientTimeout is returned
+// if there's no successful response in timeout.
+func (mc *MultiClient) CallAny(method string, req interface{}, rsp interface{}, timeout time.Duration, args ...interface{}) error {
+	type anyResult struct {
+		index int
+		won   bool
+		err   error
+	}
+
+	var (
+		won      int32
+		seqs     = make([]uint64, len(mc.clients))
+		errs     = make([]error, len(mc.clients))
+		chResult = make(chan anyResult, len(mc.clients))
+	)
+	for i, c := range mc.clients {
+		index := i
+		seq, err := c.CallAsyncSeq(method, req, func(ctx *Context) {
+			if ctx.Message.IsError() {
+				chResult <- anyResult{index: index, err: ctx.Message.Error()}
+				return
+			}
+			if atomic.CompareAndSwapInt32(&won, 0, 1) {
+				chResult <- anyResult{index: index, won: true, err: ctx.Bind(rsp)}
+			}
+		}, timeout, args...)
+		if err != nil {
+			chResult <- anyResult{index: index, err: err}
+		}
+		seqs[i] = seq
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	cancel := func() {
+		for i, c := range mc.clients {
+			c.CancelAsync(seqs[i])
+		}
+	}
+	for failed := 0; failed < len(mc.clients); {
+		select {
+		case res := <-chResult:
+			if res.won {
+				cancel()
+				return res.err
+			}
+			errs[res.index] = res.err
+			failed++
+		case <-timer.C:
+			cancel()
+			return ErrClientTimeout
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CallAll makes the call by all the Clients and returns the Results in the order of the Clients,
+// the Error of a Result is ErrClientTimeout if there's no response in timeout.
+// err is nil if any of the calls succeeded, or else it's the error of the first Client.
+func (mc *MultiClient) CallAll(method string, req interface{}, timeout time.Duration, args ...interface{}) (results []Result, err error) {
+	type allResult struct {
+		index  int
+		result Result
+	}
+
+	var (
+		seqs     = make([]uint64, len(mc.clients))
+		done     = make([]bool, len(mc.clients))
+		chResult = make(chan allResult, len(mc.clients))
+	)
+	results = make([]Result, len(mc.clients))
+	for i, c := range mc.clients {
+		index, client := i, c
+		seq, err := c.CallAsyncSeq(method, req, func(ctx *Context) {
+			result := Result{Client: client}
+			if ctx.Message.IsError() {
+				result.Error = ctx.Message.Error()
+			} else {
+				result.Data = ctx.Message.DataCopy()
+			}
+			chResult <- allResult{index: index, result: result}
+		}, timeout, args...)
+		if err != nil {
+			chResult <- allResult{index: index, result: Result{Client: client, Error: err}}
+		}
+		seqs[i] = seq
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for received, expired := 0, false; received < len(mc.clients) && !expired; {
+		select {
+		case res := <-chResult:
+			results[res.index] = res.result
+			done[res.index] = true
+			received++
+		case <-timer.C:
+			for i, c := range mc.clients {
+				if !done[i] {
+					c.CancelAsync(seqs[i])
+					results[i] = Result{Client: c, Error: ErrClientTimeout}
+				}
+			}
+			expired = true
+		}
+	}
+
+	for _, result := range results {
+		if result.Error == nil {
+			return results, nil
+		}
+	}
+	return results, results[0].Error
+}
+
+// Stop stops all the Clients.
+func (mc *MultiClient) Stop() {
+	for _, c := range mc.clients {
+		c.Stop()
+	}
+}
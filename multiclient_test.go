@@ -0,0 +1,115 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMultiClient(t *testing.T, delays []time.Duration) (*MultiClient, func()) {
+	var (
+		servers []*Server
+		clients []*Client
+	)
+	for i, delay := range delays {
+		addr := fmt.Sprintf("localhost:%v", 12100+i)
+		reply, d := addr, delay
+		svr := NewServer()
+		svr.Handler.Handle("/multi", func(ctx *Context) {
+			time.Sleep(d)
+			if d < 0 {
+				ctx.Error(errors.New(reply))
+				return
+			}
+			ctx.Write(reply)
+		}, true)
+		go svr.Run(addr)
+		servers = append(servers, svr)
+	}
+	time.Sleep(time.Second / 100)
+	for i := range delays {
+		addr := fmt.Sprintf("localhost:%v", 12100+i)
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, time.Second)
+		})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		clients = append(clients, c)
+	}
+	mc, err := NewMultiClient(clients...)
+	if err != nil {
+		t.Fatalf("NewMultiClient() error = %v", err)
+	}
+	return mc, func() {
+		mc.Stop()
+		for _, svr := range servers {
+			svr.Stop()
+		}
+	}
+}
+
+func TestMultiClient_CallAny(t *testing.T) {
+	if _, err := NewMultiClient(); err != ErrMultiClientInvalidClients {
+		t.Fatalf("NewMultiClient() error = %v, want %v", err, ErrMultiClientInvalidClients)
+	}
+
+	mc, stop := newTestMultiClient(t, []time.Duration{-1, time.Second / 5, 0})
+	defer stop()
+
+	rsp := ""
+	if err := mc.CallAny("/multi", "", &rsp, time.Second); err != nil {
+		t.Fatalf("MultiClient.CallAny() error = %v", err)
+	}
+	if want := "localhost:12102"; rsp != want {
+		t.Fatalf("MultiClient.CallAny() rsp = %v, want %v", rsp, want)
+	}
+}
+
+func TestMultiClient_CallAnyFailed(t *testing.T) {
+	mc, stop := newTestMultiClient(t, []time.Duration{-1, time.Second})
+	defer stop()
+
+	rsp := ""
+	if err := mc.CallAny("/multi", "", &rsp, time.Second/10); err != ErrClientTimeout {
+		t.Fatalf("MultiClient.CallAny() error = %v, want %v", err, ErrClientTimeout)
+	}
+	mc.clients = mc.clients[:1]
+	if err := mc.CallAny("/multi", "", &rsp, time.Second); err == nil || err.Error() != "localhost:12100" {
+		t.Fatalf("MultiClient.CallAny() error = %v, want localhost:12100", err)
+	}
+}
+
+func TestMultiClient_CallAll(t *testing.T) {
+	mc, stop := newTestMultiClient(t, []time.Duration{-1, time.Second, 0})
+	defer stop()
+
+	results, err := mc.CallAll("/multi", "", time.Second/5)
+	if err != nil {
+		t.Fatalf("MultiClient.CallAll() error = %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("MultiClient.CallAll() returned %v results, want 3", len(results))
+	}
+	if results[0].Error == nil || results[0].Error.Error() != "localhost:12100" {
+		t.Fatalf("results[0].Error = %v, want localhost:12100", results[0].Error)
+	}
+	if results[1].Error != ErrClientTimeout {
+		t.Fatalf("results[1].Error = %v, want %v", results[1].Error, ErrClientTimeout)
+	}
+	rsp := ""
+	if err = results[2].Bind(&rsp); err != nil || rsp != "localhost:12102" {
+		t.Fatalf("results[2].Bind() = %v, %v, want localhost:12102", rsp, err)
+	}
+	for i, result := range results {
+		if result.Client != mc.Clients()[i] {
+			t.Fatalf("results[%v].Client is not the Client %v", i, i)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lesismal/arpc/internal/codec"
+	"github.com/lesismal/arpc/internal/util"
+)
+
+// MaxMultiValues limits the number of values of Context.WriteMulti.
+const MaxMultiValues int = 0xFFFF
+
+// encodeMultiValues encodes values as: [count uint16][valueLen uint32][value]...,
+// every value is converted to bytes the same way as the body of Context.Write.
+func encodeMultiValues(cdc codec.Codec, values []interface{}) ([]byte, error) {
+	if len(values) > MaxMultiValues {
+		return nil, fmt.Errorf("invalid values count: %v, should <= %v", len(values), MaxMultiValues)
+	}
+	datas := make([][]byte, len(values))
+	size := 2
+	for i, v := range values {
+		datas[i] = util.ValueToBytes(cdc, v)
+		if uint64(len(datas[i])) > math.MaxUint32 {
+			return nil, ErrBodyTooLarge
+		}
+		size += 4 + len(datas[i])
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint16(buf, uint16(len(values)))
+	offset := 2
+	for _, data := range datas {
+		binary.LittleEndian.PutUint32(buf[offset:], uint32(len(data)))
+		offset += 4
+		offset += copy(buf[offset:], data)
+	}
+	return buf, nil
+}
+
+// decodeMultiValues decodes the values encoded by encodeMultiValues to rsps positionally,
+// nothing is decoded if the body is invalid or the count of the values mismatches len(rsps).
+// A nil rsp skips its value.
+func decodeMultiValues(cdc codec.Codec, data []byte, rsps []interface{}) error {
+	if len(data) < 2 {
+		return ErrInvalidMultiValues
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	if count != len(rsps) {
+		return fmt.Errorf("%w: got %v, want %v", ErrMultiValuesCount, count, len(rsps))
+	}
+	values := make([][]byte, count)
+	offset := 2
+	for i := range values {
+		if len(data) < offset+4 {
+			return ErrInvalidMultiValues
+		}
+		valueLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		offset += 4
+		if valueLen < 0 || len(data)-offset < valueLen {
+			return ErrInvalidMultiValues
+		}
+		values[i] = data[offset : offset+valueLen]
+		offset += valueLen
+	}
+	if offset != len(data) {
+		return ErrInvalidMultiValues
+	}
+
+	for i, rsp := range rsps {
+		switch vt := rsp.(type) {
+		case nil:
+		case *[]byte:
+			*vt = values[i]
+		case *string:
+			*vt = string(values[i])
+		default:
+			if err := cdc.Unmarshal(values[i], rsp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteMulti responses multiple values to the Client, which are decoded positionally by Client.CallMulti.
+// Every value is converted to bytes the same way as Write.
+func (ctx *Context) WriteMulti(values ...interface{}) error {
+	data, err := encodeMultiValues(ctx.Client.GetCodec(), values)
+	if err != nil {
+		return err
+	}
+	return ctx.Write(data)
+}
+
+// CallMulti calls the method whose handler responses by Context.WriteMulti and decodes the values to rsps positionally,
+// it returns ErrMultiValuesCount without decoding any value if the count of the values mismatches len(rsps).
+// A nil rsp skips its value.
+func (c *Client) CallMulti(method string, req interface{}, timeout time.Duration, rsps ...interface{}) error {
+	var data []byte
+	if err := c.Call(method, req, &data, timeout); err != nil {
+		return err
+	}
+	return decodeMultiValues(c.GetCodec(), data, rsps)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/arpc/internal/codec"
+)
+
+func Test_decodeMultiValues(t *testing.T) {
+	data, err := encodeMultiValues(codec.DefaultCodec, []interface{}{"hello", []byte("world"), &MessageTest{A: 1, B: "b"}, nil})
+	if err != nil {
+		t.Fatalf("encodeMultiValues() error = %v", err)
+	}
+
+	var (
+		s   string
+		b   []byte
+		msg MessageTest
+	)
+	if err = decodeMultiValues(codec.DefaultCodec, data, []interface{}{&s, &b, &msg, nil}); err != nil {
+		t.Fatalf("decodeMultiValues() error = %v", err)
+	}
+	if s != "hello" || string(b) != "world" || msg.A != 1 || msg.B != "b" {
+		t.Fatalf("decodeMultiValues() = %v, %v, %+v, want hello, world, {A:1 B:b}", s, string(b), msg)
+	}
+
+	s = ""
+	if err = decodeMultiValues(codec.DefaultCodec, data, []interface{}{&s}); !errors.Is(err, ErrMultiValuesCount) {
+		t.Fatalf("decodeMultiValues() error = %v, want %v", err, ErrMultiValuesCount)
+	}
+	if s != "" {
+		t.Fatalf("decodeMultiValues() decoded %v partially", s)
+	}
+
+	for _, invalid := range [][]byte{nil, data[:len(data)-1], append(data, 0)} {
+		if err = decodeMultiValues(codec.DefaultCodec, invalid, []interface{}{&s, &b, &msg, nil}); err != ErrInvalidMultiValues {
+			t.Fatalf("decodeMultiValues() error = %v, want %v", err, ErrInvalidMultiValues)
+		}
+	}
+}
+
+func TestClient_CallMulti(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/multi", func(ctx *Context) {
+		var id int
+		ctx.Bind(&id)
+		ctx.WriteMulti(&MessageTest{A: id, B: "data"}, map[string]string{"version": "1"})
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	var (
+		data     MessageTest
+		metadata map[string]string
+	)
+	if err = c.CallMulti("/multi", 3, time.Second, &data, &metadata); err != nil {
+		t.Fatalf("Client.CallMulti() error = %v", err)
+	}
+	if data.A != 3 || data.B != "data" || metadata["version"] != "1" {
+		t.Fatalf("Client.CallMulti() = %+v, %v, want {A:3 B:data}, map[version:1]", data, metadata)
+	}
+
+	if err = c.CallMulti("/multi", 3, time.Second, &data); !errors.Is(err, ErrMultiValuesCount) {
+		t.Fatalf("Client.CallMulti() error = %v, want %v", err, ErrMultiValuesCount)
+	}
+}
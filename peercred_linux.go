@@ -0,0 +1,41 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package arpc
+
+import (
+	"net"
+	"syscall"
+)
+
+// Ucred represents the credentials of the process on the other side of a unix socket.
+type Ucred = syscall.Ucred
+
+// PeerCred returns the pid, uid and gid of the peer process by SO_PEERCRED,
+// it returns ErrNotUnixConn if Conn is not a *net.UnixConn.
+func (c *Client) PeerCred() (*Ucred, error) {
+	conn, ok := c.Conn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnixConn
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		cred    *Ucred
+		credErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package arpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContext_PeerCred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arpc")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "arpc.sock")
+
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	svr := NewServer()
+	svr.Handler.Handle("/pid", func(ctx *Context) {
+		cred, err := ctx.PeerCred()
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(int(cred.Pid))
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("unix", addr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	pid := 0
+	if err = c.Call("/pid", nil, &pid, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if pid != os.Getpid() {
+		t.Fatalf("Context.PeerCred() pid = %v, want %v", pid, os.Getpid())
+	}
+
+	if _, err = (&Client{Conn: &net.TCPConn{}}).PeerCred(); err != ErrNotUnixConn {
+		t.Fatalf("Client.PeerCred() error = %v, want %v", err, ErrNotUnixConn)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package arpc
+
+import "net"
+
+// Ucred represents the credentials of the process on the other side of a unix socket.
+type Ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// PeerCred is only supported on linux, it returns ErrPeerCredUnsupported for unix sockets on the other platforms.
+func (c *Client) PeerCred() (*Ucred, error) {
+	if _, ok := c.Conn.(*net.UnixConn); !ok {
+		return nil, ErrNotUnixConn
+	}
+	return nil, ErrPeerCredUnsupported
+}
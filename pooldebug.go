@@ -0,0 +1,106 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPoolStats represents the statistics of Handler.GetBuffer and Handler.PutBuffer in debug mode.
+type BufferPoolStats struct {
+	// Gets is the number of buffers got.
+	Gets uint64
+	// Puts is the number of buffers put back.
+	Puts uint64
+	// Live is the number of buffers got and not put back yet.
+	Live uint64
+}
+
+var bufferDebug = struct {
+	gets    uint64
+	puts    uint64
+	enabled int32
+
+	mux sync.Mutex
+	// allocation stacks of the buffers got and not put back
+	live map[*byte][]byte
+	// allocation stacks of the buffers put back
+	returned map[*byte][]byte
+}{}
+
+// SetPoolDebug enables or disables the debug mode of the buffers got by Handler.GetBuffer,
+// the counts and the allocation stack of every buffer are recorded, and putting back a buffer
+// which has already been put back panics with its allocation stack.
+// The records are never cleared, it should only be enabled for tests and debugging.
+func SetPoolDebug(enable bool) {
+	bufferDebug.mux.Lock()
+	defer bufferDebug.mux.Unlock()
+	if enable {
+		if bufferDebug.live == nil {
+			bufferDebug.live = map[*byte][]byte{}
+			bufferDebug.returned = map[*byte][]byte{}
+		}
+		atomic.StoreInt32(&bufferDebug.enabled, 1)
+	} else {
+		atomic.StoreInt32(&bufferDebug.enabled, 0)
+	}
+}
+
+// PoolStats returns the statistics of the buffers recorded in debug mode, see SetPoolDebug.
+func PoolStats() BufferPoolStats {
+	bufferDebug.mux.Lock()
+	defer bufferDebug.mux.Unlock()
+	return BufferPoolStats{
+		Gets: atomic.LoadUint64(&bufferDebug.gets),
+		Puts: atomic.LoadUint64(&bufferDebug.puts),
+		Live: uint64(len(bufferDebug.live)),
+	}
+}
+
+func poolDebugEnabled() bool {
+	return atomic.LoadInt32(&bufferDebug.enabled) == 1
+}
+
+// bufferKey identifies a buffer by its underlying array.
+func bufferKey(buf []byte) *byte {
+	if cap(buf) == 0 {
+		return nil
+	}
+	return &buf[:cap(buf)][0]
+}
+
+func debugGetBuffer(buf []byte) {
+	atomic.AddUint64(&bufferDebug.gets, 1)
+	key := bufferKey(buf)
+	if key == nil {
+		return
+	}
+	stack := debug.Stack()
+	bufferDebug.mux.Lock()
+	delete(bufferDebug.returned, key)
+	bufferDebug.live[key] = stack
+	bufferDebug.mux.Unlock()
+}
+
+func debugPutBuffer(buf []byte) {
+	atomic.AddUint64(&bufferDebug.puts, 1)
+	key := bufferKey(buf)
+	if key == nil {
+		return
+	}
+	bufferDebug.mux.Lock()
+	defer bufferDebug.mux.Unlock()
+	if stack, ok := bufferDebug.returned[key]; ok {
+		panic(fmt.Errorf("arpc: buffer put back twice, allocated at:\n%s", stack))
+	}
+	// the buffers got before the debug mode enabled are not recorded
+	if stack, ok := bufferDebug.live[key]; ok {
+		delete(bufferDebug.live, key)
+		bufferDebug.returned[key] = stack
+	}
+}
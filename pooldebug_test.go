@@ -0,0 +1,36 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetPoolDebug(t *testing.T) {
+	SetPoolDebug(true)
+	defer SetPoolDebug(false)
+
+	h := NewHandler()
+	stats := PoolStats()
+	buf := h.GetBuffer(16)
+	got := PoolStats()
+	if got.Gets != stats.Gets+1 || got.Live != stats.Live+1 {
+		t.Fatalf("PoolStats() = %+v after GetBuffer, previous %+v", got, stats)
+	}
+	h.PutBuffer(buf)
+	got = PoolStats()
+	if got.Puts != stats.Puts+1 || got.Live != stats.Live {
+		t.Fatalf("PoolStats() = %+v after PutBuffer, previous %+v", got, stats)
+	}
+
+	defer func() {
+		err, _ := recover().(error)
+		if err == nil || !strings.Contains(err.Error(), "TestSetPoolDebug") {
+			t.Fatalf("PutBuffer twice recovered %v, want panic with the allocation stack", err)
+		}
+	}()
+	h.PutBuffer(buf)
+}
@@ -8,6 +8,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/lesismal/arpc/internal/codec"
 	"github.com/lesismal/arpc/internal/util"
@@ -27,6 +32,13 @@ const (
 	CmdNotify byte = 3
 )
 
+const (
+	// HeaderCmdMask masks the cmd in the cmd byte of the head.
+	HeaderCmdMask byte = 0x0F
+	// HeaderVersionShift shifts the protocol version stored in the high 4 bits of the cmd byte.
+	HeaderVersionShift = 4
+)
+
 const (
 	// HeaderIndexBodyLenBegin .
 	HeaderIndexBodyLenBegin = 0
@@ -48,6 +60,21 @@ const (
 	HeaderFlagMaskError byte = 0x01
 	// HeaderFlagMaskAsync .
 	HeaderFlagMaskAsync byte = 0x02
+	// HeaderFlagMaskHeader .
+	HeaderFlagMaskHeader byte = 0x04
+	// HeaderFlagMaskMore .
+	HeaderFlagMaskMore byte = 0x08
+	// HeaderFlagMaskChecksum .
+	HeaderFlagMaskChecksum byte = 0x10
+	// HeaderFlagMaskLongMethod .
+	HeaderFlagMaskLongMethod byte = 0x20
+	// HeaderFlagMaskStreamEnd .
+	HeaderFlagMaskStreamEnd byte = 0x40
+)
+
+const (
+	// ChecksumLen represents the length of the CRC32 checksum appended to the body.
+	ChecksumLen int = 4
 )
 
 const (
@@ -55,10 +82,18 @@ const (
 	HeadLen int = 16
 
 	// MaxMethodLen limits Message method length.
-	MaxMethodLen int = 127
+	MaxMethodLen int = 0xFFFF
+
+	// MaxShortMethodLen limits the method length stored in the single method length byte of the head,
+	// a longer method's length is stored as a uint16 at the beginning of the body with HeaderFlagMaskLongMethod set,
+	// so peers of older versions can still handle the shorter methods.
+	MaxShortMethodLen int = 127
 
 	// MaxBodyLen limits Message body length.
 	MaxBodyLen int = 1024*1024*64 - 16
+
+	// MaxHeaderLen limits Message header length.
+	MaxHeaderLen int = 0xFFFF
 )
 
 // Header defines Message head
@@ -69,22 +104,56 @@ func (h Header) BodyLen() int {
 	return int(binary.LittleEndian.Uint32(h[HeaderIndexBodyLenBegin:HeaderIndexBodyLenEnd]))
 }
 
-// message creates a Message by body length.
+// cmd returns the cmd of the Message, the Header must be read completely.
+func (h Header) cmd() byte {
+	return h[HeaderIndexCmd] & HeaderCmdMask
+}
+
+// isAsync returns the async flag of the Message, the Header must be read completely.
+func (h Header) isAsync() bool {
+	return h[HeaderIndexFlag]&HeaderFlagMaskAsync > 0
+}
+
+// seq returns the seq of the Message, the Header must be read completely.
+func (h Header) seq() uint64 {
+	return binary.LittleEndian.Uint64(h[HeaderIndexSeqBegin:HeaderIndexSeqEnd])
+}
+
+// message creates a Message by body length, with the Header copied to its head.
 func (h Header) message(handler Handler) (*Message, error) {
 	bodyLen := h.BodyLen()
-	if bodyLen < 0 || bodyLen > MaxBodyLen {
-		return nil, fmt.Errorf("invalid body length: %v", bodyLen)
+	if bodyLen < 0 || uint64(bodyLen) > uint64(handler.MaxBodyLen()) {
+		return nil, ErrBodyTooLarge
 	}
 
 	m := &Message{Buffer: handler.GetBuffer(HeadLen + bodyLen)}
-	binary.LittleEndian.PutUint32(m.Buffer[HeaderIndexBodyLenBegin:HeaderIndexBodyLenEnd], uint32(bodyLen))
+	copy(m.Buffer[:HeadLen], h)
 	return m, nil
 }
 
 // Message represents an arpc Message.
 type Message struct {
-	Buffer []byte
-	values map[string]interface{}
+	Buffer   []byte
+	values   map[string]interface{}
+	deadline int64
+	// err is set by the receiver for the response which failed to be received, e.g. ErrChecksumMismatch
+	err error
+}
+
+// expired returns true if the Message has a deadline and it has passed.
+func (m *Message) expired() bool {
+	return m.deadline > 0 && time.Now().UnixNano() > m.deadline
+}
+
+// SetDeadline sets the deadline of the Message, the send loop drops the Message instead of sending it
+// if it's still in the send queue when the deadline passed, see Client.PushMsgWithDeadline.
+// A zero deadline means no deadline.
+func (m *Message) SetDeadline(deadline time.Time) {
+	if deadline.IsZero() {
+		m.deadline = 0
+		return
+	}
+	m.deadline = deadline.UnixNano()
 }
 
 // Len returns total length of buffer.
@@ -94,12 +163,22 @@ func (m *Message) Len() int {
 
 // Cmd returns cmd.
 func (m *Message) Cmd() byte {
-	return m.Buffer[HeaderIndexCmd]
+	return m.Buffer[HeaderIndexCmd] & HeaderCmdMask
 }
 
 // SetCmd sets cmd.
 func (m *Message) SetCmd(cmd byte) {
-	m.Buffer[HeaderIndexCmd] = cmd
+	m.Buffer[HeaderIndexCmd] = (m.Buffer[HeaderIndexCmd] & ^HeaderCmdMask) | (cmd & HeaderCmdMask)
+}
+
+// Version returns the protocol version of the Message.
+func (m *Message) Version() byte {
+	return m.Buffer[HeaderIndexCmd] >> HeaderVersionShift
+}
+
+// SetVersion sets the protocol version of the Message.
+func (m *Message) SetVersion(version byte) {
+	m.Buffer[HeaderIndexCmd] = (m.Buffer[HeaderIndexCmd] & HeaderCmdMask) | (version << HeaderVersionShift)
 }
 
 // IsError returns error flag.
@@ -121,7 +200,48 @@ func (m *Message) Error() error {
 	if !m.IsError() {
 		return nil
 	}
-	return errors.New(util.BytesToStr(m.Buffer[HeadLen+m.MethodLen():]))
+	if m.err != nil {
+		return m.err
+	}
+	if m.HasHeader() {
+		if s, ok := m.Header()[errorCodeHeaderKey]; ok {
+			if code, err := strconv.Atoi(s); err == nil {
+				return &RPCError{Code: code, Message: string(m.Data())}
+			}
+		}
+	}
+	return errors.New(util.BytesToStr(m.Data()))
+}
+
+// HasChecksum returns true if the body is followed by a CRC32 checksum.
+func (m *Message) HasChecksum() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskChecksum > 0
+}
+
+// appendChecksum returns a copy of buffer with the CRC32 checksum of the body appended,
+// buffer is not modified because a Message may be sent to multiple Clients.
+func appendChecksum(buffer []byte) []byte {
+	buf := make([]byte, len(buffer)+ChecksumLen)
+	copy(buf, buffer)
+	binary.LittleEndian.PutUint32(buf[len(buffer):], crc32.ChecksumIEEE(buffer[HeadLen:]))
+	binary.LittleEndian.PutUint32(buf[HeaderIndexBodyLenBegin:HeaderIndexBodyLenEnd], uint32(len(buf)-HeadLen))
+	buf[HeaderIndexFlag] |= HeaderFlagMaskChecksum
+	return buf
+}
+
+// verifyChecksum checks and removes the CRC32 checksum of the body.
+func (m *Message) verifyChecksum() bool {
+	if len(m.Buffer) < HeadLen+ChecksumLen {
+		return false
+	}
+	end := len(m.Buffer) - ChecksumLen
+	if crc32.ChecksumIEEE(m.Buffer[HeadLen:end]) != binary.LittleEndian.Uint32(m.Buffer[end:]) {
+		return false
+	}
+	m.Buffer = m.Buffer[:end]
+	m.SetBodyLen(end - HeadLen)
+	m.Buffer[HeaderIndexFlag] &^= HeaderFlagMaskChecksum
+	return true
 }
 
 // IsAsync returns async flag.
@@ -138,6 +258,61 @@ func (m *Message) SetAsync(isAsync bool) {
 	}
 }
 
+// HasHeader returns header flag.
+func (m *Message) HasHeader() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskHeader > 0
+}
+
+// SetHasHeader sets header flag.
+func (m *Message) SetHasHeader(hasHeader bool) {
+	if hasHeader {
+		m.Buffer[HeaderIndexFlag] |= HeaderFlagMaskHeader
+	} else {
+		m.Buffer[HeaderIndexFlag] &= ^HeaderFlagMaskHeader
+	}
+}
+
+// HasMore returns more flag, which means more responses of the same seq will follow.
+func (m *Message) HasMore() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskMore > 0
+}
+
+// SetHasMore sets more flag.
+func (m *Message) SetHasMore(hasMore bool) {
+	if hasMore {
+		m.Buffer[HeaderIndexFlag] |= HeaderFlagMaskMore
+	} else {
+		m.Buffer[HeaderIndexFlag] &= ^HeaderFlagMaskMore
+	}
+}
+
+// IsStreamEnd returns stream end flag, which means the stream ends without a last response.
+func (m *Message) IsStreamEnd() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskStreamEnd > 0
+}
+
+// SetStreamEnd sets stream end flag.
+func (m *Message) SetStreamEnd(isEnd bool) {
+	if isEnd {
+		m.Buffer[HeaderIndexFlag] |= HeaderFlagMaskStreamEnd
+	} else {
+		m.Buffer[HeaderIndexFlag] &= ^HeaderFlagMaskStreamEnd
+	}
+}
+
+// Header returns the key-value pairs carried between method and payload data.
+func (m *Message) Header() map[string]string {
+	if !m.HasHeader() {
+		return nil
+	}
+	begin := m.methodIndex() + m.MethodLen()
+	if begin+2 > len(m.Buffer) {
+		return nil
+	}
+	end := m.dataIndex()
+	return decodeHeader(m.Buffer[begin+2 : end])
+}
+
 // Values returns values.
 func (m *Message) Values() map[string]interface{} {
 	return m.values
@@ -179,23 +354,62 @@ func (m *Message) IsFlagBitSet(index int) bool {
 	return false
 }
 
+// IsLongMethod returns true if the method length is stored as a uint16 at the beginning of the body.
+func (m *Message) IsLongMethod() bool {
+	return m.Buffer[HeaderIndexFlag]&HeaderFlagMaskLongMethod > 0
+}
+
 // MethodLen returns method length.
 func (m *Message) MethodLen() int {
+	if m.IsLongMethod() {
+		if len(m.Buffer) < HeadLen+2 {
+			return 0
+		}
+		return int(binary.LittleEndian.Uint16(m.Buffer[HeadLen:]))
+	}
 	return int(m.Buffer[HeaderIndexMethodLen])
 }
 
-// SetMethodLen sets method length.
+// SetMethodLen sets method length,
+// the body must have 2 bytes reserved at the beginning if l > MaxShortMethodLen.
 func (m *Message) SetMethodLen(l int) {
-	m.Buffer[HeaderIndexMethodLen] = byte(l)
+	if l > MaxShortMethodLen {
+		m.Buffer[HeaderIndexFlag] |= HeaderFlagMaskLongMethod
+		m.Buffer[HeaderIndexMethodLen] = 0
+		binary.LittleEndian.PutUint16(m.Buffer[HeadLen:], uint16(l))
+	} else {
+		m.Buffer[HeaderIndexFlag] &= ^HeaderFlagMaskLongMethod
+		m.Buffer[HeaderIndexMethodLen] = byte(l)
+	}
 }
 
 // Method returns method.
 func (m *Message) Method() string {
-	return string(m.Buffer[HeadLen : HeadLen+m.MethodLen()])
+	index := m.methodIndex()
+	return string(m.Buffer[index : index+m.MethodLen()])
 }
 
+// method returns the method without copying it, e.g. for looking up the routes, it shares the buffer,
+// so it must not be retained, e.g. as a map key, after the buffer is put back, use Method for that.
 func (m *Message) method() string {
-	return util.BytesToStr(m.Buffer[HeadLen : HeadLen+m.MethodLen()])
+	index := m.methodIndex()
+	return util.BytesToStr(m.Buffer[index : index+m.MethodLen()])
+}
+
+// methodIndex returns the index of method in the buffer.
+func (m *Message) methodIndex() int {
+	if m.IsLongMethod() {
+		return HeadLen + 2
+	}
+	return HeadLen
+}
+
+// methodLenSize returns the size of the extra method length field in the body.
+func methodLenSize(method string) int {
+	if len(method) > MaxShortMethodLen {
+		return 2
+	}
+	return 0
 }
 
 // BodyLen returns body length.
@@ -219,9 +433,48 @@ func (m *Message) SetSeq(seq uint64) {
 }
 
 // Data returns payload data after method.
+// The returned slice aliases Message.Buffer which may be allocated by the buffer factory of the Handler,
+// use DataCopy if it's held after the Message is released or modified.
 func (m *Message) Data() []byte {
-	length := HeadLen + m.MethodLen()
-	return m.Buffer[length:]
+	return m.Buffer[m.dataIndex():]
+}
+
+// DataCopy returns a copy of payload data after method.
+func (m *Message) DataCopy() []byte {
+	data := m.Data()
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	return cp
+}
+
+func (m *Message) dataIndex() int {
+	index := m.methodIndex() + m.MethodLen()
+	if m.HasHeader() && index+2 <= len(m.Buffer) {
+		index += 2 + int(binary.LittleEndian.Uint16(m.Buffer[index:]))
+	}
+	if index > len(m.Buffer) {
+		index = len(m.Buffer)
+	}
+	return index
+}
+
+// validate checks that the method and header lengths of a received Message fit in its body,
+// so the accessors don't index out of the buffer.
+func (m *Message) validate() error {
+	methodEnd := m.methodIndex() + m.MethodLen()
+	if methodEnd > len(m.Buffer) {
+		return fmt.Errorf("%w: method length %v, body length %v", ErrInvalidMethodLen, m.MethodLen(), m.BodyLen())
+	}
+	if m.HasHeader() {
+		if methodEnd+2 > len(m.Buffer) {
+			return fmt.Errorf("%w: missing header length, body length %v", ErrInvalidHeaderLen, m.BodyLen())
+		}
+		headerLen := int(binary.LittleEndian.Uint16(m.Buffer[methodEnd:]))
+		if methodEnd+2+headerLen > len(m.Buffer) {
+			return fmt.Errorf("%w: header length %v, body length %v", ErrInvalidHeaderLen, headerLen, m.BodyLen())
+		}
+	}
+	return nil
 }
 
 // Get returns value for key.
@@ -246,14 +499,23 @@ func (m *Message) Set(key string, value interface{}) {
 
 // newMessage creates a Message.
 func newMessage(cmd byte, method string, v interface{}, isError bool, isAsync bool, seq uint64, h Handler, codec codec.Codec, values map[string]interface{}) *Message {
+	return newMessageWithHeader(cmd, method, nil, v, isError, isAsync, seq, h, codec, values)
+}
+
+// newMessageWithHeader creates a Message with encoded header.
+func newMessageWithHeader(cmd byte, method string, header []byte, v interface{}, isError bool, isAsync bool, seq uint64, h Handler, codec codec.Codec, values map[string]interface{}) *Message {
 	var (
 		data    []byte
 		msg     *Message
 		bodyLen int
+		dataIdx int
 	)
 
 	data = util.ValueToBytes(codec, v)
-	bodyLen = len(method) + len(data)
+	bodyLen = methodLenSize(method) + len(method) + len(data)
+	if header != nil {
+		bodyLen += 2 + len(header)
+	}
 
 	if h == nil {
 		h = DefaultHandler
@@ -266,12 +528,105 @@ func newMessage(cmd byte, method string, v interface{}, isError bool, isAsync bo
 	msg.SetMethodLen(len(method))
 	msg.SetBodyLen(bodyLen)
 	msg.SetSeq(seq)
-	copy(msg.Buffer[HeadLen:HeadLen+len(method)], method)
-	copy(msg.Buffer[HeadLen+len(method):], data)
+	dataIdx = msg.methodIndex()
+	copy(msg.Buffer[dataIdx:dataIdx+len(method)], method)
+	dataIdx += len(method)
+	if header != nil {
+		msg.SetHasHeader(true)
+		binary.LittleEndian.PutUint16(msg.Buffer[dataIdx:], uint16(len(header)))
+		copy(msg.Buffer[dataIdx+2:], header)
+		dataIdx += 2 + len(header)
+	}
+	copy(msg.Buffer[dataIdx:], data)
 
 	return msg
 }
 
+// newMessageFromReader reads size bytes from r into the Message body, r must supply at least size bytes
+// and the ones after them are left unread, ErrInvalidBodySize is returned if r ends before size bytes.
+func newMessageFromReader(cmd byte, method string, r io.Reader, size int, isAsync bool, seq uint64, h Handler, values map[string]interface{}) (*Message, error) {
+	if size < 0 {
+		return nil, ErrInvalidBodySize
+	}
+	if h == nil {
+		h = DefaultHandler
+	}
+	bodyLen := methodLenSize(method) + len(method) + size
+	if err := checkBodyLen(bodyLen); err != nil {
+		return nil, err
+	}
+	if uint64(bodyLen) > uint64(h.MaxBodyLen()) {
+		return nil, ErrBodyTooLarge
+	}
+
+	msg := &Message{Buffer: h.GetBuffer(HeadLen + bodyLen), values: values}
+	msg.SetCmd(cmd)
+	msg.SetAsync(isAsync)
+	msg.SetMethodLen(len(method))
+	msg.SetBodyLen(bodyLen)
+	msg.SetSeq(seq)
+	dataIdx := msg.methodIndex() + len(method)
+	copy(msg.Buffer[msg.methodIndex():dataIdx], method)
+
+	if _, err := io.ReadFull(r, msg.Buffer[dataIdx:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidBodySize
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// encodeHeader encodes key-value pairs as: [keyLen uint16][key][valueLen uint16][value]...
+func encodeHeader(md map[string]string) ([]byte, error) {
+	size := 0
+	for k, v := range md {
+		size += 4 + len(k) + len(v)
+	}
+	if size > MaxHeaderLen {
+		return nil, fmt.Errorf("invalid header length: %v, should <= %v", size, MaxHeaderLen)
+	}
+	buf := make([]byte, size)
+	offset := 0
+	for k, v := range md {
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(len(k)))
+		offset += 2
+		offset += copy(buf[offset:], k)
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(len(v)))
+		offset += 2
+		offset += copy(buf[offset:], v)
+	}
+	return buf, nil
+}
+
+func decodeHeader(buf []byte) map[string]string {
+	md := map[string]string{}
+	for len(buf) >= 2 {
+		kl := int(binary.LittleEndian.Uint16(buf))
+		if len(buf) < 4+kl {
+			break
+		}
+		k := string(buf[2 : 2+kl])
+		buf = buf[2+kl:]
+		vl := int(binary.LittleEndian.Uint16(buf))
+		if len(buf) < 2+vl {
+			break
+		}
+		md[k] = string(buf[2 : 2+vl])
+		buf = buf[2+vl:]
+	}
+	return md
+}
+
+// checkBodyLen returns ErrBodyTooLarge if bodyLen overflows the uint32 body length of the head.
+func checkBodyLen(bodyLen int) error {
+	if uint64(bodyLen) > math.MaxUint32 {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
 func checkMethod(method string) error {
 	ml := len(method)
 	if ml == 0 || ml > MaxMethodLen {
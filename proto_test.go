@@ -5,7 +5,9 @@
 package arpc
 
 import (
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/lesismal/arpc/internal/codec"
@@ -34,8 +36,37 @@ func TestHeader_message(t *testing.T) {
 
 	head[0], head[1], head[2], head[3] = 0xFF, 0xFF, 0xFF, 0xFF
 	_, err = head.message(DefaultHandler)
-	if err == nil {
-		t.Fatalf("Header.message() error = nil")
+	if err != ErrBodyTooLarge {
+		t.Fatalf("Header.message() error = %v, want %v", err, ErrBodyTooLarge)
+	}
+
+	h := NewHandler()
+	h.SetMaxBodyLen(9)
+	msg = newMessage(CmdRequest, "hello", "hello", false, false, 0, h, codec.DefaultCodec, nil)
+	if _, err = Header(msg.Buffer[:HeadLen]).message(h); err != ErrBodyTooLarge {
+		t.Fatalf("Header.message() error = %v, want %v", err, ErrBodyTooLarge)
+	}
+}
+
+func Test_newMessageFromReader(t *testing.T) {
+	h := NewHandler()
+	h.SetMaxBodyLen(9)
+	if _, err := newMessageFromReader(CmdRequest, "hello", strings.NewReader("hello"), 5, false, 0, h, nil); err != ErrBodyTooLarge {
+		t.Fatalf("newMessageFromReader() error = %v, want %v", err, ErrBodyTooLarge)
+	}
+	h.SetMaxBodyLen(10)
+	msg, err := newMessageFromReader(CmdRequest, "hello", strings.NewReader("hello"), 5, false, 0, h, nil)
+	if err != nil || string(msg.Data()) != "hello" {
+		t.Fatalf("newMessageFromReader() = %v, %v, want hello, nil", msg, err)
+	}
+}
+
+func Test_checkBodyLen(t *testing.T) {
+	if err := checkBodyLen(MaxBodyLen); err != nil {
+		t.Fatalf("checkBodyLen() error = %v", err)
+	}
+	if err := checkBodyLen(int(uint64(math.MaxUint32) + 1)); err != ErrBodyTooLarge {
+		t.Fatalf("checkBodyLen() error = %v, want %v", err, ErrBodyTooLarge)
 	}
 }
 
@@ -191,6 +222,41 @@ func TestMessage_Data(t *testing.T) {
 	}
 }
 
+func TestMessage_DataCopy(t *testing.T) {
+	msg := newMessage(CmdRequest, "hello", "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	data := msg.DataCopy()
+	if !reflect.DeepEqual(data, []byte("hello")) {
+		t.Fatalf("Message.DataCopy() = %v, want %v", data, []byte("hello"))
+	}
+	msg.Data()[0] = 'H'
+	if !reflect.DeepEqual(data, []byte("hello")) {
+		t.Fatalf("Message.DataCopy() = %v, want %v", data, []byte("hello"))
+	}
+}
+
+func TestMessage_Header(t *testing.T) {
+	md := map[string]string{"trace": "123", "tenant": "abc"}
+	header, err := encodeHeader(md)
+	if err != nil {
+		t.Fatalf("encodeHeader() error = %v", err)
+	}
+	msg := newMessageWithHeader(CmdRequest, "hello", header, "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	if !msg.HasHeader() {
+		t.Fatalf("Message.HasHeader() = false, want true")
+	}
+	if got := msg.Header(); !reflect.DeepEqual(got, md) {
+		t.Fatalf("Message.Header() = %v, want %v", got, md)
+	}
+	if got := msg.Data(); !reflect.DeepEqual(got, []byte("hello")) {
+		t.Fatalf("Message.Data() = %v, want %v", got, []byte("hello"))
+	}
+
+	msg = newMessage(CmdRequest, "hello", "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	if got := msg.Header(); got != nil {
+		t.Fatalf("Message.Header() = %v, want nil", got)
+	}
+}
+
 func TestMessage_Get(t *testing.T) {
 	msg := &Message{}
 	if v, ok := msg.Get("key"); ok {
@@ -218,3 +284,83 @@ func TestMessage_Set(t *testing.T) {
 		t.Fatalf("Message.Get() failed: Get '%v', want '%v'", cv, value)
 	}
 }
+
+func TestMessage_Checksum(t *testing.T) {
+	msg := newMessage(CmdRequest, "hello", "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	buf := appendChecksum(msg.Buffer)
+	if len(buf) != len(msg.Buffer)+ChecksumLen {
+		t.Fatalf("appendChecksum() len = %v, want %v", len(buf), len(msg.Buffer)+ChecksumLen)
+	}
+
+	recv := &Message{Buffer: buf}
+	if !recv.HasChecksum() {
+		t.Fatalf("Message.HasChecksum() = false, want true")
+	}
+	if !recv.verifyChecksum() {
+		t.Fatalf("Message.verifyChecksum() = false, want true")
+	}
+	if recv.HasChecksum() {
+		t.Fatalf("Message.HasChecksum() = true, want false")
+	}
+	if !reflect.DeepEqual(recv.Buffer, msg.Buffer) {
+		t.Fatalf("Message.Buffer = %v, want %v", recv.Buffer, msg.Buffer)
+	}
+
+	buf = appendChecksum(msg.Buffer)
+	buf[len(buf)-ChecksumLen-1] ^= 0xFF
+	recv = &Message{Buffer: buf}
+	if recv.verifyChecksum() {
+		t.Fatalf("Message.verifyChecksum() = true, want false")
+	}
+}
+
+func TestMessage_LongMethod(t *testing.T) {
+	method := strings.Repeat("m", MaxShortMethodLen+1)
+	md := map[string]string{"trace": "123"}
+	header, err := encodeHeader(md)
+	if err != nil {
+		t.Fatalf("encodeHeader() error = %v", err)
+	}
+	msg := newMessageWithHeader(CmdRequest, method, header, "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	if !msg.IsLongMethod() {
+		t.Fatalf("Message.IsLongMethod() = false, want true")
+	}
+	if got := msg.MethodLen(); got != len(method) {
+		t.Fatalf("Message.MethodLen() = %v, want %v", got, len(method))
+	}
+	if got := msg.Method(); got != method {
+		t.Fatalf("Message.Method() = %v, want %v", got, method)
+	}
+	if got := msg.Header(); !reflect.DeepEqual(got, md) {
+		t.Fatalf("Message.Header() = %v, want %v", got, md)
+	}
+	if got := msg.Data(); !reflect.DeepEqual(got, []byte("hello")) {
+		t.Fatalf("Message.Data() = %v, want %v", got, []byte("hello"))
+	}
+
+	msg = newMessage(CmdRequest, method[:MaxShortMethodLen], "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	if msg.IsLongMethod() {
+		t.Fatalf("Message.IsLongMethod() = true, want false")
+	}
+	if got := msg.Method(); got != method[:MaxShortMethodLen] {
+		t.Fatalf("Message.Method() = %v, want %v", got, method[:MaxShortMethodLen])
+	}
+}
+
+func TestMessage_Version(t *testing.T) {
+	msg := newMessage(CmdResponse, "hello", "hello", false, false, 0, DefaultHandler, codec.DefaultCodec, nil)
+	if got := msg.Version(); got != ProtocolVersion0 {
+		t.Fatalf("Message.Version() = %v, want %v", got, ProtocolVersion0)
+	}
+	msg.SetVersion(ProtocolVersion1)
+	if got := msg.Version(); got != ProtocolVersion1 {
+		t.Fatalf("Message.Version() = %v, want %v", got, ProtocolVersion1)
+	}
+	if got := msg.Cmd(); got != CmdResponse {
+		t.Fatalf("Message.Cmd() = %v, want %v", got, CmdResponse)
+	}
+	msg.SetCmd(CmdNotify)
+	if got := msg.Version(); got != ProtocolVersion1 {
+		t.Fatalf("Message.Version() = %v, want %v", got, ProtocolVersion1)
+	}
+}
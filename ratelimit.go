@@ -0,0 +1,125 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimit represents the token bucket config of a method.
+type rateLimit struct {
+	rps   float64
+	burst float64
+}
+
+// tokenBucket is a token bucket limiter of a method for a single Client.
+type tokenBucket struct {
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(limit rateLimit) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * limit.rps
+	if b.tokens > limit.burst {
+		b.tokens = limit.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// methodLimiter holds the rate limits of the methods and the token buckets of every Client,
+// it has its own lock so the requests don't contend for the lock of the Server.
+type methodLimiter struct {
+	mux     sync.RWMutex
+	limits  map[string]rateLimit
+	buckets map[*Client]map[string]*tokenBucket
+}
+
+// bucket returns the limit of method and the token bucket of c for it, ok is false if method isn't limited.
+func (l *methodLimiter) bucket(c *Client, method string) (limit rateLimit, bucket *tokenBucket, ok bool) {
+	l.mux.RLock()
+	limit, ok = l.limits[method]
+	if !ok {
+		l.mux.RUnlock()
+		return limit, nil, false
+	}
+	bucket = l.buckets[c][method]
+	l.mux.RUnlock()
+	if bucket != nil {
+		return limit, bucket, true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	buckets, ok := l.buckets[c]
+	if !ok {
+		buckets = map[string]*tokenBucket{}
+		l.buckets[c] = buckets
+	}
+	bucket, ok = buckets[method]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.burst, last: time.Now()}
+		// method may share the buffer of the message, copy it for the key
+		buckets[string(append([]byte{}, method...))] = bucket
+	}
+	return limit, bucket, true
+}
+
+// deleteClient removes the token buckets of c.
+func (l *methodLimiter) deleteClient(c *Client) {
+	l.mux.Lock()
+	delete(l.buckets, c)
+	l.mux.Unlock()
+}
+
+// SetMethodRateLimit limits the requests of method from each Client to rps per second with burst,
+// the requests exceeding the limit are responded with ErrRateLimited without calling the handler.
+// rps <= 0 removes the limit.
+// The limit is checked by a middleware which is registered by the first call of SetMethodRateLimit,
+// so it should be called before the handlers are registered, the same as Handler.Use.
+func (s *Server) SetMethodRateLimit(method string, rps int, burst int) {
+	s.mux.Lock()
+	if !s.rateLimited {
+		s.rateLimited = true
+		s.limiter.limits = map[string]rateLimit{}
+		s.limiter.buckets = map[*Client]map[string]*tokenBucket{}
+		s.Handler.Use(s.rateLimitMiddleware)
+	}
+	s.mux.Unlock()
+
+	s.limiter.mux.Lock()
+	defer s.limiter.mux.Unlock()
+	if rps <= 0 {
+		delete(s.limiter.limits, method)
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	s.limiter.limits[method] = rateLimit{rps: float64(rps), burst: float64(burst)}
+}
+
+func (s *Server) rateLimitMiddleware(ctx *Context) {
+	limit, bucket, ok := s.limiter.bucket(ctx.Client, ctx.Message.method())
+	if !ok {
+		return
+	}
+	if !bucket.allow(limit) {
+		if ctx.Message.Cmd() == CmdRequest {
+			ctx.Error(ErrRateLimited)
+		}
+		ctx.Done()
+	}
+}
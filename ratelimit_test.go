@@ -0,0 +1,67 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_SetMethodRateLimit(t *testing.T) {
+	svr := NewServer()
+	svr.SetMethodRateLimit("/limited", 10, 2)
+	svr.Handler.Handle("/limited", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/unlimited", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	for i := 0; i < 2; i++ {
+		if err = c.Call("/limited", "hello", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+	if err = c.Call("/limited", "hello", &rsp, time.Second); err == nil || err.Error() != ErrRateLimited.Error() {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrRateLimited)
+	}
+	for i := 0; i < 3; i++ {
+		if err = c.Call("/unlimited", "hello", &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+
+	time.Sleep(time.Second / 5)
+	if err = c.Call("/limited", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+}
+
+func TestServer_rateLimitMiddlewareKey(t *testing.T) {
+	svr := NewServer()
+	svr.SetMethodRateLimit("/limited", 10, 2)
+	c := &Client{Handler: svr.Handler}
+	msg := newMessage(CmdNotify, "/limited", nil, false, false, 1, svr.Handler, nil, nil)
+	svr.rateLimitMiddleware(newContext(c, msg, nil))
+
+	// the buffer is reused after the handlers returned
+	copy(msg.Buffer[msg.methodIndex():], "/changed")
+	if _, ok := svr.limiter.buckets[c]["/limited"]; !ok {
+		t.Fatalf("buckets = %v, want the key /limited", svr.limiter.buckets[c])
+	}
+}
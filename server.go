@@ -6,6 +6,8 @@ package arpc
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -27,40 +29,58 @@ type Server struct {
 
 	Listener net.Listener
 
-	mux sync.Mutex
+	// TLSConfig is used by ListenAndServeTLS.
+	TLSConfig *tls.Config
 
-	seq     uint64
-	running bool
-	chStop  chan error
-	clients map[*Client]util.Empty
+	mux sync.RWMutex
+
+	seq         uint64
+	running     bool
+	shutdown    bool
+	queueConns  bool
+	checksum    bool
+	idleTimeout time.Duration
+	clientOpts  []ClientOption
+	chStop      chan error
+	clients     map[*Client]util.Empty
+
+	rateLimited bool
+	limiter     methodLimiter
 }
 
+// MethodServerOverload is the method of the error notify sent to a connection rejected for exceeding the max connections,
+// register a handler of it on the Client to know why the connection was closed.
+const MethodServerOverload = "/arpc/overload"
+
+// shutdownPollInterval is how often Shutdown checks whether the in-flight handlers have finished.
+const shutdownPollInterval = time.Millisecond * 10
+
 // Serve starts service with listener.
 func (s *Server) Serve(ln net.Listener) error {
 	s.Listener = ln
 	s.chStop = make(chan error)
-	log.Info("%v Running On: \"%v\"", s.Handler.LogTag(), ln.Addr())
-	defer log.Info("%v Stopped", s.Handler.LogTag())
-	return s.runLoop()
+	log.Infow("Running", "tag", s.Handler.LogTag(), "addr", ln.Addr())
+	defer log.Infow("Stopped", "tag", s.Handler.LogTag())
+	return s.runLoop(nil)
 }
 
 // Run starts tcp service on addr.
 func (s *Server) Run(addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Info("%v Running failed: %v", s.Handler.LogTag(), err)
+		log.Infow("Running failed", "tag", s.Handler.LogTag(), "error", err)
 		return err
 	}
 	s.Listener = ln
 	s.chStop = make(chan error)
-	log.Info("%v Running On: \"%v\"", s.Handler.LogTag(), ln.Addr())
-	// defer log.Info("%v Stopped", s.Handler.LogTag())
-	return s.runLoop()
+	log.Infow("Running", "tag", s.Handler.LogTag(), "addr", ln.Addr())
+	// defer log.Infow("Stopped", "tag", s.Handler.LogTag())
+	return s.runLoop(nil)
 }
 
 // Stop stops service.
 func (s *Server) Stop() error {
-	defer log.Info("%v %v Stop", s.Handler.LogTag(), s.Listener.Addr())
+	defer log.Infow("Stop", "tag", s.Handler.LogTag(), "addr", s.Listener.Addr())
 	s.running = false
 	s.Listener.Close()
 	select {
@@ -72,24 +92,168 @@ func (s *Server) Stop() error {
 	return nil
 }
 
-// Shutdown shutdown service.
+// Shutdown stops accepting new connections and waits for the in-flight handlers to finish,
+// then every connection is closed after the messages in its send queue have been sent.
+// If ctx is done before that, the remaining connections are closed forcibly
+// and an error with the number of them is returned.
 func (s *Server) Shutdown(ctx context.Context) error {
-	defer log.Info("%v %v Shutdown", s.Handler.LogTag(), s.Listener.Addr())
+	defer log.Infow("Shutdown", "tag", s.Handler.LogTag(), "addr", s.Listener.Addr())
+	s.mux.Lock()
+	s.shutdown = true
+	s.mux.Unlock()
 	s.running = false
 	s.Listener.Close()
 	select {
 	case <-s.chStop:
 	case <-ctx.Done():
-		return ErrTimeout
+		return s.closeClientsForcibly()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.numInflight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return s.closeClientsForcibly()
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, c := range s.getClients() {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.StopGracefully(TimeForever)
+		}(c)
+	}
+	chDone := make(chan util.Empty)
+	go func() {
+		wg.Wait()
+		close(chDone)
+	}()
+	select {
+	case <-chDone:
+	case <-ctx.Done():
+		return s.closeClientsForcibly()
 	}
 	return nil
 }
 
+// SetIdleTimeout sets the max duration a connection can stay without receiving any message,
+// the connection will be closed after that. 0 means no limit.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.mux.Lock()
+	s.idleTimeout = timeout
+	s.mux.Unlock()
+}
+
+// SetClientOptions sets the options applied to the Client of every accepted connection before its loops start,
+// e.g. WithSendQueueSize, it takes effect on the connections accepted after it's called.
+func (s *Server) SetClientOptions(opts ...ClientOption) {
+	s.mux.Lock()
+	s.clientOpts = opts
+	s.mux.Unlock()
+}
+
+// EnableChecksum sets whether a CRC32 checksum of the body is appended to every message sent to the clients,
+// it takes effect on the connections accepted after it's called, see Client.EnableChecksum.
+func (s *Server) EnableChecksum(enable bool) {
+	s.mux.Lock()
+	s.checksum = enable
+	s.mux.Unlock()
+}
+
+// SetMaxConnections sets the max number of simultaneous connections, it's the same as setting MaxLoad.
+// The new connections exceeding the limit are closed after an error notify of MethodServerOverload is sent,
+// unless they are queued, see SetQueueConnections.
+// n <= 0 means no limit.
+func (s *Server) SetMaxConnections(n int) {
+	atomic.StoreInt64(&s.MaxLoad, int64(n))
+}
+
+// SetQueueConnections sets whether the new connections exceeding SetMaxConnections are queued,
+// if true, the Server stops accepting until a connection is closed, the new connections wait in the listener's backlog.
+func (s *Server) SetQueueConnections(queue bool) {
+	s.mux.Lock()
+	s.queueConns = queue
+	s.mux.Unlock()
+}
+
+// NumConnections returns the number of current connections.
+func (s *Server) NumConnections() int {
+	return int(atomic.LoadInt64(&s.CurrLoad))
+}
+
+// HandleConnected registers a handler which is called with the Client of every accepted connection
+// after its loops started, it's the same as Handler.HandleConnected.
+// The handler is called in the accepting goroutine, it should not block.
+func (s *Server) HandleConnected(onConnected func(*Client)) {
+	s.Handler.HandleConnected(onConnected)
+}
+
+// HandleDisconnected registers a handler which is called when an accepted connection is closed,
+// it's the same as Handler.HandleDisconnected.
+func (s *Server) HandleDisconnected(onDisconnected func(*Client)) {
+	s.Handler.HandleDisconnected(onDisconnected)
+}
+
+// SetRecoverHandler sets the handler which will be called when a method/router handler panics,
+// it's the same as Handler.HandlePanic. By default, the panic and stack are logged.
+func (s *Server) SetRecoverHandler(h func(ctx *Context, recovered interface{})) {
+	s.Handler.HandlePanic(h)
+}
+
+// SetOverloadPolicy sets what to do with a message when the dispatch pool of Handler.SetAsyncDispatch is full,
+// it's the same as Handler.SetOverloadPolicy. With OverloadPolicyReject, the Clients get ErrServerBusy.
+func (s *Server) SetOverloadPolicy(policy OverloadPolicy) {
+	s.Handler.SetOverloadPolicy(policy)
+}
+
 // NewMessage creates a Message.
 func (s *Server) NewMessage(cmd byte, method string, v interface{}) *Message {
 	return newMessage(cmd, method, v, false, false, atomic.AddUint64(&s.seq, 1), s.Handler, s.Codec, nil)
 }
 
+// Broadcast pushes a notify message to all connected clients.
+// Clients which are stopped or reconnecting are skipped, and a client whose send queue is full
+// drops the message instead of blocking the others.
+func (s *Server) Broadcast(method string, v interface{}) {
+	s.BroadcastFilter(method, v, nil)
+}
+
+// BroadcastFilter pushes a notify message to the connected clients for which filter returns true,
+// a nil filter selects all clients. The filter is called under the read lock of the clients,
+// so it should not call other methods of the Server.
+// It returns the number of clients the message was delivered to.
+func (s *Server) BroadcastFilter(method string, v interface{}, filter func(*Client) bool) int {
+	s.mux.RLock()
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		if filter == nil || filter(c) {
+			clients = append(clients, c)
+		}
+	}
+	s.mux.RUnlock()
+
+	if len(clients) == 0 {
+		return 0
+	}
+
+	n := 0
+	msg := s.NewMessage(CmdNotify, method, v)
+	for _, c := range clients {
+		if c.CheckState() != nil {
+			continue
+		}
+		// coders may encode the buffer in place, so every client sends its own copy.
+		if c.PushMsg(&Message{Buffer: append([]byte(nil), msg.Buffer...)}, TimeZero) == nil {
+			n++
+		}
+	}
+	return n
+}
+
 func (s *Server) addLoad() int64 {
 	return atomic.AddInt64(&s.CurrLoad, 1)
 }
@@ -98,6 +262,31 @@ func (s *Server) subLoad() int64 {
 	return atomic.AddInt64(&s.CurrLoad, -1)
 }
 
+// waitForLoad blocks until the current load is less than MaxLoad if the connections should be queued.
+func (s *Server) waitForLoad() {
+	s.mux.Lock()
+	queue := s.queueConns
+	s.mux.Unlock()
+	if !queue {
+		return
+	}
+	for s.running {
+		max := atomic.LoadInt64(&s.MaxLoad)
+		if max <= 0 || atomic.LoadInt64(&s.CurrLoad) < max {
+			return
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+}
+
+// reject sends an error notify to conn and closes it.
+func (s *Server) reject(conn net.Conn) {
+	msg := newMessage(CmdNotify, MethodServerOverload, ErrServerOverload.Error(), true, true, 0, s.Handler, s.Codec, nil)
+	conn.SetWriteDeadline(time.Now().Add(time.Second / 10))
+	s.Handler.Send(conn, msg.Buffer)
+	conn.Close()
+}
+
 func (s *Server) addClient(c *Client) {
 	s.mux.Lock()
 	s.clients[c] = util.Empty{}
@@ -108,6 +297,36 @@ func (s *Server) deleteClient(c *Client) {
 	s.mux.Lock()
 	delete(s.clients, c)
 	s.mux.Unlock()
+	s.limiter.deleteClient(c)
+}
+
+func (s *Server) getClients() []*Client {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (s *Server) numInflight() int64 {
+	var n int64
+	for _, c := range s.getClients() {
+		n += atomic.LoadInt64(&c.inflight)
+	}
+	return n
+}
+
+func (s *Server) closeClientsForcibly() error {
+	s.mux.Lock()
+	n := len(s.clients)
+	s.mux.Unlock()
+	s.clearClients()
+	if n == 0 {
+		return ErrTimeout
+	}
+	return fmt.Errorf("%w: %v connections closed forcibly", ErrTimeout, n)
 }
 
 func (s *Server) clearClients() {
@@ -119,41 +338,75 @@ func (s *Server) clearClients() {
 	s.mux.Unlock()
 }
 
-func (s *Server) runLoop() error {
+// serveConn creates and starts a Client for conn, or rejects conn if the Server is overloaded.
+func (s *Server) serveConn(conn net.Conn) {
+	load := s.addLoad()
+	maxLoad := atomic.LoadInt64(&s.MaxLoad)
+	if maxLoad > 0 && load > maxLoad {
+		s.subLoad()
+		go s.reject(conn)
+		return
+	}
+
+	atomic.AddInt64(&s.Accepted, 1)
+	metrics := s.Handler.Metrics()
+	if metrics != nil {
+		metrics.AddConnections(1)
+	}
+	s.mux.RLock()
+	opts := s.clientOpts
+	s.mux.RUnlock()
+	cli := newClientWithConn(conn, s.Codec, s.Handler, func(c *Client) {
+		s.deleteClient(c)
+		s.subLoad()
+		if metrics != nil {
+			metrics.AddConnections(-1)
+		}
+	}, opts...)
+	s.mux.Lock()
+	cli.idleTimeout = s.idleTimeout
+	cli.EnableChecksum(s.checksum)
+	s.mux.Unlock()
+	cli.start()
+	s.addClient(cli)
+	s.Handler.OnConnected(cli)
+}
+
+// runLoop accepts and serves the connections, if tlsConfig is not nil, the tls handshake of every
+// connection is done in its own goroutine, so a slow peer doesn't block the accepting.
+func (s *Server) runLoop(tlsConfig *tls.Config) error {
 	var (
 		err  error
-		cli  *Client
 		conn net.Conn
 	)
 
 	s.running = true
 	defer func() {
-		s.clearClients()
+		s.mux.Lock()
+		shutdown := s.shutdown
+		s.mux.Unlock()
+		// the clients are closed by Shutdown after the in-flight handlers finished
+		if !shutdown {
+			s.clearClients()
+		}
 		close(s.chStop)
 	}()
 
 	for s.running {
+		s.waitForLoad()
 		conn, err = s.Listener.Accept()
 		if err == nil {
-			load := s.addLoad()
-			if s.MaxLoad <= 0 || load <= s.MaxLoad {
-				s.Accepted++
-				cli = newClientWithConn(conn, s.Codec, s.Handler, func(c *Client) {
-					s.deleteClient(c)
-					s.subLoad()
-				})
-				s.addClient(cli)
-				s.Handler.OnConnected(cli)
+			if tlsConfig != nil {
+				go s.serveTLSConn(conn, tlsConfig)
 			} else {
-				conn.Close()
-				s.subLoad()
+				s.serveConn(conn)
 			}
 		} else {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Error("%v Accept error: %v; retrying...", s.Handler.LogTag(), err)
+				log.Errorw("Accept error, retrying", "tag", s.Handler.LogTag(), "error", err)
 				time.Sleep(time.Second / 20)
 			} else {
-				log.Error("%v Accept error: %v", s.Handler.LogTag(), err)
+				log.Errorw("Accept error", "tag", s.Handler.LogTag(), "error", err)
 				break
 			}
 		}
@@ -162,6 +415,14 @@ func (s *Server) runLoop() error {
 	return err
 }
 
+// NewTLSServer creates an arpc Server which serves tls by ListenAndServeTLS,
+// set config.ClientAuth and config.ClientCAs to verify the client certificates.
+func NewTLSServer(config *tls.Config) *Server {
+	s := NewServer()
+	s.TLSConfig = config
+	return s
+}
+
 // NewServer creates an arpc Server.
 func NewServer() *Server {
 	h := DefaultHandler.Clone()
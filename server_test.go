@@ -6,11 +6,17 @@ package arpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/lesismal/arpc/internal/util"
 )
 
 var testServerAddr = "localhost:12000"
@@ -100,14 +106,220 @@ func TestServer_Serve(t *testing.T) {
 			log.Fatalf("failed to Dial: %v", err)
 		} else {
 			conn.SetReadDeadline(time.Now().Add(time.Second / 10))
-			if _, err = conn.Read([]byte{1}); err == nil {
-				log.Fatalf("conn.Read success, should be closed by server(limited by MaxLoad)")
+			if _, err = ioutil.ReadAll(conn); err != nil {
+				log.Fatalf("conn.Read failed: %v, should be closed by server(limited by MaxLoad)", err)
 			}
 		}
 	}
 	svr.Stop()
 }
 
+func TestServer_CallClient(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/callback", func(ctx *Context) {
+		rsp := ""
+		if err := ctx.Client.Call("/client/echo", ctx.Body(), &rsp, time.Second); err != nil {
+			ctx.Error(err)
+			return
+		}
+		ctx.Write(rsp)
+	}, true)
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+	c.Handler.Handle("/client/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+
+	req := "hello"
+	rsp := ""
+	if err = c.Call("/callback", req, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, req)
+	}
+}
+
+func TestServer_HandleDisconnectedWithError(t *testing.T) {
+	chErr := make(chan error, 1)
+	svr := NewServer()
+	svr.Handler.HandleDisconnectedWithError(func(c *Client, err error) {
+		chErr <- err
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	var stopErr error = io.ErrUnexpectedEOF
+	c.Handler.HandleDisconnectedWithError(func(c *Client, err error) {
+		stopErr = err
+	})
+	c.Stop()
+	if stopErr != nil {
+		t.Fatalf("client disconnected error = %v, want nil", stopErr)
+	}
+
+	select {
+	case err = <-chErr:
+		if err != io.EOF {
+			t.Fatalf("server disconnected error = %v, want %v", err, io.EOF)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server disconnected handler not called")
+	}
+}
+
+func TestServer_HandleConnected(t *testing.T) {
+	chDisconnected := make(chan *Client, 1)
+	svr := NewServer()
+	var connected *Client
+	svr.HandleConnected(func(c *Client) {
+		connected = c
+		// the loops have started, the Client is ready to send
+		c.Notify("/welcome", "hello", time.Second)
+	})
+	svr.HandleDisconnected(func(c *Client) {
+		chDisconnected <- c
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	chWelcome := make(chan string, 1)
+	handler := DefaultHandler.Clone()
+	handler.Handle("/welcome", func(ctx *Context) {
+		chWelcome <- string(ctx.Body())
+	})
+	defer SetHandler(DefaultHandler)
+	SetHandler(handler)
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	select {
+	case msg := <-chWelcome:
+		if msg != "hello" {
+			t.Fatalf("welcome notify = %v, want hello", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server connected handler not called")
+	}
+
+	c.Stop()
+	select {
+	case c := <-chDisconnected:
+		if c != connected {
+			t.Fatalf("server disconnected Client = %p, want %p", c, connected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server disconnected handler not called")
+	}
+}
+
+func TestServer_Broadcast(t *testing.T) {
+	svr := NewServer()
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	chBroadcast := make(chan string, 2)
+	handler := DefaultHandler.Clone()
+	handler.Handle("/announce", func(ctx *Context) {
+		chBroadcast <- string(ctx.Body())
+	})
+	defer SetHandler(DefaultHandler)
+	SetHandler(handler)
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", testServerAddr, time.Second)
+		})
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		defer c.Stop()
+	}
+	for i := 0; svr.NumConnections() < 2 && i < 100; i++ {
+		time.Sleep(time.Second / 100)
+	}
+
+	svr.Broadcast("/announce", "maintenance")
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-chBroadcast:
+			if msg != "maintenance" {
+				t.Fatalf("broadcast msg = %v, want maintenance", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast msg not received by client %d", i)
+		}
+	}
+}
+
+func TestServer_BroadcastFilter(t *testing.T) {
+	svr := NewServer()
+	svr.HandleConnected(func(c *Client) {
+		c.UserData = svr.NumConnections()
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	chBroadcast := make(chan string, 2)
+	handler := DefaultHandler.Clone()
+	handler.Handle("/announce", func(ctx *Context) {
+		chBroadcast <- string(ctx.Body())
+	})
+	defer SetHandler(DefaultHandler)
+	SetHandler(handler)
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(func() (net.Conn, error) {
+			return net.DialTimeout("tcp", testServerAddr, time.Second)
+		})
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		defer c.Stop()
+		time.Sleep(time.Second / 100)
+	}
+
+	n := svr.BroadcastFilter("/announce", "tenant", func(c *Client) bool {
+		return c.UserData == 1
+	})
+	if n != 1 {
+		t.Fatalf("Server.BroadcastFilter() = %v, want 1", n)
+	}
+	select {
+	case msg := <-chBroadcast:
+		if msg != "tenant" {
+			t.Fatalf("broadcast msg = %v, want tenant", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast msg not received")
+	}
+	select {
+	case msg := <-chBroadcast:
+		t.Fatalf("unexpected broadcast msg: %v", msg)
+	case <-time.After(time.Second / 10):
+	}
+}
+
 func TestServer_Run(t *testing.T) {
 	svr := NewServer()
 	go svr.Run(testServerAddr)
@@ -122,3 +334,317 @@ func TestServer_Shutdown(t *testing.T) {
 	time.Sleep(time.Second / 100)
 	svr.Shutdown(context.Background())
 }
+
+func TestServer_ShutdownWaitHandlers(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/slow", func(ctx *Context) {
+		time.Sleep(time.Second / 10)
+		ctx.Write(ctx.Body())
+	}, true)
+	go svr.Run(testServerAddr)
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	chErr := make(chan error, 1)
+	go func() {
+		rsp := ""
+		chErr <- c.Call("/slow", "hello", &rsp, time.Second)
+	}()
+	time.Sleep(time.Second / 50)
+
+	if err = svr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Server.Shutdown() error = %v", err)
+	}
+	if err = <-chErr; err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	svr := NewServer()
+	svr.Handler.Handle("/slow", func(ctx *Context) {
+		time.Sleep(time.Second / 5)
+	}, true)
+	go svr.Run(testServerAddr)
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	go c.Call("/slow", "hello", nil, time.Second)
+	time.Sleep(time.Second / 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/20)
+	defer cancel()
+	err = svr.Shutdown(ctx)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Server.Shutdown() error = %v, want %v", err, ErrTimeout)
+	}
+	if want := "timeout: 1 connections closed forcibly"; err.Error() != want {
+		t.Fatalf("Server.Shutdown() error = %v, want %v", err, want)
+	}
+}
+
+func TestServer_SetIdleTimeout(t *testing.T) {
+	chDisconnected := make(chan util.Empty, 1)
+	svr := NewServer()
+	svr.SetIdleTimeout(time.Second / 20)
+	svr.Handler.HandleDisconnected(func(c *Client) {
+		chDisconnected <- util.Empty{}
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	conn, err := net.Dial("tcp", testServerAddr)
+	if err != nil {
+		t.Fatalf("failed to Dial: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-chDisconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection not closed")
+	}
+}
+
+func TestServer_SetMaxConnections(t *testing.T) {
+	svr := NewServer()
+	svr.SetMaxConnections(1)
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	dialer := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	}
+	c1, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c1.Stop()
+	time.Sleep(time.Second / 100)
+	if n := svr.NumConnections(); n != 1 {
+		t.Fatalf("Server.NumConnections() = %v, want %v", n, 1)
+	}
+
+	conn, err := dialer()
+	if err != nil {
+		t.Fatalf("failed to Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("conn.Read failed: %v, should be closed by server", err)
+	}
+	msg := &Message{Buffer: buf}
+	if msg.Len() < HeadLen || msg.method() != MethodServerOverload || msg.Error().Error() != ErrServerOverload.Error() {
+		t.Fatalf("overload notify = %v, want method %v with error %v", buf, MethodServerOverload, ErrServerOverload)
+	}
+
+	c1.Stop()
+	time.Sleep(time.Second / 100)
+	if n := svr.NumConnections(); n != 0 {
+		t.Fatalf("Server.NumConnections() = %v, want %v", n, 0)
+	}
+}
+
+func TestServer_SetQueueConnections(t *testing.T) {
+	svr := NewServer()
+	svr.SetMaxConnections(1)
+	svr.SetQueueConnections(true)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	dialer := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	}
+	c1, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c1.Stop()
+	time.Sleep(time.Second / 100)
+
+	// the second connection waits in the backlog until the first one is closed
+	go func() {
+		time.Sleep(time.Second / 10)
+		c1.Stop()
+	}()
+	c2, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c2.Stop()
+	rsp := ""
+	if err = c2.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", rsp, err)
+	}
+	if n := svr.NumConnections(); n != 1 {
+		t.Fatalf("Server.NumConnections() = %v, want %v", n, 1)
+	}
+}
+
+func TestServer_SetRecoverHandler(t *testing.T) {
+	svr := NewServer()
+	svr.SetRecoverHandler(func(ctx *Context, recovered interface{}) {
+		ctx.Error(fmt.Sprintf("recovered: %v", recovered))
+	})
+	svr.Handler.Handle("/panic", func(ctx *Context) {
+		panic("test")
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	if err = c.Call("/panic", "", nil, time.Second); err == nil || err.Error() != "recovered: test" {
+		t.Fatalf("Client.Call() error = %v, want %v", err, "recovered: test")
+	}
+}
+
+func TestServer_EnableChecksum(t *testing.T) {
+	svr := NewServer()
+	svr.EnableChecksum(true)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.EnableChecksum(true)
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if rsp != "hello" {
+		t.Fatalf("Client.Call() rsp = %v, want hello", rsp)
+	}
+}
+
+// corruptCoder flips the last body byte of the responses after the checksum is appended.
+type corruptCoder struct{}
+
+func (corruptCoder) Encode(c *Client, msg *Message) *Message {
+	if msg.Cmd() == CmdResponse && msg.HasChecksum() {
+		msg.Buffer[len(msg.Buffer)-ChecksumLen-1] ^= 0xFF
+	}
+	return msg
+}
+
+func (corruptCoder) Decode(c *Client, msg *Message) *Message {
+	return msg
+}
+
+func TestServer_EnableChecksumMismatch(t *testing.T) {
+	defer SetHandler(DefaultHandler)
+	SetHandler(NewHandler())
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.EnableChecksum(true)
+	svr.Handler.UseCoder(corruptCoder{})
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != ErrChecksumMismatch {
+		t.Fatalf("Client.Call() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	chErr := make(chan error, 1)
+	err = c.CallAsync("/echo", "hello", func(ctx *Context) {
+		chErr <- ctx.Message.Error()
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	if err = <-chErr; err != ErrChecksumMismatch {
+		t.Fatalf("Client.CallAsync() response error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestServer_SetMaxBodyLen(t *testing.T) {
+	chDisconnected := make(chan error, 1)
+	svr := NewServer()
+	svr.Handler.SetMaxBodyLen(64)
+	svr.Handler.HandleDisconnectedWithError(func(c *Client, err error) {
+		chDisconnected <- err
+	})
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	}
+	if err = c.Call("/echo", strings.Repeat("a", 64), &rsp, time.Second/10); err == nil {
+		t.Fatalf("Client.Call() error = nil, want timeout")
+	}
+
+	select {
+	case err = <-chDisconnected:
+		if err != ErrBodyTooLarge {
+			t.Fatalf("disconnected error = %v, want %v", err, ErrBodyTooLarge)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("oversized message's connection not closed")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"io"
+	"time"
+)
+
+// streamQueueSize is the number of responses buffered for a Stream.
+// When the buffer is full, the Client's reading goroutine blocks until Stream.Recv is called,
+// so a slow Stream reader slows down all the other messages of the same Client.
+const streamQueueSize = 64
+
+// Stream represents a calling session which receives multiple responses.
+// A Stream should not be used by multiple goroutines simultaneously.
+type Stream struct {
+	client  *Client
+	session *rpcSession
+	timeout time.Duration
+	closed  bool
+}
+
+// Recv waits for the next response and stores the result in the value pointed to by rsp,
+// io.EOF is returned after the last response has been received or the server called Context.CloseStream.
+// The Stream is closed if it times out, the responses after that are dropped.
+func (s *Stream) Recv(rsp interface{}) error {
+	if s.closed {
+		return io.EOF
+	}
+
+	timer := getTimer(s.timeout)
+	defer putTimer(timer)
+
+	var msg *Message
+	select {
+	case msg = <-s.session.done:
+	case <-timer.C:
+		s.Close()
+		return ErrClientTimeout
+	case <-s.client.chClose:
+		s.Close()
+		return ErrClientStopped
+	}
+
+	if msg == nil || !msg.HasMore() {
+		s.Close()
+		if msg != nil && msg.IsStreamEnd() {
+			return io.EOF
+		}
+	}
+
+	return s.client.parseResponse(msg, rsp)
+}
+
+// Close stops receiving responses of the Stream.
+func (s *Stream) Close() {
+	if !s.closed {
+		s.closed = true
+		s.client.deleteSession(s.session.seq)
+		close(s.session.stop)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestClient_CallStream(t *testing.T) {
+	initServer()
+	defer testServer.Stop()
+
+	methodStream := "/stream"
+	testServer.Handler.Handle(methodStream, func(ctx *Context) {
+		n := 0
+		ctx.Bind(&n)
+		for i := 0; i < n; i++ {
+			ctx.WriteStream(fmt.Sprintf("%v", i))
+		}
+		ctx.CloseStream()
+	}, true)
+	methodStreamEmpty := "/streamEmpty"
+	testServer.Handler.Handle(methodStreamEmpty, func(ctx *Context) {
+		ctx.WriteStream("0")
+		ctx.Write("")
+	}, true)
+	methodStreamSlow := "/streamSlow"
+	testServer.Handler.Handle(methodStreamSlow, func(ctx *Context) {
+		time.Sleep(time.Second / 5)
+		ctx.Write("late")
+	}, true)
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	n := 3
+	stream, err := c.CallStream(methodStream, n, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallStream() error = %v", err)
+	}
+	for i := 0; i < n; i++ {
+		rsp := ""
+		if err = stream.Recv(&rsp); err != nil {
+			t.Fatalf("Stream.Recv() error = %v", err)
+		} else if rsp != fmt.Sprintf("%v", i) {
+			t.Fatalf("Stream.Recv() returns '%v', want '%v'", rsp, i)
+		}
+	}
+	if err = stream.Recv(nil); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+	if err = stream.Recv(nil); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+
+	rsp := ""
+	stream, err = c.CallStream(methodCallString, "hello", time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallStream() error = %v", err)
+	}
+	if err = stream.Recv(&rsp); err != nil || rsp != "hello" {
+		t.Fatalf("Stream.Recv() returns '%v', %v, want 'hello'", rsp, err)
+	}
+	if err = stream.Recv(nil); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+
+	// an empty last response is a value, not the end of the stream
+	stream, err = c.CallStream(methodStreamEmpty, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Client.CallStream() error = %v", err)
+	}
+	for _, want := range []string{"0", ""} {
+		rsp = "-"
+		if err = stream.Recv(&rsp); err != nil || rsp != want {
+			t.Fatalf("Stream.Recv() returns '%v', %v, want '%v'", rsp, err, want)
+		}
+	}
+	if err = stream.Recv(nil); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+
+	// the session is deleted when the Stream times out
+	stream, err = c.CallStream(methodStreamSlow, nil, time.Second/20)
+	if err != nil {
+		t.Fatalf("Client.CallStream() error = %v", err)
+	}
+	if err = stream.Recv(&rsp); err != ErrClientTimeout {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, ErrClientTimeout)
+	}
+	if _, ok := c.getSession(stream.session.seq); ok {
+		t.Fatalf("Stream session exists after timeout")
+	}
+	if err = stream.Recv(&rsp); err != io.EOF {
+		t.Fatalf("Stream.Recv() error = %v, want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// StreamCompression represents the algorithm of the whole stream compression, see Handler.EnableStreamCompression.
+type StreamCompression byte
+
+const (
+	// StreamCompressionNone disables the stream compression.
+	StreamCompressionNone StreamCompression = 0
+	// StreamCompressionFlate compresses the stream by compress/flate with flate.BestSpeed.
+	StreamCompressionFlate StreamCompression = 1
+)
+
+// streamPreambleMagic begins the preamble which both sides write before the compressed stream,
+// the algorithm follows it, so a peer with another algorithm or without the stream compression is detected.
+var streamPreambleMagic = []byte("ARPZ")
+
+func streamPreamble(algo StreamCompression) []byte {
+	return append(append([]byte{}, streamPreambleMagic...), byte(algo))
+}
+
+// streamReader reads the preamble of the peer and decompresses the rest of the stream.
+type streamReader struct {
+	r    io.Reader
+	algo StreamCompression
+	fr   io.ReadCloser
+	err  error
+}
+
+func newStreamReader(r io.Reader, algo StreamCompression) *streamReader {
+	return &streamReader{r: r, algo: algo}
+}
+
+func (sr *streamReader) Read(b []byte) (int, error) {
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	if sr.fr == nil {
+		preamble := make([]byte, len(streamPreambleMagic)+1)
+		if _, err := io.ReadFull(sr.r, preamble); err != nil {
+			sr.err = err
+			return 0, err
+		}
+		if want := streamPreamble(sr.algo); !bytes.Equal(preamble, want) {
+			sr.err = fmt.Errorf("%w: got preamble %x, want %x", ErrStreamCompressionMismatch, preamble, want)
+			return 0, sr.err
+		}
+		sr.fr = flate.NewReader(sr.r)
+	}
+	return sr.fr.Read(b)
+}
+
+// streamWriter writes the preamble and compresses the stream to w, Flush pushes the compressed data to w
+// and flushes w if it's buffered, so the small messages are not stuck in the compressor.
+type streamWriter struct {
+	w         io.Writer
+	algo      StreamCompression
+	fw        *flate.Writer
+	preambled bool
+}
+
+func newStreamWriter(w io.Writer, algo StreamCompression) *streamWriter {
+	fw, _ := flate.NewWriter(w, flate.BestSpeed)
+	return &streamWriter{w: w, algo: algo, fw: fw}
+}
+
+// writePreamble writes the preamble before the first compressed data, it's not written when the writer
+// is created because the peer may not be reading yet.
+func (sw *streamWriter) writePreamble() error {
+	if sw.preambled {
+		return nil
+	}
+	sw.preambled = true
+	_, err := sw.w.Write(streamPreamble(sw.algo))
+	return err
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if err := sw.writePreamble(); err != nil {
+		return 0, err
+	}
+	return sw.fw.Write(b)
+}
+
+func (sw *streamWriter) Flush() error {
+	if err := sw.writePreamble(); err != nil {
+		return err
+	}
+	if err := sw.fw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := sw.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
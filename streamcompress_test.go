@@ -0,0 +1,94 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countConn counts the bytes written to the Conn.
+type countConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestHandler_EnableStreamCompression(t *testing.T) {
+	svr := NewServer()
+	svr.Handler = NewHandler()
+	svr.Handler.EnableStreamCompression(StreamCompressionFlate)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	handler := NewHandler()
+	handler.EnableStreamCompression(StreamCompressionFlate)
+	defer SetHandler(DefaultHandler)
+	SetHandler(handler)
+	var conn *countConn
+	c, err := NewClient(func() (net.Conn, error) {
+		tcpConn, err := net.DialTimeout("tcp", testServerAddr, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		conn = &countConn{Conn: tcpConn}
+		return conn, nil
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	// the small messages are flushed through the compressor, the calls don't time out
+	req := strings.Repeat("hello world ", 100)
+	total := 0
+	for i := 0; i < 100; i++ {
+		rsp := ""
+		if err = c.Call("/echo", req, &rsp, time.Second); err != nil {
+			t.Fatalf("Client.Call() error = %v", err)
+		}
+		if rsp != req {
+			t.Fatalf("Client.Call() rsp = %v, want %v", rsp, req)
+		}
+		total += len(req)
+	}
+	if written := atomic.LoadInt64(&conn.written); written*10 > int64(total) {
+		t.Fatalf("written %v bytes for %v bytes of requests, want compressed", written, total)
+	}
+
+	// a peer without the stream compression is disconnected
+	SetHandler(NewHandler())
+	c2, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c2.Stop()
+	if err = c2.Call("/echo", req, nil, time.Second/10); err == nil {
+		t.Fatalf("Client.Call() error = nil, want non-nil")
+	}
+}
+
+func TestContext_HijackStreamCompression(t *testing.T) {
+	h := NewHandler()
+	h.EnableStreamCompression(StreamCompressionFlate)
+	ctx := &Context{Client: &Client{Handler: h}, sync: true}
+	if _, err := ctx.Hijack(); err != ErrContextHijackStreamCompression {
+		t.Fatalf("Context.Hijack() error = %v, want %v", err, ErrContextHijackStreamCompression)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"sync"
+	"time"
+)
+
+// timerPool reuses the timers of Calls to avoid allocating a time.Timer per Call.
+var timerPool sync.Pool
+
+// getTimer returns a timer which fires after d.
+func getTimer(d time.Duration) *time.Timer {
+	if t, ok := timerPool.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops t and puts it back to the pool, t must not be used after that.
+func putTimer(t *time.Timer) {
+	if !t.Stop() {
+		// drain the fired value which was not received, so that it's not received after Reset
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	timerPool.Put(t)
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_getTimer(t *testing.T) {
+	timer := getTimer(time.Millisecond)
+	<-timer.C
+	putTimer(timer)
+
+	// a fired but not received timer must not fire immediately after reused
+	timer = getTimer(time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	putTimer(timer)
+
+	timer = getTimer(time.Second / 10)
+	defer putTimer(timer)
+	select {
+	case <-timer.C:
+		t.Fatalf("reused timer fired before timeout")
+	case <-time.After(time.Second / 20):
+	}
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatalf("reused timer didn't fire")
+	}
+}
+
+func Benchmark_newTimer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		timer := time.NewTimer(time.Second)
+		timer.Stop()
+	}
+}
+
+func Benchmark_getTimer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		putTimer(getTimer(time.Second))
+	}
+}
+
+func BenchmarkClient_Call(b *testing.B) {
+	initServer()
+	defer testServer.Stop()
+
+	c, err := NewClient(dialer)
+	if err != nil {
+		b.Fatalf("NewClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	req := "hello"
+	rsp := ""
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = c.Call(methodCallString, req, &rsp, time.Second); err != nil {
+			b.Fatalf("Client.Call() error = %v", err)
+		}
+	}
+}
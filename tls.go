@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/lesismal/arpc/internal/log"
+)
+
+// TLSHandshakeTimeout limits how long the Server waits for the tls handshake of a connection.
+var TLSHandshakeTimeout = time.Second * 10
+
+// DialTLS returns a dialer which connects to addr with tls.
+// The config is cloned, and ServerName is set from addr if it's empty.
+func DialTLS(addr string, config *tls.Config) DialerFunc {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	return func() (net.Conn, error) {
+		return tls.Dial("tcp", addr, config)
+	}
+}
+
+// NewTLSClient creates a Client which connects and reconnects to addr with tls.
+func NewTLSClient(addr string, config *tls.Config) (*Client, error) {
+	return NewClient(DialTLS(addr, config))
+}
+
+// ListenAndServeTLS starts tls service on addr with TLSConfig.
+// The tls handshake is done for every connection before it's served,
+// the connections failed to handshake are closed.
+func (s *Server) ListenAndServeTLS(addr string) error {
+	if s.TLSConfig == nil {
+		return ErrServerNilTLSConfig
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Infow("Running failed", "tag", s.Handler.LogTag(), "error", err)
+		return err
+	}
+	s.Listener = ln
+	s.chStop = make(chan error)
+	log.Infow("Running TLS", "tag", s.Handler.LogTag(), "addr", ln.Addr())
+	return s.runLoop(s.TLSConfig)
+}
+
+func (s *Server) serveTLSConn(conn net.Conn, config *tls.Config) {
+	tlsConn := tls.Server(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Errorw("TLS handshake failed", "tag", s.Handler.LogTag(), "remote_addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if !s.running {
+		conn.Close()
+		return
+	}
+	s.serveConn(tlsConn)
+}
+
+// PeerCertificate returns the first certificate sent by the peer of a tls connection,
+// it returns nil if the connection is not tls or the peer didn't send any certificate.
+func (c *Client) PeerCertificate() *x509.Certificate {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// PeerCertificate returns the certificate of the peer, see Client.PeerCertificate.
+func (ctx *Context) PeerCertificate() *x509.Certificate {
+	return ctx.Client.PeerCertificate()
+}
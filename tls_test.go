@@ -0,0 +1,118 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var testTLSServerAddr = "localhost:13000"
+
+func TestNewTLSClient(t *testing.T) {
+	ln, err := tls.Listen("tcp", testTLSServerAddr, generateTLSConfig())
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	go svr.Serve(ln)
+	defer svr.Stop()
+
+	c, err := NewTLSClient(testTLSServerAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("NewTLSClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	req := "hello"
+	rsp := ""
+	if err = c.Call("/echo", req, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != req {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, req)
+	}
+}
+
+func TestServer_ListenAndServeTLS(t *testing.T) {
+	clientCert := generateTLSCert("arpc client")
+	config := generateTLSConfig()
+	config.ClientAuth = tls.RequireAnyClientCert
+
+	svr := NewTLSServer(config)
+	svr.Handler.Handle("/whoami", func(ctx *Context) {
+		cert := ctx.PeerCertificate()
+		if cert == nil {
+			ctx.Error("no client certificate")
+			return
+		}
+		ctx.Write(cert.Subject.CommonName)
+	})
+	go svr.ListenAndServeTLS(testTLSServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewTLSClient(testTLSServerAddr, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatalf("NewTLSClient failed: %v", err)
+	}
+	defer c.Stop()
+
+	rsp := ""
+	if err = c.Call("/whoami", nil, &rsp, time.Second); err != nil {
+		t.Fatalf("Client.Call() error = %v", err)
+	} else if rsp != "arpc client" {
+		t.Fatalf("Client.Call() error, returns '%v', want '%v'", rsp, "arpc client")
+	}
+	if c.PeerCertificate() == nil {
+		t.Fatalf("Client.PeerCertificate() = nil, want server certificate")
+	}
+
+	// the connection without client certificate is closed after the handshake failed
+	if c2, err := NewTLSClient(testTLSServerAddr, &tls.Config{InsecureSkipVerify: true}); err == nil {
+		c2.Stop()
+	}
+	if svr.NumConnections() != 1 {
+		t.Fatalf("Server.NumConnections() = %v, want 1", svr.NumConnections())
+	}
+
+	if err = NewServer().ListenAndServeTLS(testTLSServerAddr); err != ErrServerNilTLSConfig {
+		t.Fatalf("Server.ListenAndServeTLS() error = %v, want %v", err, ErrServerNilTLSConfig)
+	}
+}
+
+func generateTLSConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{generateTLSCert("")}}
+}
+
+func generateTLSCert(commonName string) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName}, NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return tlsCert
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Span represents a span started by Tracer.
+type Span interface {
+	// RecordError records err and marks the span failed.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Tracer starts the spans of rpc calls, the trace context is carried by the header of the request,
+// see extension/tracing/opentelemetry for the OpenTelemetry implementation.
+// A nil Tracer traces nothing.
+type Tracer interface {
+	// StartClientSpan starts a client span named method and injects the trace context into header.
+	StartClientSpan(ctx context.Context, method string, header map[string]string) (context.Context, Span)
+	// StartServerSpan extracts the trace context from header and starts a server span named method.
+	StartServerSpan(ctx context.Context, method string, header map[string]string) (context.Context, Span)
+}
+
+// tracerHolder wraps the Tracer so that different implementations can be stored in the same atomic.Value.
+type tracerHolder struct {
+	Tracer
+}
+
+// SetTracer sets the Tracer used by the calls, nil disables tracing.
+// The client spans of Call, CallWithHeader and CallAsync have no parent, CallWith parents them on its context.
+func (c *Client) SetTracer(tracer Tracer) {
+	c.tracerValue.Store(tracerHolder{tracer})
+}
+
+func (c *Client) getTracer() Tracer {
+	if h, ok := c.tracerValue.Load().(tracerHolder); ok {
+		return h.Tracer
+	}
+	return nil
+}
+
+// endClientSpan records err if it's not nil and ends span.
+func endClientSpan(span Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// asyncClientSpan wraps handler to end span when the response of the async call arrives,
+// an error response is recorded, and the span ends with ErrClientTimeout if no response arrives in timeout.
+// The returned endSpan ends it earlier, e.g. if the request failed to be sent, the span is ended only once.
+func asyncClientSpan(span Span, handler HandlerFunc, timeout time.Duration) (endSpan func(err error), wrapped HandlerFunc) {
+	if span == nil {
+		return nil, handler
+	}
+	var (
+		once  sync.Once
+		timer *time.Timer
+	)
+	endSpan = func(err error) {
+		once.Do(func() { endClientSpan(span, err) })
+	}
+	if handler == nil {
+		return endSpan, nil
+	}
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { endSpan(ErrClientTimeout) })
+	}
+	return endSpan, func(ctx *Context) {
+		if timer != nil {
+			timer.Stop()
+		}
+		var err error
+		if ctx.Message.IsError() {
+			err = ctx.Message.Error()
+		}
+		endSpan(err)
+		handler(ctx)
+	}
+}
+
+// SetTracer sets the Tracer which starts a server span for every request handled,
+// it's the same as Handler.SetTracer.
+func (s *Server) SetTracer(tracer Tracer) {
+	s.Handler.SetTracer(tracer)
+}
+
+// TraceContext returns the context of the server span, it's used as the parent of the spans started by the handler,
+// e.g. pass it to Client.CallWith to trace a call made by the handler as a child span.
+// It returns context.Background() if tracing is disabled.
+func (ctx *Context) TraceContext() context.Context {
+	if ctx.traceCtx == nil {
+		return context.Background()
+	}
+	return ctx.traceCtx
+}
+
+// startSpan starts the server span of the request if the Handler has a Tracer.
+func (ctx *Context) startSpan() {
+	tracer := ctx.Client.Handler.Tracer()
+	if tracer == nil || ctx.Message.Cmd() != CmdRequest {
+		return
+	}
+	ctx.traceCtx, ctx.span = tracer.StartServerSpan(context.Background(), ctx.Method(), ctx.Header())
+}
+
+// endSpan records recovered as an error if it's not nil and ends the server span.
+func (ctx *Context) endSpan(recovered interface{}) {
+	if ctx.span == nil {
+		return
+	}
+	if recovered != nil {
+		ctx.span.RecordError(fmt.Errorf("panic: %v", recovered))
+	}
+	ctx.span.End()
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package arpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSpan struct {
+	tracer *testTracer
+	kind   string
+	name   string
+	parent string
+	id     string
+	err    error
+}
+
+func (sp *testSpan) RecordError(err error) {
+	sp.err = err
+}
+
+func (sp *testSpan) End() {
+	sp.tracer.mux.Lock()
+	sp.tracer.ended = append(sp.tracer.ended, sp)
+	sp.tracer.mux.Unlock()
+}
+
+type testTracer struct {
+	mux   sync.Mutex
+	seq   int
+	ended []*testSpan
+}
+
+func (t *testTracer) newSpan(kind, method, parent string) *testSpan {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.seq++
+	return &testSpan{tracer: t, kind: kind, name: method, parent: parent, id: strconv.Itoa(t.seq)}
+}
+
+func (t *testTracer) StartClientSpan(ctx context.Context, method string, header map[string]string) (context.Context, Span) {
+	parent, _ := ctx.Value("span").(string)
+	sp := t.newSpan("client", method, parent)
+	header["span"] = sp.id
+	return ctx, sp
+}
+
+func (t *testTracer) StartServerSpan(ctx context.Context, method string, header map[string]string) (context.Context, Span) {
+	sp := t.newSpan("server", method, header["span"])
+	return context.WithValue(ctx, "span", sp.id), sp
+}
+
+func (t *testTracer) spans() []*testSpan {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return append([]*testSpan{}, t.ended...)
+}
+
+func TestClient_SetTracer(t *testing.T) {
+	cliTracer, svrTracer := &testTracer{}, &testTracer{}
+	chTraceCtx := make(chan context.Context, 1)
+
+	svr := NewServer()
+	svr.SetTracer(svrTracer)
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		chTraceCtx <- ctx.TraceContext()
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/fail", func(ctx *Context) {
+		ctx.Error("failed")
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.SetTracer(cliTracer)
+
+	rsp := ""
+	if err = c.Call("/echo", "hello", &rsp, time.Second); err != nil || rsp != "hello" {
+		t.Fatalf("Client.Call() = %v, %v, want hello, nil", rsp, err)
+	}
+	if v := (<-chTraceCtx).Value("span"); v != "1" {
+		t.Fatalf("Context.TraceContext() span = %v, want 1", v)
+	}
+	if err = c.Call("/fail", "hello", &rsp, time.Second); err == nil {
+		t.Fatalf("Client.Call() error = nil, want failed")
+	}
+	time.Sleep(time.Second / 100)
+
+	cliSpans, svrSpans := cliTracer.spans(), svrTracer.spans()
+	if len(cliSpans) != 2 || len(svrSpans) != 2 {
+		t.Fatalf("spans = %v, %v, want 2, 2", len(cliSpans), len(svrSpans))
+	}
+	for i, method := range []string{"/echo", "/fail"} {
+		cs, ss := cliSpans[i], svrSpans[i]
+		if cs.name != method || ss.name != method || ss.parent != cs.id {
+			t.Fatalf("span %v: client %v %v, server %v parent %v", i, cs.name, cs.id, ss.name, ss.parent)
+		}
+	}
+	if cliSpans[0].err != nil || svrSpans[0].err != nil {
+		t.Fatalf("span errors = %v, %v, want nil", cliSpans[0].err, svrSpans[0].err)
+	}
+	if cliSpans[1].err == nil || cliSpans[1].err.Error() != "failed" || svrSpans[1].err == nil || svrSpans[1].err.Error() != "failed" {
+		t.Fatalf("span errors = %v, %v, want failed", cliSpans[1].err, svrSpans[1].err)
+	}
+}
+
+func TestClient_SetTracerCallWithAsync(t *testing.T) {
+	cliTracer := &testTracer{}
+
+	svr := NewServer()
+	svr.Handler.Handle("/echo", func(ctx *Context) {
+		ctx.Write(ctx.Body())
+	})
+	svr.Handler.Handle("/fail", func(ctx *Context) {
+		ctx.Error("failed")
+	})
+	go svr.Run(testServerAddr)
+	defer svr.Stop()
+	time.Sleep(time.Second / 100)
+
+	c, err := NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", testServerAddr, time.Second)
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	c.SetTracer(cliTracer)
+
+	// the span of CallWith is parented on its context, e.g. Context.TraceContext of a handler
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), "span", "parent"), time.Second)
+	defer cancel()
+	rsp := ""
+	if err = c.CallWith(parent, "/echo", "hello", &rsp); err != nil || rsp != "hello" {
+		t.Fatalf("Client.CallWith() = %v, %v, want hello, nil", rsp, err)
+	}
+
+	chDone := make(chan struct{})
+	if err = c.CallAsync("/fail", "hello", func(*Context) { close(chDone) }, time.Second); err != nil {
+		t.Fatalf("Client.CallAsync() error = %v", err)
+	}
+	<-chDone
+
+	spans := cliTracer.spans()
+	if len(spans) != 2 {
+		t.Fatalf("spans = %v, want 2", len(spans))
+	}
+	if spans[0].name != "/echo" || spans[0].parent != "parent" || spans[0].err != nil {
+		t.Fatalf("CallWith span = %v, parent %v, error %v, want /echo, parent, nil", spans[0].name, spans[0].parent, spans[0].err)
+	}
+	if spans[1].name != "/fail" || spans[1].err == nil || spans[1].err.Error() != "failed" {
+		t.Fatalf("CallAsync span = %v, error %v, want /fail, failed", spans[1].name, spans[1].err)
+	}
+}